@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/virtuald/ews-proxy"
+	"github.com/virtuald/go-ordered-json"
+)
+
+// newDebugServer creates the server for -debugListen: the net/http/pprof
+// profiles, the expvar variables (with the proxy status as "ewsProxy"), a
+// text dump of all goroutines at /debug/goroutines and the kept results of
+// the login checks at /debug/logins. It has its own mux, so
+// none of this is reachable through the proxy. addr must be on the loopback
+// interface, and requests must be for a local Host so that web pages can't
+// get at it by rebinding a DNS name to the loopback address. Nothing is
+// started if addr is "".
+func newDebugServer(addr string, translator *ews.TranslationMiddleware) (*http.Server, net.Listener, error) {
+	if addr == "" {
+		return nil, nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, nil, errors.Errorf("%s is not a loopback address", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.HandleFunc("/debug/logins", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		data, _ := json.MarshalIndent(translator.LoginChecks(), "", "  ")
+		w.Write(data)
+	})
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		writeVars(w, translator)
+	})
+
+	return &http.Server{Addr: listener.Addr().String(), Handler: localHostOnly(mux)}, listener, nil
+}
+
+// rejects requests whose Host isn't localhost or a loopback address
+func localHostOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.Trim(host, "[]"))
+
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// the same as expvar.Handler, with the proxy status added. It isn't
+// published with expvar.Publish, which can only be done once per name.
+func writeVars(w http.ResponseWriter, translator *ews.TranslationMiddleware) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	status, _ := json.Marshal(translator.Status())
+	fmt.Fprintf(w, "{\n%q: %s", "ewsProxy", status)
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, ",\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
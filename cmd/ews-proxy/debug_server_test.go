@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy"
+)
+
+func TestDebugServer(t *testing.T) {
+	translator := ews.NewTranslationMiddleware()
+
+	// the default is off
+	if server, listener, err := newDebugServer("", translator); server != nil || listener != nil || err != nil {
+		t.Errorf("expected no debug server, got %v %v %v", server, listener, err)
+	}
+
+	for _, addr := range []string{"0.0.0.0:0", ":0", "192.0.2.1:0", "example.com:6060"} {
+		if _, _, err := newDebugServer(addr, translator); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+	}
+
+	server, listener, err := newDebugServer("127.0.0.1:0", translator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	for path, expected := range map[string]string{
+		"/debug/pprof/":             "goroutine",
+		"/debug/pprof/cmdline":      "",
+		"/debug/pprof/heap?debug=1": "heap profile",
+		"/debug/goroutines":         "goroutine 1",
+		"/debug/logins":             "[]",
+		"/debug/vars":               `"ewsProxy": {"loggedIn":false`,
+	} {
+		response, err := http.Get("http://" + server.Addr + path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK || !strings.Contains(string(body), expected) {
+			t.Errorf("%s: unexpected response %s\n%.500s", path, response.Status, body)
+		}
+	}
+
+	// a name that was rebound to the loopback address isn't served
+	request, _ := http.NewRequest("GET", "http://"+server.Addr+"/debug/vars", nil)
+	request.Host = "attacker.example.com"
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a foreign Host, got %v %v", response, err)
+	}
+
+	// the proxy's paths aren't served here
+	if response, err := http.Get("http://" + server.Addr + "/ews/exchange.asmx"); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for the EWS path, got %v %v", response, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// listenAddrs is a repeatable flag of host:port addresses. IPv6 addresses
+// must be in brackets ([::1]:60001)
+type listenAddrs []string
+
+func (this *listenAddrs) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *listenAddrs) Set(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.Errorf("invalid port in `%s`", value)
+	}
+
+	*this = append(*this, net.JoinHostPort(host, port))
+	return nil
+}
+
+// listenerUrl returns the URL that a browser on this machine should use to
+// reach a listener bound to addr
+func listenerUrl(addr string) (*url.URL, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// can't browse to a wildcard address
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}, nil
+}
+
+// serverGroup is one http.Server per listener, all sharing a handler. It
+// implements graceful.Server, so that shutting down waits for all of them.
+type serverGroup struct {
+	servers   []*http.Server
+	listeners []net.Listener
+}
+
+// serverTimeouts are applied to every server in a group. Zero leaves the
+// net/http default (no timeout), a negative TCPKeepAlive disables keep-alive
+// probes on accepted connections.
+type serverTimeouts struct {
+	Read         time.Duration
+	Write        time.Duration
+	Idle         time.Duration
+	TCPKeepAlive time.Duration
+}
+
+// defaults for the listen flags. WriteTimeout covers the whole response,
+// which includes waiting for OWA, so it has to be longer than the slowest
+// FindItem or attachment download. Idle clients are disconnected before a
+// NAT or firewall in between forgets the connection, so that they see a
+// clean close instead of a reset on the next request.
+const (
+	DefaultReadTimeout  = 2 * time.Minute
+	DefaultWriteTimeout = 10 * time.Minute
+	DefaultIdleTimeout  = 2 * time.Minute
+	DefaultTCPKeepAlive = 30 * time.Second
+)
+
+// newServerGroup binds all of the addresses, so errors are reported before
+// anything is served and the actual address of port 0 is known
+func newServerGroup(addrs []string, timeouts serverTimeouts) (*serverGroup, error) {
+	group := &serverGroup{}
+	config := net.ListenConfig{KeepAlive: timeouts.TCPKeepAlive}
+
+	for _, addr := range addrs {
+		listener, err := config.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			group.close()
+			return nil, errors.Wrapf(err, "cannot listen on %s", addr)
+		}
+
+		// for HTTP/1.0 clients that end the body of a POST by closing their
+		// side of the connection, then requests with ambiguous framing are
+		// marked for the FramingMiddleware
+		group.listeners = append(group.listeners, proxyutils.NewFramingListener(proxyutils.NewCloseDelimitedListener(listener)))
+		group.servers = append(group.servers, &http.Server{
+			Addr:         listener.Addr().String(),
+			ReadTimeout:  timeouts.Read,
+			WriteTimeout: timeouts.Write,
+			IdleTimeout:  timeouts.Idle,
+		})
+	}
+
+	return group, nil
+}
+
+func (this *serverGroup) close() {
+	for _, listener := range this.listeners {
+		listener.Close()
+	}
+}
+
+// Addrs returns the bound addresses, in the same order they were given
+func (this *serverGroup) Addrs() []string {
+	addrs := make([]string, len(this.listeners))
+	for i, listener := range this.listeners {
+		addrs[i] = listener.Addr().String()
+	}
+	return addrs
+}
+
+// SetHandler must be called before ListenAndServe
+func (this *serverGroup) SetHandler(handler http.Handler) {
+	for _, server := range this.servers {
+		server.Handler = handler
+	}
+}
+
+// ListenAndServe serves on all listeners until they are shut down. Returns
+// http.ErrServerClosed, or the first error from any of the servers.
+func (this *serverGroup) ListenAndServe() error {
+	errs := make(chan error, len(this.servers))
+
+	for i, server := range this.servers {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(server, this.listeners[i])
+	}
+
+	result := http.ErrServerClosed
+	for range this.servers {
+		if err := <-errs; err != http.ErrServerClosed && result == http.ErrServerClosed {
+			result = err
+			// don't leave the others running if one of them fails
+			go this.Shutdown(context.Background())
+		}
+	}
+
+	return result
+}
+
+// Shutdown gracefully shuts down all of the servers, and waits for them
+func (this *serverGroup) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(this.servers))
+
+	for i, server := range this.servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+			errs[i] = server.Shutdown(ctx)
+		}(i, server)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenAddrsFlag(t *testing.T) {
+	var addrs listenAddrs
+
+	for _, value := range []string{"127.0.0.1:60001", "[::1]:60001", ":60002", "localhost:0"} {
+		if err := addrs.Set(value); err != nil {
+			t.Errorf("%s: %s", value, err)
+		}
+	}
+
+	for _, value := range []string{"::1:60001", "localhost", "localhost:http", "localhost:70000"} {
+		if err := addrs.Set(value); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+
+	if addrs.String() != "127.0.0.1:60001,[::1]:60001,:60002,localhost:0" {
+		t.Errorf("unexpected addresses %s", addrs.String())
+	}
+}
+
+func TestListenerUrl(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"127.0.0.1:60001": "http://127.0.0.1:60001",
+		"[::1]:60001":     "http://[::1]:60001",
+		"[::]:60001":      "http://localhost:60001",
+		"0.0.0.0:60001":   "http://localhost:60001",
+		":60001":          "http://localhost:60001",
+	} {
+		u, err := listenerUrl(addr)
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+		} else if u.String() != expected {
+			t.Errorf("%s: expected %s, got %s", addr, expected, u)
+		}
+	}
+}
+
+func TestServerGroup(t *testing.T) {
+	addrs := []string{"127.0.0.1:0"}
+	if listener, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		listener.Close()
+		addrs = append(addrs, "[::1]:0")
+	} else {
+		t.Log("IPv6 is not available, only testing IPv4")
+	}
+
+	group, err := newServerGroup(addrs, serverTimeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	done := make(chan error)
+	go func() {
+		done <- group.ListenAndServe()
+	}()
+
+	for _, addr := range group.Addrs() {
+		u, _ := listenerUrl(addr)
+		response, err := http.Get(u.String())
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("%s: unexpected response %q", addr, body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = group.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after Shutdown")
+	}
+
+	for _, addr := range group.Addrs() {
+		if _, err = net.Dial("tcp", addr); err == nil {
+			t.Errorf("%s is still listening", addr)
+		}
+	}
+}
+
+func TestServerGroupBindError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the first address is released when the second can't be bound
+	if _, err = newServerGroup([]string{"127.0.0.1:0", listener.Addr().String()}, serverTimeouts{}); err == nil {
+		t.Error("expected an error for an address that is in use")
+	}
+}
+
+func TestServerGroupIdleTimeout(t *testing.T) {
+	const idle = 500 * time.Millisecond
+
+	group, err := newServerGroup([]string{"127.0.0.1:0"}, serverTimeouts{Idle: idle, TCPKeepAlive: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Shutdown(context.Background())
+
+	group.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	go group.ListenAndServe()
+
+	conn, err := net.Dial("tcp", group.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	get := func() error {
+		request, _ := http.NewRequest("GET", "http://"+group.Addrs()[0]+"/", nil)
+		if err := request.Write(conn); err != nil {
+			return err
+		}
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			return err
+		}
+		ioutil.ReadAll(response.Body)
+		return response.Body.Close()
+	}
+
+	if err = get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection is reused while it has been idle for less than the timeout
+	time.Sleep(idle - 200*time.Millisecond)
+	if err = get(); err != nil {
+		t.Fatalf("connection was closed before the idle timeout: %s", err)
+	}
+
+	// and closed by the server after it
+	time.Sleep(idle + 200*time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the server to close the idle connection, got %v", err)
+	}
+}
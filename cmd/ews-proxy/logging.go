@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// the level of -v, -q and -debug. -debug shows everything, the chain logs
+// the headers of each request at Trace.
+func logLevel(verbose, quiet, debug bool) (proxyutils.LogLevel, error) {
+	switch {
+	case quiet && (verbose || debug):
+		return 0, errors.New("-q cannot be used with -v or -debug")
+	case quiet:
+		return proxyutils.LevelWarn, nil
+	case debug:
+		return proxyutils.LevelTrace, nil
+	case verbose:
+		return proxyutils.LevelDebug, nil
+	}
+	return proxyutils.LevelInfo, nil
+}
+
+// the loggers of the ews package and the chain, identical messages within
+// window are collapsed (0 to log all of them)
+func newLoggers(level proxyutils.LogLevel, window time.Duration) *proxyutils.LevelLoggers {
+	var logger proxyutils.Logger = log.Default()
+	if window > 0 {
+		logger = proxyutils.NewDedupLogger(logger, window)
+	}
+	return proxyutils.NewLevelLoggers(logger, level)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestLogLevel(t *testing.T) {
+	for _, test := range []struct {
+		verbose, quiet, debug bool
+		level                 proxyutils.LogLevel
+	}{
+		{false, false, false, proxyutils.LevelInfo},
+		{true, false, false, proxyutils.LevelDebug},
+		{false, true, false, proxyutils.LevelWarn},
+		{false, false, true, proxyutils.LevelTrace},
+		{true, false, true, proxyutils.LevelTrace},
+	} {
+		level, err := logLevel(test.verbose, test.quiet, test.debug)
+		if err != nil || level != test.level {
+			t.Errorf("%+v: got %d %v", test, level, err)
+		}
+	}
+
+	if _, err := logLevel(true, true, false); err == nil {
+		t.Error("expected an error for -v with -q")
+	}
+}
@@ -7,86 +7,459 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 	"os"
 
 	"github.com/TV4/graceful"
 	"github.com/pkg/browser"
 	"github.com/virtuald/ews-proxy"
+	"github.com/virtuald/ews-proxy/diagnostics"
 	"github.com/virtuald/ews-proxy/proxyutils"
 )
 
+// stringList is a repeatable string flag
+type stringList []string
+
+func (this *stringList) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *stringList) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
+// splits a comma separated flag value, an empty value is an empty list
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// reloads the settings whenever SIGHUP is received
+func reloadOnSignal(reloader *ews.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Error reloading settings, keeping the current ones: %s", err)
+		} else {
+			log.Printf("Reloaded settings from %s", reloader.Path)
+		}
+	}
+}
+
 func main() {
 
-	debug := flag.Bool("debug", false, "Enable extra debug logging")
+	debug := flag.Bool("debug", false, "Enable extra debug logging, and serve the MIME content of items at /debug/item?id= to local clients that have the token which is logged at startup")
+	verbose := flag.Bool("v", false, "Also log debug messages, such as the keepalives")
+	quiet := flag.Bool("q", false, "Only log warnings and errors")
+	logRepeats := flag.Duration("logRepeats", time.Minute, "Identical log messages within this long are logged once, followed by how often they were repeated. 0 to log all of them")
 	noverify := flag.Bool("noverify", false, "Disable HTTPS certificate verfication")
-	listenPort := flag.Int("listenPort", 60001, "Port to listen on")
+	debugListen := flag.String("debugListen", "", "Serve pprof profiles, expvar variables and a goroutine dump on this localhost address (such as localhost:6060), separately from the proxy")
+	listenPort := flag.Int("listenPort", 60001, "Port to listen on localhost, if -listen isn't given")
+	var listen listenAddrs
+	flag.Var(&listen, "listen", "Address to listen on as host:port, with IPv6 addresses in brackets ([::1]:60001). May be repeated")
+	publicUrl := flag.String("publicUrl", "", "URL that clients use to reach the proxy, default is the first -listen address")
+	sessionFile := flag.String("session", "", "File to persist learned session state in")
+	userAgent := flag.String("userAgent", "", "User-Agent of the requests that the proxy makes itself (login checks and keepalives), instead of the one of the browser that logged in")
+	captureUserAgent := flag.Bool("captureUserAgent", true, "Use the User-Agent of the browser that logged in when -userAgent isn't set")
+	suppressNoop := flag.Bool("suppressNoopUpdates", false, "Hide SyncFolderItems updates that only change the ChangeKey")
+	stripChangeKeys := flag.Bool("stripChangeKeys", false, "Remove the ChangeKey from items sent with DeleteItem, MoveItem and SendItem requests")
+	maxAttachmentDepth := flag.Int("maxAttachmentDepth", ews.DefaultMaxAttachmentDepth, "How deep item attachments can be nested in a response")
+	maxRequestDepth := flag.Int("maxRequestDepth", ews.DefaultMaxRequestDepth, "How deep elements can be nested in an EWS request")
+	maxRequestTokens := flag.Int("maxRequestTokens", ews.DefaultMaxRequestTokens, "Maximum number of XML tokens in an EWS request")
+	omitUnusedNamespaces := flag.Bool("omitUnusedNamespaces", false, "Only declare the m: and t: namespaces in responses that use them")
+	bestEffortLists := flag.Bool("bestEffortLists", false, "Leave out items and folders that cannot be translated instead of failing the whole response")
+	validateOutbound := flag.Bool("validateOutbound", false, "Check every translated request against the JSON that OWA expects before it is sent, and fail it with a fault that names the offending member. For testing")
+	experimental := flag.Bool("experimental", false, "Enable translation of experimental operations (FindPeople)")
+	oauthClientId := flag.String("oauthClientId", "", "Azure AD application id; enables Exchange Online (OAuth2) login")
+	oauthTenant := flag.String("oauthTenant", "organizations", "Azure AD tenant used for Exchange Online login")
+	maxCookies := flag.Int("maxCookies", 50, "Maximum number of cookies kept for the exchange server")
+	cookieAllowList := flag.String("cookieAllowList", "", "Comma separated names of cookies kept for the exchange server (a trailing * matches a prefix), or 'default' for the cookies that OWA is known to need")
+	requestDateTimes := flag.String("requestDateTimeFormat", "unchanged", "Format of date-time values sent to the exchange server: unchanged, utc, offset or wcf")
+	responseDateTimes := flag.String("responseDateTimeFormat", "unchanged", "Format of date-time values sent to the EWS client: unchanged, utc, offset or wcf")
+	folderNameMap := flag.String("folderNameMap", "", "JSON file that maps well-known folders to the display names that clients see, such as {\"inbox\": \"Inbox\"}")
+	shadowEwsUrl := flag.String("shadow-ews-url", "", "EXPERIMENTAL: also send the requests that only read the mailbox to this native EWS endpoint, log the differences from the translated responses, and return the native responses")
+	allowActions := flag.String("allowActions", "", "Comma separated EWS operations that clients may use, all others are denied")
+	declineActions := flag.String("declineActions", "", "Comma separated EWS operations that are answered with a SOAP fault instead of being sent to the server, as Name or Name=ResponseCode. Unified Messaging operations are always declined")
+	denyActions := flag.String("denyActions", "", "Comma separated EWS operations that clients may not use (such as SendItem,DeleteItem)")
+	synthesizeExtensions := flag.Bool("synthesizeEmptyExtensions", false, "Answer the GetAppManifests and GetClientAccessToken requests of Outlook with no add-ins instead of sending them to the server")
+	maxConcurrent := flag.Int("maxConcurrentRequests", ews.DefaultMaxConcurrentRequests, "Maximum number of EWS requests sent to the exchange server at the same time, others wait for a free slot. 0 for no limit")
+	anchorMailbox := flag.String("anchorMailbox", "", "Mailbox sent as X-AnchorMailbox with every request to the exchange server, so that Exchange Online routes them in a hybrid setup. Requests that impersonate a user are routed to that user's mailbox")
+	attachmentCache := flag.String("attachmentCache", "", "Keep the content of downloaded attachments in this directory, and answer requests for them without asking the exchange server")
+	attachmentCacheSize := flag.Int64("attachmentCacheSize", 256, "Maximum size of -attachmentCache in MB, the least recently used attachments are removed")
+	attachmentCacheShared := flag.Bool("attachmentCacheShared", false, "Keep the -attachmentCache when the login changes, only for a proxy that is used by a single user")
+	syncStateCompression := flag.Bool("syncStateCompression", false, "Give clients a short token instead of the SyncState of SyncFolderItems responses, the SyncState is kept by the proxy")
+	syncStateDir := flag.String("syncStateDir", "", "Keep the SyncStates of -syncStateCompression in this directory instead of in memory")
+	syncStateSize := flag.Int64("syncStateSize", 64, "Maximum size of the SyncStates kept for -syncStateCompression in MB, the least recently used are removed")
+	concurrencyWait := flag.Duration("concurrencyWait", ews.DefaultConcurrencyWait, "How long an EWS request waits for a free slot before the client is told that the server is busy")
+	upstreamTimeout := flag.Duration("upstreamTimeout", 0, "Maximum time the exchange server gets to answer an EWS request, 0 for no limit other than -writeTimeout")
+	longRunningTimeout := flag.Duration("longRunningTimeout", ews.DefaultLongRunningTimeout, "Maximum time the exchange server gets to answer EmptyFolder, DeleteFolder and MoveItem, which are never sent twice. Overrides -upstreamTimeout and -writeTimeout for them")
+	translationWorkers := flag.Int("translationWorkers", 0, "Maximum number of EWS requests that are translated at the same time, others wait. For a proxy with many users on a small machine, -1 for the number of CPUs. 0 for no limit")
+	forwardedHeaders := flag.String("forwardedHeaders", "off", "What the exchange server is told about clients: off, standard (X-Forwarded-For, X-Forwarded-Proto and Forwarded with the client address) or anonymize (the headers without the client address)")
+	kerberosKeytab := flag.String("kerberosKeytab", "", "Authenticate to the exchange server with Kerberos (Negotiate), using this keytab for -kerberosPrincipal. Needs a build with -tags kerberos")
+	kerberosPrincipal := flag.String("kerberosPrincipal", "", "Kerberos principal (user@REALM) in -kerberosKeytab")
+	kerberosCCache := flag.String("kerberosCCache", "", "Authenticate to the exchange server with Kerberos (Negotiate), using the tickets in this credential cache. Needs a build with -tags kerberos")
+	kerberosConfig := flag.String("kerberosConfig", "/etc/krb5.conf", "Kerberos configuration file")
+	kerberosSpn := flag.String("kerberosSpn", "", "Service principal of the exchange server, default is HTTP/ and its host name")
+	clockSkewThreshold := flag.Duration("clockSkewThreshold", proxyutils.DefaultSkewThreshold, "Warn when the clock of the exchange server differs from the local clock by more than this")
+	autoRelogin := flag.Bool("auto-relogin", false, "Keep the login form (including the password) in memory and post it again when the OWA session expires. Not used with -oauthClientId")
+	closePage := flag.String("close-page", "", "html/template file shown after the login, instead of the built-in page")
+	reopenBrowser := flag.Bool("reopenBrowser", false, "Open the OWA login page in the browser again when the session expires (once per expiry)")
+	notify := flag.Bool("notify", false, "Show a desktop notification when the session expires")
+	var bypass stringList
+	flag.Var(&bypass, "bypass", "Path pattern (such as /owa/ev.owa*) of requests that are passed through without cookie or header changes. May be repeated")
+	settingsFile := flag.String("settings", "", "JSON file with settings that are read again on SIGHUP (debug, bypass, allowActions, denyActions, keepAlivePeriod)")
+	check := flag.Bool("check", false, "Check connectivity to the exchange server and exit")
+	readTimeout := flag.Duration("readTimeout", DefaultReadTimeout, "Maximum time to read a request from an EWS client, 0 for no limit")
+	writeTimeout := flag.Duration("writeTimeout", DefaultWriteTimeout, "Maximum time to send a response to an EWS client, including the time spent waiting for the exchange server, 0 for no limit")
+	idleTimeout := flag.Duration("idleTimeout", DefaultIdleTimeout, "Close client connections that have been idle for this long, 0 for no limit")
+	tcpKeepAlive := flag.Duration("tcpKeepAlive", DefaultTCPKeepAlive, "Period of TCP keep-alive probes on client and exchange server connections, negative to disable")
+	upstreamIdleTimeout := flag.Duration("upstreamIdleTimeout", 50*time.Second, "Close idle connections to the exchange server after this long, before a firewall in between drops them")
+	upstreamHost := flag.String("upstream-host-override", "", "Host header and TLS server name sent to the exchange server, when it is given by IP address but routes on its public name. The certificate is verified against this name, so -noverify isn't needed for the address")
+	outboundInterface := flag.String("outbound-interface", "", "Network interface that connections to the exchange server are made from")
+	outboundIp := flag.String("outbound-ip", "", "Local IP address that connections to the exchange server are made from")
+	failoverRetest := flag.Duration("failoverRetest", proxyutils.DefaultRetestInterval, "When more than one exchange server is given, how often an unreachable one is tried again")
 
 	flag.Parse()
 
+	// scripts run -check to find out whether the proxy can work, an invalid
+	// configuration fails it too
+	checkFailed := func() {
+		if *check {
+			os.Exit(1)
+		}
+	}
+
 	exchangeServer := flag.Arg(0)
 	if exchangeServer == "" {
 		log.Println("Error: must specify exchange server")
+		checkFailed()
 		return
 	}
 
-	target, err := url.Parse(exchangeServer)
+	// more than one server can be given, the others are used when the first
+	// one cannot be reached
+	var targets []*url.URL
+	for _, exchangeServer := range flag.Args() {
+		target, err := url.Parse(exchangeServer)
+		if err != nil {
+			log.Printf("Error parsing exchange server: %s", err)
+			checkFailed()
+			return
+		}
+
+		// fixup target
+		if err = proxyutils.NormalizeTargetUrl(target); err != nil {
+			log.Printf("Invalid exchange server URL: %s", err)
+			checkFailed()
+			return
+		}
+		targets = append(targets, target)
+	}
+	target := targets[0]
+
+	localAddr, err := outboundAddr(*outboundInterface, *outboundIp)
 	if err != nil {
-		log.Printf("Error parsing exchange server: %s", err)
+		log.Printf("Error: %s", err)
+		checkFailed()
 		return
 	}
 
-	// fixup target
-	if target.Scheme == "" || target.Host == "" {
-		log.Printf("Invalid exchange server URL '%s'", exchangeServer)
+	if *check {
+		checker := diagnostics.NewChecker(target)
+		checker.NoVerify = *noverify
+		checker.OwaPath = proxyutils.AddPathPrefix(proxyutils.PathPrefix(target), checker.OwaPath)
+		if localAddr != nil {
+			checker.Dialer = &net.Dialer{Timeout: checker.Timeout, LocalAddr: localAddr}
+		}
+
+		report := checker.Run()
+		report.Print(os.Stdout)
+		if !report.OK() {
+			os.Exit(1)
+		}
 		return
 	}
 	
-	source, _ := url.Parse(fmt.Sprintf("http://localhost:%d", *listenPort))
+	requestDateTimeFormat, err := ews.ParseDateTimeFormat(*requestDateTimes)
+	if err != nil {
+		log.Printf("Invalid -requestDateTimeFormat: %s", err)
+		return
+	}
+	responseDateTimeFormat, err := ews.ParseDateTimeFormat(*responseDateTimes)
+	if err != nil {
+		log.Printf("Invalid -responseDateTimeFormat: %s", err)
+		return
+	}
+
+	level, err := logLevel(*verbose, *quiet, *debug)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	ews.Log = newLoggers(level, *logRepeats)
+	proxyutils.Log = ews.Log
+
+	closePageTemplate, err := ews.ParseClosePage(*closePage)
+	if err != nil {
+		log.Printf("Invalid -close-page: %s", err)
+		return
+	}
+
+	if len(listen) == 0 {
+		listen.Set(fmt.Sprintf("localhost:%d", *listenPort))
+	}
+
+	servers, err := newServerGroup(listen, serverTimeouts{
+		Read:         *readTimeout,
+		Write:        *writeTimeout,
+		Idle:         *idleTimeout,
+		TCPKeepAlive: *tcpKeepAlive,
+	})
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+
+	var source *url.URL
+	if *publicUrl != "" {
+		if source, err = url.Parse(*publicUrl); err != nil || source.Scheme == "" || source.Host == "" {
+			log.Printf("Invalid public URL '%s'", *publicUrl)
+			return
+		}
+	} else {
+		source, _ = listenerUrl(servers.Addrs()[0])
+	}
 
 	// construct the HTTP transport
-	dialer := net.Dialer{Timeout: 2 * time.Second}
+	dialer := net.Dialer{Timeout: 2 * time.Second, KeepAlive: *tcpKeepAlive}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
 
-	transport := &http.Transport{Dial: dialer.Dial}
+	httpTransport := &http.Transport{Dial: dialer.Dial, IdleConnTimeout: *upstreamIdleTimeout}
 	if *noverify {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if *upstreamHost != "" {
+		if httpTransport.TLSClientConfig == nil {
+			httpTransport.TLSClientConfig = &tls.Config{}
+		}
+		// SNI and certificate verification use the name without the port
+		httpTransport.TLSClientConfig.ServerName = (&url.URL{Host: *upstreamHost}).Hostname()
+	}
+	var transport http.RoundTripper = httpTransport
+
+	// the OWA pages (and the canary) come back already authenticated, the
+	// login in the browser is just the redirect to the close page
+	if *kerberosKeytab != "" || *kerberosCCache != "" {
+		transport, err = proxyutils.NewKerberosTransport(&proxyutils.KerberosConfig{
+			Keytab:    *kerberosKeytab,
+			Principal: *kerberosPrincipal,
+			CCache:    *kerberosCCache,
+			Krb5Conf:  *kerberosConfig,
+			SPN:       *kerberosSpn,
+		}, httpTransport)
+		if err != nil {
+			log.Printf("Error: %s", err)
+			return
+		}
 	}
 
 	// construct the needed middlewares
 	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	redirector.HostOverride = *upstreamHost
+	redirector.UserAgent = *userAgent
+	redirector.CaptureUserAgent = *captureUserAgent
+	if redirector.ForwardedHeaders, err = proxyutils.ParseForwardedHeaderMode(*forwardedHeaders); err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+
+	if len(targets) > 1 {
+		pool := proxyutils.NewTargetPool(targets)
+		pool.RetestInterval = *failoverRetest
+		redirector.UseTargetPool(pool)
+		transport = pool.Transport(transport)
+	}
+
+	cookies := proxyutils.NewBoundedCookieJar()
+	cookies.MaxPerHost = *maxCookies
+	cookies.Debug = *debug
+	if *cookieAllowList == "default" {
+		cookies.AllowList = proxyutils.DefaultCookieAllowList
+	} else if *cookieAllowList != "" {
+		cookies.AllowList = strings.Split(*cookieAllowList, ",")
+	}
+	redirector.Cookies = cookies
+
+	if *sessionFile != "" {
+		store := proxyutils.NewSessionStore(*sessionFile)
+		if err := store.Load(redirector); err != nil {
+			log.Printf("Error loading session: %s", err)
+			return
+		}
+		defer func() {
+			if err := store.Flush(); err != nil {
+				log.Printf("Error saving session: %s", err)
+			}
+		}()
+	}
 	
 	translator := ews.NewTranslationMiddleware()
 	translator.Debug = *debug
-	
-	
-	login := &ews.LoginMiddleware{
-		Redirector: redirector,
-		Translator: translator,
-		Transport: transport,
-		CheckPath: "/owa/",
+	translator.SuppressNoopUpdates = *suppressNoop
+	translator.StripStaleChangeKeys = *stripChangeKeys
+	translator.Experimental = *experimental
+	translator.BestEffortLists = *bestEffortLists
+	translator.ValidateOutbound = *validateOutbound
+	if *reopenBrowser || *notify {
+		var loginUrl string
+		if *reopenBrowser {
+			loginUrl = source.ResolveReference(&url.URL{Path: "/owa/"}).String()
+		}
+		translator.OnStateChange = newSessionEvents(loginUrl, *notify, target.Host).onStateChange
+	}
+	translator.MaxAttachmentDepth = *maxAttachmentDepth
+	translator.OmitUnusedNamespaces = *omitUnusedNamespaces
+	translator.RequestDateTimes = requestDateTimeFormat
+	translator.MaxRequestDepth = *maxRequestDepth
+	translator.MaxRequestTokens = *maxRequestTokens
+	translator.ResponseDateTimes = responseDateTimeFormat
+	translator.Skew.Threshold = *clockSkewThreshold
+	translator.SynthesizeEmptyExtensions = *synthesizeExtensions
+	translator.MaxConcurrentRequests = *maxConcurrent
+	translator.ConcurrencyWait = *concurrencyWait
+	translator.TranslationWorkers = *translationWorkers
+	translator.UpstreamTimeout = *upstreamTimeout
+	translator.LongRunningTimeout = *longRunningTimeout
+	translator.AnchorMailbox = *anchorMailbox
+	if *attachmentCache != "" {
+		if translator.AttachmentCache, err = ews.NewAttachmentCache(*attachmentCache, *attachmentCacheSize*1024*1024); err != nil {
+			log.Printf("Error: %s", err)
+			return
+		}
+		translator.AttachmentCache.Shared = *attachmentCacheShared
+	}
+	if *syncStateCompression {
+		if translator.SyncStates, err = ews.NewSyncStateStore(*syncStateDir, *syncStateSize*1024*1024); err != nil {
+			log.Printf("Error: %s", err)
+			return
+		}
+	}
+	if *allowActions != "" || *denyActions != "" {
+		if translator.Policy, err = ews.NewActionPolicy(splitList(*allowActions), splitList(*denyActions)); err != nil {
+			log.Printf("Error: %s", err)
+			return
+		}
+	}
+	if translator.DeclinedOperations, err = ews.ParseDeclinedOperations(*declineActions); err != nil {
+		log.Printf("Invalid -declineActions: %s", err)
+		return
+	}
+	if *folderNameMap != "" {
+		if translator.FolderNames, err = ews.LoadFolderNameMap(*folderNameMap); err != nil {
+			log.Printf("Error loading folder names: %s", err)
+			return
+		}
+	}
+	if *shadowEwsUrl != "" {
+		log.Printf("Shadow mode is experimental: responses will come from %s", *shadowEwsUrl)
+		translator.Shadow = ews.NewShadowEws(*shadowEwsUrl)
+		translator.Shadow.Client = &http.Client{Transport: transport}
 	}
-	login.CanaryFinder = login.CookieCanaryFinder
 	
+	bypassMiddleware, err := proxyutils.NewBypassMiddleware(bypass)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+
 	// create a chained reverse proxy
-	logAll := log.New(os.Stderr, "", log.LstdFlags)
-	chain := proxyutils.CreateChainedProxy("EWS Proxy", logAll, logAll, logAll, logAll, logAll, transport, login, translator, redirector)
-	
-	proxy := &httputil.ReverseProxy{
-		Director: func(*http.Request){},
-		Transport: chain,
+	opts := &ews.ProxyOptions{
+		Transport:  transport,
+		Translator: translator,
+		Redirector: redirector,
+		Bypass:     bypassMiddleware,
+		ClosePage:  closePageTemplate,
 	}
-	
+
+	if *oauthClientId != "" {
+		opts.OAuth = ews.NewOAuthLoginMiddleware(translator, transport, *oauthClientId)
+		opts.OAuth.TenantId = *oauthTenant
+	} else {
+		opts.Login = &ews.LoginMiddleware{
+			Redirector: redirector,
+			Translator: translator,
+			Transport:  transport,
+			CheckPath:  "/owa/",
+		}
+		opts.Login.CanaryFinder = opts.Login.CookieCanaryFinder
+		if *autoRelogin {
+			opts.Login.AutoRelogin = true
+			translator.Relogin = opts.Login.Relogin
+		}
+	}
+
+	if *settingsFile != "" {
+		reloader := &ews.Reloader{
+			Path:       *settingsFile,
+			Translator: translator,
+			Login:      opts.Login,
+			Bypass:     bypassMiddleware,
+			Cookies:    cookies,
+		}
+		if err = reloader.Reload(); err != nil {
+			log.Printf("Error loading settings: %s", err)
+			return
+		}
+		go reloadOnSignal(reloader)
+	}
+
+	proxy, err := ews.NewProxy(opts)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+
+	debugServer, debugListener, err := newDebugServer(*debugListen, translator)
+	if err != nil {
+		log.Printf("Invalid -debugListen: %s", err)
+		return
+	} else if debugServer != nil {
+		log.Printf("Debug endpoints on http://%s/debug/pprof/", debugServer.Addr)
+		go debugServer.Serve(debugListener)
+		defer debugServer.Close()
+	}
+
 	// navigate to listening port after the server starts
 	go func() {
 		time.Sleep(1 * time.Second)
-		openUrl := fmt.Sprintf("http://localhost:%d/owa/", *listenPort)
-		browser.OpenURL(openUrl)
+		openUrl := source.ResolveReference(&url.URL{Path: "/owa/"})
+		browser.OpenURL(openUrl.String())
 	}()
 
-	graceful.LogListenAndServe(&http.Server{
-		Addr:    fmt.Sprintf("localhost:%d", *listenPort),
-		Handler: proxy,
-	})
+	for _, addr := range servers.Addrs() {
+		log.Printf("Listening on %s", addr)
+	}
+
+	// -longRunningTimeout can be longer than -writeTimeout
+	if *debug {
+		// the MIME content of items at /debug/item?id=, see ews_debug_item.go
+		debugItems := ews.NewDebugItemHandler(proxy, translator)
+		itemUrl := source.ResolveReference(&url.URL{Path: debugItems.Path, RawQuery: "token=" + debugItems.Token})
+		log.Printf("The MIME content of items is at %s&id=<ItemId>", itemUrl)
+		servers.SetHandler(proxyutils.AllowLongerWrites(debugItems, *writeTimeout))
+	} else {
+		servers.SetHandler(proxyutils.AllowLongerWrites(proxy, *writeTimeout))
+	}
+	graceful.LogListenAndServe(servers)
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// outboundAddr returns the local address that connections to the exchange
+// server are made from, or nil if neither option is given. With only an
+// interface, its first IPv4 address is used (or the first address if it
+// has none); with both, the address must be on that interface.
+func outboundAddr(ifaceName string, ipStr string) (net.Addr, error) {
+	if ifaceName == "" && ipStr == "" {
+		return nil, nil
+	}
+
+	var ip net.IP
+	if ipStr != "" {
+		if ip = net.ParseIP(ipStr); ip == nil {
+			return nil, errors.Errorf("invalid outbound IP address `%s`", ipStr)
+		}
+	}
+
+	if ifaceName != "" {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "outbound interface `%s`", ifaceName)
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, errors.Wrapf(err, "outbound interface `%s`", ifaceName)
+		}
+
+		var found net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if ip != nil {
+				if ipnet.IP.Equal(ip) {
+					found = ip
+					break
+				}
+			} else if found == nil || (found.To4() == nil && ipnet.IP.To4() != nil) {
+				found = ipnet.IP
+			}
+		}
+
+		if found == nil {
+			if ip != nil {
+				return nil, errors.Errorf("%s is not assigned to the outbound interface `%s`", ip, ifaceName)
+			}
+			return nil, errors.Errorf("the outbound interface `%s` has no addresses", ifaceName)
+		}
+		ip = found
+	}
+
+	// the address can only be used as a source if it can be bound
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, errors.Errorf("%s is not assigned to this machine: %s", ip, err)
+	}
+	listener.Close()
+
+	return &net.TCPAddr{IP: ip}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOutboundAddr(t *testing.T) {
+	if addr, err := outboundAddr("", ""); addr != nil || err != nil {
+		t.Errorf("expected no address, got %v %v", addr, err)
+	}
+
+	// TEST-NET-1 is never assigned
+	for _, test := range [][2]string{{"", "192.0.2.1"}, {"", "not-an-ip"}, {"no-such-interface0", ""}} {
+		if _, err := outboundAddr(test[0], test[1]); err == nil {
+			t.Errorf("%v: expected an error", test)
+		}
+	}
+
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Log("no lo interface, not testing interface lookup")
+		return
+	}
+
+	if addr, err := outboundAddr(iface.Name, "127.0.0.1"); err != nil || addr.String() != "127.0.0.1:0" {
+		t.Errorf("expected 127.0.0.1 on %s, got %v %v", iface.Name, addr, err)
+	}
+	if _, err = outboundAddr(iface.Name, "192.0.2.1"); err == nil {
+		t.Errorf("192.0.2.1 is not on %s", iface.Name)
+	}
+}
+
+func TestOutboundAddrSource(t *testing.T) {
+	localAddr, err := outboundAddr("", "127.0.0.2")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %s", err)
+	}
+
+	var remote string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer server.Close()
+
+	dialer := &net.Dialer{LocalAddr: localAddr}
+	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+
+	response, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if remote != "127.0.0.2" {
+		t.Errorf("the server saw the connection from %s", remote)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/browser"
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy"
+)
+
+// sessionEvents tells the user when the OWA session has expired, by opening
+// the login page in the browser (-reopenBrowser) and with a desktop
+// notification (-notify). It is the OnStateChange of the translator.
+type sessionEvents struct {
+	// the OWA page of the proxy, "" to not open the browser
+	loginUrl string
+	notify   bool
+
+	// target host, for the notification
+	host string
+
+	// replaced by tests
+	openBrowser   func(url string) error
+	notifyDesktop func(title string, message string) error
+
+	lock sync.Mutex
+	// the browser was already opened for the current expiry
+	reopened bool
+}
+
+func newSessionEvents(loginUrl string, notify bool, host string) *sessionEvents {
+	return &sessionEvents{
+		loginUrl:      loginUrl,
+		notify:        notify,
+		host:          host,
+		openBrowser:   browser.OpenURL,
+		notifyDesktop: desktopNotification,
+	}
+}
+
+func (this *sessionEvents) onStateChange(old, new ews.SessionState) {
+	log.Printf("OWA session: %s -> %s", old, new)
+
+	this.lock.Lock()
+	if new != ews.SessionExpired {
+		if new == ews.SessionAuthenticated {
+			this.reopened = false
+		}
+		this.lock.Unlock()
+		return
+	}
+
+	// once per expiry, the login page stays open until the user logs in
+	reopen := this.loginUrl != "" && !this.reopened
+	this.reopened = this.reopened || reopen
+	this.lock.Unlock()
+
+	// the translator waits for OnStateChange
+	go func() {
+		if this.notify {
+			if err := this.notifyDesktop("ews-proxy", "The session with "+this.host+" has expired, log in again to keep mail syncing."); err != nil {
+				log.Printf("Error showing a notification: %s", err)
+			}
+		}
+		if reopen {
+			if err := this.openBrowser(this.loginUrl); err != nil {
+				log.Printf("Error opening the browser: %s", err)
+			}
+		}
+	}()
+}
+
+// shows a notification on the desktop, with the tool of the platform
+func desktopNotification(title string, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		quote := func(s string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		cmd = exec.Command("osascript", "-e", "display notification "+quote(message)+" with title "+quote(title))
+	case "windows":
+		cmd = exec.Command("msg", "*", title+": "+message)
+	default:
+		cmd = exec.Command("notify-send", title, message)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s: %s", cmd.Path, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy"
+)
+
+func TestSessionEvents(t *testing.T) {
+	opened := make(chan string, 10)
+	notified := make(chan string, 10)
+
+	events := newSessionEvents("http://localhost:60001/owa/", true, "mail.example.com")
+	events.openBrowser = func(url string) error {
+		opened <- url
+		return nil
+	}
+	events.notifyDesktop = func(title string, message string) error {
+		notified <- message
+		return nil
+	}
+
+	expect := func(step string, ch chan string, n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-ch:
+			case <-time.After(time.Second):
+				t.Fatalf("%s: expected %d events, got %d", step, n, i)
+			}
+		}
+		select {
+		case value := <-ch:
+			t.Errorf("%s: unexpected event %s", step, value)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	events.onStateChange(ews.SessionUnauthenticated, ews.SessionAuthenticated)
+	events.onStateChange(ews.SessionAuthenticated, ews.SessionDegraded)
+	expect("login", opened, 0)
+
+	events.onStateChange(ews.SessionDegraded, ews.SessionExpired)
+	expect("expired", opened, 1)
+	expect("expired", notified, 1)
+
+	events.onStateChange(ews.SessionExpired, ews.SessionAuthenticated)
+	events.onStateChange(ews.SessionAuthenticated, ews.SessionExpired)
+	expect("expired again", opened, 1)
+	expect("expired again", notified, 1)
+
+	// only the notification
+	events.loginUrl = ""
+	events.onStateChange(ews.SessionExpired, ews.SessionAuthenticated)
+	events.onStateChange(ews.SessionAuthenticated, ews.SessionExpired)
+	expect("without -reopenBrowser", opened, 0)
+	expect("without -reopenBrowser", notified, 1)
+}
@@ -25,6 +25,7 @@ from xmlschema.components.elements import XsdComplexType, XsdGroup
 from xmlschema.qnames import split_qname, split_reference, XSD_CHOICE_TAG
 
 ns_x = 'http://www.w3.org/2001/XMLSchema'
+ns_xml = 'http://www.w3.org/XML/1998/namespace'
 
 namespaces = {
     'http://schemas.microsoft.com/exchange/services/2006/messages': 'm',
@@ -32,6 +33,10 @@ namespaces = {
     ns_x: 'xs'
 }
 
+# operations that can keep the server busy for much longer than others, see
+# ews_long_running.go
+long_running_operations = {'DeleteFolder', 'EmptyFolder', 'MoveItem'}
+
 def shorten_qname(n):
     ns, n = split_qname(n)
     return '%s:%s' % (namespaces[ns], n)
@@ -271,6 +276,7 @@ def apply_hacks(operations, types, elements):
 
     m = '{http://schemas.microsoft.com/exchange/services/2006/messages}'
     t = '{http://schemas.microsoft.com/exchange/services/2006/types}'
+    x = '{%s}' % ns_x
 
     #
     # Messages namespace
@@ -278,6 +284,11 @@ def apply_hacks(operations, types, elements):
 
     types[m + "ArrayOfResponseMessagesType"].json_list_name = "Items"
 
+    # SetUserPhotoResponse has ResponseMessages, but the schema forgot to put
+    # a SetUserPhotoResponseMessage in them
+    e = types[m + "ArrayOfResponseMessagesType"].elements
+    e[m + 'SetUserPhotoResponseMessage'] = copy.copy(e[m + 'GetLastPrivateCatalogUpdateResponseMessage'])
+
     types[m + "CreateAttachmentResponseType"].json_extra = [
         'SharingInformation'
     ]
@@ -285,6 +296,20 @@ def apply_hacks(operations, types, elements):
     e = types[m + "FindFolderType"].elements
     e[m + 'IndexedPageFolderView'].json_default = 'json.OrderedObject{json.Member{"__type", "IndexedPageView:#Exchange"}, json.Member{"MaxEntriesReturned", 2147483647}, json.Member{"Offset", 0}, json.Member{"BasePoint", "Beginning"}}'
 
+    # MessageXml is xs:any, but what Exchange puts in it is a list of
+    # <t:Value Name="...">...</t:Value> elements (such as the
+    # BackOffMilliseconds of ErrorServerBusy)
+    message_xml_value = TypeData(t[1:-1], 'MessageXmlValueType', None, False)
+    message_xml_value.simple_type = 'string'
+    message_xml_value.attrs['Name'] = types[x + 'string']
+    message_xml_value.json_text_attr = 'Value'
+    types[t + 'MessageXmlValueType'] = message_xml_value
+
+    message_xml_element = ElementData(message_xml_value)
+    message_xml_element.is_list = True
+    types['MessageXmlAnonType'].elements[t + 'Value'] = message_xml_element
+    types['MessageXmlAnonType'].is_list = True
+
     types[m + "FindItemResponseMessageType"].json_extra = [
         'IsSearchInProgress','SearchFolderId'
     ]
@@ -337,6 +362,31 @@ def apply_hacks(operations, types, elements):
     types[t + "DaysOfWeekType"].simple_type = "list"
     types[t + "DaysOfWeekType"].list_item_type = 'DayOfWeekType'
 
+    # MailTipTypes is a list of flags, the enum values are in bit order ('All'
+    # isn't a bit, it's every bit)
+    mail_tip = TypeData(t[1:-1], 'MailTipType', None, False)
+    mail_tip.simple_type = 'enum'
+    mail_tip.enum_values = [
+        'OutOfOfficeMessage', 'MailboxFullStatus', 'CustomMailTip',
+        'ExternalMemberCount', 'TotalMemberCount', 'MaxMessageSize',
+        'DeliveryRestriction', 'ModerationStatus', 'InvalidRecipient',
+        'Scope', 'RecipientSuggestions', 'PreferAccessibleContent',
+    ]
+    types[t + 'MailTipType'] = mail_tip
+
+    types[t + "MailTipTypes"].simple_type = "list"
+    types[t + "MailTipTypes"].list_item_type = 'MailTipType'
+
+    # UserConfigurationPropertyType is a list of flags of an anonymous type,
+    # in bit order ('All' is every bit)
+    user_config_property = TypeData(t[1:-1], 'UserConfigurationPropertyItemType', None, False)
+    user_config_property.simple_type = 'enum'
+    user_config_property.enum_values = ['Id', 'Dictionary', 'XmlData', 'BinaryData']
+    types[t + 'UserConfigurationPropertyItemType'] = user_config_property
+
+    types[t + "UserConfigurationPropertyType"].simple_type = "list"
+    types[t + "UserConfigurationPropertyType"].list_item_type = 'UserConfigurationPropertyItemType'
+
     types[t + "EmailAddressType"].json_extra = [
         'EmailAddressIndex', 'RelevanceScore', 'SipUri', 'Submitted',
     ]
@@ -348,6 +398,13 @@ def apply_hacks(operations, types, elements):
 
     types[t + "FieldOrderType"].json_name = 'SortResults'
 
+    # OWA adds the public folder mailbox that a public folder lives in to its
+    # id, as a routing hint. EWS clients route with the X-PublicFolderMailbox
+    # header instead, so the ids have no place for it
+    types[t + "FolderIdType"].json_extra = [
+        'PublicFolderMailbox',
+    ]
+
     types[t + 'FieldURIOrConstantType'].json_name = 'FieldURIOrConstantType'
 
     types[t + "ImAddressDictionaryEntryType"].json_name = 'ImAddressDictionaryEntryType'
@@ -373,6 +430,35 @@ def apply_hacks(operations, types, elements):
     types[t + "PathToIndexedFieldType"].json_name = "DictionaryPropertyUri"
     types[t + "PathToUnindexedFieldType"].json_name = "PropertyUri"
 
+    # OWA people service. Most of the attributed value arrays have an 'Array'
+    # suffix in JSON, but not all of them
+    e = types[t + "PersonaType"].elements
+    e[t + 'PersonaType'].json_name = 'PersonaTypeString'
+    e[t + 'CreationTime'].json_name = 'CreationTimeString'
+    e[t + 'Attributions'].json_name = 'AttributionsArray'
+
+    raw_attributed = ['ItemLinkIds', 'AttributedHasActiveDeals',
+                      'AttributedIsBusinessContact', 'SourceMailboxGuids']
+
+    for k, v in e.items():
+        tname = v.type.name
+        if tname.startswith('ArrayOf') and 'AttributedValue' in tname and \
+           split_qname(k)[1] not in raw_attributed:
+            v.json_name = split_qname(k)[1] + 'Array'
+
+    types[t + "PersonaType"].json_extra = [
+        'ADObjectId',
+    ]
+
+    types[t + "PersonaAttributionType"].json_extra = [
+        'FolderName', 'IsGuest',
+    ]
+
+    # OWA returns the persona for each resolution, but EWS has no place for it
+    types[t + "ResolutionType"].json_extra = [
+        'Persona',
+    ]
+
     types[t + "PhoneNumberDictionaryEntryType"].json_name = 'PhoneNumberDictionaryEntryType'
     types[t + "PhoneNumberDictionaryEntryType"].json_text_attr = 'PhoneNumber'
 
@@ -435,6 +521,23 @@ def apply_hacks(operations, types, elements):
     e = types[t + "SyncFolderItemsChangesType"].elements
     e[t + 'Create'].json_hint = 'SyncFolderItemsCreateType:#Exchange'
     e[t + 'Update'].json_hint = 'SyncFolderItemsUpdateType:#Exchange'
+
+    # the events of a notification are an unbounded choice, which the schema
+    # processing doesn't make a list, and several events share their types
+    # so the hint names the event
+    e = types[t + "NotificationType"].elements
+    for event in ['Copied', 'Created', 'Deleted', 'Modified', 'Moved', 'NewMail', 'Status', 'FreeBusyChanged']:
+        e[t + event + 'Event'].is_list = True
+    for event in ['Copied', 'Moved', 'Created', 'Deleted', 'NewMail', 'FreeBusyChanged']:
+        e[t + event + 'Event'].json_hint = event + 'EventType:#Exchange'
+
+    # OWA rejects conversation actions without a ConversationLastSyncTime,
+    # EWS applies them to all of the items of the conversation when it's
+    # left out. A time far in the future includes all of them (a fidelity
+    # note says that it was added), without overflowing when Exchange
+    # applies the time zone.
+    e = types[t + "ConversationActionType"].elements
+    e[t + 'ConversationLastSyncTime'].json_default = '"9000-01-01T00:00:00.000"'
     
     types[t + "SyncFolderHierarchyChangesType"].json_list_name = "Changes"
     types[t + "SyncFolderHierarchyCreateOrUpdateType"].json_extra = [
@@ -453,6 +556,28 @@ def apply_hacks(operations, types, elements):
     ]
     
     types[t + "TimeZoneDefinitionType"].json_name = 'TimeZoneDefinitionType'
+    types[t + "ArrayOfTransitionsType"].json_list_name = 'Transitions'
+
+    # dateTime values are converted between the formats that EWS and OWA
+    # use, except for the ones that are in the local time of some timezone
+    # and must be passed through as-is
+    types[x + 'dateTime'].simple_type = 'datetime'
+
+    local_datetime = TypeData(None, 'localDateTime', None, False)
+    local_datetime.simple_type = 'string'
+    types['localDateTime'] = local_datetime
+
+    for typename, ename in [
+        (t + 'AbsoluteDateTransitionType', 'DateTime'),
+        (t + 'CalendarEvent', 'StartTime'),
+        (t + 'CalendarEvent', 'EndTime'),
+        (t + 'Duration', 'StartTime'),
+        (t + 'Duration', 'EndTime'),
+        (t + 'Suggestion', 'MeetingTime'),
+        (t + 'SuggestionDayResult', 'Date'),
+    ]:
+        types[typename].elements[t + ename].type = local_datetime
+
     types[t + 'UserConfigurationNameType'].json_name = 'UserConfigurationNameType'
     types[t + "VotingInformationType"].json_name = 'VotingInformationType'
 
@@ -521,7 +646,10 @@ def process_type(typ, types, parent_name, cls_hierarchy):
             # in a custom way?
             continue
 
-        _, attr_name = split_qname(attrname)
+        # EWS attributes are unqualified, but xml:lang must keep its prefix
+        ns, attr_name = split_qname(attrname)
+        if ns == ns_xml:
+            attr_name = 'xml:' + attr_name
         data.attrs[attr_name] = process_type(attr.type, types, None, cls_hierarchy)
 
     if typ.is_simple():
@@ -854,6 +982,7 @@ golang_simple_type_map = {
     'boolean': 'T_BOOL',
     'decimal': 'T_NUM',
     'string': 'T_STR',
+    'datetime': 'T_DATETIME',
     'enum': 'T_ENUM',
     'list': 'T_LIST'
 }
@@ -874,6 +1003,7 @@ golang_op_fmt = '''\t"%(opname)s": {
 \t\tBodyType: "%(action)sRequest:#Exchange",
 \t\tRequestType: "%(action)sJsonRequest:#Exchange", Request: ewsTypes["%(in_type)s"],
 \t\tResponse: EwsJsonElement{JsonName: "%(rname)s", SingleType: NewEwsJsonType("%(out_elem)s", ewsTypes["%(out_type)s"])},
+\t\tLongRunning: %(long_running)s,
 \t},
 '''
 
@@ -917,6 +1047,9 @@ def generate_golang(elements, types, operations, fp):
                     t = ', T: "%s"' % v.name
                     if v.json_name:
                         t += ', JN: "%s"' % v.json_name
+                    elif ':' in n:
+                        # the JSON name has no prefix
+                        t += ', JN: "%s"' % n.split(':')[1]
 
                 aa.append('{XN: "%s"%s},' % (n, t))
 
@@ -999,6 +1132,7 @@ def generate_golang(elements, types, operations, fp):
             in_type=in_type, out_type=out_type,
             out_elem=shorten_qname(op.out_elem),
             rname=split_qname(op.out_elem)[1],
+            long_running='true' if op.action in long_running_operations else 'false',
         ), file=fp)
 
     print("}\n", file=fp)
@@ -0,0 +1,74 @@
+// Package comparison contains helpers for showing the differences between
+// two EWS messages, used by the tests and by shadow mode
+package comparison
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	diff "github.com/yudai/gojsondiff"
+	"github.com/yudai/gojsondiff/formatter"
+)
+
+// ErrDifferent is returned when the compared messages are not the same
+var ErrDifferent = errors.New("A and B are different")
+
+// DiffJson compares two JSON documents. If they are different, a description
+// of the differences is returned along with ErrDifferent.
+//
+// borrowed from https://github.com/yudai/gojsondiff/blob/master/jd/main.go
+// .. why isn't there a utility function for this?
+func DiffJson(a []byte, b []byte, coloring bool) (diffString string, err error) {
+
+	var aj map[string]interface{}
+	var bj map[string]interface{}
+
+	if err = json.Unmarshal(a, &aj); err != nil {
+		return "", errors.Wrap(err, "A json error")
+	}
+
+	if err = json.Unmarshal(b, &bj); err != nil {
+		return "", errors.Wrap(err, "B json error")
+	}
+
+	return diffObjects(aj, bj, coloring)
+}
+
+func diffObjects(aj map[string]interface{}, bj map[string]interface{}, coloring bool) (diffString string, err error) {
+
+	// the diff library seems to be buggy (but still useful for showing
+	// the output), so use Reflect instead
+	if reflect.DeepEqual(aj, bj) {
+		return "", nil
+	}
+
+	d := diff.New().CompareObjects(aj, bj)
+
+	if d.Modified() {
+		config := formatter.AsciiFormatterConfig{
+			ShowArrayIndex: true,
+			Coloring:       coloring,
+		}
+
+		dformat := formatter.NewAsciiFormatter(aj, config)
+
+		diffString, err = dformat.Format(d)
+		if err != nil {
+			return "", errors.Wrap(err, "json diff format failed")
+		}
+	}
+
+	return diffString, ErrDifferent
+}
+
+// DiffText returns a readable diff of two texts
+//
+// TODO: this diff ignores whitespace, which happens to be really annoying if
+// the texts only differ by whitespace
+func DiffText(expected string, actual string) string {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMain(expected, actual, true)
+	return dmp.DiffPrettyText(diffs)
+}
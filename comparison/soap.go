@@ -0,0 +1,134 @@
+package comparison
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SoapOptions controls which parts of a SOAP message are ignored when
+// comparing it with another
+type SoapOptions struct {
+	// attributes that are removed from every element (local name)
+	IgnoreAttrs []string
+
+	// elements that are removed along with their children (local name)
+	IgnoreElements []string
+}
+
+// DefaultSoapOptions ignores things that are expected to differ between two
+// servers that are returning the same data
+var DefaultSoapOptions = &SoapOptions{
+	IgnoreAttrs: []string{
+		"ChangeKey",
+	},
+	IgnoreElements: []string{
+		"ServerVersionInfo",
+		"DateTimeCreated",
+		"DateTimeReceived",
+		"DateTimeSent",
+		"DateTimeStamp",
+		"LastModifiedTime",
+	},
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffSoap compares the structure of two SOAP messages, ignoring namespace
+// prefixes, whitespace, attribute order and anything in opts. If they are
+// different, a description of the differences is returned along with
+// ErrDifferent.
+func DiffSoap(a []byte, b []byte, opts *SoapOptions) (diffString string, err error) {
+	if opts == nil {
+		opts = DefaultSoapOptions
+	}
+
+	aj, err := soapToObject(a, opts)
+	if err != nil {
+		return "", errors.Wrap(err, "A xml error")
+	}
+
+	bj, err := soapToObject(b, opts)
+	if err != nil {
+		return "", errors.Wrap(err, "B xml error")
+	}
+
+	return diffObjects(aj, bj, false)
+}
+
+// converts the XML to something that the JSON differ understands:
+// - attributes become "@name" keys
+// - text becomes a "#text" key
+// - child elements are always stored in a list, keyed by their name
+func soapToObject(data []byte, opts *SoapOptions) (map[string]interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	root := make(map[string]interface{})
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return root, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if el, ok := tok.(xml.StartElement); ok {
+			if err = addElement(d, el, root, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func addElement(d *xml.Decoder, el xml.StartElement, parent map[string]interface{}, opts *SoapOptions) error {
+	if contains(opts.IgnoreElements, el.Name.Local) {
+		return d.Skip()
+	}
+
+	obj := make(map[string]interface{})
+	for _, attr := range el.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" ||
+			contains(opts.IgnoreAttrs, attr.Name.Local) {
+			continue
+		}
+		obj["@"+attr.Name.Local] = attr.Value
+	}
+
+	text := ""
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err = addElement(d, t, obj, opts); err != nil {
+				return err
+			}
+
+		case xml.CharData:
+			text += string(t)
+
+		case xml.EndElement:
+			if text = strings.TrimSpace(text); text != "" {
+				obj["#text"] = text
+			}
+
+			list, _ := parent[el.Name.Local].([]interface{})
+			parent[el.Name.Local] = append(list, obj)
+			return nil
+		}
+	}
+}
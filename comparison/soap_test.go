@@ -0,0 +1,53 @@
+package comparison
+
+import (
+	"strings"
+	"testing"
+)
+
+const soapA = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Header>
+    <h:ServerVersionInfo MajorVersion="15" MinorVersion="1" xmlns:h="http://schemas.microsoft.com/exchange/services/2006/types"/>
+  </s:Header>
+  <s:Body>
+    <m:GetItemResponse xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types">
+      <m:ResponseMessages>
+        <m:GetItemResponseMessage ResponseClass="Success">
+          <m:ResponseCode>NoError</m:ResponseCode>
+          <m:Items>
+            <t:Message>
+              <t:ItemId Id="AAA=" ChangeKey="CK1"/>
+              <t:Subject>Hello</t:Subject>
+              <t:DateTimeCreated>2017-01-01T00:00:00Z</t:DateTimeCreated>
+            </t:Message>
+          </m:Items>
+        </m:GetItemResponseMessage>
+      </m:ResponseMessages>
+    </m:GetItemResponse>
+  </s:Body>
+</s:Envelope>`
+
+// same message as produced by the translator: different prefixes, server
+// version, ChangeKey and timestamp
+const soapB = `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types"><soap:Header><t:ServerVersionInfo MajorVersion="15" MinorVersion="0"></t:ServerVersionInfo></soap:Header><soap:Body><m:GetItemResponse><m:ResponseMessages><m:GetItemResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode><m:Items><t:Message><t:ItemId ChangeKey="CK2" Id="AAA="></t:ItemId><t:Subject>Hello</t:Subject><t:DateTimeCreated>2017-01-01T00:00:01Z</t:DateTimeCreated></t:Message></m:Items></m:GetItemResponseMessage></m:ResponseMessages></m:GetItemResponse></soap:Body></soap:Envelope>`
+
+func TestDiffSoapIgnoresNoise(t *testing.T) {
+	if diffString, err := DiffSoap([]byte(soapA), []byte(soapB), nil); err != nil {
+		t.Errorf("messages should be equal: %s\n%s", err, diffString)
+	}
+}
+
+func TestDiffSoapDifferent(t *testing.T) {
+	changed := []byte(strings.Replace(soapA, "<t:Subject>Hello</t:Subject>", "<t:Subject>Goodbye</t:Subject>", 1))
+
+	diffString, err := DiffSoap([]byte(soapA), changed, nil)
+	if err != ErrDifferent {
+		t.Fatalf("expected ErrDifferent, got %v", err)
+	}
+
+	if diffString == "" {
+		t.Error("expected a description of the difference")
+	}
+}
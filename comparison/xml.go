@@ -0,0 +1,97 @@
+package comparison
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DiffXml compares two XML documents token by token. Whitespace between
+// elements and around text is ignored, so documents that only differ in
+// their indentation or namespace prefixes are the same. Unlike DiffSoap,
+// everything else counts: element and attribute order, namespaces and the
+// XML declaration. If they are different, the first different token is
+// described along with ErrDifferent.
+func DiffXml(a []byte, b []byte) (diffString string, err error) {
+	ad := xml.NewDecoder(bytes.NewReader(a))
+	bd := xml.NewDecoder(bytes.NewReader(b))
+
+	for {
+		at, aerr := nextXmlToken(ad)
+		if aerr != nil && aerr != io.EOF {
+			return "", errors.Wrap(aerr, "A xml error")
+		}
+
+		bt, berr := nextXmlToken(bd)
+		if berr != nil && berr != io.EOF {
+			return "", errors.Wrap(berr, "B xml error")
+		}
+
+		if aerr == io.EOF && berr == io.EOF {
+			return "", nil
+		}
+
+		as, bs := describeXmlToken(at, aerr), describeXmlToken(bt, berr)
+		if as != bs {
+			aline, _ := ad.InputPos()
+			bline, _ := bd.InputPos()
+			return fmt.Sprintf("A line %d: %s\nB line %d: %s", aline, as, bline, bs), ErrDifferent
+		}
+	}
+}
+
+// returns the next token that isn't only whitespace
+func nextXmlToken(d *xml.Decoder) (xml.Token, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if text, ok := tok.(xml.CharData); ok && len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		return tok, nil
+	}
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return "{" + name.Space + "}" + name.Local
+}
+
+// a string that is the same for tokens that are the same
+func describeXmlToken(tok xml.Token, err error) string {
+	if err == io.EOF {
+		return "end of document"
+	}
+
+	switch t := tok.(type) {
+	case xml.StartElement:
+		s := "<" + xmlName(t.Name)
+		for _, attr := range t.Attr {
+			if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+				continue
+			}
+			s += fmt.Sprintf(" %s=%q", xmlName(attr.Name), attr.Value)
+		}
+		return s + ">"
+	case xml.EndElement:
+		return "</" + xmlName(t.Name) + ">"
+	case xml.CharData:
+		return fmt.Sprintf("text %q", strings.TrimSpace(string(t)))
+	case xml.Comment:
+		return fmt.Sprintf("<!--%s-->", t)
+	case xml.ProcInst:
+		return fmt.Sprintf("<?%s %s?>", t.Target, t.Inst)
+	case xml.Directive:
+		return fmt.Sprintf("<!%s>", t)
+	}
+	return fmt.Sprintf("%#v", tok)
+}
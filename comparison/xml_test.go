@@ -0,0 +1,58 @@
+package comparison
+
+import (
+	"strings"
+	"testing"
+)
+
+const xmlIndented = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <m:GetItemResponse xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+      <m:ResponseCode>
+        NoError
+      </m:ResponseCode>
+      <m:Items/>
+    </m:GetItemResponse>
+  </s:Body>
+</s:Envelope>
+`
+
+func TestDiffXmlIgnoresWhitespace(t *testing.T) {
+	equivalent := []string{
+		// no indentation at all
+		`<?xml version="1.0" encoding="utf-8"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><m:GetItemResponse xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages"><m:ResponseCode>NoError</m:ResponseCode><m:Items></m:Items></m:GetItemResponse></s:Body></s:Envelope>`,
+
+		// tabs, CRLF and a different prefix for the same namespace
+		strings.NewReplacer("  ", "\t", "\n", "\r\n", "m:", "msg:", "xmlns:m=", "xmlns:msg=").Replace(xmlIndented),
+	}
+
+	for i, other := range equivalent {
+		if diffString, err := DiffXml([]byte(xmlIndented), []byte(other)); err != nil {
+			t.Errorf("%d: documents should be equal: %s\n%s", i, err, diffString)
+		}
+	}
+}
+
+func TestDiffXmlDifferent(t *testing.T) {
+	different := []string{
+		strings.Replace(xmlIndented, "NoError", "ErrorItemNotFound", 1),
+		strings.Replace(xmlIndented, "<m:Items/>", "<m:Items><m:Item/></m:Items>", 1),
+		strings.Replace(xmlIndented, "services/2006/messages", "services/2010/messages", 1),
+		strings.Replace(xmlIndented, "</s:Envelope>", "</s:Envelope><!-- trailer -->", 1),
+	}
+
+	for i, other := range different {
+		diffString, err := DiffXml([]byte(xmlIndented), []byte(other))
+		if err != ErrDifferent {
+			t.Errorf("%d: expected ErrDifferent, got %v", i, err)
+		} else if diffString == "" {
+			t.Errorf("%d: expected a description of the difference", i)
+		}
+	}
+
+	truncated := strings.TrimSuffix(xmlIndented, "</s:Envelope>\n")
+	if _, err := DiffXml([]byte(xmlIndented), []byte(truncated)); err == nil || err == ErrDifferent {
+		t.Errorf("expected an xml error, got %v", err)
+	}
+}
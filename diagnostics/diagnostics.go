@@ -0,0 +1,337 @@
+// Package diagnostics contains probes that check whether an exchange server
+// is reachable and usable by the proxy, and explain what is wrong if it isn't
+package diagnostics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type AuthType string
+
+const (
+	AuthUnknown   AuthType = "unknown"
+	AuthForms     AuthType = "forms"
+	AuthBasic     AuthType = "basic"
+	AuthNegotiate AuthType = "negotiate"
+	AuthFederated AuthType = "federated"
+)
+
+// Result is the outcome of a single probe
+type Result struct {
+	Name   string
+	OK     bool
+	Detail string
+
+	// if not OK, something the user can do about it
+	Hint string
+}
+
+// Report is the outcome of all probes, in the order they were run
+type Report struct {
+	Target   *url.URL
+	Results  []Result
+	AuthType AuthType
+}
+
+// OK returns true if every probe succeeded
+func (this *Report) OK() bool {
+	for _, r := range this.Results {
+		if !r.OK {
+			return false
+		}
+	}
+	return len(this.Results) != 0
+}
+
+// Print writes a human readable report to w
+func (this *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Diagnostics for %s\n", this.Target)
+	for _, r := range this.Results {
+		status := " OK "
+		if !r.OK {
+			status = "FAIL"
+		}
+
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, r.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Fprintf(w, "       -> %s\n", r.Hint)
+		}
+	}
+
+	if this.OK() {
+		fmt.Fprintln(w, "All checks passed")
+	} else {
+		fmt.Fprintln(w, "Some checks failed")
+	}
+}
+
+// Checker probes an exchange server
+type Checker struct {
+	Target *url.URL
+
+	// path of the OWA login page, default is /owa/
+	OwaPath string
+
+	// timeout for each individual probe
+	Timeout time.Duration
+
+	// set if the user has disabled certificate verification
+	NoVerify bool
+
+	// if nil, the system roots are used
+	RootCAs *x509.CertPool
+
+	// used to establish connections; if nil, one is created with Timeout
+	Dialer *net.Dialer
+}
+
+func NewChecker(target *url.URL) *Checker {
+	return &Checker{
+		Target:  target,
+		OwaPath: "/owa/",
+		Timeout: 5 * time.Second,
+	}
+}
+
+func (this *Checker) dialer() *net.Dialer {
+	if this.Dialer != nil {
+		return this.Dialer
+	}
+	return &net.Dialer{Timeout: this.Timeout}
+}
+
+// hostPort returns the address to connect to, adding the default port for
+// the scheme if needed
+func (this *Checker) hostPort() string {
+	if this.Target.Port() != "" {
+		return this.Target.Host
+	}
+
+	if this.Target.Scheme == "https" {
+		return net.JoinHostPort(this.Target.Hostname(), "443")
+	}
+	return net.JoinHostPort(this.Target.Hostname(), "80")
+}
+
+// Run executes all probes in sequence, stopping at the first failure since
+// the later probes depend on the earlier ones
+func (this *Checker) Run() *Report {
+	report := &Report{Target: this.Target, AuthType: AuthUnknown}
+
+	probes := []func() Result{
+		this.CheckDNS,
+		this.CheckTCP,
+	}
+
+	if this.Target.Scheme == "https" {
+		probes = append(probes, this.CheckTLS)
+	}
+
+	for _, probe := range probes {
+		result := probe()
+		report.Results = append(report.Results, result)
+		if !result.OK {
+			return report
+		}
+	}
+
+	result, authType := this.CheckOWA()
+	report.Results = append(report.Results, result)
+	report.AuthType = authType
+	return report
+}
+
+// CheckDNS verifies that the target host resolves
+func (this *Checker) CheckDNS() Result {
+	result := Result{Name: "DNS"}
+	host := this.Target.Hostname()
+
+	if ip := net.ParseIP(host); ip != nil {
+		result.OK = true
+		result.Detail = fmt.Sprintf("%s is an IP address", host)
+		return result
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "check the spelling of the exchange server name, or whether you need to be on a VPN"
+		return result
+	}
+
+	result.OK = true
+	result.Detail = fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", "))
+	return result
+}
+
+// CheckTCP verifies that a TCP connection to the target can be established
+func (this *Checker) CheckTCP() Result {
+	result := Result{Name: "TCP"}
+	addr := this.hostPort()
+
+	conn, err := this.dialer().Dial("tcp", addr)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "the server is not accepting connections; check the port, the scheme (http vs https) and any firewall"
+		return result
+	}
+	conn.Close()
+
+	result.OK = true
+	result.Detail = fmt.Sprintf("connected to %s", addr)
+	return result
+}
+
+// CheckTLS performs a TLS handshake and verifies the certificate chain
+func (this *Checker) CheckTLS() Result {
+	result := Result{Name: "TLS"}
+	addr := this.hostPort()
+
+	// verification is done by hand afterwards so that the chain can be
+	// reported even when it isn't trusted
+	conn, err := tls.DialWithDialer(this.dialer(), "tcp", addr, &tls.Config{
+		ServerName:         this.Target.Hostname(),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "the server did not complete a TLS handshake; is it actually serving http instead of https?"
+		return result
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	var chain []string
+	for _, cert := range certs {
+		chain = append(chain, cert.Subject.CommonName)
+	}
+
+	result.Detail = fmt.Sprintf("certificate chain: %s", strings.Join(chain, " <- "))
+
+	if len(certs) == 0 {
+		result.Detail = "server presented no certificates"
+		return result
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       this.Target.Hostname(),
+		Roots:         this.RootCAs,
+		Intermediates: intermediates,
+	})
+
+	if err != nil {
+		if this.NoVerify {
+			result.OK = true
+			result.Detail += fmt.Sprintf(" (not trusted: %s, ignored because of -noverify)", err)
+		} else {
+			result.Detail += fmt.Sprintf(" (not trusted: %s)", err)
+			result.Hint = "if you trust this server (or a corporate proxy is intercepting TLS), use -noverify"
+		}
+		return result
+	}
+
+	result.OK = true
+	return result
+}
+
+// CheckOWA fetches the OWA login page and determines which type of
+// authentication the server wants
+func (this *Checker) CheckOWA() (Result, AuthType) {
+	result := Result{Name: "OWA"}
+
+	transport := &http.Transport{
+		Dial:            this.dialer().Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: this.NoVerify, RootCAs: this.RootCAs},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   this.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	owaUrl := this.Target.ResolveReference(&url.URL{Path: this.OwaPath})
+	response, err := client.Get(owaUrl.String())
+	if err != nil {
+		result.Detail = err.Error()
+		return result, AuthUnknown
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 256*1024))
+
+	authType, err := DetectAuthType(owaUrl, response, body)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = fmt.Sprintf("make sure OWA is available at %s", owaUrl)
+		return result, authType
+	}
+
+	result.OK = true
+	result.Detail = fmt.Sprintf("GET %s returned %d, authentication is %s", owaUrl, response.StatusCode, authType)
+	return result, authType
+}
+
+// DetectAuthType examines the response to a request for the OWA page and
+// figures out how the user is expected to authenticate
+func DetectAuthType(owaUrl *url.URL, response *http.Response, body []byte) (AuthType, error) {
+
+	switch response.StatusCode {
+	case http.StatusUnauthorized:
+		for _, value := range response.Header["Www-Authenticate"] {
+			scheme := strings.ToLower(strings.SplitN(value, " ", 2)[0])
+			switch scheme {
+			case "negotiate", "ntlm":
+				return AuthNegotiate, nil
+			case "basic":
+				return AuthBasic, nil
+			}
+		}
+		return AuthUnknown, errors.New("server requires authentication of an unknown type")
+
+	case http.StatusFound, http.StatusMovedPermanently, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		location, err := response.Location()
+		if err != nil {
+			return AuthUnknown, errors.Wrap(err, "invalid redirect")
+		}
+
+		if location.Host != owaUrl.Host {
+			return AuthFederated, nil
+		}
+
+		if strings.Contains(strings.ToLower(location.Path), "/owa/auth/") {
+			return AuthForms, nil
+		}
+
+		return AuthUnknown, errors.Errorf("unexpected redirect to %s", location)
+
+	case http.StatusOK:
+		lower := strings.ToLower(string(body))
+		if strings.Contains(lower, "auth.owa") || strings.Contains(lower, "logon.aspx") {
+			return AuthForms, nil
+		}
+		return AuthUnknown, nil
+
+	default:
+		return AuthUnknown, errors.Errorf("unexpected status %d", response.StatusCode)
+	}
+}
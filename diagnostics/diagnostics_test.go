@@ -0,0 +1,158 @@
+package diagnostics
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newChecker(t *testing.T, serverUrl string) *Checker {
+	target, err := url.Parse(serverUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := NewChecker(target)
+	checker.Timeout = 2 * time.Second
+	return checker
+}
+
+func lastResult(report *Report) Result {
+	return report.Results[len(report.Results)-1]
+}
+
+func TestCheckFormsAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/owa/auth/logon.aspx?replaceCurrent=1", http.StatusFound)
+	}))
+	defer server.Close()
+
+	report := newChecker(t, server.URL).Run()
+	if !report.OK() {
+		t.Fatalf("expected success, got %+v", report.Results)
+	}
+
+	if report.AuthType != AuthForms {
+		t.Errorf("expected forms auth, got %s", report.AuthType)
+	}
+
+	buf := new(bytes.Buffer)
+	report.Print(buf)
+	if !strings.Contains(buf.String(), "All checks passed") {
+		t.Errorf("unexpected report: %s", buf)
+	}
+}
+
+func TestCheckBasicAndFederatedAuth(t *testing.T) {
+	basic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mail.example.com"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer basic.Close()
+
+	if report := newChecker(t, basic.URL).Run(); report.AuthType != AuthBasic {
+		t.Errorf("expected basic auth, got %s", report.AuthType)
+	}
+
+	federated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://adfs.example.com/adfs/ls/?wa=wsignin1.0", http.StatusFound)
+	}))
+	defer federated.Close()
+
+	if report := newChecker(t, federated.URL).Run(); report.AuthType != AuthFederated {
+		t.Errorf("expected federated auth, got %s", report.AuthType)
+	}
+}
+
+func TestCheckMissingOwa(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	report := newChecker(t, server.URL).Run()
+	if report.OK() {
+		t.Fatal("expected failure")
+	}
+
+	if r := lastResult(report); r.Name != "OWA" || r.Hint == "" {
+		t.Errorf("expected OWA failure with a hint, got %+v", r)
+	}
+}
+
+func TestCheckConnectionRefused(t *testing.T) {
+	// grab a port that nobody is listening on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	report := newChecker(t, "http://"+addr).Run()
+	if report.OK() {
+		t.Fatal("expected failure")
+	}
+
+	if r := lastResult(report); r.Name != "TCP" {
+		t.Errorf("expected TCP failure, got %+v", r)
+	}
+}
+
+func TestCheckDNSFailure(t *testing.T) {
+	report := newChecker(t, "https://exchange.invalid").Run()
+	if report.OK() {
+		t.Fatal("expected failure")
+	}
+
+	if r := lastResult(report); r.Name != "DNS" {
+		t.Errorf("expected DNS failure, got %+v", r)
+	}
+}
+
+func TestCheckUntrustedCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/owa/auth/logon.aspx", http.StatusFound)
+	}))
+	defer server.Close()
+
+	// self-signed certificate isn't trusted
+	report := newChecker(t, server.URL).Run()
+	if report.OK() {
+		t.Fatal("expected failure")
+	}
+
+	r := lastResult(report)
+	if r.Name != "TLS" || !strings.Contains(r.Hint, "-noverify") {
+		t.Errorf("expected TLS failure suggesting -noverify, got %+v", r)
+	}
+
+	// ... unless the user said not to care
+	checker := newChecker(t, server.URL)
+	checker.NoVerify = true
+	if report = checker.Run(); !report.OK() {
+		t.Errorf("expected success with NoVerify, got %+v", report.Results)
+	}
+
+	// ... or the certificate is actually trusted
+	checker = newChecker(t, server.URL)
+	checker.RootCAs = x509.NewCertPool()
+	checker.RootCAs.AddCert(server.Certificate())
+	if report = checker.Run(); !report.OK() {
+		t.Errorf("expected success with trusted root, got %+v", report.Results)
+	}
+}
+
+func TestCheckPlainHttpOnHttps(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	report := newChecker(t, strings.Replace(server.URL, "http://", "https://", 1)).Run()
+	if r := lastResult(report); r.Name != "TLS" || r.OK {
+		t.Errorf("expected TLS failure, got %+v", r)
+	}
+}
@@ -0,0 +1,81 @@
+package ews
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ActionPolicy decides which EWS operations clients may use, for
+// deployments where the proxy should only allow reading mail
+type ActionPolicy struct {
+	// if true only Actions are allowed, otherwise Actions are denied
+	AllowList bool
+	Actions   map[string]bool
+
+	lock   sync.Mutex
+	denied map[string]int
+}
+
+// NewActionPolicy creates an allow-list policy if allow is given, or a
+// deny-list policy if deny is given. Unknown operation names are an error,
+// as they are most likely a typo.
+func NewActionPolicy(allow []string, deny []string) (*ActionPolicy, error) {
+	if (len(allow) == 0) == (len(deny) == 0) {
+		return nil, errors.New("the action policy needs either allowed or denied actions")
+	}
+
+	policy := &ActionPolicy{
+		AllowList: len(allow) != 0,
+		Actions:   make(map[string]bool),
+		denied:    make(map[string]int),
+	}
+
+	actions := deny
+	if policy.AllowList {
+		actions = allow
+	}
+
+	for _, action := range actions {
+		if EwsOperations[action] == nil {
+			return nil, errors.Errorf("unknown EWS operation `%s` in the action policy", action)
+		}
+		policy.Actions[action] = true
+	}
+
+	return policy, nil
+}
+
+// Allowed returns true if the policy allows action
+func (this *ActionPolicy) Allowed(action string) bool {
+	return this.Actions[action] == this.AllowList
+}
+
+// records the decision for action, returns false if it's denied
+func (this *ActionPolicy) check(action string) bool {
+	if this.Allowed(action) {
+		return true
+	}
+
+	this.lock.Lock()
+	if this.denied == nil {
+		this.denied = make(map[string]int)
+	}
+	this.denied[action]++
+	this.lock.Unlock()
+
+	Log.Info.Printf("Action policy denied %s", action)
+	return false
+}
+
+// Denied returns the number of requests denied for each operation
+func (this *ActionPolicy) Denied() map[string]int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	denied := make(map[string]int, len(this.denied))
+	for action, count := range this.denied {
+		denied[action] = count
+	}
+	return denied
+}
@@ -0,0 +1,126 @@
+package ews
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// sends the request in testfile through a translator with policy, returns
+// the fault response if the request was denied
+func applyPolicy(t *testing.T, policy *ActionPolicy, testfile string) *http.Response {
+	data, err := os.Open(filepath.Join("testdata", "requests", testfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.Policy = policy
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", data)
+	err = translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	if err == nil {
+		return nil
+	}
+
+	re, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("%s: %s", testfile, err)
+	}
+	return re.Response
+}
+
+func TestActionPolicyAllowList(t *testing.T) {
+	policy, err := NewActionPolicy([]string{"GetItem", "FindItem"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if applyPolicy(t, policy, "owa_getitem_request.xml") != nil || applyPolicy(t, policy, "owa_finditem_request.xml") != nil {
+		t.Error("allowed operation was denied")
+	}
+
+	if applyPolicy(t, policy, "owa_deleteitem_request.xml") == nil {
+		t.Error("DeleteItem was not denied")
+	}
+
+	if denied := policy.Denied(); len(denied) != 1 || denied["DeleteItem"] != 1 {
+		t.Errorf("unexpected denied counts %v", denied)
+	}
+}
+
+func TestActionPolicyDenyList(t *testing.T) {
+	policy, err := NewActionPolicy(nil, []string{"DeleteItem", "SendItem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if applyPolicy(t, policy, "owa_getitem_request.xml") != nil {
+		t.Error("GetItem was denied")
+	}
+
+	for i := 0; i < 2; i++ {
+		if applyPolicy(t, policy, "owa_deleteitem_request.xml") == nil {
+			t.Error("DeleteItem was not denied")
+		}
+	}
+
+	if denied := policy.Denied(); denied["DeleteItem"] != 2 {
+		t.Errorf("unexpected denied counts %v", denied)
+	}
+}
+
+func TestActionPolicyErrors(t *testing.T) {
+	if _, err := NewActionPolicy(nil, nil); err == nil {
+		t.Error("empty policy was accepted")
+	}
+
+	if _, err := NewActionPolicy([]string{"GetItem"}, []string{"SendItem"}); err == nil {
+		t.Error("policy with both lists was accepted")
+	}
+
+	if _, err := NewActionPolicy(nil, []string{"SendItems"}); err == nil {
+		t.Error("unknown operation was accepted")
+	}
+}
+
+func TestActionPolicyFault(t *testing.T) {
+	policy, _ := NewActionPolicy(nil, []string{"DeleteItem"})
+
+	response := applyPolicy(t, policy, "owa_deleteitem_request.xml")
+	if response == nil {
+		t.Fatal("DeleteItem was not denied")
+	}
+
+	if response.StatusCode != http.StatusInternalServerError || response.Header.Get("Content-Type") != "text/xml; charset=utf-8" {
+		t.Errorf("unexpected response %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	var fault struct {
+		Body struct {
+			Fault struct {
+				Code         string `xml:"faultcode"`
+				String       string `xml:"faultstring"`
+				ResponseCode string `xml:"detail>ResponseCode"`
+			}
+		}
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if err := xml.Unmarshal(body, &fault); err != nil {
+		t.Fatalf("invalid fault: %s\n%s", err, body)
+	}
+
+	if fault.Body.Fault.Code != "a:ErrorAccessDenied" || fault.Body.Fault.ResponseCode != "ErrorAccessDenied" ||
+		fault.Body.Fault.String != "The DeleteItem operation is not allowed by the proxy." {
+		t.Errorf("unexpected fault:\n%s", body)
+	}
+}
@@ -0,0 +1,47 @@
+package ews
+
+/*
+	Exchange Online in a hybrid deployment decides which backend serves a
+	request using the X-AnchorMailbox header, and a request for a mailbox
+	that lives somewhere else fails or is slow without it. EWS clients that
+	impersonate another user expect the request to go to that user's
+	mailbox, so the mailbox in the ExchangeImpersonation header wins over
+	TranslationMiddleware.AnchorMailbox.
+
+	Once routed, Exchange returns an X-BackEndOverrideCookie that pins later
+	requests to the same backend when the client sends
+	X-PreferServerAffinity. The header is passed on like any other client
+	header, and the cookie is kept by the redirector's cookie jar.
+*/
+
+import (
+	"github.com/virtuald/go-ordered-json"
+)
+
+// ImpersonatedMailbox returns the mailbox from the ConnectingSID in the
+// ExchangeImpersonation header of the request, or "" if there is none. The
+// SID can't be used for routing, so it is ignored.
+func (this *JsonRequest) ImpersonatedMailbox() string {
+	header := memberObject(this.msg, "Header")
+	sid := memberObject(memberObject(header, "ExchangeImpersonation"), "ConnectingSID")
+
+	for _, key := range []string{"PrimarySmtpAddress", "SmtpAddress", "PrincipalName"} {
+		for _, member := range sid {
+			if value, ok := member.Value.(string); ok && member.Key == key && value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// returns the member of obj called key if it is an object
+func memberObject(obj json.OrderedObject, key string) json.OrderedObject {
+	for _, member := range obj {
+		if member.Key == key {
+			value, _ := member.Value.(json.OrderedObject)
+			return value
+		}
+	}
+	return nil
+}
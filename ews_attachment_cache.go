@@ -0,0 +1,406 @@
+package ews
+
+/*
+	Some clients download an attachment again every time it is opened, which
+	is slow on a slow link. With an AttachmentCache, the content of file
+	attachments returned by GetAttachment is kept on disk, and a
+	GetAttachment for attachments that are all in the cache is answered by
+	the proxy without asking OWA.
+
+	Each attachment is two files named after a hash of its AttachmentId: the
+	decoded content, and its metadata (the attachment without its Content,
+	the size and sha256 of the content, and whose session stored it).
+	Content that doesn't match its size and hash is thrown away.
+
+	Anyone who knows an AttachmentId could get the attachment from the
+	cache, so entries are only used by the session that stored them: when
+	the credential changes (another user may have logged in), everything
+	else is thrown away. Shared turns this off for proxies that only ever
+	have one user.
+*/
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const attachmentCacheMetaSuffix = ".json"
+const attachmentCacheContentSuffix = ".bin"
+
+// AttachmentCache keeps the content of file attachments in a directory, the
+// least recently used are removed when there are more than MaxSize bytes
+type AttachmentCache struct {
+	// maximum total size of the content in bytes, larger attachments are
+	// not cached
+	MaxSize int64
+
+	// If true, entries are kept when the credential changes, for a proxy
+	// that only ever has one user
+	Shared bool
+
+	dir string
+
+	lock  sync.Mutex
+	owner string // of the current session
+	size  int64
+
+	// most recently used at the front
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// stored as the metadata file
+type attachmentCacheEntry struct {
+	Id     string `json:"id"`
+	Owner  string `json:"owner"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+
+	// the OWA JSON of the attachment, without Content
+	Attachment map[string]interface{} `json:"attachment"`
+}
+
+// NewAttachmentCache uses dir for the cache, it is created if it doesn't
+// exist. Entries that are already there are kept, up to maxSize.
+func NewAttachmentCache(dir string, maxSize int64) (*AttachmentCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating attachment cache")
+	}
+
+	this := &AttachmentCache{
+		MaxSize: maxSize,
+		dir:     dir,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	if err := this.load(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// reads the metadata of the entries in dir, the last modification time of
+// the metadata is when the entry was last used
+func (this *AttachmentCache) load() error {
+	files, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return errors.Wrap(err, "reading attachment cache")
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), attachmentCacheMetaSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(this.dir, file.Name()))
+		if err != nil {
+			return errors.Wrap(err, "reading attachment cache")
+		}
+
+		entry := &attachmentCacheEntry{}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err = d.Decode(entry); err != nil || this.fileName(entry.Id) != strings.TrimSuffix(file.Name(), attachmentCacheMetaSuffix) {
+			// not one of ours, or a leftover from a crash
+			os.Remove(filepath.Join(this.dir, file.Name()))
+			continue
+		}
+
+		this.entries[entry.Id] = this.order.PushFront(entry)
+		this.size += entry.Size
+	}
+
+	// content without metadata can't be used
+	names := make(map[string]bool, len(this.entries))
+	for id := range this.entries {
+		names[this.fileName(id)] = true
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), attachmentCacheMetaSuffix) &&
+			!names[strings.TrimSuffix(file.Name(), attachmentCacheContentSuffix)] {
+			os.Remove(filepath.Join(this.dir, file.Name()))
+		}
+	}
+
+	this.evict()
+	return nil
+}
+
+// returns the name of the files of id, without the suffix
+func (this *AttachmentCache) fileName(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:])
+}
+
+func (this *AttachmentCache) path(id string, suffix string) string {
+	return filepath.Join(this.dir, this.fileName(id)+suffix)
+}
+
+// throws away the entries of other sessions when the owner changes. Must be
+// called with the lock held.
+func (this *AttachmentCache) setOwner(owner string) {
+	if this.Shared || owner == this.owner {
+		return
+	}
+
+	this.owner = owner
+	for el := this.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*attachmentCacheEntry).Owner != owner {
+			this.remove(el)
+		}
+		el = next
+	}
+}
+
+// must be called with the lock held
+func (this *AttachmentCache) remove(el *list.Element) {
+	entry := this.order.Remove(el).(*attachmentCacheEntry)
+	delete(this.entries, entry.Id)
+	this.size -= entry.Size
+
+	os.Remove(this.path(entry.Id, attachmentCacheMetaSuffix))
+	os.Remove(this.path(entry.Id, attachmentCacheContentSuffix))
+}
+
+// must be called with the lock held
+func (this *AttachmentCache) evict() {
+	for this.size > this.MaxSize && this.order.Len() != 0 {
+		this.remove(this.order.Back())
+	}
+}
+
+// get returns the OWA JSON of the attachment with id, with its Content, if
+// it was stored by owner
+func (this *AttachmentCache) get(owner string, id string) (map[string]interface{}, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setOwner(owner)
+
+	el, ok := this.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*attachmentCacheEntry)
+
+	content, err := ioutil.ReadFile(this.path(id, attachmentCacheContentSuffix))
+	hash := sha256.Sum256(content)
+	if err != nil || int64(len(content)) != entry.Size || hex.EncodeToString(hash[:]) != entry.Sha256 {
+		this.remove(el)
+		return nil, false
+	}
+
+	this.order.MoveToFront(el)
+	now := time.Now()
+	os.Chtimes(this.path(id, attachmentCacheMetaSuffix), now, now)
+
+	attachment := make(map[string]interface{}, len(entry.Attachment)+1)
+	for key, value := range entry.Attachment {
+		attachment[key] = value
+	}
+	attachment["Content"] = base64.StdEncoding.EncodeToString(content)
+	return attachment, true
+}
+
+// put stores a FileAttachment from an OWA JSON response for owner
+func (this *AttachmentCache) put(owner string, attachment map[string]interface{}) error {
+	attachmentId, _ := attachment["AttachmentId"].(map[string]interface{})
+	id, _ := attachmentId["Id"].(string)
+	encoded, ok := attachment["Content"].(string)
+	if id == "" || !ok {
+		return errors.New("attachment has no AttachmentId or Content")
+	}
+
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.Wrap(err, "decoding attachment Content")
+	} else if int64(len(content)) > this.MaxSize {
+		return nil
+	}
+
+	hash := sha256.Sum256(content)
+	entry := &attachmentCacheEntry{
+		Id:         id,
+		Owner:      owner,
+		Size:       int64(len(content)),
+		Sha256:     hex.EncodeToString(hash[:]),
+		Attachment: make(map[string]interface{}, len(attachment)),
+	}
+	for key, value := range attachment {
+		if key != "Content" {
+			entry.Attachment[key] = value
+		}
+	}
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setOwner(owner)
+	if el, ok := this.entries[id]; ok {
+		this.remove(el)
+	}
+
+	// the metadata is written last, so that load only sees complete entries
+	if err = writeFileAtomic(this.path(id, attachmentCacheContentSuffix), content); err == nil {
+		err = writeFileAtomic(this.path(id, attachmentCacheMetaSuffix), meta)
+	}
+	if err != nil {
+		os.Remove(this.path(id, attachmentCacheContentSuffix))
+		return errors.Wrap(err, "writing attachment cache")
+	}
+
+	this.entries[id] = this.order.PushFront(entry)
+	this.size += entry.Size
+	this.evict()
+	return nil
+}
+
+// writes data to a temporary file that is then renamed to name
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// identifies the session in the cache without writing the credential to disk
+func attachmentCacheOwner(credential string) string {
+	hash := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(hash[:])
+}
+
+// returns the ids of a GetAttachment request if it can be answered from the
+// cache, a request with an AttachmentShape asks for something other than
+// what is cached
+func cacheableAttachmentIds(jsonRequest *JsonRequest) []string {
+	body := memberObject(jsonRequest.msg, "Body")
+
+	var ids []string
+	for _, member := range body {
+		switch member.Key {
+		case "AttachmentShape":
+			return nil
+		case "AttachmentIds":
+			list, _ := member.Value.([]interface{})
+			for _, value := range list {
+				attachmentId, _ := value.(json.OrderedObject)
+				for _, idMember := range attachmentId {
+					if id, ok := idMember.Value.(string); ok && idMember.Key == "Id" {
+						ids = append(ids, id)
+					}
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// returns the local response for a GetAttachment request whose attachments
+// are all in the cache, or nil if the request should be sent to OWA. The
+// response to a request that can be cached is stored by cacheAttachments.
+func (this *TranslationMiddleware) cachedAttachmentResponse(request *http.Request, ctx *ewsProxyContext, jsonRequest *JsonRequest, canary string) (*http.Response, error) {
+	if this.AttachmentCache == nil || ctx.EwsProxyOp.Action != "GetAttachment" {
+		return nil, nil
+	}
+
+	ids := cacheableAttachmentIds(jsonRequest)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx.attachmentOwner = attachmentCacheOwner(canary)
+
+	messages := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		attachment, ok := this.AttachmentCache.get(ctx.attachmentOwner, id)
+		if !ok {
+			return nil, nil
+		}
+
+		messages = append(messages, map[string]interface{}{
+			"__type":        "AttachmentInfoResponseMessage:#Exchange",
+			"ResponseClass": "Success",
+			"ResponseCode":  "NoError",
+			"Attachments":   []interface{}{attachment},
+		})
+	}
+
+	jsonResponse, err := json.Marshal(map[string]interface{}{
+		"Body": map[string]interface{}{
+			"ResponseMessages": map[string]interface{}{"Items": messages},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	outbuf := new(bytes.Buffer)
+	if err = JSON2SOAP(bytes.NewReader(jsonResponse), ctx.EwsProxyOp, outbuf, false); err != nil {
+		return nil, err
+	}
+
+	this.appendTransaction(ctx, "Ews Translator: GetAttachment is answered from the attachment cache")
+
+	response := proxyutils.CreateNewResponse(request, outbuf.String())
+	response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return response, nil
+}
+
+// stores the file attachments of a successful GetAttachment response
+func (this *TranslationMiddleware) cacheAttachments(ctx *ewsProxyContext, jsonResponseData []byte) {
+	msg, err := decodeJsonMessage(bytes.NewReader(jsonResponseData))
+	if err != nil {
+		return
+	}
+
+	body, _ := msg["Body"].(map[string]interface{})
+	responseMessages, _ := body["ResponseMessages"].(map[string]interface{})
+	items, _ := responseMessages["Items"].([]interface{})
+
+	for _, rmsg := range items {
+		rmsgObj, _ := rmsg.(map[string]interface{})
+		if rmsgObj["ResponseClass"] != "Success" {
+			continue
+		}
+
+		attachments, _ := rmsgObj["Attachments"].([]interface{})
+		for _, attachment := range attachments {
+			attachmentObj, _ := attachment.(map[string]interface{})
+			if attachmentObj["__type"] != "FileAttachment:#Exchange" {
+				continue
+			}
+
+			if err = this.AttachmentCache.put(ctx.attachmentOwner, attachmentObj); err != nil {
+				this.appendTransaction(ctx, "Ews Translator: not cached: "+err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ews
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func testAttachment(id string, content string) map[string]interface{} {
+	return map[string]interface{}{
+		"__type":       "FileAttachment:#Exchange",
+		"AttachmentId": map[string]interface{}{"Id": id},
+		"Name":         id + ".txt",
+		"Content":      base64.StdEncoding.EncodeToString([]byte(content)),
+	}
+}
+
+func tempCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ews-attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestAttachmentCacheProxy(t *testing.T) {
+	getAttachment, err := ioutil.ReadFile("testdata/requests/ews_getattachment.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	getAttachmentResponse, err := ioutil.ReadFile("testdata/responses/GetAttachment_owa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	if translator.AttachmentCache, err = NewAttachmentCache(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := 0
+	proxy := newLimitedProxy(translator, roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		upstream++
+		return proxyutils.CreateNewResponse(request, string(getAttachmentResponse)), nil
+	}))
+
+	send := func(body []byte) string {
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(body))
+		response, err := proxy.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d\n%s", response.StatusCode, data)
+		}
+		return string(data)
+	}
+
+	for i, test := range []struct {
+		canary   string
+		shared   bool
+		upstream int
+	}{
+		{"canary", false, 1}, // miss
+		{"canary", false, 1}, // hit
+		{"other", false, 2},  // a new session doesn't see it
+		{"other", false, 2},
+		{"third", true, 2}, // unless the cache is shared
+	} {
+		translator.OwaCanary = test.canary
+		translator.AttachmentCache.Shared = test.shared
+
+		response := send(getAttachment)
+		if upstream != test.upstream {
+			t.Errorf("%d: expected %d requests to OWA, got %d", i, test.upstream, upstream)
+		}
+
+		for _, s := range []string{
+			`<t:AttachmentId Id="AAMkAGAttachment1=" RootItemChangeKey="CQAAAA==" RootItemId="AAMkAGMessage=">`,
+			`<t:Name>report.pdf</t:Name>`,
+			`<t:Size>70</t:Size>`,
+			`<t:Content>JVBERi0xLjQKJSBxdWFydGVybHkgcmVwb3J0CjEgMCBvYmogPDwgL1R5cGUgL0NhdGFsb2cgPj4gZW5kb2JqCiUlRU9GCg==</t:Content>`,
+		} {
+			if !strings.Contains(response, s) {
+				t.Errorf("%d: %s is not in the response\n%s", i, s, response)
+			}
+		}
+	}
+
+	// a different shape isn't cached
+	withShape := bytes.Replace(getAttachment, []byte("<m:AttachmentIds>"),
+		[]byte("<m:AttachmentShape><t:IncludeMimeContent>true</t:IncludeMimeContent></m:AttachmentShape><m:AttachmentIds>"), 1)
+	send(withShape)
+	if upstream != 3 {
+		t.Errorf("request with an AttachmentShape was answered from the cache")
+	}
+}
+
+func TestAttachmentCacheEviction(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	cache, err := NewAttachmentCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err = cache.put("owner", testAttachment(id, "1234")); err != nil {
+			t.Fatal(err)
+		}
+		// a is used, so b is the least recently used
+		cache.get("owner", "a")
+	}
+
+	for id, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.get("owner", id); ok != expected {
+			t.Errorf("%s: expected cached %v", id, expected)
+		}
+	}
+
+	// too large for the cache
+	if err = cache.put("owner", testAttachment("d", "12345678901")); err != nil {
+		t.Fatal(err)
+	} else if _, ok := cache.get("owner", "d"); ok {
+		t.Error("attachment larger than MaxSize was cached")
+	}
+
+	// the entries are still there after a restart
+	if cache, err = NewAttachmentCache(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	attachment, ok := cache.get("owner", "c")
+	if !ok || attachment["Name"] != "c.txt" || attachment["Content"] != base64.StdEncoding.EncodeToString([]byte("1234")) {
+		t.Errorf("unexpected attachment after reload %v %v", attachment, ok)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 4 {
+		t.Errorf("expected the files of two entries, got %d", len(files))
+	}
+}
+
+func TestAttachmentCacheIntegrity(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	cache, err := NewAttachmentCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"changed", "truncated", "missing"} {
+		if err = cache.put("owner", testAttachment(id, "content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ioutil.WriteFile(cache.path("changed", attachmentCacheContentSuffix), []byte("CONTENT"), 0600)
+	ioutil.WriteFile(cache.path("truncated", attachmentCacheContentSuffix), []byte("cont"), 0600)
+	os.Remove(cache.path("missing", attachmentCacheContentSuffix))
+
+	for _, id := range []string{"changed", "truncated", "missing"} {
+		if _, ok := cache.get("owner", id); ok {
+			t.Errorf("%s: damaged entry was used", id)
+		}
+		if _, err := os.Stat(cache.path(id, attachmentCacheMetaSuffix)); !os.IsNotExist(err) {
+			t.Errorf("%s: damaged entry was not removed", id)
+		}
+	}
+
+	if cache.size != 0 {
+		t.Errorf("expected an empty cache, size is %d", cache.size)
+	}
+
+	// leftovers that aren't entries are removed when the cache is opened
+	ioutil.WriteFile(filepath.Join(dir, "orphan"+attachmentCacheContentSuffix), []byte("x"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "junk"+attachmentCacheMetaSuffix), []byte("{"), 0600)
+	if _, err = NewAttachmentCache(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected an empty directory, got %d files", len(files))
+	}
+}
@@ -0,0 +1,88 @@
+package ews
+
+/*
+	Exchange throttles clients by returning a response message with
+	ResponseCode ErrorServerBusy, which has a BackOffMilliseconds value in
+	its MessageXml. The EWS client gets the translated message and backs off
+	by itself, but the proxy's own requests (the keepalive) need to know
+	about it too.
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/virtuald/go-ordered-json"
+)
+
+type serverBusyResponse struct {
+	Body struct {
+		ResponseMessages struct {
+			Items []struct {
+				ResponseCode string
+				MessageXml   []struct {
+					Name  string
+					Value interface{}
+				}
+			}
+		}
+	}
+}
+
+// serverBusyBackOff returns the longest BackOffMilliseconds of any
+// ErrorServerBusy response message in an OWA JSON response, or 0
+func serverBusyBackOff(jsonResponseData []byte) (backOff time.Duration) {
+	// don't bother parsing normal responses
+	if !bytes.Contains(jsonResponseData, []byte("ErrorServerBusy")) {
+		return 0
+	}
+
+	var response serverBusyResponse
+	if err := json.Unmarshal(jsonResponseData, &response); err != nil {
+		return 0
+	}
+
+	for _, message := range response.Body.ResponseMessages.Items {
+		if message.ResponseCode != "ErrorServerBusy" {
+			continue
+		}
+
+		for _, value := range message.MessageXml {
+			if value.Name != "BackOffMilliseconds" {
+				continue
+			}
+
+			text, err := toString(value.Value)
+			if err != nil {
+				continue
+			}
+
+			if ms, err := strconv.ParseInt(text, 10, 64); err == nil {
+				if d := time.Duration(ms) * time.Millisecond; d > backOff {
+					backOff = d
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// BackOffUntil returns the time until which the server asked not to be sent
+// any requests, it is in the past if the server isn't busy
+func (this *TranslationMiddleware) BackOffUntil() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.backOffUntil
+}
+
+func (this *TranslationMiddleware) setBackOff(backOff time.Duration) {
+	until := this.Clock.Now().Add(backOff)
+
+	this.lock.Lock()
+	if until.After(this.backOffUntil) {
+		this.backOffUntil = until
+	}
+	this.lock.Unlock()
+}
@@ -0,0 +1,62 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestServerBusyBackOff(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/responses/GetItem_owa_serverbusy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if backOff := serverBusyBackOff(data); backOff != 29878*time.Millisecond {
+		t.Errorf("expected 29.878s, got %s", backOff)
+	}
+
+	if data, err = ioutil.ReadFile("testdata/responses/GetItem_owa.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if backOff := serverBusyBackOff(data); backOff != 0 {
+		t.Errorf("expected no backoff, got %s", backOff)
+	}
+}
+
+func TestServerBusyResponse(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/responses/GetItem_owa_serverbusy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+
+	cctx := proxyutils.NewChainValues()
+	cctx.Set(ewsContextName, &ewsProxyContext{
+		EwsProxyOp:     EwsOperations["GetItem"],
+		TransactionLog: new(bytes.Buffer),
+	})
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/owa/service.svc", nil)
+	response := proxyutils.CreateNewResponse(request, string(data))
+
+	if err = translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if !bytes.Contains(body, []byte(`<t:Value Name="BackOffMilliseconds">29878</t:Value>`)) {
+		t.Errorf("BackOffMilliseconds is missing from the response:\n%s", body)
+	}
+
+	if wait := time.Until(translator.BackOffUntil()); wait < 29*time.Second || wait > 30*time.Second {
+		t.Errorf("expected to back off for about 30s, got %s", wait)
+	}
+}
@@ -0,0 +1,251 @@
+package ews
+
+/*
+	Normally the canary comes from the browser: the user logs in to OWA
+	through the proxy and the LoginMiddleware picks it up on the way back.
+	When OWA is behind an SSO portal that the browser never leaves, or there
+	is no browser at all, set LoginMiddleware.CanarySource instead. The
+	source is asked for a canary (and the session cookies that go with it)
+	when an EWS request arrives and there is none, and when the session
+	expires. When the server rejects its canary, Invalidate is called so
+	that the next Acquire logs in again instead of returning the same one.
+
+	The browser is a source too (browserLogin), but one that never logs in
+	by itself: the canary of the OWA page that the browser loaded is checked
+	like the canary of any other source. AutoRelogin is implemented as a
+	source that posts the login form that the browser posted (see
+	ews_relogin.go), and NewFormLogin returns a source that posts a user
+	name and password to the login form of the exchange server.
+
+	A login that fails with a wrong or changed password would be tried again
+	by every request of a client that retries, until the account is locked
+	out. So after a failed login, the next one waits canaryRetryDelay, and
+	the delay doubles with each failure up to canaryMaxRetryDelay. A login
+	with the browser, or an automatic one that succeeds, ends the delay.
+*/
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long Relogin waits for a CanarySource
+const canaryAcquireTimeout = time.Minute
+
+// how long Relogin waits after a failed login, see acquireBackOff
+const (
+	canaryRetryDelay    = 30 * time.Second
+	canaryMaxRetryDelay = 15 * time.Minute
+)
+
+// CanarySource gets OWA canaries without the browser
+type CanarySource interface {
+	// Acquire logs in, and returns the canary and the cookies of the
+	// session. The cookies are kept for the exchange server, cookies that
+	// were set with a client that uses the jar of the RedirectorMiddleware
+	// don't need to be returned.
+	Acquire(ctx context.Context) (canary string, cookies []*http.Cookie, err error)
+
+	// Invalidate is called when the server rejected the canary
+	Invalidate()
+}
+
+// a CanarySource that posts a forms based login to the exchange server
+type formLogin struct {
+	login *LoginMiddleware
+
+	// path and query of the form action, relative to the target server
+	action string
+	form   url.Values
+}
+
+// NewFormLogin returns a CanarySource that logs in to the forms based
+// authentication of the exchange server (auth.owa) with username and
+// password, without the browser
+func NewFormLogin(login *LoginMiddleware, username string, password string) CanarySource {
+	return &formLogin{
+		login:  login,
+		action: "/owa/" + loginFormPath,
+		form: url.Values{
+			"destination": {login.Redirector.TargetUrl(&url.URL{Path: "/owa/"}).String()},
+			"flags":       {"4"},
+			"username":    {username},
+			"password":    {password},
+			"isUtf8":      {"1"},
+		},
+	}
+}
+
+func (this *formLogin) Acquire(ctx context.Context) (string, []*http.Cookie, error) {
+	action, err := url.Parse(this.action)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client := http.Client{Transport: this.login.Transport}
+	client.Jar = this.login.Redirector.Cookies
+
+	request, err := http.NewRequest("POST", this.login.Redirector.TargetUrl(action).String(), strings.NewReader(this.form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	request = request.WithContext(ctx)
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if userAgent := this.login.Redirector.CurrentUserAgent(); userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", nil, err
+	}
+	response.Body.Close()
+
+	finder := this.login.CanaryFinder
+	if finder == nil {
+		finder = this.login.CookieCanaryFinder
+	}
+
+	canary, err := finder(response)
+	if err == nil && canary == "" {
+		err = errors.New("the login did not return a canary")
+	}
+	return canary, nil, err
+}
+
+// the session cookies are in the jar, there is nothing to forget
+func (this *formLogin) Invalidate() {}
+
+// the CanarySource of the browser, the LoginMiddleware captures the canary
+// of the OWA pages that the browser loads. The session cookies are already
+// in the jar of the RedirectorMiddleware.
+type browserLogin struct {
+	lock   sync.Mutex
+	canary string
+}
+
+func (this *browserLogin) capture(canary string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.canary = canary
+}
+
+func (this *browserLogin) Acquire(ctx context.Context) (string, []*http.Cookie, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.canary == "" {
+		return "", nil, errors.New("the browser login is needed")
+	}
+	return this.canary, nil, nil
+}
+
+func (this *browserLogin) Invalidate() {
+	this.capture("")
+}
+
+// the delay before a login is tried again after one failed
+type acquireBackOff struct {
+	lock     sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+// returns how long to wait before the next login, 0 if it can be tried now
+func (this *acquireBackOff) wait(now time.Time) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if wait := this.retryAt.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// counts a failed login, returns the delay before the next one
+func (this *acquireBackOff) failed(now time.Time) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delay := canaryRetryDelay
+	for i := 0; i < this.failures && delay < canaryMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > canaryMaxRetryDelay {
+		delay = canaryMaxRetryDelay
+	}
+
+	this.failures++
+	this.retryAt = now.Add(delay)
+	return delay
+}
+
+func (this *acquireBackOff) reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.failures = 0
+	this.retryAt = time.Time{}
+}
+
+// gets a canary from source, and keeps it if the server accepts it
+func (this *LoginMiddleware) acquire(source CanarySource) error {
+	ctx, cancel := context.WithTimeout(context.Background(), canaryAcquireTimeout)
+	defer cancel()
+
+	canary, cookies, err := source.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(cookies) != 0 {
+		this.Redirector.Cookies.SetCookies(this.Redirector.TargetServer, cookies)
+	}
+
+	if canary == "" {
+		return errors.New("no canary was returned")
+	}
+	if !this.CheckLogin(canary) {
+		return errors.New("the server did not accept the canary, the browser login is needed")
+	}
+
+	this.acquireBackOff.reset()
+	return nil
+}
+
+// checks the canary of an OWA page that the browser loaded
+func (this *LoginMiddleware) browserLoggedIn(canary string) {
+	this.browser.capture(canary)
+	if err := this.acquire(&this.browser); err != nil {
+		Log.Debug.Printf("Browser login: %s", err)
+	}
+}
+
+// returns CanarySource, or the login form that the browser posted if
+// AutoRelogin is set. nil if there is neither.
+func (this *LoginMiddleware) canarySource() CanarySource {
+	if this.CanarySource != nil {
+		return this.CanarySource
+	}
+	if login := this.recorded.get(); login != nil {
+		return &formLogin{login: this, action: login.Action, form: login.Form}
+	}
+	return nil
+}
+
+// gets a canary from CanarySource before an EWS request is translated, if
+// there is none. Concurrent requests wait for the same login.
+func (this *LoginMiddleware) acquireCanary() {
+	this.acquireLock.Lock()
+	defer this.acquireLock.Unlock()
+
+	if this.Translator.OwaCanary == "" {
+		this.relogin()
+	}
+}
@@ -0,0 +1,263 @@
+package ews
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/ewstest"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// a CanarySource that logs in to the fake OWA server directly
+type scriptedCanarySource struct {
+	owa *ewstest.Server
+
+	lock        sync.Mutex
+	acquired    int
+	invalidated int
+	err         error // if set, Acquire fails with it
+}
+
+func (this *scriptedCanarySource) Acquire(ctx context.Context) (string, []*http.Cookie, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.acquired++
+	if this.err != nil {
+		return "", nil, this.err
+	}
+	return this.owa.Login(), []*http.Cookie{{Name: "sso", Value: "ticket"}}, nil
+}
+
+func (this *scriptedCanarySource) Invalidate() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.invalidated++
+}
+
+// records the paths of the requests sent to the exchange server
+type pathRecorder struct {
+	lock  sync.Mutex
+	paths []string
+}
+
+func (this *pathRecorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	this.lock.Lock()
+	this.paths = append(this.paths, request.URL.Path)
+	this.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestCanarySource(t *testing.T) {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	transport := &pathRecorder{}
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	canaries := &scriptedCanarySource{owa: owa}
+
+	login := &LoginMiddleware{
+		Translator:   translator,
+		Redirector:   redirector,
+		Transport:    transport,
+		CheckPath:    "/owa/",
+		CanarySource: canaries,
+	}
+	login.CanaryFinder = login.CookieCanaryFinder
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  transport,
+		Translator: translator,
+		Redirector: redirector,
+		Login:      login,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ewsRequest := func() int {
+		data, err := os.Open(filepath.Join("testdata", "requests", "ews_getfolder_comment.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer data.Close()
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", data))
+		return w.Code
+	}
+
+	// the first request gets a canary
+	if code := ewsRequest(); code != http.StatusOK {
+		t.Fatalf("expected the request to succeed, got %d", code)
+	}
+	if translator.OwaCanary != "canary1" || canaries.acquired != 1 {
+		t.Errorf("expected canary1 to be acquired once, got %q (%d times)", translator.OwaCanary, canaries.acquired)
+	}
+
+	cookies := redirector.Cookies.Cookies(target)
+	if len(cookies) != 1 || cookies[0].Name != "sso" {
+		t.Errorf("the cookies of the source were not kept: %v", cookies)
+	}
+
+	// the keepalive finds that the session expired
+	owa.Expire()
+	if login.CheckLogin(translator.OwaCanary) || canaries.invalidated != 1 {
+		t.Errorf("expected the canary to be invalidated once, got %d", canaries.invalidated)
+	}
+
+	if code := ewsRequest(); code != http.StatusOK {
+		t.Fatalf("expected the request to succeed after the session expired, got %d", code)
+	}
+	if translator.OwaCanary != "canary2" || canaries.acquired != 2 {
+		t.Errorf("expected canary2 to be acquired, got %q (%d times)", translator.OwaCanary, canaries.acquired)
+	}
+
+	for _, path := range transport.paths {
+		if path != "/owa/service.svc" {
+			t.Errorf("unexpected request to %s", path)
+		}
+	}
+	if owa.Logins() != 0 {
+		t.Errorf("the login form was used %d times", owa.Logins())
+	}
+}
+
+func TestCanarySourceRetryDelay(t *testing.T) {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	clock := proxyutils.NewFakeClock(time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC))
+	translator := NewTranslationMiddleware()
+	translator.Clock = clock
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	canaries := &scriptedCanarySource{owa: owa, err: errors.New("wrong password")}
+
+	login := &LoginMiddleware{
+		Translator:   translator,
+		Redirector:   redirector,
+		Transport:    http.DefaultTransport,
+		CheckPath:    "/owa/",
+		CanarySource: canaries,
+	}
+	login.CanaryFinder = login.CookieCanaryFinder
+
+	// the translator throttles requests without a canary on the clock, so
+	// they only go to the LoginMiddleware
+	ewsRequests := func(n int) {
+		for i := 0; i < n; i++ {
+			request := httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", nil)
+			if err := login.RequestModifier(request.Context(), request, proxyutils.NewChainValues()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a client that retries doesn't make the source log in each time
+	ewsRequests(5)
+	if canaries.acquired != 1 {
+		t.Fatalf("expected one login, got %d", canaries.acquired)
+	}
+
+	clock.Advance(canaryRetryDelay)
+	ewsRequests(5)
+	if canaries.acquired != 2 {
+		t.Fatalf("expected a second login after %s, got %d", canaryRetryDelay, canaries.acquired)
+	}
+
+	// the delay doubles
+	clock.Advance(canaryRetryDelay)
+	ewsRequests(1)
+	if canaries.acquired != 2 {
+		t.Fatalf("expected the second delay to be longer, got %d logins", canaries.acquired)
+	}
+
+	// and ends once a login succeeds
+	canaries.lock.Lock()
+	canaries.err = nil
+	canaries.lock.Unlock()
+
+	clock.Advance(canaryRetryDelay)
+	ewsRequests(1)
+	if canaries.acquired != 3 || translator.OwaCanary != owa.Canary() {
+		t.Fatalf("expected a successful third login, got %d logins and canary %q", canaries.acquired, translator.OwaCanary)
+	}
+	if wait := login.acquireBackOff.wait(clock.Now()); wait != 0 {
+		t.Errorf("the delay was kept after a successful login: %s", wait)
+	}
+}
+
+func TestAcquireBackOff(t *testing.T) {
+	var backOff acquireBackOff
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, expected := range []time.Duration{
+		canaryRetryDelay, 2 * canaryRetryDelay, 4 * canaryRetryDelay, 8 * canaryRetryDelay,
+		16 * canaryRetryDelay, canaryMaxRetryDelay, canaryMaxRetryDelay,
+	} {
+		if delay := backOff.failed(now); delay != expected {
+			t.Errorf("expected a delay of %s, got %s", expected, delay)
+		}
+	}
+
+	if wait := backOff.wait(now.Add(time.Minute)); wait != canaryMaxRetryDelay-time.Minute {
+		t.Errorf("unexpected wait %s", wait)
+	}
+}
+
+func TestBrowserLoginIsCanarySource(t *testing.T) {
+	var browser CanarySource = &browserLogin{}
+	if _, _, err := browser.Acquire(context.Background()); err == nil {
+		t.Error("expected an error before the browser logged in")
+	}
+
+	browser.(*browserLogin).capture("canary")
+	if canary, _, err := browser.Acquire(context.Background()); err != nil || canary != "canary" {
+		t.Errorf("expected the captured canary, got %q %v", canary, err)
+	}
+
+	browser.Invalidate()
+	if _, _, err := browser.Acquire(context.Background()); err == nil {
+		t.Error("expected an error after Invalidate")
+	}
+}
+
+func TestFormLogin(t *testing.T) {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	login := &LoginMiddleware{
+		Translator: NewTranslationMiddleware(),
+		Redirector: proxyutils.NewRedirectorMiddleware(source, target),
+		CheckPath:  "/owa/",
+	}
+
+	if _, _, err := NewFormLogin(login, ewstest.DefaultUsername, "wrong").Acquire(context.Background()); err == nil {
+		t.Error("the login succeeded with the wrong password")
+	}
+
+	canary, _, err := NewFormLogin(login, ewstest.DefaultUsername, ewstest.DefaultPassword).Acquire(context.Background())
+	if err != nil || canary == "" || canary != owa.Canary() {
+		t.Errorf("expected the canary of the session %q, got %q (%v)", owa.Canary(), canary, err)
+	}
+}
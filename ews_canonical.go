@@ -0,0 +1,109 @@
+package ews
+
+/*
+	The JSON that soap2json produces keeps the order of the SOAP document, so
+	two clients that send the same request with their attributes or elements
+	in a different order produce different JSON. That doesn't matter to OWA,
+	but it makes captures and diffs noisy. CanonicalizeJSON puts the members
+	of each object in the order that the schema defines instead:
+
+		__type, attributes, text, list items, elements
+
+	Members that the schema doesn't know about (added by hooks, for example)
+	are kept at the end in the order they were in.
+*/
+
+import (
+	"github.com/virtuald/go-ordered-json"
+)
+
+// CanonicalizeJSON reorders the members of the translated body of a request
+// into schema order. It has the signature of a RequestHookFunc.
+func CanonicalizeJSON(op *OpDescriptor, body json.OrderedObject) json.OrderedObject {
+	return canonicalObject(op.Request, body)
+}
+
+func canonicalObject(typ *EwsType, obj json.OrderedObject) json.OrderedObject {
+	if typ == nil {
+		return obj
+	}
+
+	ret := make(json.OrderedObject, 0, len(obj))
+	used := make([]bool, len(obj))
+
+	take := func(key string, elem *EwsJsonElement) {
+		for i, member := range obj {
+			if used[i] || member.Key != key {
+				continue
+			}
+			used[i] = true
+			if elem != nil {
+				member.Value = canonicalValue(elem, member.Value)
+			}
+			ret = append(ret, member)
+		}
+	}
+
+	take("__type", nil)
+
+	for _, attr := range typ.Attributes {
+		take(attr.JN, nil)
+	}
+
+	if typ.TextAttr != "" {
+		take(typ.TextAttr, nil)
+	}
+
+	if typ.JsonListName != "" {
+		take(typ.JsonListName, typ.JsonListElement)
+	}
+
+	for _, elem := range typ.JsonElementList {
+		take(elem.JsonName, elem)
+	}
+
+	for i, member := range obj {
+		if !used[i] {
+			ret = append(ret, member)
+		}
+	}
+
+	return ret
+}
+
+// value: the JSON value of an element
+// elem: describes the element
+func canonicalValue(elem *EwsJsonElement, value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.OrderedObject:
+		var jtyp *EwsJsonType
+		if elem.SingleType != nil {
+			jtyp = elem.SingleType
+		} else {
+			for _, member := range v {
+				if typeName, ok := member.Value.(string); ok && member.Key == "__type" {
+					jtyp = elem.Types[typeName]
+					break
+				}
+			}
+		}
+
+		if jtyp == nil {
+			return v
+		}
+		return canonicalObject(jtyp.Type, v)
+
+	case []interface{}:
+		// same lookup as processJsonList
+		itemElem := elem
+		if elem.SingleType != nil && elem.SingleType.Type.IsList && elem.SingleType.Type.JsonListElement != nil {
+			itemElem = elem.SingleType.Type.JsonListElement
+		}
+
+		for i, item := range v {
+			v[i] = canonicalValue(itemElem, item)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,89 @@
+package ews
+
+import (
+	"strings"
+	"testing"
+)
+
+const canonicalFindItem = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header><t:RequestServerVersion Version="Exchange2013"/></soap:Header>
+    <soap:Body>
+        <m:FindItem Traversal="Shallow">
+            <m:ItemShape>
+                <t:BaseShape>IdOnly</t:BaseShape>
+                <t:AdditionalProperties>
+                    <t:FieldURI FieldURI="item:Subject"/>
+                </t:AdditionalProperties>
+            </m:ItemShape>
+            <m:IndexedPageItemView MaxEntriesReturned="25" Offset="0" BasePoint="Beginning"/>
+            <m:Restriction>
+                <t:IsEqualTo>
+                    <t:FieldURI FieldURI="message:IsRead"/>
+                    <t:FieldURIOrConstant><t:Constant Value="false"/></t:FieldURIOrConstant>
+                </t:IsEqualTo>
+            </m:Restriction>
+            <m:ParentFolderIds>
+                <t:DistinguishedFolderId Id="inbox"/>
+            </m:ParentFolderIds>
+        </m:FindItem>
+    </soap:Body>
+</soap:Envelope>`
+
+// the same request, with attributes and elements in a different order
+const canonicalFindItemReordered = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header><t:RequestServerVersion Version="Exchange2013"/></soap:Header>
+    <soap:Body>
+        <m:FindItem Traversal="Shallow">
+            <m:ParentFolderIds>
+                <t:DistinguishedFolderId Id="inbox"/>
+            </m:ParentFolderIds>
+            <m:Restriction>
+                <t:IsEqualTo>
+                    <t:FieldURIOrConstant><t:Constant Value="false"/></t:FieldURIOrConstant>
+                    <t:FieldURI FieldURI="message:IsRead"/>
+                </t:IsEqualTo>
+            </m:Restriction>
+            <m:IndexedPageItemView BasePoint="Beginning" Offset="0" MaxEntriesReturned="25"/>
+            <m:ItemShape>
+                <t:AdditionalProperties>
+                    <t:FieldURI FieldURI="item:Subject"/>
+                </t:AdditionalProperties>
+                <t:BaseShape>IdOnly</t:BaseShape>
+            </m:ItemShape>
+        </m:FindItem>
+    </soap:Body>
+</soap:Envelope>`
+
+func TestCanonicalizeJSON(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	// off by default, the document order is kept
+	first := translateRequest(t, translator, []byte(canonicalFindItem))
+	second := translateRequest(t, translator, []byte(canonicalFindItemReordered))
+	if first == second {
+		t.Fatal("expected the requests to be translated differently without CanonicalizeJSON")
+	}
+
+	translator.CanonicalizeJSON = true
+
+	first = translateRequest(t, translator, []byte(canonicalFindItem))
+	second = translateRequest(t, translator, []byte(canonicalFindItemReordered))
+	if first != second {
+		t.Errorf("canonical JSON differs:\n%s\n%s", first, second)
+	}
+
+	// and it's stable
+	if again := translateRequest(t, translator, []byte(canonicalFindItemReordered)); again != second {
+		t.Errorf("canonical JSON changed when translated again:\n%s\n%s", second, again)
+	}
+
+	body := first[strings.Index(first, `"Body":`):]
+	if !strings.HasPrefix(body, `"Body":{"__type":"FindItemRequest:#Exchange"`) {
+		t.Errorf("__type is not the first member of the body: %s", body)
+	}
+
+	if !strings.Contains(body, `"Paging":{"__type":"IndexedPageView:#Exchange","BasePoint":"Beginning","MaxEntriesReturned":25,"Offset":0}`) {
+		t.Errorf("attributes are not in schema order: %s", body)
+	}
+}
@@ -0,0 +1,86 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// Version is shown on the close page, set it at build time with
+// -ldflags "-X github.com/virtuald/ews-proxy.Version=..."
+var Version = "dev"
+
+// ClosePageData is what the close page template is executed with
+type ClosePageData struct {
+	Version       string
+	Authenticated bool
+	TargetHost    string
+
+	// the state of the OWA session, so that a user who comes back to the
+	// page can see if the login is still valid
+	State SessionState
+}
+
+// ParseClosePage parses the close page template in path, or the default
+// template if path is empty
+func ParseClosePage(path string) (*template.Template, error) {
+	if path == "" {
+		return template.New("close").Parse(defaultClosePageHtml)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading close page")
+	}
+
+	tmpl, err := template.New("close").Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing close page %s", path)
+	}
+	return tmpl, nil
+}
+
+// ClosePage serves the page that the browser is sent to once the login is
+// done (at /close.html and /proxyclose.html). NewProxy puts it before the
+// login middleware.
+type ClosePage struct {
+	Template   *template.Template
+	Translator *TranslationMiddleware
+	TargetHost string
+}
+
+func (this *ClosePage) RequestModifier(ctx context.Context, request *http.Request, cctx *proxyutils.ChainValues) error {
+	if request.URL.Path != "/close.html" && request.URL.Path != "/proxyclose.html" {
+		return nil
+	}
+
+	data := &ClosePageData{
+		Version:       Version,
+		Authenticated: this.Translator.isLoggedIn(),
+		TargetHost:    this.TargetHost,
+		State:         this.Translator.SessionState(),
+	}
+
+	var response *http.Response
+
+	buf := new(bytes.Buffer)
+	if err := this.Template.Execute(buf, data); err != nil {
+		Log.Error.Printf("Error rendering close page: %s", err)
+		response = proxyutils.CreateNewResponse(request, "")
+		response.StatusCode = http.StatusInternalServerError
+	} else {
+		response = proxyutils.CreateNewResponse(request, buf.String())
+		response.Header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+
+	return proxyutils.NewRequestError(response)
+}
+
+func (this *ClosePage) ResponseModifier(ctx context.Context, response *http.Response, cctx *proxyutils.ChainValues) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package ews
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func renderClosePage(t *testing.T, closePage *ClosePage, path string) string {
+	request, _ := http.NewRequest("GET", "http://localhost:60001"+path, nil)
+
+	err := closePage.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	re, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("%s: expected a response, got %v", path, err)
+	}
+
+	if re.Response.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", path, re.Response.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(re.Response.Body)
+	return string(body)
+}
+
+func TestDefaultClosePage(t *testing.T) {
+	tmpl, err := ParseClosePage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	closePage := &ClosePage{Template: tmpl, Translator: translator, TargetHost: "mail.example.com"}
+
+	body := renderClosePage(t, closePage, "/close.html")
+	if !strings.Contains(body, "Not logged in to mail.example.com") || !strings.Contains(body, `href="/owa/"`) {
+		t.Errorf("unexpected page before login:\n%s", body)
+	}
+
+	translator.onSuccess()
+
+	for _, path := range []string{"/close.html", "/proxyclose.html"} {
+		body = renderClosePage(t, closePage, path)
+		if !strings.Contains(body, "window.close()") || !strings.Contains(body, "Login to Exchange successful!") {
+			t.Errorf("%s: unexpected page after login:\n%s", path, body)
+		}
+	}
+
+	// a user who comes back to the page sees that the session has expired
+	translator.onTimeout()
+	body = renderClosePage(t, closePage, "/close.html")
+	if !strings.Contains(body, "The session with mail.example.com has expired.") || !strings.Contains(body, `href="/owa/"`) {
+		t.Errorf("unexpected page after the session expired:\n%s", body)
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+	if err = closePage.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Errorf("other paths must be passed on, got %v", err)
+	}
+}
+
+func TestCustomClosePage(t *testing.T) {
+	tmpl, err := ParseClosePage(filepath.Join("testdata", "close_page.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved string) { Version = saved }(Version)
+	Version = "1.2.3"
+
+	translator := NewTranslationMiddleware()
+	translator.onSuccess()
+	closePage := &ClosePage{Template: tmpl, Translator: translator, TargetHost: "<mail.example.com>"}
+
+	body := renderClosePage(t, closePage, "/proxyclose.html")
+	if !strings.Contains(body, "Connected to &lt;mail.example.com&gt;") || !strings.Contains(body, "ews-proxy 1.2.3") {
+		t.Errorf("unexpected page:\n%s", body)
+	}
+}
+
+func TestClosePageParseError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "closepage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "close.html")
+	ioutil.WriteFile(path, []byte("<p>{{if .Authenticated}}</p>"), 0600)
+
+	if _, err = ParseClosePage(path); err == nil {
+		t.Error("expected a parse error")
+	}
+
+	if _, err = ParseClosePage(filepath.Join(dir, "missing.html")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,159 @@
+package ews
+
+/*
+	OWA budgets the number of concurrent requests of a session, and answers
+	with ErrorServerBusy once a client goes over it. Clients such as DavMail
+	open many connections in parallel, and every one of them is sent with the
+	same session, so translated requests are limited here instead. Requests
+	over the limit wait in line (first come, first served) until a slot is
+	free or ConcurrencyWait has passed.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConcurrentRequests = 4
+	DefaultConcurrencyWait       = 30 * time.Second
+)
+
+type requestLimiter struct {
+	lock    sync.Mutex
+	active  int
+	waiting []chan struct{}
+
+	// the requests that got a slot after waiting for it, and how long
+	waited   int
+	waitTime time.Duration
+	maxWait  time.Duration
+}
+
+// acquire waits for a slot and returns true once it has one, or false if
+// timeout passed or ctx was cancelled first
+func (this *requestLimiter) acquire(ctx context.Context, limit int, timeout time.Duration) bool {
+	this.lock.Lock()
+	if this.active < limit && len(this.waiting) == 0 {
+		this.active++
+		this.lock.Unlock()
+		return true
+	}
+
+	ready := make(chan struct{})
+	this.waiting = append(this.waiting, ready)
+	this.lock.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		this.addWait(time.Since(start))
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	this.lock.Lock()
+	for i, waiting := range this.waiting {
+		if waiting == ready {
+			this.waiting = append(this.waiting[:i], this.waiting[i+1:]...)
+			this.lock.Unlock()
+			return false
+		}
+	}
+	this.lock.Unlock()
+
+	// the slot was handed over while giving up, pass it on
+	this.release()
+	return false
+}
+
+// release hands the slot to the first waiting request, or frees it
+func (this *requestLimiter) release() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.waiting) != 0 {
+		close(this.waiting[0])
+		this.waiting = this.waiting[1:]
+	} else {
+		this.active--
+	}
+}
+
+func (this *requestLimiter) counts() (active int, queued int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.active, len(this.waiting)
+}
+
+func (this *requestLimiter) addWait(wait time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.waited++
+	this.waitTime += wait
+	if wait > this.maxWait {
+		this.maxWait = wait
+	}
+}
+
+// waits returns how many requests had to wait for a slot, and how long
+// they waited on average and at most
+func (this *requestLimiter) waits() (waited int, average time.Duration, max time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.waited != 0 {
+		average = this.waitTime / time.Duration(this.waited)
+	}
+	return this.waited, average, this.maxWait
+}
+
+// waits for a slot for a translated request. Returns a SOAP fault if there
+// wasn't one in time, otherwise ctx.release must be called when the
+// request is done.
+func (this *TranslationMiddleware) acquireSlot(reqCtx context.Context, request *http.Request, ctx *ewsProxyContext) (*http.Response, error) {
+	if this.MaxConcurrentRequests <= 0 {
+		return nil, nil
+	}
+
+	if !this.limiter.acquire(reqCtx, this.MaxConcurrentRequests, this.ConcurrencyWait) {
+		if reqCtx.Err() != nil {
+			return nil, reqCtx.Err()
+		}
+
+		backOff := this.ConcurrencyWait
+		if backOff < time.Second {
+			backOff = time.Second
+		}
+
+		this.appendTransaction(ctx, fmt.Sprintf("Ews Translator: no free request slot after %s", this.ConcurrencyWait))
+		return createSoapFault(request, "ErrorServerBusy",
+			"The server cannot service this request right now. Try again later.",
+			soapFaultValue{"BackOffMilliseconds", strconv.FormatInt(int64(backOff/time.Millisecond), 10)}), nil
+	}
+
+	var once sync.Once
+	ctx.release = func() {
+		once.Do(this.limiter.release)
+	}
+
+	// response modifiers aren't called when the request fails, the slot is
+	// released when the client request is over
+	if done := reqCtx.Done(); done != nil {
+		go func() {
+			<-done
+			ctx.release()
+		}()
+	}
+
+	return nil, nil
+}
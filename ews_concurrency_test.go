@@ -0,0 +1,181 @@
+package ews
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// gives back the request slot of a request that was translated but not sent
+func releaseSlot(cctx *proxyutils.ChainValues) {
+	if value, ok := cctx.Lookup(ewsContextName); ok {
+		if ctx := value.(*ewsProxyContext); ctx.release != nil {
+			ctx.release()
+		}
+	}
+}
+
+// an OWA server that answers GetItem requests one at a time, when told to.
+// arrived gets the ItemId of each request when it comes in.
+type slowOwa struct {
+	arrived  chan string
+	proceed  chan struct{}
+	response []byte
+}
+
+func newSlowOwa(t *testing.T) *slowOwa {
+	response, err := ioutil.ReadFile("testdata/responses/GetItem_owa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &slowOwa{
+		arrived:  make(chan string, 10),
+		proceed:  make(chan struct{}),
+		response: response,
+	}
+}
+
+func (this *slowOwa) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body struct {
+		Body struct {
+			ItemIds []struct{ Id string }
+		}
+	}
+	data, _ := ioutil.ReadAll(request.Body)
+	if err := json.Unmarshal(data, &body); err != nil || len(body.Body.ItemIds) == 0 {
+		return nil, err
+	}
+
+	this.arrived <- body.Body.ItemIds[0].Id
+	<-this.proceed
+	return proxyutils.CreateNewResponse(request, string(this.response)), nil
+}
+
+func newLimitedProxy(translator *TranslationMiddleware, upstream http.RoundTripper) http.RoundTripper {
+	logger := log.New(ioutil.Discard, "", 0)
+	return proxyutils.CreateChainedProxy("test", logger, logger, logger, logger, logger, nil, upstream, translator)
+}
+
+func sendGetItem(proxy http.RoundTripper, id string) (*http.Response, error) {
+	body := strings.Replace(getItemRequest, `Id="i2="`, `Id="`+id+`"`, 1)
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(body))
+	return proxy.RoundTrip(request)
+}
+
+func waitForQueue(t *testing.T, translator *TranslationMiddleware, queued int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if _, n := translator.limiter.counts(); n == queued {
+			return
+		}
+	}
+	t.Fatalf("expected %d queued requests", queued)
+}
+
+func TestConcurrencyLimitOrder(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.MaxConcurrentRequests = 2
+
+	owa := newSlowOwa(t)
+	proxy := newLimitedProxy(translator, owa)
+
+	var wg sync.WaitGroup
+	send := func(id string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := sendGetItem(proxy, id)
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Errorf("%s: request failed: %v", id, err)
+			}
+		}()
+	}
+
+	// the first two are sent right away
+	send("a")
+	send("b")
+	started := map[string]bool{<-owa.arrived: true, <-owa.arrived: true}
+	if !started["a"] || !started["b"] {
+		t.Fatalf("unexpected requests %v", started)
+	}
+
+	// the others wait, in the order that they came in
+	for i, id := range []string{"c", "d", "e"} {
+		send(id)
+		waitForQueue(t, translator, i+1)
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost:60001/status", nil)
+	data, _ := ioutil.ReadAll(translator.statusResponse(request).Body)
+	var status ProxyStatus
+	if err := json.Unmarshal(data, &status); err != nil || status.ActiveRequests != 2 || status.QueuedRequests != 3 {
+		t.Errorf("unexpected status %s", data)
+	}
+
+	for _, expected := range []string{"c", "d", "e"} {
+		owa.proceed <- struct{}{}
+		if id := <-owa.arrived; id != expected {
+			t.Errorf("expected %s to be sent next, got %s", expected, id)
+		}
+
+		select {
+		case id := <-owa.arrived:
+			t.Fatalf("%s was sent over the limit", id)
+		default:
+		}
+	}
+
+	close(owa.proceed)
+	wg.Wait()
+
+	if active, queued := translator.limiter.counts(); active != 0 || queued != 0 {
+		t.Errorf("slots were not released: %d active, %d queued", active, queued)
+	}
+}
+
+func TestConcurrencyLimitTimeout(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.MaxConcurrentRequests = 1
+	translator.ConcurrencyWait = 50 * time.Millisecond
+
+	owa := newSlowOwa(t)
+	proxy := newLimitedProxy(translator, owa)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendGetItem(proxy, "a")
+	}()
+	<-owa.arrived
+
+	response, err := sendGetItem(proxy, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fault, values := parseSoapFault(t, response)
+	if fault.Code != "a:ErrorServerBusy" {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+	if ms, err := strconv.Atoi(values["BackOffMilliseconds"]); err != nil || ms < 1000 {
+		t.Errorf("unexpected back-off %q", values["BackOffMilliseconds"])
+	}
+
+	close(owa.proceed)
+	<-done
+
+	// the slot is free again
+	if response, err = sendGetItem(proxy, "c"); err != nil || response.StatusCode != http.StatusOK {
+		t.Errorf("request after the timeout failed: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package ews
+
+/*
+	EWS clients send and expect xs:dateTime values (2023-04-01T12:00:00Z,
+	or with an offset), while OWA sometimes returns them without the Z, or
+	in the WCF /Date(1680350400000)/ format. A value without a timezone is
+	treated by most clients as local time, which shifts it by the local
+	offset, so values of type T_DATETIME are converted in each direction.
+
+	Values that are in the local time of a timezone (timezone transitions,
+	availability) use the localDateTime type instead, and are never
+	converted.
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type DateTimeFormat int
+
+const (
+	// the value is passed through as-is
+	DateTimeUnchanged DateTimeFormat = iota
+
+	// 2023-04-01T12:00:00Z
+	DateTimeUTC
+
+	// 2023-04-01T14:00:00+02:00, the original offset is kept
+	DateTimeOffset
+
+	// /Date(1680350400000)/
+	DateTimeWCF
+)
+
+var dateTimeFormatNames = map[string]DateTimeFormat{
+	"unchanged": DateTimeUnchanged,
+	"utc":       DateTimeUTC,
+	"offset":    DateTimeOffset,
+	"wcf":       DateTimeWCF,
+}
+
+// ParseDateTimeFormat returns the format for a name: unchanged, utc, offset
+// or wcf
+func ParseDateTimeFormat(name string) (DateTimeFormat, error) {
+	if format, ok := dateTimeFormatNames[strings.ToLower(name)]; ok {
+		return format, nil
+	}
+	return DateTimeUnchanged, errors.Errorf("unknown date-time format `%s`", name)
+}
+
+// OWA includes an offset (+0200) when the value isn't UTC, but the number
+// is always milliseconds since the epoch in UTC
+var wcfDateTimeRe = regexp.MustCompile(`^/Date\((-?\d+)([+-]\d{4})?\)/$`)
+
+// values without a timezone are UTC, which is what OWA means when it drops
+// the Z
+const isoLocalDateTime = "2006-01-02T15:04:05.999999999"
+
+func parseDateTime(value string) (t time.Time, ok bool) {
+	if m := wcfDateTimeRe.FindStringSubmatch(value); m != nil {
+		ms, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		t = time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+		if m[2] != "" {
+			hours, _ := strconv.Atoi(m[2][1:3])
+			minutes, _ := strconv.Atoi(m[2][3:5])
+			offset := hours*3600 + minutes*60
+			if m[2][0] == '-' {
+				offset = -offset
+			}
+			t = t.In(time.FixedZone("", offset))
+		}
+		return t, true
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, isoLocalDateTime} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, true
+		}
+	}
+
+	return
+}
+
+func formatDateTime(t time.Time, format DateTimeFormat) string {
+	switch format {
+	case DateTimeUTC:
+		return t.UTC().Format(time.RFC3339Nano)
+	case DateTimeWCF:
+		ms := t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+		if _, offset := t.Zone(); offset != 0 {
+			sign := '+'
+			if offset < 0 {
+				sign, offset = '-', -offset
+			}
+			return fmt.Sprintf("/Date(%d%c%02d%02d)/", ms, sign, offset/3600, offset%3600/60)
+		}
+		return fmt.Sprintf("/Date(%d)/", ms)
+	default:
+		return t.Format(time.RFC3339Nano)
+	}
+}
+
+// convertDateTime returns value in the requested format, values that can't
+// be parsed are returned unchanged
+func convertDateTime(value string, format DateTimeFormat) string {
+	if format == DateTimeUnchanged || value == "" {
+		return value
+	}
+
+	t, ok := parseDateTime(value)
+	if !ok {
+		Log.Debug.Printf("Unknown date-time format, not converting `%s`", value)
+		return value
+	}
+
+	return formatDateTime(t, format)
+}
@@ -0,0 +1,123 @@
+package ews
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/virtuald/go-ordered-json"
+)
+
+func TestConvertDateTime(t *testing.T) {
+	tests := []struct {
+		value    string
+		format   DateTimeFormat
+		expected string
+	}{
+		// Z-suffixed
+		{"2023-04-01T12:00:00Z", DateTimeUnchanged, "2023-04-01T12:00:00Z"},
+		{"2023-04-01T12:00:00Z", DateTimeUTC, "2023-04-01T12:00:00Z"},
+		{"2023-04-01T12:00:00Z", DateTimeOffset, "2023-04-01T12:00:00Z"},
+		{"2023-04-01T12:00:00Z", DateTimeWCF, "/Date(1680350400000)/"},
+		{"2023-04-01T12:00:00.250Z", DateTimeWCF, "/Date(1680350400250)/"},
+
+		// offset-suffixed
+		{"2023-04-01T14:00:00+02:00", DateTimeUTC, "2023-04-01T12:00:00Z"},
+		{"2023-04-01T14:00:00+02:00", DateTimeOffset, "2023-04-01T14:00:00+02:00"},
+		{"2023-04-01T08:00:00-04:00", DateTimeWCF, "/Date(1680350400000-0400)/"},
+
+		// no timezone, OWA means UTC
+		{"2023-04-01T12:00:00", DateTimeUTC, "2023-04-01T12:00:00Z"},
+		{"2023-04-01T12:00:00.5", DateTimeUTC, "2023-04-01T12:00:00.5Z"},
+
+		// WCF epoch
+		{"/Date(1680350400000)/", DateTimeUTC, "2023-04-01T12:00:00Z"},
+		{"/Date(1680350400000+0200)/", DateTimeUTC, "2023-04-01T12:00:00Z"},
+		{"/Date(1680350400000+0200)/", DateTimeOffset, "2023-04-01T14:00:00+02:00"},
+		{"/Date(1680350400000-0430)/", DateTimeOffset, "2023-04-01T07:30:00-04:30"},
+		{"/Date(1680350400000+0200)/", DateTimeWCF, "/Date(1680350400000+0200)/"},
+		{"/Date(-1000)/", DateTimeUTC, "1969-12-31T23:59:59Z"},
+
+		// unknown formats are left alone
+		{"2023-04-01", DateTimeUTC, "2023-04-01"},
+		{"April 1st", DateTimeWCF, "April 1st"},
+		{"", DateTimeUTC, ""},
+	}
+
+	for _, test := range tests {
+		if actual := convertDateTime(test.value, test.format); actual != test.expected {
+			t.Errorf("%q (format %d): expected %q, got %q", test.value, test.format, test.expected, actual)
+		}
+	}
+}
+
+func TestDateTimeRequestFormat(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/requests/ews_createitem_datetimes.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ParseSOAPWithOptions(bytes.NewReader(data), SOAP2JSONOptions{DateTimes: DateTimeWCF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData, err := json.Marshal(request.msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg struct {
+		Body struct {
+			Items []map[string]interface{}
+		}
+	}
+
+	if err = json.Unmarshal(jsonData, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	item := msg.Body.Items[0]
+	for name, expected := range map[string]string{
+		"ReminderDueBy": "/Date(1680527700500)/",
+		"Start":         "/Date(1680528600000)/",
+		"End":           "/Date(1680530400000-0400)/",
+	} {
+		if item[name] != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, item[name])
+		}
+	}
+}
+
+func TestDateTimeResponseFormat(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "GetItem_owa_datetimes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "GetItem_owa_datetimes.json.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	opts := JSON2SOAPOptions{Indent: true, DateTimes: DateTimeUTC}
+	if _, err = JSON2SOAPWithOptions(bytes.NewReader(data), EwsOperations["GetItem"], buf, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff, err := compareXml(expected, buf.Bytes()); err != nil {
+		t.Errorf("%s\n%s", err, diff)
+	}
+}
+
+func TestParseDateTimeFormat(t *testing.T) {
+	if format, err := ParseDateTimeFormat("WCF"); err != nil || format != DateTimeWCF {
+		t.Errorf("expected DateTimeWCF, got %d %v", format, err)
+	}
+
+	if _, err := ParseDateTimeFormat("iso"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
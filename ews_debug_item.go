@@ -0,0 +1,246 @@
+package ews
+
+/*
+	When the translation of one message keeps failing, the message itself is
+	needed to reproduce the problem. DebugItemHandler serves
+	DebugItemPath?id=<ItemId>: it asks for the item with a GetItem request
+	that goes through the proxy like a client's would (the translation, the
+	session's cookies and the proxy's transport), and returns the MIME
+	content as a message/rfc822 download.
+
+	The MIME content is the whole message, so main only installs the handler
+	with -debug, and a request must:
+
+	- come from the loopback interface
+	- be for the proxy's own host name, or for localhost, so that a web page
+	  can't reach the handler with a DNS name that points to 127.0.0.1
+	- have the token parameter, which is random for each run and only shown
+	  in the log of the proxy, so that other web pages the user visits can't
+	  make the browser download items
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDebugItemPath is where NewDebugItemHandler serves the MIME content
+// of items
+const DefaultDebugItemPath = "/debug/item"
+
+const getItemMimeTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+  <soap:Header><t:RequestServerVersion Version="Exchange2013"/></soap:Header>
+  <soap:Body>
+    <m:GetItem>
+      <m:ItemShape>
+        <t:BaseShape>IdOnly</t:BaseShape>
+        <t:IncludeMimeContent>true</t:IncludeMimeContent>
+      </m:ItemShape>
+      <m:ItemIds><t:ItemId Id="%s"/></m:ItemIds>
+    </m:GetItem>
+  </soap:Body>
+</soap:Envelope>
+`
+
+// DebugItemHandler answers GET requests for Path from the loopback
+// interface that have Token, everything else is passed on to Proxy
+type DebugItemHandler struct {
+	// default is DefaultDebugItemPath
+	Path string
+
+	// the value of the token parameter that requests must have, it must not
+	// be empty
+	Token string
+
+	// the proxy returned by NewProxy, its Transport is used for the
+	// GetItem requests
+	Proxy *httputil.ReverseProxy
+
+	// where the GetItem requests are sent, the proxy's own EWS URL
+	EwsUrl *url.URL
+}
+
+// NewDebugItemHandler wraps proxy, translator must be the one that proxy
+// was created with
+func NewDebugItemHandler(proxy *httputil.ReverseProxy, translator *TranslationMiddleware) *DebugItemHandler {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	return &DebugItemHandler{
+		Path:   DefaultDebugItemPath,
+		Token:  hex.EncodeToString(token),
+		Proxy:  proxy,
+		EwsUrl: translator.SourceServer.ResolveReference(&url.URL{Path: translator.EwsPath}),
+	}
+}
+
+func (this *DebugItemHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != this.Path || request.Method != "GET" {
+		this.Proxy.ServeHTTP(w, request)
+		return
+	}
+
+	if !isLoopback(request.RemoteAddr) || !this.allowedHost(request.Host) ||
+		!this.validToken(request.URL.Query().Get("token")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id := request.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "The id parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	client := &ewsClient{Url: this.EwsUrl, Transport: this.Proxy.Transport}
+	mime, err := client.getItemMime(request.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="item.eml"`)
+	w.Write(mime)
+}
+
+// returns true if the Host of a request names the proxy, or localhost
+func (this *DebugItemHandler) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if host == "localhost" || host == strings.ToLower(this.EwsUrl.Hostname()) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (this *DebugItemHandler) validToken(token string) bool {
+	return this.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(this.Token)) == 1
+}
+
+// returns true if addr (host:port) is on the loopback interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ewsClient sends SOAP requests to the proxy's chain without going through
+// a listener, so they are translated like a client's
+type ewsClient struct {
+	Url       *url.URL
+	Transport http.RoundTripper
+}
+
+// call sends a SOAP request and returns the SOAP response, which can be a
+// fault
+func (this *ewsClient) call(ctx context.Context, action string, soap string) ([]byte, error) {
+	request, err := http.NewRequest("POST", this.Url.String(), strings.NewReader(soap))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/`+action+`"`)
+
+	response, err := this.Transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s response", action)
+	}
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusInternalServerError {
+		return nil, errors.Errorf("%s failed: %s", action, response.Status)
+	}
+	return body, nil
+}
+
+// getItemMime returns the decoded MIME content of the item with id
+func (this *ewsClient) getItemMime(ctx context.Context, id string) ([]byte, error) {
+	soap, err := this.call(ctx, "GetItem", fmt.Sprintf(getItemMimeTemplate, escapeXml(id)))
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := soapValues(soap, "MimeContent", "ResponseCode", "MessageText", "faultstring")
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing GetItem response")
+	}
+
+	if fault := values["faultstring"]; fault != "" {
+		return nil, errors.Errorf("GetItem failed: %s", fault)
+	} else if code := values["ResponseCode"]; code != "NoError" {
+		return nil, errors.Errorf("GetItem failed: %s %s", code, values["MessageText"])
+	}
+
+	mime, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(values["MimeContent"]), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding MimeContent")
+	} else if len(mime) == 0 {
+		return nil, errors.New("the item has no MimeContent")
+	}
+	return mime, nil
+}
+
+// returns the text of the first element with each of the local names
+func soapValues(soap []byte, names ...string) (map[string]string, error) {
+	values := make(map[string]string)
+	d := xml.NewDecoder(bytes.NewReader(soap))
+
+	var text *bytes.Buffer
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			text = nil
+			for _, name := range names {
+				if _, seen := values[name]; !seen && t.Name.Local == name {
+					text = new(bytes.Buffer)
+				}
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if text != nil {
+				values[t.Name.Local] = strings.TrimSpace(text.String())
+				text = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package ews
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestDebugItemHandler(t *testing.T) {
+	getItemResponse, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetItem_owa_mimecontent.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamBody string
+	var upstreamCookie string
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBody, upstreamCookie = string(body), r.Header.Get("Cookie")
+
+		if strings.Contains(upstreamBody, `"Id":"missing=="`) {
+			w.Write([]byte(`{"Body": {"ResponseMessages": {"Items": [{"__type": "ItemInfoResponseMessage:#Exchange", "ResponseClass": "Error", "ResponseCode": "ErrorItemNotFound", "MessageText": "The specified object was not found in the store."}]}}}`))
+		} else {
+			w.Write(getItemResponse)
+		}
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	redirector.Cookies.SetCookies(target, []*http.Cookie{{Name: "cadata", Value: "session"}})
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  &http.Transport{},
+		Translator: translator,
+		Redirector: redirector,
+		Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewDebugItemHandler(proxy, translator)
+
+	handler.Token = "secret"
+
+	request := httptest.NewRequest("GET", "http://localhost:60001/debug/item?token=secret&id=IIII%3D%3D", nil)
+	request.RemoteAddr = "127.0.0.1:50000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "message/rfc822" {
+		t.Fatalf("unexpected response %d %s\n%s", w.Code, w.Header(), w.Body)
+	}
+	if !strings.HasPrefix(w.Body.String(), "From: Test User <test@example.com>\r\n") {
+		t.Errorf("expected the decoded MIME content, got %q", w.Body)
+	}
+
+	// the request went through the translator with the session's cookies
+	if !strings.Contains(upstreamBody, `"IncludeMimeContent":true`) || !strings.Contains(upstreamBody, `"Id":"IIII=="`) {
+		t.Errorf("unexpected OWA request %s", upstreamBody)
+	}
+	if upstreamCookie != "cadata=session" {
+		t.Errorf("expected the session cookie, got %q", upstreamCookie)
+	}
+
+	for _, test := range []struct {
+		url, remoteAddr string
+		code            int
+		body            string
+	}{
+		{"http://localhost:60001/debug/item?token=secret&id=missing%3D%3D", "127.0.0.1:50000", http.StatusBadGateway, "ErrorItemNotFound"},
+		{"http://localhost:60001/debug/item?token=secret&id=IIII%3D%3D", "192.0.2.1:50000", http.StatusForbidden, ""},
+		{"http://localhost:60001/debug/item?token=secret", "[::1]:50000", http.StatusBadRequest, ""},
+		{"http://127.0.0.1:60001/debug/item?token=secret", "127.0.0.1:50000", http.StatusBadRequest, ""},
+		// the token is required
+		{"http://localhost:60001/debug/item?id=IIII%3D%3D", "127.0.0.1:50000", http.StatusForbidden, ""},
+		{"http://localhost:60001/debug/item?token=guess&id=IIII%3D%3D", "127.0.0.1:50000", http.StatusForbidden, ""},
+		// a name that was made to point to the loopback interface
+		{"http://attacker.example:60001/debug/item?token=secret&id=IIII%3D%3D", "127.0.0.1:50000", http.StatusForbidden, ""},
+	} {
+		upstreamBody = ""
+		request := httptest.NewRequest("GET", test.url, nil)
+		request.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s from %s: unexpected response %d %s", test.url, test.remoteAddr, w.Code, w.Body)
+		}
+		if test.code != http.StatusBadGateway && upstreamBody != "" {
+			t.Errorf("%s from %s: request was sent to OWA", test.url, test.remoteAddr)
+		}
+	}
+
+	// each handler has its own token
+	if other := NewDebugItemHandler(proxy, translator); len(other.Token) != 32 || other.Token == NewDebugItemHandler(proxy, translator).Token {
+		t.Errorf("unexpected token %q", other.Token)
+	}
+
+	// everything else goes to the proxy
+	request = httptest.NewRequest("GET", "http://localhost:60001/status", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "loggedIn") {
+		t.Errorf("unexpected status response %d %s", w.Code, w.Body)
+	}
+}
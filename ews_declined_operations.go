@@ -0,0 +1,71 @@
+package ews
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DeclinedOperation is the fault that an operation is answered with instead
+// of being sent to OWA
+type DeclinedOperation struct {
+	ResponseCode string
+	Message      string
+}
+
+// Unified Messaging isn't available through OWA. Clients that probe for it
+// turn the feature off when they are told that there is no UM server,
+// instead of retrying what looks like a broken server.
+var DefaultDeclinedOperations = map[string]DeclinedOperation{
+	"GetPhoneCallInformation": {"ErrorUnifiedMessagingServerNotFound", "Unified Messaging is not available through the proxy."},
+	"PlayOnPhone":             {"ErrorUnifiedMessagingServerNotFound", "Unified Messaging is not available through the proxy."},
+	"DisconnectPhoneCall":     {"ErrorUnifiedMessagingServerNotFound", "Unified Messaging is not available through the proxy."},
+}
+
+const defaultDeclineCode = "ErrorInvalidOperation"
+
+// ParseDeclinedOperations parses a comma separated list of operations as
+// Name or Name=ResponseCode, and adds them to a copy of
+// DefaultDeclinedOperations. Names don't have to be known operations, as
+// the point is to answer the ones that the proxy can't translate.
+func ParseDeclinedOperations(value string) (map[string]DeclinedOperation, error) {
+	declined := make(map[string]DeclinedOperation)
+	for name, op := range DefaultDeclinedOperations {
+		declined[name] = op
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, code := entry, defaultDeclineCode
+		if i := strings.Index(entry, "="); i != -1 {
+			name, code = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+
+		if name == "" || code == "" {
+			return nil, errors.Errorf("invalid declined operation `%s`", entry)
+		}
+
+		declined[name] = DeclinedOperation{
+			ResponseCode: code,
+			Message:      "The " + name + " operation is not supported by the proxy.",
+		}
+	}
+
+	return declined, nil
+}
+
+// returns the fault for a declined action, or nil if it isn't declined
+func (this *TranslationMiddleware) declineResponse(request *http.Request, ctx *ewsProxyContext, action string) *http.Response {
+	declined, ok := this.DeclinedOperations[action]
+	if !ok || action == "" {
+		return nil
+	}
+
+	this.appendTransaction(ctx, "Ews Translator: "+action+" is declined with "+declined.ResponseCode)
+	return createSoapFault(request, declined.ResponseCode, declined.Message)
+}
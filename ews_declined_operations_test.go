@@ -0,0 +1,80 @@
+package ews
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const playOnPhoneRequest = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+  <soap:Header><t:RequestServerVersion Version="Exchange2010"/></soap:Header>
+  <soap:Body>
+    <m:PlayOnPhone>
+      <m:ItemId Id="AAMkAGVoicemail="/>
+      <m:DialString>5550100</m:DialString>
+    </m:PlayOnPhone>
+  </soap:Body>
+</soap:Envelope>`
+
+func TestDeclinedOperations(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	var err error
+	if translator.DeclinedOperations, err = ParseDeclinedOperations("GetItem, NotAnEwsOperation=ErrorUnsupportedQueryFilter"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		body   string
+		action string
+		code   string
+	}{
+		// by the SOAPAction header, or by the body without one
+		{playOnPhoneRequest, "PlayOnPhone", "a:ErrorUnifiedMessagingServerNotFound"},
+		{playOnPhoneRequest, "", "a:ErrorUnifiedMessagingServerNotFound"},
+		{getItemRequest, "GetItem", "a:ErrorInvalidOperation"},
+		// the body can't be translated, the header is enough
+		{"<not-soap/>", "NotAnEwsOperation", "a:ErrorUnsupportedQueryFilter"},
+	} {
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(test.body))
+		if test.action != "" {
+			request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/`+test.action+`"`)
+		}
+
+		err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+		re, ok := err.(*proxyutils.RequestError)
+		if !ok {
+			t.Errorf("%s: expected a fault, got %v", test.action, err)
+			continue
+		}
+
+		if fault, _ := parseSoapFault(t, re.Response); fault.Code != test.code {
+			t.Errorf("%s: unexpected fault %+v", test.action, fault)
+		}
+	}
+
+	// anything else is still translated
+	findItem, err := os.Open(filepath.Join("testdata", "requests", "ews_finditem_davmail.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer findItem.Close()
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", findItem)
+	if err = translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Errorf("FindItem was not translated: %v", err)
+	}
+
+	for _, value := range []string{"=ErrorInvalidOperation", "GetItem="} {
+		if _, err = ParseDeclinedOperations(value); err == nil {
+			t.Errorf("%q should be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package ews
+
+/*
+	Newer versions of Outlook ask for the mail add-ins (GetAppManifests) and
+	for tokens for them (GetClientAccessToken) when they start, and give up
+	on the account when those requests fail. They are translated like any
+	other operation, but when SynthesizeEmptyExtensions is set they are
+	answered by the proxy instead, as if there were no add-ins.
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// OWA JSON responses with no manifests and no tokens, they go through the
+// normal response translation
+var emptyExtensionResponses = map[string]string{
+	"GetAppManifests":      `{"Body": {"ResponseClass": "Success", "ResponseCode": "NoError", "Manifests": []}}`,
+	"GetClientAccessToken": `{"Body": {"ResponseMessages": {"Items": []}}}`,
+}
+
+// returns the local response for an extension operation, or nil if the
+// request should be sent to OWA
+func (this *TranslationMiddleware) synthesizedResponse(request *http.Request, ctx *ewsProxyContext) (*http.Response, error) {
+	if !this.SynthesizeEmptyExtensions {
+		return nil, nil
+	}
+
+	jsonResponse, ok := emptyExtensionResponses[ctx.EwsProxyOp.Action]
+	if !ok {
+		return nil, nil
+	}
+
+	outbuf := new(bytes.Buffer)
+	if err := JSON2SOAP(strings.NewReader(jsonResponse), ctx.EwsProxyOp, outbuf, false); err != nil {
+		return nil, err
+	}
+
+	this.appendTransaction(ctx, "Ews Translator: "+ctx.EwsProxyOp.Action+" is answered by the proxy")
+
+	response := proxyutils.CreateNewResponse(request, outbuf.String())
+	response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return response, nil
+}
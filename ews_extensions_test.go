@@ -0,0 +1,84 @@
+package ews
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/comparison"
+)
+
+var extensionRequests = map[string]string{
+	"GetAppManifests":      "testdata/requests/ews_getappmanifests_outlook.xml",
+	"GetClientAccessToken": "testdata/requests/ews_getclientaccesstoken_outlook.xml",
+}
+
+func TestExtensionsPassthrough(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	for action, fname := range extensionRequests {
+		data := translateRequestFile(t, translator, fname, "text/xml; charset=utf-8")
+
+		expected, err := ioutil.ReadFile(fname + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff, err := comparison.DiffJson(expected, data, true); err != nil || diff != "" {
+			t.Errorf("%s: unexpected translation %v\n%s", action, err, diff)
+		}
+	}
+}
+
+func TestSynthesizeEmptyExtensions(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.SynthesizeEmptyExtensions = true
+
+	proxy := newLimitedProxy(translator, roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		t.Errorf("request was sent to OWA: %s", request.Header.Get("Action"))
+		return nil, os.ErrInvalid
+	}))
+
+	expected := map[string][]string{
+		"GetAppManifests": {
+			`<m:GetAppManifestsResponse ResponseClass="Success">`,
+			`<m:ResponseCode>NoError</m:ResponseCode>`,
+		},
+		"GetClientAccessToken": {
+			`<m:GetClientAccessTokenResponse>`,
+		},
+	}
+
+	for action, fname := range extensionRequests {
+		file, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", file)
+		response, err := proxy.RoundTrip(request)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", action, response.StatusCode)
+		}
+
+		for _, s := range expected[action] {
+			if !strings.Contains(string(body), s) {
+				t.Errorf("%s: %s is not in the response\n%s", action, s, body)
+			}
+		}
+
+		if strings.Contains(string(body), "<m:Manifest>") || strings.Contains(string(body), "<m:Token>") {
+			t.Errorf("%s: response is not empty\n%s", action, body)
+		}
+	}
+}
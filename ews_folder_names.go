@@ -0,0 +1,98 @@
+package ews
+
+/*
+	OWA returns the display names of the well-known folders in the language
+	of the mailbox ("Posteingang" instead of "Inbox"), which confuses clients
+	that look for folders by name. A FolderNameMap replaces the DisplayName
+	of those folders, which are identified by their DistinguishedFolderId.
+*/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
+)
+
+// FolderNameMap maps a DistinguishedFolderId (inbox, sentitems, ...) to the
+// DisplayName that clients should see
+type FolderNameMap map[string]string
+
+// LoadFolderNameMap reads a JSON object such as {"inbox": "Inbox"}
+func LoadFolderNameMap(path string) (FolderNameMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names map[string]string
+	if err = json.Unmarshal(data, &names); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+
+	folderNames := make(FolderNameMap, len(names))
+	for id, name := range names {
+		folderNames[strings.ToLower(id)] = name
+	}
+	return folderNames, nil
+}
+
+// rewrite replaces the display names of well-known folders in a JSON
+// response, returning the number of folders that were renamed
+func (this FolderNameMap) rewrite(jsonData []byte) ([]byte, int, error) {
+	// most responses don't contain any folders
+	if !bytes.Contains(jsonData, []byte(`"DistinguishedFolderId"`)) {
+		return jsonData, 0, nil
+	}
+
+	msg, err := decodeJsonMessage(bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "decoding response")
+	}
+
+	renamed := this.rewriteValue(msg)
+	if renamed == 0 {
+		return jsonData, 0, nil
+	}
+
+	ret, err := json.Marshal(msg)
+	return ret, renamed, err
+}
+
+func (this FolderNameMap) rewriteValue(value interface{}) (renamed int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if isFolderObject(v) {
+			id, _ := v["DistinguishedFolderId"].(string)
+			if name, ok := this[strings.ToLower(id)]; ok {
+				if _, hasName := v["DisplayName"]; hasName {
+					v["DisplayName"] = name
+					renamed++
+				}
+			}
+		}
+
+		for _, child := range v {
+			renamed += this.rewriteValue(child)
+		}
+
+	case []interface{}:
+		for _, child := range v {
+			renamed += this.rewriteValue(child)
+		}
+	}
+	return
+}
+
+// only folders are renamed, never items or anything else that happens to
+// have a DisplayName
+func isFolderObject(obj map[string]interface{}) bool {
+	if _, ok := obj["DistinguishedFolderId"].(string); !ok {
+		return false
+	}
+
+	typ, ok := obj["__type"].(string)
+	return !ok || strings.HasSuffix(strings.SplitN(typ, ":", 2)[0], "Folder")
+}
@@ -0,0 +1,65 @@
+package ews
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFolderNameMap(t *testing.T) {
+	folderNames, err := LoadFolderNameMap("testdata/folder_names_de.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile("testdata/responses/GetFolder_owa_german.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, renamed, err := folderNames.rewrite(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renamed != 4 {
+		t.Errorf("expected 4 folders to be renamed, got %d", renamed)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = JSON2SOAP(bytes.NewReader(data), EwsOperations["GetFolder"], buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	soap := buf.String()
+	for _, name := range []string{"Inbox", "Sent Items", "Deleted Items", "Drafts", "Projekte"} {
+		if !strings.Contains(soap, "<t:DisplayName>"+name+"</t:DisplayName>") {
+			t.Errorf("%s is missing from the response", name)
+		}
+	}
+
+	if strings.Contains(soap, "Posteingang") {
+		t.Error("the inbox was not renamed")
+	}
+}
+
+func TestFolderNameMapIgnoresItems(t *testing.T) {
+	folderNames := FolderNameMap{"inbox": "Inbox"}
+
+	data := []byte(`{"Body": {"ResponseMessages": {"Items": [{"Items": [{
+		"__type": "Message:#Exchange",
+		"Subject": "Posteingang",
+		"DisplayName": "Posteingang",
+		"DistinguishedFolderId": "inbox"
+	}]}]}}}`)
+
+	rewritten, renamed, err := folderNames.rewrite(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renamed != 0 || !bytes.Equal(rewritten, data) {
+		t.Errorf("an item was renamed: %s", rewritten)
+	}
+}
@@ -0,0 +1,27 @@
+package ews
+
+/*
+	The ews package logs through Log instead of the standard logger, at
+	the level of the message:
+
+		Debug  routine events (keepalives, shadow responses that match)
+		Info   what the proxy does (logins, server version), and what the
+		       Debug settings ask for (the transactions)
+		Warn   things that failed and are retried or worked around
+		Error  things that failed for good
+
+	cmd/ews-proxy replaces Log (and proxyutils.Log) before the proxy is
+	created, with loggers that collapse repeated messages (see
+	proxyutils.DedupLogger) and the level of -v and -q.
+*/
+
+import (
+	"log"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// Log is what the ews package logs with, and the chain of NewProxy unless
+// ProxyOptions.Logger is set. The default logs Info and above to the
+// standard logger.
+var Log = proxyutils.NewLevelLoggers(log.Default(), proxyutils.LevelInfo)
@@ -0,0 +1,139 @@
+package ews
+
+/*
+	When a session keeps getting logged out, the log only says that the
+	canary was invalidated at some point. The result of each CheckLogin (the
+	keepalive, the checks of the login middleware and the relogin) is kept in
+	a ring of the last MaxLoginChecks, so that it can be seen when and how
+	the checks started failing: the status has a summary, the debug server
+	has all of them, and the transaction log of a request that gets a 440
+	has the last few.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxLoginChecks is how many results of CheckLogin are kept
+const MaxLoginChecks = 100
+
+// how many results of CheckLogin are added to the transaction log of a 440
+const loginChecksInTransaction = 5
+
+// LoginOutcome says how a CheckLogin ended
+type LoginOutcome string
+
+const (
+	LoginOk           LoginOutcome = "ok"
+	LoginNoCanary     LoginOutcome = "no canary"
+	LoginRequestError LoginOutcome = "request error"
+	LoginNetworkError LoginOutcome = "network error"
+	LoginBadStatus    LoginOutcome = "bad status"
+	LoginUnreadable   LoginOutcome = "unreadable response"
+	LoginServerBusy   LoginOutcome = "server busy"
+	LoginRejected     LoginOutcome = "rejected"
+)
+
+// LoginCheck is the result of one CheckLogin
+type LoginCheck struct {
+	Time    time.Time     `json:"time"`
+	Outcome LoginOutcome  `json:"outcome"`
+	Status  int           `json:"status,omitempty"` // the HTTP status, 0 if there was no response
+	Latency time.Duration `json:"latency"`
+
+	// set if the check cleared OwaCanary
+	Invalidated bool   `json:"invalidated,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (this LoginCheck) String() string {
+	text := fmt.Sprintf("%s %s in %s", this.Time.Format(time.RFC3339), this.Outcome, this.Latency)
+	if this.Status != 0 {
+		text += fmt.Sprintf(", status %d", this.Status)
+	}
+	if this.Invalidated {
+		text += ", canary invalidated"
+	}
+	if this.Error != "" {
+		text += ": " + this.Error
+	}
+	return text
+}
+
+// LoginCheckSummary is the part of the login checks that is in the status
+type LoginCheckSummary struct {
+	Checks        int          `json:"checks"`
+	Failures      int          `json:"failures"`
+	Invalidations int          `json:"invalidations"`
+	LastOutcome   LoginOutcome `json:"lastOutcome"`
+	LastTime      time.Time    `json:"lastTime"`
+	LastOk        *time.Time   `json:"lastOk,omitempty"`
+}
+
+func (this *TranslationMiddleware) recordLoginCheck(check LoginCheck) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.loginChecks) < MaxLoginChecks {
+		this.loginChecks = append(this.loginChecks, check)
+	} else {
+		this.loginChecks[this.loginChecksNext] = check
+	}
+	this.loginChecksNext = (this.loginChecksNext + 1) % MaxLoginChecks
+}
+
+// LoginChecks returns the kept results of CheckLogin, the oldest first
+func (this *TranslationMiddleware) LoginChecks() []LoginCheck {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	checks := make([]LoginCheck, 0, len(this.loginChecks))
+	if len(this.loginChecks) == MaxLoginChecks {
+		checks = append(checks, this.loginChecks[this.loginChecksNext:]...)
+		return append(checks, this.loginChecks[:this.loginChecksNext]...)
+	}
+	return append(checks, this.loginChecks...)
+}
+
+// returns the summary of the kept checks, nil if there are none
+func (this *TranslationMiddleware) loginCheckSummary() *LoginCheckSummary {
+	checks := this.LoginChecks()
+	if len(checks) == 0 {
+		return nil
+	}
+
+	summary := &LoginCheckSummary{Checks: len(checks)}
+	for i := range checks {
+		if checks[i].Outcome != LoginOk {
+			summary.Failures++
+		} else {
+			summary.LastOk = &checks[i].Time
+		}
+		if checks[i].Invalidated {
+			summary.Invalidations++
+		}
+	}
+
+	last := checks[len(checks)-1]
+	summary.LastOutcome, summary.LastTime = last.Outcome, last.Time
+	return summary
+}
+
+// returns the last few checks for the transaction log, one per line
+func (this *TranslationMiddleware) recentLoginChecks() string {
+	checks := this.LoginChecks()
+	if len(checks) > loginChecksInTransaction {
+		checks = checks[len(checks)-loginChecksInTransaction:]
+	}
+
+	lines := []string{"Recent login checks:"}
+	for _, check := range checks {
+		lines = append(lines, "  "+check.String())
+	}
+	if len(checks) == 0 {
+		lines = append(lines, "  (none)")
+	}
+	return strings.Join(lines, "\n")
+}
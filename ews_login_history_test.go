@@ -0,0 +1,127 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestLoginHistory(t *testing.T) {
+	// the answers of the fake OWA, in order
+	var lock sync.Mutex
+	answers := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			fmt.Fprint(w, `{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"NoError","ResponseClass":"Success"}]}}}`)
+		},
+		func(w http.ResponseWriter) {
+			fmt.Fprint(w, `{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"ErrorServerBusy","MessageXml":[{"Name":"BackOffMilliseconds","Value":"10"}]}]}}}`)
+		},
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		func(w http.ResponseWriter) {
+			fmt.Fprint(w, `{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"ErrorAccessDenied","ResponseClass":"Error"}]}}}`)
+		},
+	}
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		answers[0](w)
+		answers = answers[1:]
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	login := &LoginMiddleware{
+		Translator: translator,
+		Redirector: proxyutils.NewRedirectorMiddleware(source, target),
+	}
+
+	if translator.Status().LoginChecks != nil {
+		t.Error("expected no login checks in the status")
+	}
+
+	for i, expected := range []bool{true, false, false, false} {
+		if login.CheckLogin("canary") != expected {
+			t.Errorf("check %d: expected %v", i, expected)
+		}
+	}
+	owa.Close()
+	login.CheckLogin("canary")
+	login.CheckLogin("")
+
+	checks := translator.LoginChecks()
+	expected := []struct {
+		outcome     LoginOutcome
+		status      int
+		invalidated bool
+	}{
+		{LoginOk, 200, false},
+		{LoginServerBusy, 200, false},
+		{LoginBadStatus, 500, true},
+		{LoginRejected, 200, true},
+		{LoginNetworkError, 0, false},
+		{LoginNoCanary, 0, false},
+	}
+	if len(checks) != len(expected) {
+		t.Fatalf("expected %d checks, got %v", len(expected), checks)
+	}
+	for i, check := range checks {
+		if check.Outcome != expected[i].outcome || check.Status != expected[i].status || check.Invalidated != expected[i].invalidated {
+			t.Errorf("check %d: expected %v, got %s", i, expected[i], check)
+		}
+		if check.Time.IsZero() || (i > 0 && check.Time.Before(checks[i-1].Time)) {
+			t.Errorf("check %d: unexpected time %s", i, check.Time)
+		}
+	}
+
+	summary := translator.Status().LoginChecks
+	if summary == nil || summary.Checks != 6 || summary.Failures != 5 || summary.Invalidations != 2 ||
+		summary.LastOutcome != LoginNoCanary || summary.LastOk == nil || !summary.LastOk.Equal(checks[0].Time) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	// the ring keeps the last MaxLoginChecks
+	for i := 0; i < MaxLoginChecks; i++ {
+		translator.recordLoginCheck(LoginCheck{Outcome: LoginOk, Status: i})
+	}
+	checks = translator.LoginChecks()
+	if len(checks) != MaxLoginChecks || checks[0].Status != 0 || checks[MaxLoginChecks-1].Status != MaxLoginChecks-1 {
+		t.Errorf("unexpected checks after the ring wrapped: %d, %v ... %v", len(checks), checks[0], checks[len(checks)-1])
+	}
+}
+
+// a request that gets a 440 has the last checks in its transaction log
+func TestLoginHistoryTransaction(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.Debug = true
+	translator.recordLoginCheck(LoginCheck{Outcome: LoginBadStatus, Status: 440, Invalidated: true})
+
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(""))
+	err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	if err, ok := err.(*proxyutils.RequestError); !ok || err.Response.StatusCode != 440 {
+		t.Fatalf("expected a 440, got %v", err)
+	}
+
+	if !strings.Contains(logBuf.String(), "Recent login checks:\n  ") ||
+		!strings.Contains(logBuf.String(), " bad status in 0s, status 440, canary invalidated\n") {
+		t.Errorf("the login checks are missing from the transaction log:\n%s", logBuf)
+	}
+}
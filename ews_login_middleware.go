@@ -1,11 +1,12 @@
 package ews
 
 import (
+	"context"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/virtuald/ews-proxy/proxyutils"
@@ -22,43 +23,69 @@ type LoginMiddleware struct {
 	// used for ews client
 	Transport http.RoundTripper
 
-	// disabled if 0
+	// disabled if 0, use SetKeepAlivePeriod once the proxy is running
 	KeepAlivePeriod time.Duration
-	keepAliveTicker *time.Ticker
+	keepAliveLock   sync.Mutex
+	keepAliveTicker proxyutils.Ticker
+	keepAliveStop   chan struct{}
 
 	CanaryFinder func(*http.Response) (string, error)
+
+	// if set, the login form posted by the browser is kept in memory and
+	// Relogin can replay it when the session expires
+	AutoRelogin bool
+	recorded    loginRecorder
+
+	// if set, canaries are acquired from it instead of the browser, see
+	// ews_canary_source.go
+	CanarySource   CanarySource
+	acquireLock    sync.Mutex
+	acquireBackOff acquireBackOff
+	browser        browserLogin
 }
 
-func (this *LoginMiddleware) RequestModifier(request *http.Request, cctx proxyutils.ChainContext) error {
-	// special redirect -- tell the user to close the page
-	if request.URL.Path == "/proxyclose.html" {
-		response := proxyutils.CreateNewResponse(request, closePageHtml)
-		return proxyutils.NewRequestError(response)
+func (this *LoginMiddleware) RequestModifier(ctx context.Context, request *http.Request, cctx *proxyutils.ChainValues) error {
+	if proxyutils.IsBypassed(cctx) {
+		return nil
 	}
 
 	// store this in the context because other people modify it
-	cctx["login_ctx"] = request.URL.Path
+	cctx.Set("login_ctx", request.URL.Path)
+
+	if this.AutoRelogin && isLoginForm(request) {
+		return this.recordLogin(request)
+	}
+
+	if this.CanarySource != nil && this.Translator.OwaCanary == "" &&
+		request.Method == "POST" && this.Translator.isEwsPath(request.URL.Path) {
+		this.acquireCanary()
+	}
 	return nil
 }
 
 // This processes /owa/ pages and searches for a valid OWA canary in the
 // page cookies. Once the canary has been found, then it redirects to the
 // /close page
-func (this *LoginMiddleware) ResponseModifier(response *http.Response, cctx proxyutils.ChainContext) error {
+func (this *LoginMiddleware) ResponseModifier(ctx context.Context, response *http.Response, cctx *proxyutils.ChainValues) error {
+	if proxyutils.IsBypassed(cctx) {
+		return nil
+	}
+
+	// the headers are replaced below if the login succeeded
+	this.Translator.Server.Update(response.Header)
+
 	// Watch for OWA Canary info, and snag it
-	if strings.Contains(cctx["login_ctx"].(string), this.CheckPath) && response.StatusCode != 302 {
+	if strings.Contains(cctx.Get("login_ctx").(string), this.CheckPath) && response.StatusCode != 302 {
 		canary, err := this.CanaryFinder(response)
 		if err != nil {
 			return err
 		} else if canary != "" {
 			// if the user agent isn't set, set it since this access is being
 			// done by a user's browser
-			if this.Redirector.UserAgent == "" {
-				this.Redirector.UserAgent = response.Header.Get("User-Agent")
-			}
+			this.captureUserAgent(response)
 
 			// validate and set the canary if it's valid
-			this.CheckLogin(canary)
+			this.browserLoggedIn(canary)
 		}
 
 		// If we have a canary stored, _always_ tell the user's page to close, otherwise
@@ -88,78 +115,153 @@ func (this *LoginMiddleware) CookieCanaryFinder(response *http.Response) (string
 	return "", nil
 }
 
+// keeps the User-Agent of the browser's request, if the Redirector
+// captures it and doesn't have one yet
+func (this *LoginMiddleware) captureUserAgent(response *http.Response) {
+	if !this.Redirector.CaptureUserAgent || this.Redirector.CurrentUserAgent() != "" || response.Request == nil {
+		return
+	}
+	if userAgent := response.Request.Header.Get("User-Agent"); userAgent != "" {
+		this.Redirector.SetUserAgent(userAgent)
+	}
+}
+
 // CheckLogin returns false if login is required, and will
-// invalidate the canary if the server responds that it is invalid
+// invalidate the canary if the server responds that it is invalid. The
+// result is kept in the login history, see ews_login_history.go
 func (this *LoginMiddleware) CheckLogin(canary string) bool {
+	start := this.Translator.Clock.Now()
+	check := this.checkLogin(canary)
+	check.Time, check.Latency = start, this.Translator.Clock.Now().Sub(start)
+
+	this.Translator.recordLoginCheck(check)
+	if check.Invalidated {
+		this.browser.Invalidate()
+		if this.CanarySource != nil {
+			this.CanarySource.Invalidate()
+		}
+	}
+	return check.Outcome == LoginOk
+}
+
+func (this *LoginMiddleware) checkLogin(canary string) LoginCheck {
 
 	if canary == "" {
-		return false
+		return LoginCheck{Outcome: LoginNoCanary}
 	}
 
 	client := http.Client{Transport: this.Transport}
 	client.Jar = this.Redirector.Cookies
 
-	req, err := http.NewRequest("POST", this.Redirector.TargetServer.ResolveReference(&url.URL{Path: this.Translator.OwaServicePath}).String(), nil)
+	req, err := http.NewRequest("POST", this.Redirector.TargetUrl(&url.URL{Path: this.Translator.OwaServicePath}).String(), nil)
 	if err != nil {
-		log.Printf("Error checking OWA: %s", err)
-		this.Translator.OwaCanary = ""
-		return false
+		Log.Warn.Printf("Error checking OWA: %s", err)
+		this.Translator.invalidateCanary()
+		return LoginCheck{Outcome: LoginRequestError, Invalidated: true, Error: err.Error()}
 	}
 
 	SetupOwaRequest(this.Translator, req, keepAliveJson, keepAliveJsonAction, canary)
 
-	if this.Redirector.UserAgent != "" {
-		req.Header.Set("User-Agent", this.Redirector.UserAgent)
+	if userAgent := this.Redirector.CurrentUserAgent(); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
 	}
 
 	// post something
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Exchange server not available: %s", err)
+		Log.Warn.Printf("Exchange server not available: %s", err)
 		// don't invalidate the canary in a network error
-		return false
+		this.Translator.onNetworkError()
+		return LoginCheck{Outcome: LoginNetworkError, Error: err.Error()}
 	}
 
+	this.Translator.Skew.Update(resp.Header)
+
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		log.Printf("Exchange server returned %d status, invalidating canary", resp.StatusCode)
-		this.Translator.OwaCanary = ""
-		return false
+		Log.Warn.Printf("Exchange server returned %d status, invalidating canary", resp.StatusCode)
+		this.Translator.invalidateCanary()
+		return LoginCheck{Outcome: LoginBadStatus, Status: resp.StatusCode, Invalidated: true}
 	}
 
-	bodyBytes, err := proxyutils.ReadGzipBody(&resp.Header, resp.Body)
+	bodyBytes, err := proxyutils.ReadResponseBody(resp)
 	if err != nil {
-		log.Printf("Could not read json response, invalidating canary: %s", err)
-		this.Translator.OwaCanary = ""
-		return false
+		Log.Warn.Printf("Could not read json response, invalidating canary: %s", err)
+		this.Translator.invalidateCanary()
+		return LoginCheck{Outcome: LoginUnreadable, Status: resp.StatusCode, Invalidated: true, Error: err.Error()}
+	}
+
+	// don't invalidate the canary when the server is just busy
+	if backOff := serverBusyBackOff(bodyBytes); backOff > 0 {
+		Log.Warn.Printf("Exchange server is busy, backing off for %s", backOff)
+		this.Translator.setBackOff(backOff)
+		return LoginCheck{Outcome: LoginServerBusy, Status: resp.StatusCode, Error: "backing off for " + backOff.String()}
 	}
 
 	jsonBody := string(bodyBytes)
 	if !strings.Contains(jsonBody, "\"ResponseCode\":\"NoError\"") ||
 		!strings.Contains(jsonBody, "\"ResponseClass\":\"Success\"") {
-		this.Translator.OwaCanary = ""
-		return false
+		this.Translator.invalidateCanary()
+		return LoginCheck{Outcome: LoginRejected, Status: resp.StatusCode, Invalidated: true}
 	}
 
 	// it was successful, begin the keep alive channel if it doesn't already
 	// exist
+	this.startKeepAlive()
+
+	// successful checks
+	this.Translator.setCanary(canary)
+	return LoginCheck{Outcome: LoginOk, Status: resp.StatusCode}
+}
+
+// starts the keepalive if it is enabled and isn't running yet
+func (this *LoginMiddleware) startKeepAlive() {
+	this.keepAliveLock.Lock()
+	defer this.keepAliveLock.Unlock()
+
 	if this.KeepAlivePeriod > 0 && this.keepAliveTicker == nil {
-		this.keepAliveTicker = time.NewTicker(this.KeepAlivePeriod)
-		go this.OwaKeepalive()
+		this.keepAliveTicker = this.Translator.Clock.NewTicker(this.KeepAlivePeriod)
+		this.keepAliveStop = make(chan struct{})
+		go this.owaKeepalive(this.keepAliveTicker, this.keepAliveStop)
 	}
+}
 
-	// successful checks
-	this.Translator.OwaCanary = canary
-	return true
+// SetKeepAlivePeriod changes KeepAlivePeriod while the proxy is running. The
+// keepalive is restarted with the new period, or stopped if it is 0.
+func (this *LoginMiddleware) SetKeepAlivePeriod(period time.Duration) {
+	this.keepAliveLock.Lock()
+	running := this.keepAliveTicker != nil
+	if running {
+		this.keepAliveTicker.Stop()
+		close(this.keepAliveStop)
+		this.keepAliveTicker = nil
+	}
+	this.KeepAlivePeriod = period
+	this.keepAliveLock.Unlock()
+
+	if running || this.Translator.OwaCanary != "" {
+		this.startKeepAlive()
+	}
 }
 
-func (this *LoginMiddleware) OwaKeepalive() {
-	for _ = range this.keepAliveTicker.C {
+func (this *LoginMiddleware) owaKeepalive(ticker proxyutils.Ticker, stop <-chan struct{}) {
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-stop:
+			return
+		}
+
 		if this.Translator.OwaCanary == "" {
 			continue
 		}
 
-		log.Println("OWA keepalive")
+		// the server asked us to leave it alone for a while
+		if this.Translator.Clock.Now().Before(this.Translator.BackOffUntil()) {
+			continue
+		}
+
+		Log.Debug.Println("OWA keepalive")
 
 		if !this.CheckLogin(this.Translator.OwaCanary) {
 			// only set the status if the canary is unset
@@ -0,0 +1,33 @@
+package ews
+
+/*
+	Transaction captures of a long session are hard to read when you can't
+	tell which login a request belongs to. Each time the login middleware
+	sets a new canary (a login, or a check after the canary was invalidated)
+	a new login session starts. Its number is the prefix of the request IDs
+	and is written in each transaction log. Keepalives that confirm the same
+	canary stay in the same session.
+
+	Session 0 is the canary that the proxy was started with, if any.
+*/
+
+// sets OwaCanary, and starts a new login session if it changed
+func (this *TranslationMiddleware) setCanary(canary string) {
+	this.lock.Lock()
+	if canary != this.OwaCanary {
+		this.loginSession++
+	}
+	this.OwaCanary = canary
+	this.lock.Unlock()
+
+	if canary != "" {
+		this.changeSessionState(SessionAuthenticated)
+	}
+}
+
+// returns the number of the current login session
+func (this *TranslationMiddleware) currentLoginSession() uint64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.loginSession
+}
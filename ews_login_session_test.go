@@ -0,0 +1,79 @@
+package ews
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/ewstest"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestLoginSession(t *testing.T) {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	login := &LoginMiddleware{
+		Translator: translator,
+		Redirector: proxyutils.NewRedirectorMiddleware(source, target),
+	}
+
+	// a request in the current session, returns its context
+	send := func() *ewsProxyContext {
+		data, err := ioutil.ReadFile("testdata/requests/ews_getitem_retention.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(string(data)))
+		cctx := proxyutils.NewChainValues()
+		if err := translator.RequestModifier(context.Background(), request, cctx); err != nil {
+			t.Fatal(err)
+		}
+		return cctx.Get(ewsContextName).(*ewsProxyContext)
+	}
+
+	expectSession := func(step string, session uint64) {
+		if current := translator.Status().LoginSession; current != session {
+			t.Errorf("%s: expected session %d, got %d", step, session, current)
+		}
+		if translator.OwaCanary == "" {
+			return
+		}
+
+		ctx := send()
+		prefix := fmt.Sprintf("%d-", session)
+		if !strings.HasPrefix(ctx.RequestId, prefix) {
+			t.Errorf("%s: request ID %s doesn't start with %s", step, ctx.RequestId, prefix)
+		}
+		if !strings.Contains(ctx.TransactionLog.String(), fmt.Sprintf("\nLogin session %d\n", session)) {
+			t.Errorf("%s: the session is not in the transaction log:\n%s", step, ctx.TransactionLog)
+		}
+	}
+
+	expectSession("before the login", 0)
+
+	canary := owa.Login()
+	login.CheckLogin(canary)
+	expectSession("login", 1)
+
+	// the keepalive confirms the canary, it's the same session
+	login.CheckLogin(canary)
+	expectSession("keepalive", 1)
+
+	// the keepalive is rejected, then the user logs in again
+	owa.Respond("GetFolder", []byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"ErrorAccessDenied","ResponseClass":"Error"}]}}}`))
+	login.CheckLogin(canary)
+	expectSession("invalidated", 1)
+
+	owa.Respond("GetFolder", []byte(ewstest.DefaultResponse))
+	login.CheckLogin(owa.Login())
+	expectSession("relogin", 2)
+}
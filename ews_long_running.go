@@ -0,0 +1,75 @@
+package ews
+
+/*
+	EmptyFolder, DeleteFolder and MoveItem (of many items) can keep the
+	server busy for much longer than any other request. They are marked
+	LongRunning in EwsOperations, and are handled differently:
+
+	- the server gets LongRunningTimeout to answer instead of
+	  UpstreamTimeout, and the client connection is kept open that long
+	- they are sent only once. After a network error the server is probably
+	  still working on the first one, and a second one would do the work
+	  twice (or fail halfway through, as the items are gone).
+	- when the server doesn't answer in time, the client gets an
+	  ErrorServerBusy SOAP fault that tells it to wait before sending the
+	  request again, instead of a 504 that it would retry right away
+
+	MoveItem is long-running however many items it moves, the classification
+	is per operation.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// DefaultLongRunningTimeout is how long the server gets to answer a
+// LongRunning operation
+const DefaultLongRunningTimeout = 30 * time.Minute
+
+// how long a client should wait before sending a long-running operation
+// again after it timed out
+const longRunningBackOff = 5 * time.Minute
+
+func (this *TranslationMiddleware) longRunningTimeout() time.Duration {
+	if this.LongRunningTimeout <= 0 {
+		return DefaultLongRunningTimeout
+	}
+	return this.LongRunningTimeout
+}
+
+// sets how the chained proxy sends a translated request to the server
+func (this *TranslationMiddleware) setUpstreamOptions(reqCtx context.Context, ctx *ewsProxyContext, cctx *proxyutils.ChainValues) {
+	if !ctx.EwsProxyOp.LongRunning {
+		if this.UpstreamTimeout > 0 {
+			proxyutils.SetUpstreamTimeout(cctx, this.UpstreamTimeout)
+		}
+		return
+	}
+
+	timeout := this.longRunningTimeout()
+	proxyutils.SetUpstreamTimeout(cctx, timeout)
+	proxyutils.SetNoRetry(cctx)
+
+	// leave some time to send the response
+	if !proxyutils.ExtendWriteDeadline(reqCtx, timeout+time.Minute) {
+		this.appendTransaction(ctx, "Ews Translator: the client connection may time out before the server answers")
+	}
+	this.appendTransaction(ctx, fmt.Sprintf("Ews Translator: %s is long-running, waiting up to %s", ctx.EwsProxyOp.Action, timeout))
+}
+
+// replaces the 504 of a long-running operation that the server didn't
+// answer in time with a SOAP fault
+func (this *TranslationMiddleware) setLongRunningFault(ctx *ewsProxyContext, response *http.Response) {
+	this.appendTransaction(ctx, "Ews Translator: "+ctx.EwsProxyOp.Action+" timed out")
+
+	setSoapFault(response, "ErrorServerBusy",
+		"The server did not finish the "+ctx.EwsProxyOp.Action+" operation in time, but may still be working on it. "+
+			"Do not send the request again right away.",
+		soapFaultValue{"BackOffMilliseconds", strconv.FormatInt(int64(longRunningBackOff/time.Millisecond), 10)})
+}
@@ -0,0 +1,92 @@
+package ews
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const moveItemResponse = `{"Body":{"ResponseMessages":{"Items":[{"__type":"MoveItemResponseMessage:#Exchange","ResponseClass":"Success","ResponseCode":"NoError","Items":[]}]}}}`
+
+// an OWA server that takes delay to answer, or gives up when the request is
+// cancelled
+type delayedOwa struct {
+	delay    time.Duration
+	response string
+
+	lock     sync.Mutex
+	attempts int
+}
+
+func (this *delayedOwa) RoundTrip(request *http.Request) (*http.Response, error) {
+	this.lock.Lock()
+	this.attempts++
+	this.lock.Unlock()
+
+	select {
+	case <-time.After(this.delay):
+		return proxyutils.CreateNewResponse(request, this.response), nil
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+}
+
+func (this *delayedOwa) count() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.attempts
+}
+
+func TestLongRunningTimeout(t *testing.T) {
+	moveItem, err := ioutil.ReadFile(filepath.Join("testdata", "requests", "ews_moveitem_davmail.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.UpstreamTimeout = 50 * time.Millisecond
+	translator.LongRunningTimeout = 2 * time.Second
+
+	send := func(owa *delayedOwa, body string) (*http.Response, string) {
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(body))
+		response, err := newLimitedProxy(translator, owa).RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		return response, string(data)
+	}
+
+	// a normal operation times out, and is retried
+	owa := &delayedOwa{delay: 200 * time.Millisecond}
+	if response, _ := send(owa, getItemRequest); response.StatusCode != http.StatusGatewayTimeout || owa.count() != 3 {
+		t.Errorf("expected a 504 after 3 attempts, got %d after %d", response.StatusCode, owa.count())
+	}
+
+	// the same delay is fine for a long-running operation
+	owa = &delayedOwa{delay: 200 * time.Millisecond, response: moveItemResponse}
+	if response, body := send(owa, string(moveItem)); response.StatusCode != http.StatusOK ||
+		!strings.Contains(body, "MoveItemResponseMessage") || owa.count() != 1 {
+		t.Errorf("expected the MoveItem response, got %d after %d attempts: %s", response.StatusCode, owa.count(), body)
+	}
+
+	// it is sent only once when it times out, and the client is told not to
+	// send it again right away
+	translator.LongRunningTimeout = 100 * time.Millisecond
+	owa = &delayedOwa{delay: time.Second}
+	response, body := send(owa, string(moveItem))
+	if response.StatusCode != http.StatusInternalServerError || owa.count() != 1 {
+		t.Errorf("expected a fault after 1 attempt, got %d after %d", response.StatusCode, owa.count())
+	}
+	if !strings.Contains(body, "<e:ResponseCode xmlns:e=\"http://schemas.microsoft.com/exchange/services/2006/errors\">ErrorServerBusy<") ||
+		!strings.Contains(body, `Name="BackOffMilliseconds">300000<`) {
+		t.Errorf("unexpected fault: %s", body)
+	}
+}
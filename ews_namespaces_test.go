@@ -0,0 +1,330 @@
+package ews
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the elements of a complex type or group of the schema, and what they
+// inherit
+type schemaContent struct {
+	// key is the local name, value the prefixes it has in the schema
+	elements map[string]map[string]bool
+	refs     []string // elements that are referenced, with their prefix
+	bases    []string // base types and groups, with their prefix
+}
+
+func (this *schemaContent) addElement(prefix string, local string) {
+	if this.elements[local] == nil {
+		this.elements[local] = make(map[string]bool)
+	}
+	this.elements[local][prefix] = true
+}
+
+// the namespace assignment of the EWS schema: which prefix each element of
+// each type has
+type schemaNamespaces struct {
+	// key is the prefixed name, anonymous types are named like the
+	// generated ones (the element name + AnonType, without prefix)
+	types map[string]*schemaContent
+
+	// global elements, and the members of substitution groups. Key is the
+	// prefixed name of the element (of the head).
+	globals      map[string]bool
+	substitution map[string][]string
+
+	// the attributes are unqualified, except the ones that are references
+	// to attributes of other schemas (xml:lang). Key is the local name.
+	attributes    map[string]bool
+	attributeRefs map[string]string
+}
+
+func readSchemaNamespaces(t *testing.T) *schemaNamespaces {
+	this := &schemaNamespaces{
+		types:        make(map[string]*schemaContent),
+		globals:      make(map[string]bool),
+		substitution: make(map[string][]string),
+
+		attributes:    make(map[string]bool),
+		attributeRefs: make(map[string]string),
+	}
+
+	for fileName, prefix := range map[string]string{"codegen/types.xsd": "t", "codegen/messages.xsd": "m"} {
+		data, err := schemaFiles.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = this.read(data, prefix); err != nil {
+			t.Fatalf("%s: %s", fileName, err)
+		}
+	}
+	return this
+}
+
+// reads the schema with the target namespace prefix. Both files use t: and
+// m: for the EWS namespaces, so the prefixes are taken as they are.
+func (this *schemaNamespaces) read(data []byte, prefix string) error {
+	var stack []*schemaContent
+	var elementNames []string
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch tok := token.(type) {
+		case xml.StartElement:
+			attrs := make(map[string]string)
+			for _, attr := range tok.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+
+			var current *schemaContent
+			if len(stack) != 0 {
+				current = stack[len(stack)-1]
+			}
+
+			var content *schemaContent
+			switch tok.Name.Local {
+			case "complexType", "group":
+				name := attrs["name"]
+				if name != "" {
+					name = prefix + ":" + name
+				} else if tok.Name.Local == "complexType" && len(elementNames) != 0 {
+					name = elementNames[len(elementNames)-1] + "AnonType"
+				}
+
+				if name != "" && attrs["ref"] == "" {
+					if content = this.types[name]; content == nil {
+						content = &schemaContent{elements: make(map[string]map[string]bool)}
+						this.types[name] = content
+					}
+				} else if current != nil && attrs["ref"] != "" {
+					current.bases = append(current.bases, attrs["ref"])
+				}
+
+			case "extension", "restriction":
+				if current != nil && (strings.HasPrefix(attrs["base"], "t:") || strings.HasPrefix(attrs["base"], "m:")) {
+					current.bases = append(current.bases, attrs["base"])
+				}
+
+			case "element":
+				if ref := attrs["ref"]; ref != "" {
+					if current != nil {
+						current.refs = append(current.refs, ref)
+					}
+				} else if current != nil {
+					current.addElement(prefix, attrs["name"])
+				} else {
+					this.globals[prefix+":"+attrs["name"]] = true
+					if head := attrs["substitutionGroup"]; head != "" {
+						this.substitution[head] = append(this.substitution[head], prefix+":"+attrs["name"])
+					}
+				}
+				elementNames = append(elementNames, attrs["name"])
+
+			case "attribute":
+				if ref := attrs["ref"]; ref != "" {
+					this.attributeRefs[ref[strings.Index(ref, ":")+1:]] = ref
+				} else {
+					this.attributes[attrs["name"]] = true
+				}
+			}
+
+			if content == nil {
+				content = current
+			}
+			stack = append(stack, content)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			if tok.Name.Local == "element" {
+				elementNames = elementNames[:len(elementNames)-1]
+			}
+		}
+	}
+}
+
+// returns the elements of the type (or group) name with their prefixes,
+// including the inherited ones and the members of substitution groups
+func (this *schemaNamespaces) elements(name string) map[string]map[string]bool {
+	elements := make(map[string]map[string]bool)
+	seen := make(map[string]bool)
+
+	var add func(qname string)
+	add = func(qname string) {
+		if seen[qname] {
+			return
+		}
+		seen[qname] = true
+
+		parts := strings.SplitN(qname, ":", 2)
+		if elements[parts[1]] == nil {
+			elements[parts[1]] = make(map[string]bool)
+		}
+		elements[parts[1]][parts[0]] = true
+
+		for _, member := range this.substitution[qname] {
+			add(member)
+		}
+	}
+
+	var walk func(name string)
+	walk = func(name string) {
+		content := this.types[name]
+		if content == nil || seen["type "+name] {
+			return
+		}
+		seen["type "+name] = true
+
+		for local, prefixes := range content.elements {
+			for prefix := range prefixes {
+				add(prefix + ":" + local)
+			}
+		}
+		for _, ref := range content.refs {
+			add(ref)
+		}
+		for _, base := range content.bases {
+			walk(base)
+		}
+	}
+
+	walk(name)
+	return elements
+}
+
+// the prefix of an element of a type that isn't in the schema (added by
+// codegen), or that the schema doesn't declare for the type
+func (this *schemaNamespaces) globalPrefixes(local string) map[string]bool {
+	prefixes := make(map[string]bool)
+	for _, prefix := range []string{"m", "t"} {
+		if this.globals[prefix+":"+local] {
+			prefixes[prefix] = true
+		}
+	}
+	return prefixes
+}
+
+// returns the schema name of a type of ews_data.go
+func (this *schemaNamespaces) typeName(name string) string {
+	for _, prefix := range []string{"t", "m"} {
+		if this.types[prefix+":"+name] != nil {
+			return prefix + ":" + name
+		}
+	}
+	return name
+}
+
+func checkPrefix(schema map[string]bool, tag string) string {
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) != 2 {
+		return "has no prefix"
+	}
+	if !schema[parts[0]] {
+		var expected []string
+		for prefix := range schema {
+			expected = append(expected, prefix+":")
+		}
+		sort.Strings(expected)
+		return "should be " + strings.Join(expected, " or ")
+	}
+	return ""
+}
+
+// every element that JSON2SOAP emits must have the prefix of its namespace
+// in the schema, strict clients (such as the ones based on Apache Axis)
+// reject the response otherwise
+func TestElementNamespaces(t *testing.T) {
+	schema := readSchemaNamespaces(t)
+
+	names := make([]string, 0, len(ewsTypes))
+	for name := range ewsTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	checked := 0
+	for _, name := range names {
+		typ := ewsTypes[name]
+		if typ.IsSimple {
+			continue
+		}
+
+		typeName := schema.typeName(name)
+		declared := schema.elements(typeName)
+
+		for _, e := range typ.elements {
+			local := e.XN
+			if i := strings.Index(local, ":"); i != -1 {
+				local = local[i+1:]
+			}
+
+			// elements added by codegen that the schema doesn't have for the
+			// type are in the namespace of the type, or are global elements
+			prefixes := declared[local]
+			if prefixes == nil {
+				prefixes = schema.globalPrefixes(local)
+			}
+			if len(prefixes) == 0 && strings.Contains(typeName, ":") {
+				prefixes = map[string]bool{typeName[:1]: true}
+			}
+			if len(prefixes) == 0 {
+				t.Errorf("%s: %s is not in the schema", name, e.XN)
+				continue
+			}
+
+			if problem := checkPrefix(prefixes, e.XN); problem != "" {
+				t.Errorf("%s: %s %s", name, e.XN, problem)
+			}
+			checked++
+		}
+
+		for _, attr := range typ.Attributes {
+			local := attr.XN[strings.Index(attr.XN, ":")+1:]
+			if ref, ok := schema.attributeRefs[local]; ok && !schema.attributes[local] && attr.XN != ref {
+				t.Errorf("%s: attribute %s should be %s", name, attr.XN, ref)
+			} else if !ok && local != attr.XN {
+				t.Errorf("%s: attribute %s should have no prefix", name, attr.XN)
+			}
+		}
+	}
+
+	// the response elements of the operations are global
+	for action, op := range EwsOperations {
+		tag := op.Response.SingleType.XmlTag.Local
+		if problem := checkPrefix(schema.globalPrefixes(tag[strings.Index(tag, ":")+1:]), tag); problem != "" {
+			t.Errorf("%s: response %s %s", action, tag, problem)
+		}
+	}
+
+	if checked == 0 {
+		t.Fatal("no elements were checked")
+	}
+}
+
+// SOAP2JSON looks up the children of an element by their local name, so that
+// requests that declare the namespaces differently (such as the PowerShell
+// samples, with a default namespace and no prefixes) are read the same. That
+// only works as long as no type has elements with the same local name in
+// both namespaces.
+func TestElementLocalNames(t *testing.T) {
+	for name, typ := range ewsTypes {
+		seen := make(map[string]string)
+		for _, e := range typ.elements {
+			local := e.XN[strings.Index(e.XN, ":")+1:]
+			if other, ok := seen[local]; ok && other != e.XN {
+				t.Errorf("%s has %s and %s", name, other, e.XN)
+			}
+			seen[local] = e.XN
+		}
+	}
+}
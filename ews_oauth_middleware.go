@@ -0,0 +1,406 @@
+package ews
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const oauthContextName = "oauth_ctx"
+
+// how long a request to the Azure AD endpoints may take
+const oauthRequestTimeout = 30 * time.Second
+
+// TokenSource provides OAuth2 bearer tokens to the TranslationMiddleware.
+// When one is set, OWA requests are authenticated with an Authorization
+// header instead of the X-OWA-Canary header
+type TokenSource interface {
+	// Token returns the current access token, or "" if there isn't one
+	Token() string
+
+	// Refresh is called when the upstream server rejects the current token
+	Refresh() error
+}
+
+// OAuthLoginMiddleware authenticates against Exchange Online (Office 365)
+// using the OAuth2 device code flow against Azure AD. The user is shown a
+// code on the CheckPath page, which they enter at the Microsoft login page.
+//
+// This middleware must be last in the chain, so that it sees the upstream
+// response before any other middleware.
+type OAuthLoginMiddleware struct {
+	Translator *TranslationMiddleware
+
+	// used for requests to the token endpoint, and to retry requests when
+	// the token has been refreshed
+	Transport http.RoundTripper
+
+	// Azure AD tenant, default is "organizations"
+	TenantId string
+
+	// Application (client) id registered in Azure AD
+	ClientId string
+
+	// default is "https://outlook.office365.com/.default offline_access"
+	Scope string
+
+	// default is "https://login.microsoftonline.com"
+	AuthorityUrl string
+
+	// string contains on path; typically /owa/
+	CheckPath string
+
+	lock         sync.Mutex
+	accessToken  string
+	refreshToken string
+	expires      time.Time
+	deviceCode   *deviceCodeResponse
+}
+
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func NewOAuthLoginMiddleware(translator *TranslationMiddleware, transport http.RoundTripper, clientId string) *OAuthLoginMiddleware {
+	this := &OAuthLoginMiddleware{
+		Translator:   translator,
+		Transport:    transport,
+		TenantId:     "organizations",
+		ClientId:     clientId,
+		Scope:        "https://outlook.office365.com/.default offline_access",
+		AuthorityUrl: "https://login.microsoftonline.com",
+		CheckPath:    "/owa/",
+	}
+
+	translator.TokenSource = this
+	return this
+}
+
+func (this *OAuthLoginMiddleware) endpoint(name string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/%s", strings.TrimRight(this.AuthorityUrl, "/"), this.TenantId, name)
+}
+
+func (this *OAuthLoginMiddleware) post(endpoint string, form url.Values, v interface{}) error {
+	client := http.Client{Transport: this.Transport, Timeout: oauthRequestTimeout}
+
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+
+	bodyBytes, err := proxyutils.ReadResponseBody(resp)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(bodyBytes, v); err != nil {
+		return errors.Wrapf(err, "invalid response from %s (status %d)", endpoint, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Token returns the current access token, refreshing it first if it has
+// expired. A failed refresh is a login timeout, like a rejected canary.
+func (this *OAuthLoginMiddleware) Token() string {
+	this.lock.Lock()
+	token := this.accessToken
+	expired := token != "" && this.Translator.Clock.Now().After(this.expires)
+	this.lock.Unlock()
+
+	if !expired {
+		return token
+	}
+
+	if err := this.Refresh(); err != nil {
+		Log.Warn.Printf("Error refreshing OAuth token: %s", err)
+		this.Translator.onTimeout()
+		return ""
+	}
+
+	// the new token is used even if the server says it has expired already,
+	// only the next request refreshes it again
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.accessToken
+}
+
+// Refresh uses the refresh token to acquire a new access token. If the token
+// endpoint rejects the refresh token, the tokens are discarded and the user
+// must log in again. They are kept when the endpoint can't be reached, so
+// the next request tries again.
+func (this *OAuthLoginMiddleware) Refresh() error {
+	this.lock.Lock()
+	refreshToken := this.refreshToken
+	this.lock.Unlock()
+
+	if refreshToken == "" {
+		this.clearTokens()
+		return errors.New("no refresh token available")
+	}
+
+	var token tokenResponse
+	err := this.post(this.endpoint("token"), url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {this.ClientId},
+		"refresh_token": {refreshToken},
+		"scope":         {this.Scope},
+	}, &token)
+
+	if err != nil {
+		return errors.Wrap(err, "token refresh failed")
+	}
+
+	if token.Error != "" {
+		this.clearTokens()
+		return errors.Errorf("token refresh failed: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	if token.AccessToken == "" {
+		return errors.New("token refresh failed: no access token returned")
+	}
+
+	this.setTokens(&token)
+	return nil
+}
+
+func (this *OAuthLoginMiddleware) setTokens(token *tokenResponse) {
+	this.lock.Lock()
+	this.accessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		this.refreshToken = token.RefreshToken
+	}
+	this.expires = this.Translator.Clock.Now().Add(tokenLifetime(token.ExpiresIn))
+	this.deviceCode = nil
+	this.lock.Unlock()
+}
+
+// the shortest time that a token is used for before it is refreshed, for
+// tokens without an expires_in or that expire right away
+const minTokenLifetime = 30 * time.Second
+
+// returns how long a token that expires in expiresIn seconds is used for.
+// It is refreshed a little early so requests don't race the expiration.
+func tokenLifetime(expiresIn int) time.Duration {
+	lifetime := time.Duration(expiresIn)*time.Second - time.Minute
+	if lifetime < minTokenLifetime {
+		lifetime = minTokenLifetime
+	}
+	return lifetime
+}
+
+func (this *OAuthLoginMiddleware) clearTokens() {
+	this.lock.Lock()
+	this.accessToken = ""
+	this.refreshToken = ""
+	this.lock.Unlock()
+}
+
+// StartDeviceCode begins the device code flow if it isn't already in
+// progress, and returns the code that the user must enter
+func (this *OAuthLoginMiddleware) StartDeviceCode() (*deviceCodeResponse, error) {
+	this.lock.Lock()
+	current := this.deviceCode
+	this.lock.Unlock()
+
+	if current != nil {
+		return current, nil
+	}
+
+	// the lock isn't held for the request, so Token() isn't blocked by a
+	// slow endpoint
+	var code deviceCodeResponse
+	err := this.post(this.endpoint("devicecode"), url.Values{
+		"client_id": {this.ClientId},
+		"scope":     {this.Scope},
+	}, &code)
+	if err != nil {
+		return nil, err
+	}
+
+	if code.DeviceCode == "" {
+		return nil, errors.New("no device code returned")
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// another request started the flow in the meantime
+	if this.deviceCode != nil {
+		return this.deviceCode, nil
+	}
+
+	// the user has to act on it, so it's shown with -q too
+	Log.Warn.Printf("OAuth login: %s", code.Message)
+
+	this.deviceCode = &code
+	go this.pollDeviceCode(&code)
+	return &code, nil
+}
+
+func (this *OAuthLoginMiddleware) pollDeviceCode(code *deviceCodeResponse) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	clock := this.Translator.Clock
+	deadline := clock.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	defer func() {
+		this.lock.Lock()
+		if this.deviceCode == code {
+			this.deviceCode = nil
+		}
+		this.lock.Unlock()
+	}()
+
+	for clock.Now().Before(deadline) {
+		clock.Sleep(interval)
+
+		var token tokenResponse
+		err := this.post(this.endpoint("token"), url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":   {this.ClientId},
+			"device_code": {code.DeviceCode},
+		}, &token)
+
+		if err != nil {
+			Log.Warn.Printf("Error polling for OAuth token: %s", err)
+			continue
+		}
+
+		switch token.Error {
+		case "":
+			this.setTokens(&token)
+			Log.Info.Println("OAuth login successful")
+			this.Translator.onSuccess()
+			return
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		default:
+			Log.Error.Printf("OAuth login failed: %s %s", token.Error, token.ErrorDescription)
+			return
+		}
+	}
+}
+
+func (this *OAuthLoginMiddleware) RequestModifier(ctx context.Context, request *http.Request, cctx *proxyutils.ChainValues) error {
+	if proxyutils.IsBypassed(cctx) {
+		return nil
+	}
+
+	// remember authorized requests so they can be retried on a 401
+	if request.Header.Get("Authorization") != "" {
+		cctx.Set(oauthContextName, request)
+		return nil
+	}
+
+	if !strings.Contains(request.URL.Path, this.CheckPath) {
+		return nil
+	}
+
+	// the browser is never sent to OWA, instead it is shown the device code
+	var response *http.Response
+
+	if this.Token() != "" {
+		response = proxyutils.CreateNewResponse(request, "")
+		response.Header.Set("Location", "/proxyclose.html")
+		response.StatusCode = http.StatusFound
+	} else {
+		code, err := this.StartDeviceCode()
+		if err != nil {
+			response = proxyutils.CreateNewResponse(request, fmt.Sprintf(oauthErrorHtml, html.EscapeString(err.Error())))
+			response.StatusCode = http.StatusBadGateway
+		} else {
+			response = proxyutils.CreateNewResponse(request, fmt.Sprintf(oauthDeviceCodeHtml,
+				html.EscapeString(code.VerificationUri), html.EscapeString(code.VerificationUri),
+				html.EscapeString(code.UserCode)))
+		}
+	}
+
+	response.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return proxyutils.NewRequestError(response)
+}
+
+// When the server rejects the token, refresh it and retry the request once.
+// If that isn't possible, the response is turned into a login timeout
+func (this *OAuthLoginMiddleware) ResponseModifier(ctx context.Context, response *http.Response, cctx *proxyutils.ChainValues) error {
+	request, ok := cctx.Get(oauthContextName).(*http.Request)
+	if !ok || response.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+
+	if err := this.Refresh(); err != nil {
+		Log.Error.Printf("OAuth token rejected and could not be refreshed: %s", err)
+		response.StatusCode = 440 // MS LoginTimeout
+		return nil
+	}
+
+	if request.GetBody == nil {
+		return nil
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return err
+	}
+
+	request.Body = body
+	request.Header.Set("Authorization", "Bearer "+this.Token())
+
+	newResponse, err := this.Transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	*response = *newResponse
+	return nil
+}
+
+var oauthDeviceCodeHtml = `
+<html>
+  <head><title>Exchange Online login</title></head>
+  <body>
+    <p>To sign in, open <a href="%s" target="_blank">%s</a> and enter the code
+       <b>%s</b>.</p>
+    <p>Reload this page once you have signed in.</p>
+  </body>
+</html>
+`
+
+var oauthErrorHtml = `
+<html>
+  <head><title>Exchange Online login</title></head>
+  <body>
+    <p>Could not begin login: %s</p>
+  </body>
+</html>
+`
@@ -0,0 +1,329 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// fake Azure AD token endpoint
+type fakeTokenServer struct {
+	lock          sync.Mutex
+	pendingPolls  int
+	refreshTokens map[string]string // refresh token -> next access token
+}
+
+func (this *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/testtenant/oauth2/v2.0/devicecode"):
+		fmt.Fprint(w, `{"device_code": "dc1", "user_code": "ABCD-EFGH",
+			"verification_uri": "https://microsoft.com/devicelogin",
+			"expires_in": 60, "interval": 1, "message": "enter ABCD-EFGH"}`)
+
+	case strings.HasSuffix(r.URL.Path, "/testtenant/oauth2/v2.0/token"):
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if this.pendingPolls > 0 {
+				this.pendingPolls--
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "authorization_pending"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "tok1", "refresh_token": "refresh1", "expires_in": 3600}`)
+
+		case "refresh_token":
+			next, ok := this.refreshTokens[r.Form.Get("refresh_token")]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "expired"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token": "%s", "refresh_token": "refresh-%s", "expires_in": 3600}`, next, next)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestOAuth(tokenServer *httptest.Server) (*OAuthLoginMiddleware, *TranslationMiddleware) {
+	translator := NewTranslationMiddleware()
+	oauth := NewOAuthLoginMiddleware(translator, http.DefaultTransport, "client")
+	oauth.TenantId = "testtenant"
+	oauth.AuthorityUrl = tokenServer.URL
+	return oauth, translator
+}
+
+func TestOAuthDeviceCodeLogin(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{pendingPolls: 1})
+	defer tokenServer.Close()
+
+	oauth, _ := newTestOAuth(tokenServer)
+
+	request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+	err := oauth.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+
+	re, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("expected the device code page, got %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(re.Response.Body)
+	if !strings.Contains(string(body), "ABCD-EFGH") {
+		t.Errorf("user code not shown: %s", body)
+	}
+
+	// wait for the poller to receive the token
+	deadline := time.Now().Add(10 * time.Second)
+	for oauth.Token() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("token was never acquired")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if oauth.Token() != "tok1" {
+		t.Errorf("unexpected token %s", oauth.Token())
+	}
+
+	// once logged in, the browser is told to close
+	request, _ = http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+	re, ok = oauth.RequestModifier(context.Background(), request, proxyutils.NewChainValues()).(*proxyutils.RequestError)
+	if !ok || re.Response.Header.Get("Location") != "/proxyclose.html" {
+		t.Errorf("expected redirect to close page")
+	}
+}
+
+func TestOAuthHeaderInjection(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{})
+	defer tokenServer.Close()
+
+	oauth, translator := newTestOAuth(tokenServer)
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "refresh1", ExpiresIn: 3600})
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", nil)
+	SetupOwaRequest(translator, request, []byte("{}"), "GetFolder", translator.credential())
+
+	if auth := request.Header.Get("Authorization"); auth != "Bearer tok1" {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+
+	if canary := request.Header.Get("X-OWA-Canary"); canary != "" {
+		t.Errorf("canary should not be sent in OAuth mode, got %q", canary)
+	}
+}
+
+func TestOAuthRefreshOn401(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{
+		refreshTokens: map[string]string{"refresh1": "tok2"},
+	})
+	defer tokenServer.Close()
+
+	// upstream only accepts the refreshed token, and echoes the body
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	oauth, translator := newTestOAuth(tokenServer)
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "refresh1", ExpiresIn: 3600})
+
+	request, _ := http.NewRequest("POST", upstream.URL+"/ews/exchange.asmx", nil)
+	SetupOwaRequest(translator, request, []byte(`{"hello": "world"}`), "GetFolder", translator.credential())
+
+	cctx := proxyutils.NewChainValues()
+	if err := oauth.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = oauth.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected retried request to succeed, got %d", response.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != `{"hello": "world"}` {
+		t.Errorf("request body was not replayed, got %q", body)
+	}
+
+	if oauth.Token() != "tok2" {
+		t.Errorf("expected refreshed token, got %s", oauth.Token())
+	}
+}
+
+func TestOAuthRefreshFailureTimesOut(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{})
+	defer tokenServer.Close()
+
+	oauth, translator := newTestOAuth(tokenServer)
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "revoked", ExpiresIn: 3600})
+
+	timedOut := false
+	translator.OnEwsTimeout = func() { timedOut = true }
+
+	request, _ := http.NewRequest("POST", "http://localhost/owa/service.svc", nil)
+	SetupOwaRequest(translator, request, []byte("{}"), "GetFolder", translator.credential())
+
+	cctx := proxyutils.NewChainValues()
+	cctx.Set(ewsContextName, &ewsProxyContext{TransactionLog: new(bytes.Buffer)})
+	if err := oauth.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	response := proxyutils.CreateNewResponse(request, "")
+	response.StatusCode = http.StatusUnauthorized
+
+	// same order as the chain: oauth is last, so it sees the response first
+	if err := oauth.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !timedOut {
+		t.Error("OnEwsTimeout was not called")
+	}
+
+	if oauth.Token() != "" {
+		t.Error("tokens should be discarded after a failed refresh")
+	}
+}
+
+func TestOAuthRefreshKeepsTokensOnTransportError(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{
+		refreshTokens: map[string]string{"refresh1": "tok2"},
+	})
+
+	oauth, _ := newTestOAuth(tokenServer)
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "refresh1", ExpiresIn: 3600})
+
+	// the endpoint can't be reached
+	tokenServer.Close()
+
+	if err := oauth.Refresh(); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+	if oauth.refreshToken != "refresh1" {
+		t.Errorf("refresh token was discarded: %q", oauth.refreshToken)
+	}
+
+	tokenServer = httptest.NewServer(&fakeTokenServer{
+		refreshTokens: map[string]string{"refresh1": "tok2"},
+	})
+	defer tokenServer.Close()
+	oauth.AuthorityUrl = tokenServer.URL
+
+	if err := oauth.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if token := oauth.Token(); token != "tok2" {
+		t.Errorf("expected the refreshed token, got %q", token)
+	}
+}
+
+func TestOAuthShortLivedToken(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{
+		refreshTokens: map[string]string{"refresh1": "tok2"},
+	})
+	defer tokenServer.Close()
+
+	oauth, translator := newTestOAuth(tokenServer)
+	clock := proxyutils.NewFakeClock(time.Now())
+	translator.Clock = clock
+
+	// a token without an expires_in is used for a while, instead of being
+	// refreshed over and over
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "refresh1"})
+	if token := oauth.Token(); token != "tok1" {
+		t.Errorf("expected tok1, got %q", token)
+	}
+
+	clock.Advance(minTokenLifetime + time.Second)
+	if token := oauth.Token(); token != "tok2" {
+		t.Errorf("expected the refreshed token, got %q", token)
+	}
+}
+
+func TestOAuthExpiredTokenTimesOut(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{})
+	defer tokenServer.Close()
+
+	oauth, translator := newTestOAuth(tokenServer)
+	clock := proxyutils.NewFakeClock(time.Now())
+	translator.Clock = clock
+
+	timedOut := false
+	translator.OnEwsTimeout = func() { timedOut = true }
+
+	oauth.setTokens(&tokenResponse{AccessToken: "tok1", RefreshToken: "revoked", ExpiresIn: 3600})
+	clock.Advance(time.Hour)
+
+	if token := oauth.Token(); token != "" {
+		t.Errorf("expected no token, got %q", token)
+	}
+	if !timedOut {
+		t.Error("OnEwsTimeout was not called")
+	}
+}
+
+func TestOAuthIgnoresBypassed(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{})
+	defer tokenServer.Close()
+
+	oauth, _ := newTestOAuth(tokenServer)
+
+	bypass, err := proxyutils.NewBypassMiddleware([]string{"/owa/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the browser isn't shown the device code
+	request, _ := http.NewRequest("GET", "http://localhost:60001/owa/page", nil)
+	request.Header.Set("Authorization", "Bearer client-token")
+
+	cctx := proxyutils.NewChainValues()
+	bypass.RequestModifier(context.Background(), request, cctx)
+	if err = oauth.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatalf("expected the request to be left alone, got %v", err)
+	}
+
+	// and the token of the client isn't refreshed on a 401
+	response := proxyutils.CreateNewResponse(request, "")
+	response.StatusCode = http.StatusUnauthorized
+	if err = oauth.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the 401 to be passed through, got %d", response.StatusCode)
+	}
+}
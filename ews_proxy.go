@@ -0,0 +1,147 @@
+package ews
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// ProxyOptions contains the middlewares that NewProxy chains together
+type ProxyOptions struct {
+	// default is "EWS Proxy"
+	Name string
+
+	// used for all of the chain's logging, at every level. Default is Log
+	Logger *log.Logger
+
+	// used to talk to the exchange server, default is http.DefaultTransport
+	Transport http.RoundTripper
+
+	// required
+	Translator *TranslationMiddleware
+	Redirector *proxyutils.RedirectorMiddleware
+
+	// exactly one of these is required
+	Login *LoginMiddleware
+	OAuth *OAuthLoginMiddleware
+
+	// Additional middlewares (audit logging, custom auth, ...). The chain is
+	//
+	//   FramingMiddleware, ClosePage, PreMiddlewares, LoginMiddleware,
+	//   TranslationMiddleware, RedirectorMiddleware, PostMiddlewares,
+	//   OAuthLoginMiddleware
+	//
+	// Request modifiers are called in that order, response modifiers in the
+	// reverse order. So PreMiddlewares see the request as the client sent
+	// it and the response as the client gets it, and PostMiddlewares see
+	// the request that is sent to the exchange server (translated and
+	// retargeted) and its response before anything is done to it. The
+	// OAuthLoginMiddleware is always last, as it retries the request when
+	// the token is rejected.
+	PreMiddlewares  []proxyutils.Middleware
+	PostMiddlewares []proxyutils.Middleware
+
+	// shown at /close.html and /proxyclose.html, default is the template
+	// returned by ParseClosePage("")
+	ClosePage *template.Template
+
+	// Requests to paths that match these patterns (see path.Match) are
+	// passed through as they are, they are only sent to the exchange server.
+	// The check is done before any other middleware.
+	BypassPaths []string
+
+	// Used instead of BypassPaths if set, so that the patterns can be
+	// changed with SetPaths while the proxy is running
+	Bypass *proxyutils.BypassMiddleware
+}
+
+// NewProxy creates the reverse proxy that EWS clients talk to
+func NewProxy(opts *ProxyOptions) (*httputil.ReverseProxy, error) {
+	if opts.Translator == nil || opts.Redirector == nil {
+		return nil, errors.New("a Translator and a Redirector are required")
+	}
+
+	if (opts.Login == nil) == (opts.OAuth == nil) {
+		return nil, errors.New("exactly one of Login and OAuth is required")
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = "EWS Proxy"
+	}
+
+	loggers := Log
+	if opts.Logger != nil {
+		loggers = proxyutils.NewLevelLoggers(opts.Logger, proxyutils.LevelTrace)
+	}
+
+	if opts.Translator.SourceServer == nil {
+		opts.Translator.SourceServer = opts.Redirector.SourceServer
+	}
+	if opts.Translator.PathPrefix == "" {
+		opts.Translator.PathPrefix = proxyutils.PathPrefix(opts.Redirector.TargetServer)
+	}
+
+	if opts.Redirector.Skew == nil {
+		opts.Redirector.Skew = opts.Translator.Skew
+	}
+
+	// the CanarySource logs in again when the session expires
+	if opts.Login != nil && opts.Login.CanarySource != nil && opts.Translator.Relogin == nil {
+		opts.Translator.Relogin = opts.Login.Relogin
+	}
+
+	closePage := &ClosePage{
+		Template:   opts.ClosePage,
+		Translator: opts.Translator,
+		TargetHost: opts.Redirector.TargetServer.Host,
+	}
+	if closePage.Template == nil {
+		var err error
+		if closePage.Template, err = ParseClosePage(""); err != nil {
+			return nil, err
+		}
+	}
+
+	// requests with ambiguous framing are rejected before anything else
+	middlewares := []proxyutils.Middleware{&proxyutils.FramingMiddleware{}}
+	if opts.Bypass != nil {
+		middlewares = append(middlewares, opts.Bypass)
+	} else if len(opts.BypassPaths) != 0 {
+		bypass, err := proxyutils.NewBypassMiddleware(opts.BypassPaths)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, bypass)
+	}
+	middlewares = append(middlewares, closePage)
+	middlewares = append(middlewares, opts.PreMiddlewares...)
+	if opts.Login != nil {
+		middlewares = append(middlewares, opts.Login)
+	}
+	middlewares = append(middlewares, opts.Translator, opts.Redirector)
+	middlewares = append(middlewares, opts.PostMiddlewares...)
+	if opts.OAuth != nil {
+		middlewares = append(middlewares, opts.OAuth)
+	}
+
+	chain := proxyutils.CreateChainedProxy(name, loggers.Trace, loggers.Debug, loggers.Info, loggers.Warn, loggers.Error, opts.Translator.Clock, opts.Transport, middlewares...)
+
+	return &httputil.ReverseProxy{
+		// ReverseProxy doesn't add X-Forwarded-For when Rewrite is used. The
+		// headers that the client sent are kept for the RedirectorMiddleware,
+		// which adds the client according to its ForwardedHeaders.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "Forwarded"} {
+				if values, ok := pr.In.Header[name]; ok {
+					pr.Out.Header[name] = values
+				}
+			}
+		},
+		Transport: chain,
+	}, nil
+}
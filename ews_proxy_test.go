@@ -0,0 +1,537 @@
+package ews
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+const proxyOrderName = "test_order"
+
+// records the order that it's called in, and what the built-in middlewares
+// had done to the request/response at that point
+type recordingMiddleware struct {
+	name string
+}
+
+func (this *recordingMiddleware) record(cctx *proxyutils.ChainValues, event string) {
+	order, _ := cctx.Get(proxyOrderName).([]string)
+	cctx.Set(proxyOrderName, append(order, this.name+" "+event))
+}
+
+func (this *recordingMiddleware) RequestModifier(ctx context.Context, request *http.Request, cctx *proxyutils.ChainValues) error {
+	_, login := cctx.Lookup("login_ctx")
+	_, redirected := cctx.Lookup("maskcxt_host")
+	this.record(cctx, "request")
+
+	if login || redirected {
+		this.record(cctx, "after builtins")
+	}
+	return nil
+}
+
+func (this *recordingMiddleware) ResponseModifier(ctx context.Context, response *http.Response, cctx *proxyutils.ChainValues) error {
+	this.record(cctx, "response")
+	response.Header.Set("X-Order-"+this.name, response.Header.Get("Location"))
+
+	if this.name == "pre1" {
+		// last one called, report back to the test
+		for _, event := range cctx.Get(proxyOrderName).([]string) {
+			response.Header.Add("X-Order", event)
+		}
+	}
+	return nil
+}
+
+func TestProxyMiddlewareOrder(t *testing.T) {
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse("https://exchange.example.com")
+
+	var upstreamHost string
+	transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		upstreamHost = request.URL.Host
+		response := proxyutils.CreateNewResponse(request, "ok")
+		response.Header.Set("Location", "https://exchange.example.com/owa/")
+		return response, nil
+	})
+
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  transport,
+		Translator: translator,
+		Redirector: redirector,
+		Login: &LoginMiddleware{
+			Translator: translator,
+			Redirector: redirector,
+			CheckPath:  "/owa/",
+		},
+		PreMiddlewares:  []proxyutils.Middleware{&recordingMiddleware{"pre1"}, &recordingMiddleware{"pre2"}},
+		PostMiddlewares: []proxyutils.Middleware{&recordingMiddleware{"post1"}, &recordingMiddleware{"post2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/test", nil))
+
+	if upstreamHost != "exchange.example.com" {
+		t.Errorf("request was sent to %q", upstreamHost)
+	}
+
+	expected := []string{
+		"pre1 request",
+		"pre2 request",
+		"post1 request", "post1 after builtins",
+		"post2 request", "post2 after builtins",
+		"post2 response",
+		"post1 response",
+		"pre2 response",
+		"pre1 response",
+	}
+
+	if order := w.Header()["X-Order"]; !reflect.DeepEqual(order, expected) {
+		t.Errorf("unexpected order\nexpected: %q\ngot:      %q", expected, order)
+	}
+
+	// the redirector retargets the Location header between the post and pre
+	// response modifiers
+	if w.Header().Get("X-Order-post1") != "https://exchange.example.com/owa/" ||
+		w.Header().Get("X-Order-pre2") != "http://localhost:60001/owa/" {
+		t.Error("response modifiers were not called around the RedirectorMiddleware")
+	}
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse("https://exchange.example.com")
+
+	for mode, expected := range map[proxyutils.ForwardedHeaderMode]string{
+		proxyutils.ForwardedOff:       "",
+		proxyutils.ForwardedStandard:  "198.51.100.1, 192.0.2.1",
+		proxyutils.ForwardedAnonymize: "",
+	} {
+		var upstream http.Header
+		transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			upstream = request.Header
+			return proxyutils.CreateNewResponse(request, "ok"), nil
+		})
+
+		translator := NewTranslationMiddleware()
+		redirector := proxyutils.NewRedirectorMiddleware(source, target)
+		redirector.ForwardedHeaders = mode
+
+		proxy, err := NewProxy(&ProxyOptions{
+			Logger:     log.New(ioutil.Discard, "", 0),
+			Transport:  transport,
+			Translator: translator,
+			Redirector: redirector,
+			Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// httptest requests come from 192.0.2.1
+		request := httptest.NewRequest("GET", "http://localhost:60001/test", nil)
+		request.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, request)
+
+		// ReverseProxy doesn't add the client a second time
+		if forwardedFor := upstream.Get("X-Forwarded-For"); forwardedFor != expected {
+			t.Errorf("%s: unexpected X-Forwarded-For %q", mode, forwardedFor)
+		}
+
+		if host := w.Header().Get("Host"); host != "" {
+			t.Errorf("%s: Host header %q in the response", mode, host)
+		}
+	}
+}
+
+func TestProxyOptionsRequired(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(&url.URL{}, &url.URL{})
+
+	if _, err := NewProxy(&ProxyOptions{Translator: translator, Redirector: redirector}); err == nil {
+		t.Error("expected an error without a login middleware")
+	}
+
+	if _, err := NewProxy(&ProxyOptions{Login: &LoginMiddleware{}}); err == nil {
+		t.Error("expected an error without a translator")
+	}
+}
+
+func TestProxyPathPrefix(t *testing.T) {
+	getItemResponse, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetItem_owa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OWA published under /exchange/
+	var outside []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/exchange/owa/auth/logon.aspx":
+			http.Redirect(w, r, "/exchange/owa/", http.StatusFound)
+		case "/exchange/owa/":
+			http.SetCookie(w, &http.Cookie{Name: "X-OWA-CANARY", Value: "canary", Path: "/"})
+			w.Write([]byte("<html></html>"))
+		case "/exchange/owa/service.svc":
+			if r.Header.Get("X-OWA-Canary") != "canary" {
+				w.WriteHeader(440)
+			} else if r.Header.Get("Action") == "GetItem" {
+				w.Write(getItemResponse)
+			} else {
+				w.Write([]byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"NoError","ResponseClass":"Success"}]}}}`))
+			}
+		default:
+			outside = append(outside, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(server.URL + "/exchange/owa")
+	if err = proxyutils.NormalizeTargetUrl(target); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &http.Transport{}
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	login := &LoginMiddleware{
+		Translator: translator,
+		Redirector: redirector,
+		Transport:  transport,
+		CheckPath:  "/owa/",
+	}
+	login.CanaryFinder = login.CookieCanaryFinder
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  transport,
+		Translator: translator,
+		Redirector: redirector,
+		Login:      login,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// redirects point to the proxy, without the prefix
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/owa/auth/logon.aspx", nil))
+	if location := w.Header().Get("Location"); location != "http://localhost:60001/owa/" {
+		t.Errorf("unexpected Location %q", location)
+	}
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/owa/", nil))
+	if translator.OwaCanary != "canary" {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body)
+	}
+
+	// EWS clients may use the path with or without the prefix
+	for _, ewsPath := range []string{"/ews/exchange.asmx", "/exchange/ews/exchange.asmx"} {
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:60001"+ewsPath, strings.NewReader(getItemRequest)))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "GetItemResponseMessage") {
+			t.Errorf("%s: EWS request failed: %d %.200s", ewsPath, w.Code, w.Body)
+		}
+	}
+
+	if len(outside) != 0 {
+		t.Errorf("requests outside of the prefix: %v", outside)
+	}
+}
+
+func TestProxyUnframedRequests(t *testing.T) {
+	getItemResponse, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetItem_owa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what OWA gets: the length of the JSON, however the client framed the
+	// SOAP
+	var upstreamLength int64
+	var upstreamChunked bool
+	var upstreamBody []byte
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamLength = r.ContentLength
+		upstreamChunked = len(r.TransferEncoding) != 0
+		upstreamBody, _ = ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(getItemResponse)))
+		w.Write(getItemResponse)
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  &http.Transport{},
+		Translator: translator,
+		Redirector: redirector,
+		Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(proxy)
+	server.Listener = proxyutils.NewCloseDelimitedListener(server.Listener)
+	server.Start()
+	defer server.Close()
+
+	for name, request := range map[string]string{
+		// the body ends when the client shuts down its side
+		"HTTP/1.0": "POST /ews/exchange.asmx HTTP/1.0\r\nHost: localhost:60001\r\nContent-Type: text/xml\r\n\r\n" + getItemRequest,
+
+		"chunked": "POST /ews/exchange.asmx HTTP/1.1\r\nHost: localhost:60001\r\nContent-Type: text/xml\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n" +
+			strconv.FormatInt(int64(len(getItemRequest)), 16) + "\r\n" + getItemRequest + "\r\n0\r\n\r\n",
+	} {
+		upstreamLength, upstreamChunked, upstreamBody = 0, false, nil
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(request))
+		if name == "HTTP/1.0" {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+
+		// the response ends with the connection too
+		raw, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+		if err != nil {
+			t.Errorf("%s: %s\n%s", name, err, raw)
+			continue
+		}
+		body, err := ioutil.ReadAll(response.Body)
+
+		if err != nil || response.StatusCode != http.StatusOK || !strings.Contains(string(body), "GetItemResponseMessage") {
+			t.Errorf("%s: unexpected response %v\n%s", name, err, raw)
+		} else if response.ContentLength >= 0 && response.ContentLength != int64(len(body)) {
+			t.Errorf("%s: response has Content-Length %d, but %d bytes", name, response.ContentLength, len(body))
+		} else if name == "HTTP/1.0" && (len(response.TransferEncoding) != 0 || !response.Close) {
+			// an HTTP/1.0 client can't read chunks, and doesn't expect
+			// another response on the connection
+			t.Errorf("%s: response is framed wrong %v %v\n%s", name, response.TransferEncoding, response.Close, raw)
+		}
+
+		if upstreamChunked || upstreamLength <= 0 || upstreamLength != int64(len(upstreamBody)) {
+			t.Errorf("%s: OWA got %d bytes with Content-Length %d, chunked %v", name, len(upstreamBody), upstreamLength, upstreamChunked)
+		}
+	}
+}
+
+func TestProxyAnchorMailbox(t *testing.T) {
+	getItemResponse, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetItem_owa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream http.Header
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header
+		http.SetCookie(w, &http.Cookie{Name: "X-BackEndOverrideCookie", Value: "backend1~" + r.Header.Get("X-AnchorMailbox"), Path: "/"})
+		w.Write(getItemResponse)
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.AnchorMailbox = "service@example.com"
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	cookies := proxyutils.NewBoundedCookieJar()
+	cookies.AllowList = proxyutils.DefaultCookieAllowList
+	redirector.Cookies = cookies
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  &http.Transport{},
+		Translator: translator,
+		Redirector: redirector,
+		Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	impersonated := strings.Replace(getItemRequest, `<t:RequestServerVersion Version="Exchange2013_SP1"/>`,
+		`<t:RequestServerVersion Version="Exchange2013_SP1"/><t:ExchangeImpersonation><t:ConnectingSID><t:SID>S-1-5-21</t:SID><t:SmtpAddress>alice@example.com</t:SmtpAddress></t:ConnectingSID></t:ExchangeImpersonation>`, 1)
+
+	for i, test := range []struct {
+		body, anchor string
+		stream       bool
+		headers      map[string]string
+		cookie       string
+	}{
+		{body: getItemRequest, anchor: "service@example.com"},
+		{body: impersonated, anchor: "alice@example.com", cookie: "backend1~service@example.com"},
+		{body: impersonated, anchor: "alice@example.com", stream: true, cookie: "backend1~alice@example.com"},
+		// the client knows best
+		{body: impersonated, anchor: "bob@example.com", headers: map[string]string{"X-AnchorMailbox": "bob@example.com", "X-PreferServerAffinity": "true"}, cookie: "backend1~alice@example.com"},
+	} {
+		upstream = nil
+		translator.StreamThreshold = 0
+		if test.stream {
+			translator.StreamThreshold = 1
+		}
+
+		request := httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(test.body))
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, request)
+
+		if w.Code != http.StatusOK || upstream == nil {
+			t.Errorf("%d: unexpected response %d\n%s", i, w.Code, w.Body)
+			continue
+		}
+
+		if anchor := upstream.Get("X-AnchorMailbox"); anchor != test.anchor {
+			t.Errorf("%d: expected X-AnchorMailbox %q, got %q", i, test.anchor, anchor)
+		}
+		for name, value := range test.headers {
+			if upstream.Get(name) != value {
+				t.Errorf("%d: expected %s to be passed through, got %q", i, name, upstream.Get(name))
+			}
+		}
+
+		// the affinity cookie of the previous response comes back
+		expected := ""
+		if test.cookie != "" {
+			expected = "X-BackEndOverrideCookie=" + test.cookie
+		}
+		if cookie := upstream.Get("Cookie"); cookie != expected {
+			t.Errorf("%d: expected cookie %q, got %q", i, expected, cookie)
+		}
+	}
+}
+
+func TestCaptureUserAgent(t *testing.T) {
+	var checkedWith string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/owa/":
+			// servers rarely send one, but it isn't the browser's
+			w.Header().Set("User-Agent", "Server/1.0")
+			http.SetCookie(w, &http.Cookie{Name: "X-OWA-CANARY", Value: "canary", Path: "/"})
+			w.Write([]byte("<html></html>"))
+		case "/owa/service.svc":
+			checkedWith = r.Header.Get("User-Agent")
+			w.Write([]byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"NoError","ResponseClass":"Success"}]}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(server.URL)
+
+	login := func(configure func(*proxyutils.RedirectorMiddleware)) *proxyutils.RedirectorMiddleware {
+		checkedWith = ""
+		transport := &http.Transport{}
+		translator := NewTranslationMiddleware()
+		redirector := proxyutils.NewRedirectorMiddleware(source, target)
+		configure(redirector)
+
+		login := &LoginMiddleware{
+			Translator: translator,
+			Redirector: redirector,
+			Transport:  transport,
+			CheckPath:  "/owa/",
+		}
+		login.CanaryFinder = login.CookieCanaryFinder
+
+		proxy, err := NewProxy(&ProxyOptions{
+			Logger:     log.New(ioutil.Discard, "", 0),
+			Transport:  transport,
+			Translator: translator,
+			Redirector: redirector,
+			Login:      login,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest("GET", "http://localhost:60001/owa/", nil)
+		request.Header.Set("User-Agent", "Browser/1.0")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, request)
+		if translator.OwaCanary != "canary" {
+			t.Fatalf("login failed: %d %s", w.Code, w.Body)
+		}
+		return redirector
+	}
+
+	// the User-Agent of the browser's request is kept, not the one of the
+	// response
+	redirector := login(func(*proxyutils.RedirectorMiddleware) {})
+	if redirector.UserAgent != "Browser/1.0" || checkedWith != "Browser/1.0" {
+		t.Errorf("expected the browser's User-Agent, got %q (checked with %q)", redirector.UserAgent, checkedWith)
+	}
+
+	// a configured one is kept
+	redirector = login(func(redirector *proxyutils.RedirectorMiddleware) {
+		redirector.UserAgent = "Fixed/1.0"
+	})
+	if redirector.UserAgent != "Fixed/1.0" || checkedWith != "Fixed/1.0" {
+		t.Errorf("expected the configured User-Agent, got %q (checked with %q)", redirector.UserAgent, checkedWith)
+	}
+
+	// nothing is captured when it is turned off
+	redirector = login(func(redirector *proxyutils.RedirectorMiddleware) {
+		redirector.CaptureUserAgent = false
+	})
+	if redirector.UserAgent != "" || checkedWith == "Browser/1.0" {
+		t.Errorf("expected no User-Agent to be captured, got %q (checked with %q)", redirector.UserAgent, checkedWith)
+	}
+}
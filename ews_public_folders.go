@@ -0,0 +1,61 @@
+package ews
+
+/*
+	Public folders are found with the publicfoldersroot distinguished folder
+	id, and are otherwise translated like the folders of the mailbox.
+
+	When the mailbox can't use public folders (there are none, or the public
+	folder mailbox can't be found), OWA doesn't answer with a response
+	message but with a fault: a Body that has the name of the exception and
+	the ResponseCode. That isn't a response that the proxy can translate, so
+	the client gets the ErrorPublicFolderRequestProcessingFailed SOAP fault
+	that Exchange sends in this case, instead of a ProxyTranslationError.
+*/
+
+import (
+	"bytes"
+	"strings"
+)
+
+// the ResponseCode of public folder faults start with it
+const publicFolderCodePrefix = "ErrorPublicFolder"
+
+// owaFault is the Body of a fault that OWA answers with instead of a
+// response
+type owaFault struct {
+	ExceptionName string
+	FaultMessage  string
+	ResponseCode  string
+}
+
+// publicFolderFault returns the fault that OWA refused a public folder
+// operation with, or nil if the response isn't one
+func publicFolderFault(jsonResponseData []byte) *owaFault {
+	// don't bother parsing normal responses
+	if !bytes.Contains(jsonResponseData, []byte(publicFolderCodePrefix)) {
+		return nil
+	}
+
+	msg, err := decodeJsonMessage(bytes.NewReader(jsonResponseData))
+	if err != nil {
+		return nil
+	}
+
+	body, _ := msg["Body"].(map[string]interface{})
+	fault := &owaFault{}
+	fault.ExceptionName, _ = body["ExceptionName"].(string)
+	fault.FaultMessage, _ = body["FaultMessage"].(string)
+	fault.ResponseCode, _ = body["ResponseCode"].(string)
+
+	if fault.ExceptionName == "" || !strings.HasPrefix(fault.ResponseCode, publicFolderCodePrefix) {
+		return nil
+	}
+	return fault
+}
+
+func (this *owaFault) faultValues() []soapFaultValue {
+	return []soapFaultValue{
+		{"OwaResponseCode", this.ResponseCode},
+		{"ExceptionName", this.ExceptionName},
+	}
+}
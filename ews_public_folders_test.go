@@ -0,0 +1,70 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestPublicFolderFault(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/FindFolder_publicfolders_refused.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fault := publicFolderFault(data); fault == nil || fault.ResponseCode != "ErrorPublicFolderMailboxDiscoveryFailed" {
+		t.Errorf("expected the public folder fault, got %+v", fault)
+	}
+
+	// a response message with a public folder error is translated as usual
+	message := []byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"ErrorPublicFolderRequestProcessingFailed","ResponseClass":"Error"}]}}}`)
+	if fault := publicFolderFault(message); fault != nil {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+}
+
+func TestPublicFolderFaultResponse(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/FindFolder_publicfolders_refused.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OnEwsTranslationError = func(transactionLog *bytes.Buffer) {
+		t.Error("the fault was handled as a translation error")
+	}
+
+	cctx := proxyutils.NewChainValues()
+	cctx.Set(ewsContextName, &ewsProxyContext{
+		EwsProxyOp:     EwsOperations["FindFolder"],
+		TransactionLog: new(bytes.Buffer),
+	})
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/owa/service.svc", nil)
+	response := proxyutils.CreateNewResponse(request, string(data))
+	response.StatusCode = http.StatusInternalServerError
+
+	if err = translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	for _, expected := range []string{
+		`<faultcode xmlns:a="http://schemas.microsoft.com/exchange/services/2006/types">a:ErrorPublicFolderRequestProcessingFailed</faultcode>`,
+		`Unable to find a public folder mailbox for the organization.`,
+		`Name="OwaResponseCode">ErrorPublicFolderMailboxDiscoveryFailed<`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("%s is missing from the fault:\n%s", expected, body)
+		}
+	}
+
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a 500, got %d", response.StatusCode)
+	}
+}
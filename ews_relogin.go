@@ -0,0 +1,133 @@
+package ews
+
+/*
+	When the OWA session expires, the user normally has to log in with the
+	browser again. With forms based authentication the login is a single
+	POST to auth.owa, so if the user allows it (AutoRelogin), that POST is
+	remembered and replayed when a timeout is detected. The form includes
+	the password, so it is only ever kept in memory.
+*/
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the forms based authentication endpoint
+const loginFormPath = "auth.owa"
+
+// a login form that was posted by the browser
+type recordedLogin struct {
+	// path and query of the form action, relative to the target server
+	Action string
+	Form   url.Values
+}
+
+func (this *recordedLogin) fieldNames() []string {
+	names := make([]string, 0, len(this.Form))
+	for name := range this.Form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type loginRecorder struct {
+	lock  sync.Mutex
+	login *recordedLogin
+}
+
+func (this *loginRecorder) get() *recordedLogin {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.login
+}
+
+func (this *loginRecorder) set(login *recordedLogin) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.login = login
+}
+
+func isLoginForm(request *http.Request) bool {
+	return request.Method == "POST" &&
+		strings.HasSuffix(strings.ToLower(request.URL.Path), loginFormPath)
+}
+
+// remembers the login form, the request body is replaced so that it can
+// still be sent
+func (this *LoginMiddleware) recordLogin(request *http.Request) error {
+	if request.Body == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		Log.Warn.Printf("Ignoring login form that could not be parsed: %s", err)
+		return nil
+	}
+
+	login := &recordedLogin{Action: request.URL.RequestURI(), Form: form}
+	Log.Info.Printf("Recorded login form %s (fields %s) for automatic login", login.Action, strings.Join(login.fieldNames(), ", "))
+	this.recorded.set(login)
+	return nil
+}
+
+// HasRecordedLogin returns true if there is a login form that Relogin can use
+func (this *LoginMiddleware) HasRecordedLogin() bool {
+	return this.recorded.get() != nil
+}
+
+// Relogin gets a new canary from CanarySource, or replays the last login
+// form that the browser posted. Returns true if that resulted in a valid
+// canary. After a failed login, Relogin fails without trying again until
+// the delay of acquireBackOff is over.
+func (this *LoginMiddleware) Relogin() bool {
+	this.acquireLock.Lock()
+	defer this.acquireLock.Unlock()
+	return this.relogin()
+}
+
+// called with acquireLock held
+func (this *LoginMiddleware) relogin() bool {
+	source := this.canarySource()
+	if source == nil {
+		return false
+	}
+
+	now := this.Translator.Clock.Now()
+	if wait := this.acquireBackOff.wait(now); wait > 0 {
+		Log.Debug.Printf("The last automatic login failed, not trying again for %s", wait)
+		return false
+	}
+	if now.Before(this.Translator.BackOffUntil()) {
+		return false
+	}
+
+	if err := this.acquire(source); err != nil {
+		delay := this.acquireBackOff.failed(now)
+		Log.Warn.Printf("Automatic login failed, not trying again for %s: %s", delay, err)
+		return false
+	}
+
+	Log.Info.Printf("Automatic login succeeded")
+	this.Translator.onSuccess()
+	return true
+}
@@ -0,0 +1,220 @@
+package ews
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/ewstest"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+type reloginTest struct {
+	owa        *ewstest.Server
+	translator *TranslationMiddleware
+	login      *LoginMiddleware
+	proxy      http.Handler
+}
+
+func newReloginTest(t *testing.T) (*reloginTest, func()) {
+	owa := ewstest.NewServer(nil)
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	login := &LoginMiddleware{
+		Translator:  translator,
+		Redirector:  redirector,
+		Transport:   http.DefaultTransport,
+		CheckPath:   "/owa/",
+		AutoRelogin: true,
+	}
+	login.CanaryFinder = login.CookieCanaryFinder
+	translator.Relogin = login.Relogin
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  http.DefaultTransport,
+		Translator: translator,
+		Redirector: redirector,
+		Login:      login,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &reloginTest{owa: owa, translator: translator, login: login, proxy: proxy}, owa.Close
+}
+
+// the user logs in with the browser
+func (this *reloginTest) browserLogin(t *testing.T) {
+	form := url.Values{
+		"destination": {"http://localhost:60001/owa/"},
+		"username":    {ewstest.DefaultUsername},
+		"password":    {ewstest.DefaultPassword},
+	}
+
+	request := httptest.NewRequest("POST", "http://localhost:60001/owa/auth.owa", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	this.proxy.ServeHTTP(w, request)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("login form returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	this.proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/owa/", nil))
+
+	if this.translator.OwaCanary == "" || this.translator.OwaCanary != this.owa.Canary() {
+		t.Fatalf("browser login did not set the canary, got %q", this.translator.OwaCanary)
+	}
+}
+
+// an EWS client request, while the session is expired
+func (this *reloginTest) ewsRequest(t *testing.T) int {
+	data, err := os.Open(filepath.Join("testdata", "requests", "ews_getfolder_comment.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	w := httptest.NewRecorder()
+	this.proxy.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", data))
+	return w.Code
+}
+
+func TestRelogin(t *testing.T) {
+	test, done := newReloginTest(t)
+	defer done()
+
+	test.browserLogin(t)
+
+	if !test.login.HasRecordedLogin() {
+		t.Fatal("the login form was not recorded")
+	}
+
+	loggedIn := make(chan bool, 1)
+	test.translator.OnEwsLogin = func() { loggedIn <- true }
+	test.translator.OnEwsTimeout = func() { loggedIn <- false }
+
+	test.owa.Expire()
+
+	if code := test.ewsRequest(t); code != 440 {
+		t.Errorf("expected the expired session to return 440, got %d", code)
+	}
+
+	select {
+	case ok := <-loggedIn:
+		if !ok {
+			t.Fatal("OnEwsTimeout was called instead of logging in again")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("automatic login did not happen")
+	}
+
+	if test.translator.OwaCanary != "canary2" || test.owa.Canary() != "canary2" {
+		t.Errorf("expected the new canary, got %q", test.translator.OwaCanary)
+	}
+
+	if !test.translator.isLoggedIn() {
+		t.Error("translator is not logged in after the automatic login")
+	}
+}
+
+func TestReloginFailsOver(t *testing.T) {
+	test, done := newReloginTest(t)
+	defer done()
+
+	test.browserLogin(t)
+
+	timedOut := make(chan bool, 1)
+	test.translator.OnEwsLogin = func() { timedOut <- false }
+	test.translator.OnEwsTimeout = func() { timedOut <- true }
+
+	// the password was changed, so the recorded form doesn't work anymore
+	test.owa.SetPassword("changed")
+	test.owa.Expire()
+
+	test.ewsRequest(t)
+
+	select {
+	case ok := <-timedOut:
+		if !ok {
+			t.Fatal("automatic login succeeded with the wrong password")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEwsTimeout was not called")
+	}
+
+	if logins := test.owa.Logins(); logins != 2 {
+		t.Errorf("expected one automatic login attempt, the server saw %d logins", logins)
+	}
+}
+
+func TestLoginNotRecordedByDefault(t *testing.T) {
+	test, done := newReloginTest(t)
+	defer done()
+
+	test.login.AutoRelogin = false
+	test.browserLogin(t)
+
+	if test.login.HasRecordedLogin() {
+		t.Error("the login form was recorded without AutoRelogin")
+	}
+
+	if test.login.Relogin() {
+		t.Error("Relogin succeeded without a recorded login")
+	}
+}
+
+// bypassed requests reach the server as the client sent them
+func TestLoginIgnoresBypassed(t *testing.T) {
+	test, done := newReloginTest(t)
+	defer done()
+
+	bypass, err := proxyutils.NewBypassMiddleware([]string{"/owa/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"destination": {"http://localhost:60001/owa/"},
+		"username":    {ewstest.DefaultUsername},
+		"password":    {ewstest.DefaultPassword},
+	}
+
+	request := httptest.NewRequest("POST", "http://localhost:60001/owa/auth.owa", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	cctx := proxyutils.NewChainValues()
+	bypass.RequestModifier(request.Context(), request, cctx)
+	if err = test.login.RequestModifier(request.Context(), request, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.login.HasRecordedLogin() {
+		t.Error("a bypassed login form was recorded")
+	}
+
+	// the login_ctx of the request isn't set
+	response := proxyutils.CreateNewResponse(request, "")
+	response.Header.Set("X-OWA-Canary", "canary")
+	if err = test.login.ResponseModifier(request.Context(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.translator.OwaCanary != "" {
+		t.Errorf("the canary of a bypassed response was taken, got %q", test.translator.OwaCanary)
+	}
+}
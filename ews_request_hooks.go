@@ -0,0 +1,84 @@
+package ews
+
+import (
+	"github.com/virtuald/go-ordered-json"
+)
+
+// operations that don't need the ChangeKey of the items that they act on,
+// and fail with ErrorStaleObject if it's out of date
+var changeKeyOperations = map[string]bool{
+	"DeleteItem": true,
+	"MoveItem":   true,
+	"SendItem":   true,
+}
+
+// stripItemChangeKeys removes the ChangeKey from every ItemId in a request
+func stripItemChangeKeys(op *OpDescriptor, body json.OrderedObject) json.OrderedObject {
+	return stripChangeKeys(body).(json.OrderedObject)
+}
+
+func stripChangeKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.OrderedObject:
+		isItemId := false
+		for _, member := range v {
+			if member.Key == "__type" && member.Value == "ItemId:#Exchange" {
+				isItemId = true
+				break
+			}
+		}
+
+		ret := v[:0]
+		for _, member := range v {
+			if isItemId && member.Key == "ChangeKey" {
+				continue
+			}
+			member.Value = stripChangeKeys(member.Value)
+			ret = append(ret, member)
+		}
+		return ret
+
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stripChangeKeys(item)
+		}
+	}
+
+	return value
+}
+
+// AddRequestHook registers a hook that modifies the translated JSON body of
+// requests for an operation. Hooks for the same operation are called in the
+// order that they were added.
+func (this *TranslationMiddleware) AddRequestHook(action string, hook RequestHookFunc) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.requestHooks == nil {
+		this.requestHooks = make(map[string][]RequestHookFunc)
+	}
+	this.requestHooks[action] = append(this.requestHooks[action], hook)
+}
+
+// called by SOAP2JSONWithHook for every request
+func (this *TranslationMiddleware) requestHook(op *OpDescriptor, body json.OrderedObject) json.OrderedObject {
+	if this.StripStaleChangeKeys && changeKeyOperations[op.Action] {
+		body = stripItemChangeKeys(op, body)
+	}
+	if this.SyncStates != nil && op.Action == "SyncFolderItems" {
+		body = this.expandSyncState(body)
+	}
+
+	this.lock.Lock()
+	hooks := this.requestHooks[op.Action]
+	this.lock.Unlock()
+
+	for _, hook := range hooks {
+		body = hook(op, body)
+	}
+
+	if this.CanonicalizeJSON {
+		body = CanonicalizeJSON(op, body)
+	}
+	return body
+}
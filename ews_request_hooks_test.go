@@ -0,0 +1,95 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const getItemRequest = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header><t:RequestServerVersion Version="Exchange2013_SP1"/></soap:Header>
+    <soap:Body>
+        <m:GetItem>
+            <m:ItemShape><t:BaseShape>IdOnly</t:BaseShape></m:ItemShape>
+            <m:ItemIds>
+                <t:ItemId Id="i2=" ChangeKey="c2="/>
+            </m:ItemIds>
+        </m:GetItem>
+    </soap:Body>
+</soap:Envelope>`
+
+// translates an EWS request, returns the JSON sent to OWA
+func translateRequest(t *testing.T, translator *TranslationMiddleware, ewsRequest []byte) string {
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(ewsRequest))
+	cctx := proxyutils.NewChainValues()
+	if err := translator.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatal(err)
+	}
+	releaseSlot(cctx)
+
+	data, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStripStaleChangeKeys(t *testing.T) {
+	moveItem, err := ioutil.ReadFile("testdata/requests/ews_moveitem_davmail.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	// off by default
+	if data := translateRequest(t, translator, moveItem); !strings.Contains(data, `"ChangeKey":"c2="`) {
+		t.Errorf("ChangeKey should not be removed by default: %s", data)
+	}
+
+	translator.StripStaleChangeKeys = true
+
+	data := translateRequest(t, translator, moveItem)
+	if strings.Contains(data, `"ChangeKey":"c2="`) {
+		t.Errorf("ItemId ChangeKey was not removed: %s", data)
+	}
+
+	// only ItemIds are changed, the folder still has its ChangeKey
+	if !strings.Contains(data, `"ChangeKey":"c1="`) {
+		t.Errorf("FolderId ChangeKey should not be removed: %s", data)
+	}
+
+	// other operations are not modified
+	if data := translateRequest(t, translator, []byte(getItemRequest)); !strings.Contains(data, `"ChangeKey":"c2="`) {
+		t.Errorf("GetItem ChangeKey should not be removed: %s", data)
+	}
+}
+
+func TestAddRequestHook(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	called := 0
+	translator.AddRequestHook("GetItem", stripItemChangeKeys)
+	translator.AddRequestHook("GetItem", func(op *OpDescriptor, body json.OrderedObject) json.OrderedObject {
+		called++
+		return body
+	})
+
+	data := translateRequest(t, translator, []byte(getItemRequest))
+	if strings.Contains(data, "ChangeKey") {
+		t.Errorf("hook was not applied: %s", data)
+	}
+
+	if called != 1 {
+		t.Errorf("second hook called %d times", called)
+	}
+}
@@ -1,14 +1,28 @@
 package ews
 
-// this doesn't actually close the window unless it's a popup window
-var closePageHtml = `
+// shown at /close.html and /proxyclose.html after the login, see ClosePage.
+// window.close() doesn't actually close the window unless it's a popup window
+var defaultClosePageHtml = `
 <html>
-  <head><title>Successful OWA login</title></head>
+  <head><title>{{if .Authenticated}}Successful OWA login{{else}}OWA login{{end}}</title></head>
+  {{- if .Authenticated}}
   <script type='text/javascript'>
     window.close();
   </script>
+  {{- end}}
   <body>
+    {{- if .Authenticated}}
     <p>Login to Exchange successful!</p>
+    {{- if eq .State "degraded"}}
+    <p>{{.TargetHost}} is not answering at the moment.</p>
+    {{- end}}
+    {{- else if eq .State "expired"}}
+    <p>The session with {{.TargetHost}} has expired.</p>
+    <p><a href="/owa/">Reconnect</a></p>
+    {{- else}}
+    <p>Not logged in to {{.TargetHost}}.</p>
+    <p><a href="/owa/">Reconnect</a></p>
+    {{- end}}
   </body>
 </html>
 `
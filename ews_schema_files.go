@@ -0,0 +1,88 @@
+package ews
+
+/*
+	EWS clients (the Managed API in particular) fetch Services.wsdl and the
+	schemas next to exchange.asmx before they send anything. OWA doesn't have
+	them, so the copies that ews_data.go is generated from are served. The
+	WSDL that we have doesn't say where the service is, so the service
+	element is added with the URL of the proxy.
+*/
+
+import (
+	"embed"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+//go:embed codegen/services.wsdl codegen/messages.xsd codegen/types.xsd codegen/xml.xsd
+var schemaFiles embed.FS
+
+// key is the lower case file name in the EWS directory
+var schemaFileNames = map[string]string{
+	"services.wsdl": "codegen/services.wsdl",
+	"messages.xsd":  "codegen/messages.xsd",
+	"types.xsd":     "codegen/types.xsd",
+	"xml.xsd":       "codegen/xml.xsd",
+}
+
+const wsdlServiceFormat = `    <wsdl:service name="ExchangeServices">
+        <wsdl:port name="ExchangeServicePort" binding="tns:ExchangeServiceBinding">
+            <soap:address location="%s"/>
+        </wsdl:port>
+    </wsdl:service>
+</wsdl:definitions>`
+
+// returns the response for a GET of one of the schema files, or nil if the
+// request isn't for one of them
+func (this *TranslationMiddleware) schemaResponse(request *http.Request) *http.Response {
+	dir, name := path.Split(request.URL.Path)
+	if !strings.EqualFold(path.Clean(dir), path.Dir(this.EwsPath)) {
+		return nil
+	}
+
+	file, ok := schemaFileNames[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+
+	data, err := schemaFiles.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	content := string(data)
+	if strings.HasSuffix(file, ".wsdl") {
+		content = setServiceLocation(content, this.serviceUrl(request))
+	}
+
+	response := proxyutils.CreateNewResponse(request, content)
+	response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return response
+}
+
+// the EWS URL that clients use, on SourceServer or the host they asked for
+func (this *TranslationMiddleware) serviceUrl(request *http.Request) string {
+	source := this.SourceServer
+	if source == nil {
+		scheme := "http"
+		if request.TLS != nil {
+			scheme = "https"
+		}
+		source = &url.URL{Scheme: scheme, Host: request.Host}
+	}
+	return source.ResolveReference(&url.URL{Path: this.EwsPath}).String()
+}
+
+func setServiceLocation(wsdl string, location string) string {
+	end := strings.LastIndex(wsdl, "</wsdl:definitions>")
+	if end == -1 {
+		return wsdl
+	}
+	return wsdl[:end] + fmt.Sprintf(wsdlServiceFormat, html.EscapeString(location)) + wsdl[end+len("</wsdl:definitions>"):]
+}
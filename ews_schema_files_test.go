@@ -0,0 +1,96 @@
+package ews
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// GETs a path from the translator, returns the body and content type
+func getSchemaFile(t *testing.T, translator *TranslationMiddleware, u string) (string, string) {
+	request, _ := http.NewRequest("GET", u, nil)
+
+	err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	re, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("%s: expected a response, got %v", u, err)
+	}
+
+	if re.Response.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", u, re.Response.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(re.Response.Body)
+	return string(body), re.Response.Header.Get("Content-Type")
+}
+
+// returns the location of the soap:address in a WSDL, or "" if there isn't
+// one. Fails the test if the file isn't valid XML.
+func wsdlLocation(t *testing.T, wsdl string) string {
+	decoder := xml.NewDecoder(strings.NewReader(wsdl))
+	location := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return location
+		} else if err != nil {
+			t.Fatalf("WSDL is not valid XML: %s", err)
+		}
+
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "address" {
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "location" {
+					location = attr.Value
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaFiles(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.SourceServer, _ = url.Parse("https://ews.example.com:8443")
+
+	for _, path := range []string{"/ews/Services.wsdl", "/ews/types.xsd", "/EWS/messages.xsd", "/ews/xml.xsd"} {
+		body, contentType := getSchemaFile(t, translator, "http://localhost:60001"+path)
+
+		if contentType != "text/xml; charset=utf-8" {
+			t.Errorf("%s: unexpected content type %s", path, contentType)
+		}
+
+		if len(body) == 0 {
+			t.Errorf("%s: empty file", path)
+		}
+		wsdlLocation(t, body)
+	}
+
+	wsdl, _ := getSchemaFile(t, translator, "http://localhost:60001/ews/Services.wsdl")
+	if location := wsdlLocation(t, wsdl); location != "https://ews.example.com:8443/ews/exchange.asmx" {
+		t.Errorf("unexpected service location %q", location)
+	}
+
+	// without SourceServer, the host of the request is used
+	translator.SourceServer = nil
+	wsdl, _ = getSchemaFile(t, translator, "http://localhost:60001/ews/Services.wsdl")
+	if location := wsdlLocation(t, wsdl); location != "http://localhost:60001/ews/exchange.asmx" {
+		t.Errorf("unexpected service location %q", location)
+	}
+
+	// exchange.asmx itself is the service page, see ews_service_page_test.go
+	if _, contentType := getSchemaFile(t, translator, "http://localhost:60001/ews/exchange.asmx"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type for exchange.asmx: %s", contentType)
+	}
+
+	// anything else is left to OWA
+	request, _ := http.NewRequest("GET", "http://localhost:60001/ews/other.xsd", nil)
+	if err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Errorf("unexpected response for other.xsd: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package ews
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ServerInfo records the version of the upstream exchange server, as seen
+// in the headers of its responses. Needed when troubleshooting translation
+// bugs.
+type ServerInfo struct {
+	lock     sync.Mutex
+	version  string // X-OWA-Version
+	frontEnd string // X-FEServer
+}
+
+// Update records the server headers in header, if present
+func (this *ServerInfo) Update(header http.Header) {
+	version := header.Get("X-OWA-Version")
+	frontEnd := header.Get("X-FEServer")
+	if version == "" && frontEnd == "" {
+		return
+	}
+
+	this.lock.Lock()
+	changed := version != "" && version != this.version
+	if version != "" {
+		this.version = version
+	}
+	// behind a load balancer this changes all the time, so it isn't logged
+	if frontEnd != "" {
+		this.frontEnd = frontEnd
+	}
+	this.lock.Unlock()
+
+	if changed {
+		Log.Info.Printf("Exchange server version %s (front end %s)", version, frontEnd)
+	}
+}
+
+// Version returns the exchange build and the name of the front end server
+// that last responded, either may be empty if it hasn't been seen yet
+func (this *ServerInfo) Version() (version string, frontEnd string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.version, this.frontEnd
+}
+
+func (this *ServerInfo) String() string {
+	version, frontEnd := this.Version()
+	if version == "" {
+		version = "unknown"
+	}
+	if frontEnd == "" {
+		frontEnd = "unknown"
+	}
+	return "Exchange version " + version + ", front end " + frontEnd
+}
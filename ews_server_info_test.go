@@ -0,0 +1,147 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestServerInfo(t *testing.T) {
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-OWA-Version", "15.1.2507.6")
+		w.Header().Set("X-FEServer", "EXFE01")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	login := &LoginMiddleware{
+		Translator: translator,
+		Redirector: redirector,
+		CheckPath:  "/owa/",
+	}
+	login.CanaryFinder = login.CookieCanaryFinder
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Translator: translator,
+		Redirector: redirector,
+		Login:      login,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the login page is where the headers are first seen
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/owa/", nil))
+
+	if version, frontEnd := translator.Server.Version(); version != "15.1.2507.6" || frontEnd != "EXFE01" {
+		t.Errorf("headers were not captured: %q %q", version, frontEnd)
+	}
+
+	// exposed in /status
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/status", nil))
+
+	var status map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %q: %s", w.Body.String(), err)
+	}
+
+	if status["exchangeVersion"] != "15.1.2507.6" || status["exchangeFrontEnd"] != "EXFE01" {
+		t.Errorf("unexpected status %s", w.Body.String())
+	}
+
+	// and in the transaction log of failed requests
+	var transactionLog string
+	translator.OwaCanary = "canary"
+	translator.OnEwsTranslationError = func(buf *bytes.Buffer) {
+		transactionLog = buf.String()
+	}
+
+	request := httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader("<invalid"))
+	translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+
+	if !strings.HasPrefix(transactionLog, "Exchange version 15.1.2507.6, front end EXFE01\n") {
+		t.Errorf("server version missing from the transaction log:\n%s", transactionLog)
+	}
+}
+
+func TestClockSkewStatus(t *testing.T) {
+	// an exchange server with a clock that is 40 minutes slow
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-40*time.Minute).UTC().Format(http.TimeFormat))
+		w.Write([]byte(`{"Body": {"ResponseMessages": {"Items": []}}}`))
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	login := &LoginMiddleware{
+		Translator: translator,
+		Redirector: redirector,
+		CheckPath:  "/owa/",
+	}
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Translator: translator,
+		Redirector: redirector,
+		Login:      login,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CheckLogin talks to the server directly
+	login.CheckLogin("canary")
+
+	if !translator.Skew.Exceeded() {
+		t.Error("skew was not captured by CheckLogin")
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:60001/status", nil))
+
+	var status map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %q: %s", w.Body.String(), err)
+	}
+
+	if status["clockSkewWarning"] != true || !strings.HasPrefix(status["clockSkew"].(string), "-") {
+		t.Errorf("unexpected status %s", w.Body.String())
+	}
+
+	var transactionLog string
+	translator.OwaCanary = "canary"
+	translator.OnEwsTranslationError = func(buf *bytes.Buffer) {
+		transactionLog = buf.String()
+	}
+
+	request := httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader("<invalid"))
+	translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+
+	if !strings.Contains(transactionLog, "ahead of the exchange server") {
+		t.Errorf("clock skew missing from the transaction log:\n%s", transactionLog)
+	}
+}
@@ -0,0 +1,63 @@
+package ews
+
+/*
+	Clients check that EWS is up with a GET, a HEAD or an OPTIONS request to
+	exchange.asmx before they send anything, and some of them decide that the
+	server is broken when the answer is empty. Exchange answers the GET with
+	a page about the service, so a short one is returned here, and the other
+	methods get what a web server would say. None of them go to OWA, which
+	doesn't know the path.
+*/
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// the methods that the EWS path answers
+const ewsAllowedMethods = "GET, HEAD, POST, OPTIONS"
+
+const servicePageFormat = `<!DOCTYPE html>
+<html>
+<head><title>Exchange Web Services</title></head>
+<body>
+<h1>Exchange Web Services</h1>
+<p>This is the EWS endpoint of ews-proxy at %s, SOAP requests are sent to it with POST.</p>
+<p>The service is described by <a href="Services.wsdl">Services.wsdl</a>.</p>
+</body>
+</html>
+`
+
+// returns the response for a request to the EWS path that isn't a POST, or
+// nil if the request is a POST or uses a method that isn't allowed
+func (this *TranslationMiddleware) ewsPathResponse(request *http.Request) *http.Response {
+	var response *http.Response
+
+	switch request.Method {
+	case "GET", "HEAD":
+		page := fmt.Sprintf(servicePageFormat, html.EscapeString(this.serviceUrl(request)))
+		response = proxyutils.CreateNewResponse(request, page)
+		response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		response.Header.Set("Content-Length", strconv.Itoa(len(page)))
+
+		// the headers of the GET, without the page
+		if request.Method == "HEAD" {
+			response.Body = http.NoBody
+		}
+
+	case "OPTIONS":
+		response = proxyutils.CreateNewResponse(request, "")
+		response.Header.Set("Allow", ewsAllowedMethods)
+		response.Header.Set("Content-Length", "0")
+
+	default:
+		return nil
+	}
+
+	response.Header.Set("Cache-Control", "no-cache")
+	return response
+}
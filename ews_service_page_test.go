@@ -0,0 +1,83 @@
+package ews
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestEwsPathProbes(t *testing.T) {
+	// nothing should get to OWA
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected %s %s to OWA", r.Method, r.URL)
+	}))
+	defer owa.Close()
+
+	target, _ := url.Parse(owa.URL)
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	server := httptest.NewUnstartedServer(nil)
+	source, _ := url.Parse("http://" + server.Listener.Addr().String())
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  &http.Transport{},
+		Translator: translator,
+		Redirector: redirector,
+		Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.Handler = proxy
+	server.Start()
+	defer server.Close()
+
+	var getLength int64
+	for _, method := range []string{"GET", "HEAD", "OPTIONS"} {
+		request, _ := http.NewRequest(method, server.URL+"/EWS/Exchange.asmx", nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", method, response.StatusCode)
+		}
+		if response.Header.Get("WWW-Authenticate") != "" {
+			t.Errorf("%s: unexpected WWW-Authenticate %q", method, response.Header.Get("WWW-Authenticate"))
+		}
+
+		switch method {
+		case "GET":
+			getLength = response.ContentLength
+			if response.Header.Get("Content-Type") != "text/html; charset=utf-8" || int64(len(body)) != getLength {
+				t.Errorf("GET: unexpected %q, %d bytes of %d", response.Header.Get("Content-Type"), len(body), getLength)
+			}
+			if !strings.Contains(string(body), server.URL+"/ews/exchange.asmx") || !strings.Contains(string(body), `href="Services.wsdl"`) {
+				t.Errorf("GET: unexpected page\n%s", body)
+			}
+		case "HEAD":
+			if response.ContentLength != getLength || response.Header.Get("Content-Type") != "text/html; charset=utf-8" || len(body) != 0 {
+				t.Errorf("HEAD: expected the headers of the GET, got %d %q", response.ContentLength, response.Header.Get("Content-Type"))
+			}
+		case "OPTIONS":
+			if allow := response.Header.Get("Allow"); allow != "GET, HEAD, POST, OPTIONS" {
+				t.Errorf("OPTIONS: unexpected Allow %q", allow)
+			}
+			if response.ContentLength != 0 {
+				t.Errorf("OPTIONS: unexpected Content-Length %d", response.ContentLength)
+			}
+		}
+	}
+}
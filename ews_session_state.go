@@ -0,0 +1,97 @@
+package ews
+
+/*
+	Users don't notice that the proxy has lost its OWA session, they just
+	see that mail stops syncing. The translator keeps track of the state of
+	the session, and calls OnStateChange when it changes, so that the user
+	can be told (see -notify and -reopenBrowser of cmd/ews-proxy). The close
+	page and the status show the current state.
+
+		Unauthenticated  nobody has logged in yet
+		Authenticated    the canary works
+		Degraded         logged in, but the last few requests to OWA (or
+		                 keepalives) failed with network or gateway errors
+		Expired          the session was logged out: OWA answered with 440,
+		                 or a login check invalidated the canary
+
+	Network errors of translated requests that the chained proxy gives up on
+	are not seen by the translator, the keepalive finds those.
+*/
+
+import (
+	"net/http"
+)
+
+// SessionState is the state of the OWA session, see ews_session_state.go
+type SessionState string
+
+const (
+	SessionUnauthenticated SessionState = "unauthenticated"
+	SessionAuthenticated   SessionState = "authenticated"
+	SessionDegraded        SessionState = "degraded"
+	SessionExpired         SessionState = "expired"
+)
+
+// how many network errors in a row make an authenticated session degraded
+const degradedAfterErrors = 3
+
+// SessionState returns the current state of the OWA session
+func (this *TranslationMiddleware) SessionState() SessionState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.sessionState
+}
+
+// changes the state, if the current one is one of from (or from is empty),
+// and calls OnStateChange if it changed. Transitions are serialized so that
+// the callback sees them in order.
+func (this *TranslationMiddleware) changeSessionState(state SessionState, from ...SessionState) {
+	this.stateLock.Lock()
+	defer this.stateLock.Unlock()
+
+	this.lock.Lock()
+	old := this.sessionState
+	if state == SessionAuthenticated {
+		this.networkErrors = 0
+	}
+	allowed := len(from) == 0
+	for _, f := range from {
+		allowed = allowed || f == old
+	}
+	if old == state || !allowed {
+		this.lock.Unlock()
+		return
+	}
+	this.sessionState = state
+	this.lock.Unlock()
+
+	this.OnStateChange(old, state)
+}
+
+// clears OwaCanary, after a login check found that it doesn't work
+func (this *TranslationMiddleware) invalidateCanary() {
+	this.lock.Lock()
+	this.OwaCanary = ""
+	this.lock.Unlock()
+
+	this.changeSessionState(SessionExpired, SessionAuthenticated, SessionDegraded)
+}
+
+// counts a request to OWA that failed because of the network, or of a
+// gateway in front of OWA
+func (this *TranslationMiddleware) onNetworkError() {
+	this.lock.Lock()
+	this.networkErrors++
+	degraded := this.networkErrors >= degradedAfterErrors
+	this.lock.Unlock()
+
+	if degraded {
+		this.changeSessionState(SessionDegraded, SessionAuthenticated)
+	}
+}
+
+// status codes of gateways that couldn't reach OWA
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
@@ -0,0 +1,127 @@
+package ews
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/ewstest"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestSessionStateChanges(t *testing.T) {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+	if err := owa.RespondWithFile("GetItem", "testdata/responses/GetItem_owa.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	login := &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"}
+	proxy, err := NewProxy(&ProxyOptions{Translator: translator, Redirector: redirector, Login: login})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var changes []string
+	translator.OnStateChange = func(old, new SessionState) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, fmt.Sprintf("%s -> %s", old, new))
+	}
+
+	getItem := func() int {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(getItemRequest)))
+		return w.Code
+	}
+
+	expectState := func(step string, state SessionState) {
+		if current := translator.SessionState(); current != state {
+			t.Errorf("%s: expected %s, got %s", step, state, current)
+		}
+		if status := translator.Status(); status.State != state {
+			t.Errorf("%s: the status has %s", step, status.State)
+		}
+	}
+
+	expectState("before the login", SessionUnauthenticated)
+
+	login.CheckLogin(owa.Login())
+	expectState("login", SessionAuthenticated)
+
+	if code := getItem(); code != http.StatusOK {
+		t.Fatalf("expected the GetItem response, got %d", code)
+	}
+
+	// a few gateway errors in a row, then the server answers again
+	for i := 0; i < degradedAfterErrors; i++ {
+		owa.Fail("GetItem", ewstest.ServiceUnavailable)
+		getItem()
+		if i < degradedAfterErrors-1 {
+			expectState(fmt.Sprintf("error %d", i+1), SessionAuthenticated)
+		}
+	}
+	expectState("errors", SessionDegraded)
+
+	getItem()
+	expectState("recovered", SessionAuthenticated)
+
+	// OWA logs the session out
+	owa.Expire()
+	if code := getItem(); code != 440 {
+		t.Errorf("expected a 440, got %d", code)
+	}
+	expectState("logged out", SessionExpired)
+
+	login.CheckLogin(owa.Login())
+	expectState("login again", SessionAuthenticated)
+
+	// the keepalive is rejected
+	owa.Respond("GetFolder", []byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"ErrorAccessDenied","ResponseClass":"Error"}]}}}`))
+	login.CheckLogin(translator.OwaCanary)
+	expectState("invalidated", SessionExpired)
+
+	expected := []string{
+		"unauthenticated -> authenticated",
+		"authenticated -> degraded",
+		"degraded -> authenticated",
+		"authenticated -> expired",
+		"expired -> authenticated",
+		"authenticated -> expired",
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(changes, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("unexpected changes:\n%s", strings.Join(changes, "\n"))
+	}
+}
+
+func TestSessionStateNotLoggedIn(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OnStateChange = func(old, new SessionState) {
+		t.Errorf("unexpected change %s -> %s", old, new)
+	}
+
+	// a canary that never worked doesn't expire, and there's nothing to
+	// degrade
+	translator.invalidateCanary()
+	translator.onTimeout()
+	for i := 0; i < degradedAfterErrors; i++ {
+		translator.onNetworkError()
+	}
+
+	if state := translator.SessionState(); state != SessionUnauthenticated {
+		t.Errorf("expected %s, got %s", SessionUnauthenticated, state)
+	}
+}
@@ -0,0 +1,107 @@
+package ews
+
+/*
+	Some settings can be changed without restarting the proxy (which would
+	mean logging in again). They are read from a JSON file such as
+
+		{
+			"debug": true,
+			"bypass": ["/owa/ev.owa*"],
+			"denyActions": ["SendItem"],
+			"keepAlivePeriod": "5m"
+		}
+
+	which is read again when Reloader.Reload is called (on SIGHUP). Settings
+	that aren't in the file are left as they are. The listen addresses and
+	the exchange server cannot be changed this way.
+*/
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
+	"github.com/virtuald/go-ordered-json"
+)
+
+// Settings are the contents of a settings file, nil fields weren't given
+type Settings struct {
+	Debug           *bool    `json:"debug"`
+	BypassPaths     []string `json:"bypass"`
+	AllowActions    []string `json:"allowActions"`
+	DenyActions     []string `json:"denyActions"`
+	KeepAlivePeriod string   `json:"keepAlivePeriod"`
+}
+
+func LoadSettings(path string) (*Settings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &Settings{}
+	if err = json.Unmarshal(data, settings); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	return settings, nil
+}
+
+// Reloader applies a settings file to the running proxy
+type Reloader struct {
+	Path       string
+	Translator *TranslationMiddleware
+
+	// optional, the settings for these are ignored if they're nil
+	Login   *LoginMiddleware
+	Bypass  *proxyutils.BypassMiddleware
+	Cookies *proxyutils.BoundedCookieJar
+}
+
+// Reload reads the settings file and applies it. If the file cannot be read
+// or one of the settings is invalid, nothing is changed.
+func (this *Reloader) Reload() error {
+	settings, err := LoadSettings(this.Path)
+	if err != nil {
+		return err
+	}
+
+	// check everything before changing anything
+	var keepAlive time.Duration
+	if settings.KeepAlivePeriod != "" {
+		if keepAlive, err = time.ParseDuration(settings.KeepAlivePeriod); err != nil {
+			return errors.Wrap(err, "keepAlivePeriod")
+		}
+	}
+
+	var policy *ActionPolicy
+	changePolicy := settings.AllowActions != nil || settings.DenyActions != nil
+	if len(settings.AllowActions) != 0 || len(settings.DenyActions) != 0 {
+		if policy, err = NewActionPolicy(settings.AllowActions, settings.DenyActions); err != nil {
+			return err
+		}
+	}
+
+	if settings.BypassPaths != nil && this.Bypass != nil {
+		if err = this.Bypass.SetPaths(settings.BypassPaths); err != nil {
+			return err
+		}
+	}
+
+	if settings.Debug != nil {
+		this.Translator.SetDebug(*settings.Debug)
+		if this.Cookies != nil {
+			this.Cookies.SetDebug(*settings.Debug)
+		}
+	}
+
+	if changePolicy {
+		this.Translator.SetPolicy(policy)
+	}
+
+	if settings.KeepAlivePeriod != "" && this.Login != nil {
+		this.Login.SetKeepAlivePeriod(keepAlive)
+	}
+
+	return nil
+}
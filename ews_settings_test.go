@@ -0,0 +1,147 @@
+package ews
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// returns a Reloader for a settings file in dir
+func newTestReloader(dir string) *Reloader {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	bypass, _ := proxyutils.NewBypassMiddleware(nil)
+
+	return &Reloader{
+		Path:       filepath.Join(dir, "settings.json"),
+		Translator: translator,
+		Login:      &LoginMiddleware{Translator: translator},
+		Bypass:     bypass,
+		Cookies:    proxyutils.NewBoundedCookieJar(),
+	}
+}
+
+func writeSettings(t *testing.T, reloader *Reloader, settings string) {
+	if err := ioutil.WriteFile(reloader.Path, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadDebug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	reloader := newTestReloader(dir)
+
+	writeSettings(t, reloader, `{"debug": false}`)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	translateRequest(t, reloader.Translator, []byte(getItemRequest))
+	if strings.Contains(logBuf.String(), "EWS question") {
+		t.Errorf("request was logged without debug:\n%s", logBuf)
+	}
+
+	writeSettings(t, reloader, `{"debug": true}`)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	translateRequest(t, reloader.Translator, []byte(getItemRequest))
+	if !strings.Contains(logBuf.String(), "EWS question") || !strings.Contains(logBuf.String(), "<m:GetItem>") {
+		t.Errorf("request was not logged after debug was enabled:\n%s", logBuf)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reloader := newTestReloader(dir)
+	defer reloader.Login.SetKeepAlivePeriod(0)
+
+	writeSettings(t, reloader, `{
+		"bypass": ["/owa/ev.owa*"],
+		"denyActions": ["SendItem"],
+		"keepAlivePeriod": "1h"
+	}`)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reloader.Bypass.Matches("/owa/ev.owa2") {
+		t.Error("bypass paths were not changed")
+	}
+
+	if policy := reloader.Translator.actionPolicy(); policy == nil || policy.Allowed("SendItem") {
+		t.Error("action policy was not changed")
+	}
+
+	if reloader.Login.KeepAlivePeriod != time.Hour || reloader.Login.keepAliveTicker == nil {
+		t.Error("keepalive was not started with the new period")
+	}
+
+	// settings that aren't given are left alone, empty lists clear them
+	writeSettings(t, reloader, `{"denyActions": []}`)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloader.Translator.actionPolicy() != nil {
+		t.Error("action policy was not removed")
+	}
+
+	if !reloader.Bypass.Matches("/owa/ev.owa2") || reloader.Login.KeepAlivePeriod != time.Hour {
+		t.Error("settings that weren't given were changed")
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reloader := newTestReloader(dir)
+
+	for _, settings := range []string{
+		`{"debug": true, "bypass": ["/owa/["]}`,
+		`{"debug": true, "denyActions": ["SendItems"]}`,
+		`{"debug": true, "keepAlivePeriod": "often"}`,
+		`{"debug": true`,
+	} {
+		writeSettings(t, reloader, settings)
+		if err = reloader.Reload(); err == nil {
+			t.Errorf("expected an error for %s", settings)
+		}
+
+		if reloader.Translator.isDebug() {
+			t.Errorf("settings were applied even though %s is invalid", settings)
+		}
+	}
+
+	os.Remove(reloader.Path)
+	if err = reloader.Reload(); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,175 @@
+package ews
+
+/*
+	Shadow mode is used to validate the translator against a server that
+	still has EWS enabled: each SOAP request is sent unmodified to the native
+	EWS endpoint as well as being translated and sent to OWA. The translated
+	response is compared with the native one, and the differences are logged.
+	The client always gets the native response, so a translation bug can't
+	hurt it.
+
+	Only the operations that read the mailbox are shadowed. The others
+	(CreateItem, SendItem, DeleteItem...) would run twice, once through OWA
+	and once on the native endpoint, so they are only translated.
+
+	This is experimental.
+*/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/virtuald/ews-proxy/comparison"
+)
+
+// headers from the client request that are sent to the native endpoint
+var shadowRequestHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"SOAPAction",
+	"User-Agent",
+}
+
+// ShadowEws sends requests to a native EWS endpoint, see
+// TranslationMiddleware.Shadow
+type ShadowEws struct {
+	// URL of the native EWS endpoint (https://server/EWS/Exchange.asmx)
+	Url string
+
+	// If set, used instead of the client's Authorization header
+	Username string
+	Password string
+
+	// default is http.DefaultClient
+	Client *http.Client
+
+	// controls what is ignored when comparing the responses, default is
+	// comparison.DefaultSoapOptions
+	Options *comparison.SoapOptions
+}
+
+func NewShadowEws(url string) *ShadowEws {
+	return &ShadowEws{
+		Url:     url,
+		Options: comparison.DefaultSoapOptions,
+	}
+}
+
+// returns true for the operations that only read the mailbox
+func shadowedAction(action string) bool {
+	switch action {
+	case "ResolveNames", "GetUserAvailability":
+		return true
+	}
+
+	for _, prefix := range []string{"Get", "Find", "Sync"} {
+		if strings.HasPrefix(action, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if the request for action is sent to the native endpoint:
+// it only reads the mailbox, and the proxy doesn't refuse it
+func (this *TranslationMiddleware) shadowAllowed(action string) bool {
+	if this.Shadow == nil || !shadowedAction(action) {
+		return false
+	}
+	if _, declined := this.DeclinedOperations[action]; declined {
+		return false
+	}
+	if experimentalOperations[action] && !this.Experimental {
+		return false
+	}
+	policy := this.actionPolicy()
+	return policy == nil || policy.Allowed(action)
+}
+
+type shadowResult struct {
+	response *http.Response
+	body     []byte
+	err      error
+}
+
+// send posts the SOAP request to the native endpoint in the background. The
+// channel is buffered, so nobody has to wait for the result.
+func (this *ShadowEws) send(soap []byte, header http.Header) <-chan *shadowResult {
+	result := make(chan *shadowResult, 1)
+
+	request, err := http.NewRequest("POST", this.Url, bytes.NewReader(soap))
+	if err != nil {
+		result <- &shadowResult{err: err}
+		return result
+	}
+
+	for _, name := range shadowRequestHeaders {
+		if value := header.Get(name); value != "" {
+			request.Header.Set(name, value)
+		}
+	}
+
+	if this.Username != "" {
+		request.SetBasicAuth(this.Username, this.Password)
+	}
+
+	client := this.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	go func() {
+		response, err := client.Do(request)
+		if err != nil {
+			result <- &shadowResult{err: err}
+			return
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		result <- &shadowResult{response: response, body: body, err: err}
+	}()
+
+	return result
+}
+
+// useShadowResponse waits for the native response, logs the differences
+// between it and translated (nil if the translation of the request or of
+// the response failed), and replaces response with it. If the native
+// request failed, response is left alone.
+func (this *TranslationMiddleware) useShadowResponse(ctx *ewsProxyContext, action string, response *http.Response, translated []byte) {
+	result := <-ctx.shadow
+
+	if result.err != nil {
+		Log.Warn.Printf("Shadow: %s: native request failed: %s", action, result.err)
+		this.appendTransaction(ctx, "Shadow: native request failed: "+result.err.Error())
+		return
+	}
+
+	this.appendTransaction(ctx, "Shadow: native EWS response:")
+	this.appendTransaction(ctx, string(result.body))
+
+	if translated == nil {
+		Log.Warn.Printf("Shadow: %s: translation failed, native response was %s", action, result.response.Status)
+	} else {
+		diffString, err := comparison.DiffSoap(result.body, translated, this.Shadow.Options)
+		if err == comparison.ErrDifferent {
+			Log.Warn.Printf("Shadow: %s: translated response differs from native response\n%s", action, diffString)
+			this.appendTransaction(ctx, "Shadow: translated response differs:")
+			this.appendTransaction(ctx, diffString)
+		} else if err != nil {
+			Log.Warn.Printf("Shadow: %s: cannot compare responses: %s", action, err)
+		} else if this.isDebug() {
+			Log.Debug.Printf("Shadow: %s: translated response matches", action)
+		}
+	}
+
+	response.StatusCode = result.response.StatusCode
+	response.Status = result.response.Status
+	response.Header = result.response.Header
+	response.Header.Del("Content-Length")
+	response.Body = ioutil.NopCloser(bytes.NewReader(result.body))
+	response.ContentLength = int64(len(result.body))
+}
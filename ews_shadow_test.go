@@ -0,0 +1,217 @@
+package ews
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestShadowMode(t *testing.T) {
+	owaResponse, err := ioutil.ReadFile("testdata/responses/GetFolder_simple.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translated, err := ioutil.ReadFile("testdata/responses/GetFolder_simple.json.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the native server disagrees about the unread count, and has a different
+	// ChangeKey (which should be ignored)
+	nativeResponse := strings.Replace(string(translated), "<t:UnreadCount>291<", "<t:UnreadCount>290<", 1)
+	nativeResponse = strings.Replace(nativeResponse, `ChangeKey="AQAAABYAAABMwfD+`, `ChangeKey="BQAAABYAAABMwfD+`, 1)
+
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Action") != "GetFolder" {
+			t.Errorf("OWA got unexpected action %q", r.Header.Get("Action"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(owaResponse)
+	}))
+	defer owa.Close()
+
+	native := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !bytes.Contains(body, []byte("GetFolder")) {
+			t.Error("native server didn't get the SOAP request")
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(nativeResponse))
+	}))
+	defer native.Close()
+
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.Shadow = NewShadowEws(native.URL + "/EWS/Exchange.asmx")
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := proxyutils.CreateChainedProxy("test", discard, discard, discard, discard, discard,
+		nil, http.DefaultTransport, translator, proxyutils.NewRedirectorMiddleware(source, target))
+
+	data, err := ioutil.ReadFile("testdata/requests/ews_getfolder_root_davmail.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+	response, err := chain.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != nativeResponse {
+		t.Errorf("client should get the native response, got:\n%s", body)
+	}
+
+	logged := logBuf.String()
+	if !strings.Contains(logged, "translated response differs") || !strings.Contains(logged, "UnreadCount") {
+		t.Errorf("difference was not logged:\n%s", logged)
+	}
+
+	if strings.Contains(logged, "ChangeKey") {
+		t.Errorf("ChangeKey difference should be ignored:\n%s", logged)
+	}
+}
+
+// a proxy in shadow mode, and the number of requests that the native
+// endpoint got
+func newShadowChain(t *testing.T, nativeResponse string) (http.RoundTripper, *TranslationMiddleware, func() int, func()) {
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"NoError","ResponseClass":"Success"}]}}}`))
+	}))
+
+	var lock sync.Mutex
+	requests := 0
+	native := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(nativeResponse))
+	}))
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.Shadow = NewShadowEws(native.URL + "/EWS/Exchange.asmx")
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := proxyutils.CreateChainedProxy("test", discard, discard, discard, discard, discard,
+		nil, http.DefaultTransport, translator, proxyutils.NewRedirectorMiddleware(source, target))
+
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+	return chain, translator, count, func() {
+		owa.Close()
+		native.Close()
+	}
+}
+
+func postShadowRequest(t *testing.T, chain http.RoundTripper, action string, soap []byte) []byte {
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(soap))
+	if action != "" {
+		request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/`+action+`"`)
+	}
+	response, err := chain.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	return body
+}
+
+// operations that change the mailbox would run twice
+func TestShadowReadOnly(t *testing.T) {
+	chain, _, nativeRequests, closeServers := newShadowChain(t, "<native/>")
+	defer closeServers()
+
+	data, err := ioutil.ReadFile("testdata/requests/ews_createitem_davmail.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := postShadowRequest(t, chain, "CreateItem", data); string(body) == "<native/>" {
+		t.Error("the client got the native response to CreateItem")
+	}
+	if n := nativeRequests(); n != 0 {
+		t.Errorf("CreateItem was sent to the native endpoint %d times", n)
+	}
+}
+
+// the client still gets the native response when the request can't be
+// translated
+func TestShadowTranslationError(t *testing.T) {
+	chain, _, nativeRequests, closeServers := newShadowChain(t, "<native/>")
+	defer closeServers()
+
+	soap := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+  <soap:Body>
+    <m:GetFolder>
+      <m:NotAnElement/>
+    </m:GetFolder>
+  </soap:Body>
+</soap:Envelope>`)
+
+	if body := postShadowRequest(t, chain, "GetFolder", soap); string(body) != "<native/>" {
+		t.Errorf("expected the native response, got:\n%s", body)
+	}
+	if n := nativeRequests(); n != 1 {
+		t.Errorf("expected 1 native request, got %d", n)
+	}
+}
+
+// the native endpoint never gets a request that the proxy refuses
+func TestShadowDeniedAction(t *testing.T) {
+	chain, translator, nativeRequests, closeServers := newShadowChain(t, "<native/>")
+	defer closeServers()
+
+	policy, err := NewActionPolicy(nil, []string{"GetFolder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	translator.SetPolicy(policy)
+
+	data, err := ioutil.ReadFile("testdata/requests/ews_getfolder_root_davmail.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with and without the SOAPAction header
+	body := postShadowRequest(t, chain, "GetFolder", data)
+	if !bytes.Contains(body, []byte("ErrorAccessDenied")) {
+		t.Errorf("expected ErrorAccessDenied, got:\n%s", body)
+	}
+	body = postShadowRequest(t, chain, "", data)
+	if !bytes.Contains(body, []byte("ErrorAccessDenied")) {
+		t.Errorf("expected ErrorAccessDenied, got:\n%s", body)
+	}
+
+	if n := nativeRequests(); n != 0 {
+		t.Errorf("the denied GetFolder was sent to the native endpoint %d times", n)
+	}
+}
@@ -0,0 +1,129 @@
+package ews
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+var soapFaultTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <s:Fault>
+      <faultcode xmlns:a="http://schemas.microsoft.com/exchange/services/2006/types">a:%[1]s</faultcode>
+      <faultstring xml:lang="en-US">%[2]s</faultstring>
+      <detail>
+        <e:ResponseCode xmlns:e="http://schemas.microsoft.com/exchange/services/2006/errors">%[1]s</e:ResponseCode>
+        <e:Message xmlns:e="http://schemas.microsoft.com/exchange/services/2006/errors">%[2]s</e:Message>
+%[3]s      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>
+`
+
+// exchange puts details of an error in MessageXml as a list of values
+var soapFaultValuesTemplate = `        <e:MessageXml xmlns:e="http://schemas.microsoft.com/exchange/services/2006/errors">
+%s        </e:MessageXml>
+`
+
+var soapFaultValueTemplate = `          <t:Value xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" Name="%s">%s</t:Value>
+`
+
+// a value in the MessageXml of a SOAP fault
+type soapFaultValue struct {
+	Name  string
+	Value string
+}
+
+func escapeXml(s string) string {
+	escaped := new(bytes.Buffer)
+	xml.EscapeText(escaped, []byte(s))
+	return escaped.String()
+}
+
+func soapFaultBody(code string, message string, values []soapFaultValue) string {
+	messageXml := ""
+	if len(values) != 0 {
+		valuesXml := ""
+		for _, value := range values {
+			valuesXml += fmt.Sprintf(soapFaultValueTemplate, escapeXml(value.Name), escapeXml(value.Value))
+		}
+		messageXml = fmt.Sprintf(soapFaultValuesTemplate, valuesXml)
+	}
+
+	return fmt.Sprintf(soapFaultTemplate, code, escapeXml(message), messageXml)
+}
+
+// createSoapFault returns the SOAP fault that exchange sends when a request
+// fails as a whole. SOAP 1.1 requires faults to be sent with a 500 status,
+// EWS clients read the fault from the body.
+func createSoapFault(request *http.Request, code string, message string, values ...soapFaultValue) *http.Response {
+	response := proxyutils.CreateNewResponse(request, soapFaultBody(code, message, values))
+	response.StatusCode = http.StatusInternalServerError
+	response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return response
+}
+
+// TranslationError is a request or response that the proxy could not
+// translate. The client gets it as a ProxyTranslationError SOAP fault, the
+// RequestId is in the transaction log too.
+type TranslationError struct {
+	RequestId string
+	Operation string // "" if it isn't known
+	Response  bool
+	Err       error
+}
+
+func (this *TranslationError) Error() string {
+	what := "request"
+	if this.Response {
+		what = "response"
+	}
+	if this.Operation != "" {
+		what = this.Operation + " " + what
+	}
+	return fmt.Sprintf("the proxy could not translate the %s: %s", what, this.Err)
+}
+
+func (this *TranslationError) faultValues() []soapFaultValue {
+	return []soapFaultValue{
+		{"RequestId", this.RequestId},
+		{"Operation", this.Operation},
+	}
+}
+
+// createTranslationFault returns the SOAP fault for a request that could
+// not be translated
+func createTranslationFault(request *http.Request, err *TranslationError) *http.Response {
+	return createSoapFault(request, "ProxyTranslationError", err.Error(), err.faultValues()...)
+}
+
+// setSoapFault replaces the response from the server with a SOAP fault
+func setSoapFault(response *http.Response, code string, message string, values ...soapFaultValue) {
+	body := soapFaultBody(code, message, values)
+
+	response.StatusCode = http.StatusInternalServerError
+	response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	response.Header.Del("Content-Length")
+	response.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	response.ContentLength = int64(len(body))
+}
+
+// setTranslationFault replaces a response that could not be translated
+// with a SOAP fault
+func setTranslationFault(response *http.Response, err *TranslationError) {
+	setSoapFault(response, "ProxyTranslationError", err.Error(), err.faultValues()...)
+}
+
+// returns a random ID for the transaction log and faults
+func newRequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,107 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+type testSoapFault struct {
+	Code   string `xml:"Body>Fault>faultcode"`
+	String string `xml:"Body>Fault>faultstring"`
+	Values []struct {
+		Name  string `xml:"Name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"Body>Fault>detail>MessageXml>Value"`
+}
+
+// parses the fault in a response, returns the MessageXml values by name
+func parseSoapFault(t *testing.T, response *http.Response) (*testSoapFault, map[string]string) {
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", response.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	fault := &testSoapFault{}
+	if err := xml.Unmarshal(body, fault); err != nil {
+		t.Fatalf("invalid fault: %s\n%s", err, body)
+	}
+
+	values := make(map[string]string)
+	for _, value := range fault.Values {
+		values[value.Name] = value.Value
+	}
+	return fault, values
+}
+
+func TestRequestTranslationFault(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	var transactionLog string
+	translator.OnEwsTranslationError = func(buf *bytes.Buffer) {
+		transactionLog = buf.String()
+	}
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader("<invalid"))
+	request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/GetItem"`)
+
+	err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	re, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("expected a fault, got %v", err)
+	}
+
+	fault, values := parseSoapFault(t, re.Response)
+	if fault.Code != "a:ProxyTranslationError" || !strings.Contains(fault.String, "GetItem request") {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+
+	if values["RequestId"] == "" || !strings.Contains(transactionLog, "Request ID "+values["RequestId"]) {
+		t.Errorf("request ID %q is not in the transaction log:\n%s", values["RequestId"], transactionLog)
+	}
+
+	if values["Operation"] != "GetItem" {
+		t.Errorf("unexpected operation %q", values["Operation"])
+	}
+}
+
+func TestResponseTranslationFault(t *testing.T) {
+	translator := NewTranslationMiddleware()
+
+	cctx := proxyutils.NewChainValues()
+	cctx.Set(ewsContextName, &ewsProxyContext{
+		EwsProxyOp:     EwsOperations["GetItem"],
+		TransactionLog: new(bytes.Buffer),
+		RequestId:      "0123456789abcdef",
+	})
+
+	data := `{"Body": {"ResponseMessages": {"Items": [{"ResponseCode": "NoError", "ResponseClass": "Success", "Unexpected<&>": 1}]}}}`
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/owa/service.svc", nil)
+	response := proxyutils.CreateNewResponse(request, data)
+
+	if err := translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/xml; charset=utf-8" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+
+	fault, values := parseSoapFault(t, response)
+	if fault.Code != "a:ProxyTranslationError" || !strings.Contains(fault.String, "GetItem response") {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+
+	if values["RequestId"] != "0123456789abcdef" || values["Operation"] != "GetItem" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
@@ -0,0 +1,248 @@
+package ews
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
+)
+
+/*
+	OWA returns a new ChangeKey for items on every SyncFolderItems call even
+	when nothing about the item changed, which makes clients such as DavMail
+	think that the item was modified and download it again. This filter
+	remembers a hash of each item payload (ignoring the ChangeKey) and drops
+	Update changes that don't actually change anything.
+
+	A response can be lost on the way to the client, which then sends the
+	same SyncState again and gets the same changes. So the hashes of a
+	response are only pending until a request sends back the SyncState of
+	that response, which shows that the client got it, and updates are only
+	compared with those confirmed hashes. Items that have nothing but their
+	ItemId (an IdOnly ItemShape) are never dropped, there is nothing to
+	compare.
+*/
+
+// the number of responses whose hashes are kept until they are confirmed
+const noopPendingResponses = 16
+
+type noopUpdateFilter struct {
+	maxSize int
+
+	// LRU of ItemId -> hash, most recently used at the front
+	order  *list.List
+	hashes map[string]*list.Element
+
+	// SyncState of a response -> the hashes of its items, oldest first
+	pending      map[string][]noopUpdateEntry
+	pendingOrder []string
+}
+
+type noopUpdateEntry struct {
+	id   string
+	hash [sha256.Size]byte
+}
+
+func newNoopUpdateFilter(maxSize int) *noopUpdateFilter {
+	return &noopUpdateFilter{
+		maxSize: maxSize,
+		order:   list.New(),
+		hashes:  make(map[string]*list.Element),
+		pending: make(map[string][]noopUpdateEntry),
+	}
+}
+
+// returns true if hash is the confirmed hash of the item
+func (this *noopUpdateFilter) seen(id string, hash [sha256.Size]byte) bool {
+	if el, ok := this.hashes[id]; ok {
+		this.order.MoveToFront(el)
+		return el.Value.(*noopUpdateEntry).hash == hash
+	}
+	return false
+}
+
+// records the confirmed hash of an item
+func (this *noopUpdateFilter) store(id string, hash [sha256.Size]byte) {
+	if el, ok := this.hashes[id]; ok {
+		el.Value.(*noopUpdateEntry).hash = hash
+		this.order.MoveToFront(el)
+		return
+	}
+
+	this.hashes[id] = this.order.PushFront(&noopUpdateEntry{id: id, hash: hash})
+
+	for this.order.Len() > this.maxSize {
+		oldest := this.order.Back()
+		this.order.Remove(oldest)
+		delete(this.hashes, oldest.Value.(*noopUpdateEntry).id)
+	}
+}
+
+// keeps the hashes of a response until its SyncState is confirmed
+func (this *noopUpdateFilter) addPending(syncState string, entries []noopUpdateEntry) {
+	if _, ok := this.pending[syncState]; !ok {
+		this.pendingOrder = append(this.pendingOrder, syncState)
+	}
+	this.pending[syncState] = append(this.pending[syncState], entries...)
+
+	for len(this.pendingOrder) > noopPendingResponses {
+		delete(this.pending, this.pendingOrder[0])
+		this.pendingOrder = this.pendingOrder[1:]
+	}
+}
+
+// confirm is called with the SyncState of a SyncFolderItems request, the
+// client got the response that had it
+func (this *noopUpdateFilter) confirm(syncState string) {
+	entries, ok := this.pending[syncState]
+	if !ok {
+		return
+	}
+
+	for _, entry := range entries {
+		this.store(entry.id, entry.hash)
+	}
+
+	delete(this.pending, syncState)
+	for i, state := range this.pendingOrder {
+		if state == syncState {
+			this.pendingOrder = append(this.pendingOrder[:i], this.pendingOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (this *noopUpdateFilter) forget(id string) {
+	if el, ok := this.hashes[id]; ok {
+		this.order.Remove(el)
+		delete(this.hashes, id)
+	}
+}
+
+// itemHash returns the item id and a hash of the item payload, ignoring the
+// ChangeKey of the item. ok is false if the item has no properties other
+// than its ItemId.
+func itemHash(item map[string]interface{}) (id string, hash [sha256.Size]byte, ok bool) {
+	itemId, ok := item["ItemId"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	properties := 0
+	for name := range item {
+		if name != "ItemId" && name != "__type" {
+			properties++
+		}
+	}
+	if properties == 0 {
+		ok = false
+		return
+	}
+
+	id, ok = itemId["Id"].(string)
+	if !ok {
+		return
+	}
+
+	changeKey, hasChangeKey := itemId["ChangeKey"]
+	delete(itemId, "ChangeKey")
+
+	// map keys are sorted when marshalled, so this is deterministic
+	data, err := json.Marshal(item)
+
+	if hasChangeKey {
+		itemId["ChangeKey"] = changeKey
+	}
+
+	if err != nil {
+		ok = false
+		return
+	}
+
+	hash = sha256.Sum256(data)
+	return
+}
+
+// the SyncState of a SyncFolderItems request, after expandSyncState
+func requestSyncState(jsonRequest *JsonRequest) string {
+	for _, member := range memberObject(jsonRequest.msg, "Body") {
+		if syncState, ok := member.Value.(string); ok && member.Key == "SyncState" {
+			return syncState
+		}
+	}
+	return ""
+}
+
+// filter removes no-op Update entries from a SyncFolderItems JSON response.
+// Returns the (possibly modified) response and the number of dropped updates
+func (this *noopUpdateFilter) filter(jsonData []byte) ([]byte, int, error) {
+
+	msg, err := decodeJsonMessage(bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "decoding SyncFolderItems response")
+	}
+
+	body, _ := msg["Body"].(map[string]interface{})
+	responseMessages, _ := body["ResponseMessages"].(map[string]interface{})
+	items, _ := responseMessages["Items"].([]interface{})
+
+	dropped := 0
+
+	for _, rmsg := range items {
+		rmsgObj, _ := rmsg.(map[string]interface{})
+		changesObj, _ := rmsgObj["Changes"].(map[string]interface{})
+		changes, ok := changesObj["Changes"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		// SyncState and everything else is left untouched
+		filtered := make([]interface{}, 0, len(changes))
+		var seen []noopUpdateEntry
+
+		for _, change := range changes {
+			changeObj, ok := change.(map[string]interface{})
+			if !ok {
+				filtered = append(filtered, change)
+				continue
+			}
+
+			switch changeObj["ChangeType"] {
+			case "Create", "Update":
+				if item, ok := changeObj["Item"].(map[string]interface{}); ok {
+					if id, hash, ok := itemHash(item); ok {
+						seen = append(seen, noopUpdateEntry{id: id, hash: hash})
+						if this.seen(id, hash) && changeObj["ChangeType"] == "Update" {
+							dropped++
+							continue
+						}
+					}
+				}
+
+			case "Delete":
+				if itemId, ok := changeObj["ItemId"].(map[string]interface{}); ok {
+					if id, ok := itemId["Id"].(string); ok {
+						this.forget(id)
+					}
+				}
+			}
+
+			filtered = append(filtered, change)
+		}
+
+		changesObj["Changes"] = filtered
+
+		if syncState, ok := rmsgObj["SyncState"].(string); ok && len(seen) != 0 {
+			this.addPending(syncState, seen)
+		}
+	}
+
+	if dropped == 0 {
+		return jsonData, 0, nil
+	}
+
+	ret, err := json.Marshal(msg)
+	return ret, dropped, err
+}
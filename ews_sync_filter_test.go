@@ -0,0 +1,200 @@
+package ews
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func syncResponse(syncState string, changes ...string) []byte {
+	changeList := ""
+	for i, c := range changes {
+		if i != 0 {
+			changeList += ","
+		}
+		changeList += c
+	}
+
+	return []byte(fmt.Sprintf(`{
+		"Header": {"ServerVersionInfo": {"MajorVersion": 15}},
+		"Body": {"ResponseMessages": {"Items": [{
+			"__type": "SyncFolderItemsResponseMessage:#Exchange",
+			"ResponseCode": "NoError",
+			"ResponseClass": "Success",
+			"SyncState": "%s",
+			"IncludesLastItemInRange": true,
+			"Changes": {"Changes": [%s]}
+		}]}}
+	}`, syncState, changeList))
+}
+
+func syncChange(changeType, id, changeKey, subject string) string {
+	return fmt.Sprintf(`{
+		"__type": "SyncFolderItems%sType:#Exchange",
+		"ChangeType": "%s",
+		"Item": {
+			"__type": "Message:#Exchange",
+			"ItemId": {"ChangeKey": "%s", "Id": "%s"},
+			"Subject": "%s"
+		}
+	}`, changeType, changeType, changeKey, id, subject)
+}
+
+func decodedChanges(t *testing.T, data []byte) (changes []interface{}, syncState string) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	item := msg["Body"].(map[string]interface{})["ResponseMessages"].(map[string]interface{})["Items"].([]interface{})[0].(map[string]interface{})
+	return item["Changes"].(map[string]interface{})["Changes"].([]interface{}), item["SyncState"].(string)
+}
+
+func TestSuppressNoopUpdates(t *testing.T) {
+	filter := newNoopUpdateFilter(100)
+
+	// first sync: nothing has been seen before, so nothing is dropped
+	first := syncResponse("state1",
+		syncChange("Update", "A", "ck1", "hello"),
+		syncChange("Create", "B", "ck1", "world"))
+
+	out, dropped, err := filter.filter(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 || string(out) != string(first) {
+		t.Fatalf("first response should not be modified, dropped %d", dropped)
+	}
+
+	// second sync: the client got the first response, same items with
+	// different change keys
+	filter.confirm("state1")
+	second := syncResponse("state2",
+		syncChange("Update", "A", "ck2", "hello"),
+		syncChange("Update", "B", "ck2", "world"))
+
+	out, dropped, err = filter.filter(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 2 {
+		t.Errorf("expected 2 dropped updates, got %d", dropped)
+	}
+
+	changes, syncState := decodedChanges(t, out)
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, got %#v", changes)
+	}
+	if syncState != "state2" {
+		t.Errorf("SyncState was modified: %s", syncState)
+	}
+
+	// third sync: a real change must come through
+	filter.confirm("state2")
+	third := syncResponse("state3",
+		syncChange("Update", "A", "ck3", "hello again"),
+		syncChange("Update", "B", "ck3", "world"))
+
+	out, dropped, err = filter.filter(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 1 {
+		t.Errorf("expected 1 dropped update, got %d", dropped)
+	}
+
+	changes, _ = decodedChanges(t, out)
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change, got %#v", changes)
+	}
+
+	item := changes[0].(map[string]interface{})["Item"].(map[string]interface{})
+	if item["Subject"] != "hello again" {
+		t.Errorf("wrong change survived: %#v", item)
+	}
+}
+
+func TestSuppressNoopUpdatesBounded(t *testing.T) {
+	filter := newNoopUpdateFilter(2)
+
+	for _, id := range []string{"A", "B", "C"} {
+		if _, _, err := filter.filter(syncResponse("s", syncChange("Update", id, "ck1", "x"))); err != nil {
+			t.Fatal(err)
+		}
+		filter.confirm("s")
+	}
+
+	if len(filter.hashes) != 2 || filter.order.Len() != 2 {
+		t.Fatalf("filter is not bounded: %d entries", len(filter.hashes))
+	}
+
+	// A was evicted, so its update is passed through again
+	_, dropped, err := filter.filter(syncResponse("s", syncChange("Update", "A", "ck2", "x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Errorf("evicted item should not be suppressed")
+	}
+}
+
+func TestSuppressNoopUpdatesRetriedSyncState(t *testing.T) {
+	filter := newNoopUpdateFilter(100)
+
+	first := syncResponse("state1", syncChange("Create", "A", "ck1", "hello"))
+	if _, _, err := filter.filter(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first response never made it to the client, which sends the same
+	// SyncState again and must get the item again
+	filter.confirm("state0")
+
+	_, dropped, err := filter.filter(syncResponse("state1", syncChange("Update", "A", "ck2", "hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Errorf("unconfirmed item should not be suppressed")
+	}
+
+	filter.confirm("state1")
+
+	_, dropped, err = filter.filter(syncResponse("state2", syncChange("Update", "A", "ck3", "hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 1 {
+		t.Errorf("confirmed item should be suppressed, dropped %d", dropped)
+	}
+}
+
+func TestSuppressNoopUpdatesIdOnly(t *testing.T) {
+	filter := newNoopUpdateFilter(100)
+
+	idOnly := func(syncState, changeKey string) []byte {
+		return syncResponse(syncState, fmt.Sprintf(`{
+			"__type": "SyncFolderItemsUpdateType:#Exchange",
+			"ChangeType": "Update",
+			"Item": {
+				"__type": "Message:#Exchange",
+				"ItemId": {"ChangeKey": "%s", "Id": "A"}
+			}
+		}`, changeKey))
+	}
+
+	for i, syncState := range []string{"state1", "state2", "state3"} {
+		_, dropped, err := filter.filter(idOnly(syncState, fmt.Sprintf("ck%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped != 0 {
+			t.Errorf("IdOnly update should not be suppressed")
+		}
+		filter.confirm(syncState)
+	}
+
+	if len(filter.hashes) != 0 {
+		t.Errorf("IdOnly items should not be remembered")
+	}
+}
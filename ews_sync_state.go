@@ -0,0 +1,335 @@
+package ews
+
+/*
+	The SyncState of SyncFolderItems is opaque to clients, but it grows to
+	hundreds of KB and goes back and forth with every sync, which is most of
+	the traffic on a slow link. With a SyncStateStore, the proxy keeps the
+	SyncState of a response and gives the client a short token instead, and
+	puts the SyncState back when the client sends the token.
+
+	Tokens are only good in the login session that they were given out in
+	(see ews_login_session.go) and for MaxAge, so that nobody else who uses
+	the proxy can use them. A token that isn't known (anymore) is sent to the
+	server as it is. The server answers ErrorInvalidSyncStateData like it
+	does for any SyncState that it can't use, and the client syncs the
+	folder again from the start. When a SyncState can't be stored, the client
+	gets it as it is.
+
+	The SyncStates are kept in memory, or in a directory if one is given.
+	The least recently used are removed when there are more than MaxSize
+	bytes. The directory is emptied when the store is created, as the tokens
+	of an earlier run are gone with its memory.
+*/
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
+)
+
+// DefaultSyncStateMaxAge is how long a token is good for when
+// SyncStateStore.MaxAge isn't set
+const DefaultSyncStateMaxAge = 7 * 24 * time.Hour
+
+// DefaultSyncStateMinSize is the size of the smallest SyncState that is
+// replaced by a token when SyncStateStore.MinSize isn't set
+const DefaultSyncStateMinSize = 1024
+
+// tokens are valid base64 like the SyncStates, in case a client checks
+const syncStateTokenPrefix = "EwsProxy"
+const syncStateTokenLength = len(syncStateTokenPrefix) + 24
+
+const syncStateSuffix = ".syncstate"
+
+// SyncStateStore keeps the SyncStates of SyncFolderItems responses, the
+// least recently used are removed when there are more than MaxSize bytes
+type SyncStateStore struct {
+	// maximum total size of the SyncStates in bytes
+	MaxSize int64
+
+	// how long a token is good for, 0 is DefaultSyncStateMaxAge
+	MaxAge time.Duration
+
+	// smaller SyncStates are given to the client as they are, 0 is
+	// DefaultSyncStateMinSize
+	MinSize int
+
+	dir string
+
+	lock sync.Mutex
+	size int64
+
+	// most recently used at the front
+	order   *list.List
+	entries map[string]*list.Element
+
+	// the size of the last SyncState of each folder
+	folders map[string]int
+
+	stored, expanded, missed int
+}
+
+type syncStateEntry struct {
+	token   string
+	session uint64
+	created time.Time
+	size    int
+
+	// "" if it is in the directory
+	value string
+}
+
+// SyncStateStatus is the part of the status about SyncStates
+type SyncStateStatus struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+
+	// SyncStates that were replaced by a token, tokens that were replaced
+	// by their SyncState, and tokens that weren't known, were too old or
+	// were given out in another login session
+	Stored   int `json:"stored"`
+	Expanded int `json:"expanded"`
+	Missed   int `json:"missed"`
+
+	// the size of the last SyncState of each folder (the Id of its FolderId
+	// or DistinguishedFolderId), also of the ones that weren't stored
+	Folders map[string]int `json:"folders"`
+}
+
+// NewSyncStateStore keeps up to maxSize bytes of SyncStates in dir, or in
+// memory if dir is ""
+func NewSyncStateStore(dir string, maxSize int64) (*SyncStateStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "creating sync state directory")
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading sync state directory")
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), syncStateSuffix) {
+				os.Remove(filepath.Join(dir, file.Name()))
+			}
+		}
+	}
+
+	return &SyncStateStore{
+		MaxSize: maxSize,
+		dir:     dir,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		folders: make(map[string]int),
+	}, nil
+}
+
+func isSyncStateToken(value string) bool {
+	return len(value) == syncStateTokenLength && strings.HasPrefix(value, syncStateTokenPrefix)
+}
+
+func newSyncStateToken() string {
+	id := make([]byte, 18)
+	rand.Read(id)
+	return syncStateTokenPrefix + base64.StdEncoding.EncodeToString(id)
+}
+
+func (this *SyncStateStore) maxAge() time.Duration {
+	if this.MaxAge <= 0 {
+		return DefaultSyncStateMaxAge
+	}
+	return this.MaxAge
+}
+
+func (this *SyncStateStore) minSize() int {
+	if this.MinSize <= 0 {
+		return DefaultSyncStateMinSize
+	}
+	return this.MinSize
+}
+
+// the token is random, so it is also the name of the file
+func (this *SyncStateStore) path(token string) string {
+	return filepath.Join(this.dir, strings.NewReplacer("/", "_", "+", "-").Replace(token)+syncStateSuffix)
+}
+
+// must be called with the lock held
+func (this *SyncStateStore) remove(el *list.Element) {
+	entry := this.order.Remove(el).(*syncStateEntry)
+	delete(this.entries, entry.token)
+	this.size -= int64(entry.size)
+
+	if this.dir != "" {
+		os.Remove(this.path(entry.token))
+	}
+}
+
+// must be called with the lock held
+func (this *SyncStateStore) evict() {
+	maxAge := this.maxAge()
+	for el := this.order.Back(); el != nil; el = this.order.Back() {
+		entry := el.Value.(*syncStateEntry)
+		if this.size <= this.MaxSize && time.Since(entry.created) <= maxAge {
+			break
+		}
+		this.remove(el)
+	}
+}
+
+// put stores the SyncState of folder for the login session, and returns
+// its token. It returns "" if the SyncState should be given to the client
+// as it is.
+func (this *SyncStateStore) put(session uint64, folder string, value string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if folder != "" {
+		this.folders[folder] = len(value)
+	}
+	if len(value) < this.minSize() || int64(len(value)) > this.MaxSize {
+		return "", nil
+	}
+
+	entry := &syncStateEntry{
+		token:   newSyncStateToken(),
+		session: session,
+		created: time.Now(),
+		size:    len(value),
+	}
+
+	if this.dir == "" {
+		entry.value = value
+	} else if err := writeFileAtomic(this.path(entry.token), []byte(value)); err != nil {
+		return "", errors.Wrap(err, "writing sync state")
+	}
+
+	this.entries[entry.token] = this.order.PushFront(entry)
+	this.size += int64(entry.size)
+	this.stored++
+	this.evict()
+	return entry.token, nil
+}
+
+// get returns the SyncState of token if it was given out in the login
+// session and isn't too old
+func (this *SyncStateStore) get(session uint64, token string) (string, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	el, ok := this.entries[token]
+	if !ok {
+		this.missed++
+		return "", false
+	}
+
+	entry := el.Value.(*syncStateEntry)
+	if entry.session != session || time.Since(entry.created) > this.maxAge() {
+		this.remove(el)
+		this.missed++
+		return "", false
+	}
+
+	value := entry.value
+	if this.dir != "" {
+		data, err := ioutil.ReadFile(this.path(token))
+		if err != nil || len(data) != entry.size {
+			this.remove(el)
+			this.missed++
+			return "", false
+		}
+		value = string(data)
+	}
+
+	// clients send the same SyncState again when a sync fails, so it is
+	// kept until it is too old or pushed out
+	this.order.MoveToFront(el)
+	this.expanded++
+	return value, true
+}
+
+func (this *SyncStateStore) status() *SyncStateStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	status := &SyncStateStatus{
+		Entries:  this.order.Len(),
+		Size:     this.size,
+		Stored:   this.stored,
+		Expanded: this.expanded,
+		Missed:   this.missed,
+		Folders:  make(map[string]int, len(this.folders)),
+	}
+	for folder, size := range this.folders {
+		status.Folders[folder] = size
+	}
+	return status
+}
+
+// returns the Id of the folder of a SyncFolderItems request
+func syncFolderId(jsonRequest *JsonRequest) string {
+	folderId := memberObject(memberObject(memberObject(jsonRequest.msg, "Body"), "SyncFolderId"), "BaseFolderId")
+	for _, member := range folderId {
+		if id, ok := member.Value.(string); ok && member.Key == "Id" {
+			return id
+		}
+	}
+	return ""
+}
+
+// puts the SyncState back in a SyncFolderItems request that has a token,
+// called by requestHook
+func (this *TranslationMiddleware) expandSyncState(body json.OrderedObject) json.OrderedObject {
+	for i, member := range body {
+		if token, ok := member.Value.(string); ok && member.Key == "SyncState" && isSyncStateToken(token) {
+			if value, ok := this.SyncStates.get(this.currentLoginSession(), token); ok {
+				body[i].Value = value
+			}
+		}
+	}
+	return body
+}
+
+// replaces the SyncStates of a SyncFolderItems response with tokens
+func (this *TranslationMiddleware) storeSyncStates(ctx *ewsProxyContext, jsonResponseData []byte) ([]byte, error) {
+	msg, err := decodeJsonMessage(bytes.NewReader(jsonResponseData))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding SyncFolderItems response")
+	}
+
+	body, _ := msg["Body"].(map[string]interface{})
+	responseMessages, _ := body["ResponseMessages"].(map[string]interface{})
+	items, _ := responseMessages["Items"].([]interface{})
+
+	replaced := 0
+	for _, rmsg := range items {
+		rmsgObj, _ := rmsg.(map[string]interface{})
+		value, ok := rmsgObj["SyncState"].(string)
+		if !ok || rmsgObj["ResponseClass"] == "Error" {
+			continue
+		}
+
+		token, err := this.SyncStates.put(this.currentLoginSession(), ctx.syncFolder, value)
+		if err != nil {
+			this.appendTransaction(ctx, "Ews Translator: SyncState is not stored: "+err.Error())
+		} else if token != "" {
+			this.appendTransaction(ctx, "Ews Translator: SyncState is "+token)
+			rmsgObj["SyncState"] = token
+			replaced++
+		}
+	}
+
+	if replaced == 0 {
+		return jsonResponseData, nil
+	}
+	return json.Marshal(msg)
+}
@@ -0,0 +1,186 @@
+package ews
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestSyncStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncstates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// left over from an earlier run
+	ioutil.WriteFile(filepath.Join(dir, "old"+syncStateSuffix), []byte("old"), 0600)
+
+	for _, dir := range []string{"", dir} {
+		store, err := NewSyncStateStore(dir, 5000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.MinSize = 100
+
+		if files, _ := filepath.Glob(filepath.Join(dir, "*"+syncStateSuffix)); dir != "" && len(files) != 0 {
+			t.Errorf("the directory was not emptied: %v", files)
+		}
+
+		// small SyncStates are given out as they are
+		if token, err := store.put(1, "inbox", "small"); token != "" || err != nil {
+			t.Errorf("expected a small SyncState to be kept, got %q (%v)", token, err)
+		}
+
+		state := strings.Repeat("S", 2000)
+		token, err := store.put(1, "inbox", state)
+		if err != nil || !isSyncStateToken(token) {
+			t.Fatalf("expected a token, got %q (%v)", token, err)
+		}
+
+		// the same token can be used more than once, but only in its session
+		for i := 0; i < 2; i++ {
+			if value, ok := store.get(1, token); !ok || value != state {
+				t.Errorf("%q: the SyncState of the token was not returned", dir)
+			}
+		}
+		if _, ok := store.get(2, token); ok {
+			t.Errorf("%q: the token was used in another login session", dir)
+		}
+		if _, ok := store.get(1, token); ok {
+			t.Errorf("%q: the token of another login session is still known", dir)
+		}
+
+		// too old
+		store.MaxAge = time.Minute
+		token, _ = store.put(1, "inbox", state)
+		store.entries[token].Value.(*syncStateEntry).created = time.Now().Add(-2 * time.Minute)
+		if _, ok := store.get(1, token); ok {
+			t.Errorf("%q: an expired token was used", dir)
+		}
+
+		// the least recently used are removed
+		first, _ := store.put(1, "inbox", state)
+		second, _ := store.put(1, "calendar", state)
+		store.get(1, first)
+		store.put(1, "contacts", state)
+		if _, ok := store.get(1, second); ok {
+			t.Errorf("%q: the least recently used SyncState was not removed", dir)
+		}
+		if _, ok := store.get(1, first); !ok {
+			t.Errorf("%q: the wrong SyncState was removed", dir)
+		}
+
+		status := store.status()
+		if status.Entries != 2 || status.Size != 4000 || status.Folders["inbox"] != 2000 || status.Missed != 4 {
+			t.Errorf("%q: unexpected status %+v", dir, status)
+		}
+
+		// a damaged file is a miss
+		if dir != "" {
+			ioutil.WriteFile(store.path(first), []byte("damaged"), 0600)
+			if _, ok := store.get(1, first); ok {
+				t.Error("a damaged SyncState was used")
+			}
+		}
+	}
+}
+
+// an OWA server that answers SyncFolderItems with a new large SyncState, and
+// keeps the SyncStates that it was sent
+type syncStateOwa struct {
+	lock     sync.Mutex
+	received []string
+}
+
+func (this *syncStateOwa) RoundTrip(request *http.Request) (*http.Response, error) {
+	var msg struct {
+		Body struct {
+			SyncState string
+		}
+	}
+	data, _ := ioutil.ReadAll(request.Body)
+	json.Unmarshal(data, &msg)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.received = append(this.received, msg.Body.SyncState)
+
+	state := strings.Repeat("S", 2000) + string(rune('0'+len(this.received)))
+	return proxyutils.CreateNewResponse(request, string(syncResponse(state))), nil
+}
+
+func (this *syncStateOwa) last() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.received[len(this.received)-1]
+}
+
+var soapSyncState = regexp.MustCompile(`<m:SyncState>([^<]*)</m:SyncState>`)
+
+func TestSyncStateCompression(t *testing.T) {
+	request, err := ioutil.ReadFile(filepath.Join("testdata", "requests", "ews_syncfolderitems_macmail.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	if translator.SyncStates, err = NewSyncStateStore("", 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	owa := &syncStateOwa{}
+	proxy := newLimitedProxy(translator, owa)
+
+	// returns the SyncState that the client got
+	send := func(syncState string) string {
+		body := strings.Replace(string(request), "STATE==", syncState, 1)
+		r, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(body))
+		response, err := proxy.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+
+		match := soapSyncState.FindStringSubmatch(string(data))
+		if match == nil {
+			t.Fatalf("no SyncState in the response: %s", data)
+		}
+		return match[1]
+	}
+
+	// a real SyncState is sent as it is
+	token := send("STATE==")
+	if owa.last() != "STATE==" || !isSyncStateToken(token) {
+		t.Fatalf("expected a token, got %q", token)
+	}
+
+	// the token is the SyncState of the first response
+	token = send(token)
+	if owa.last() != strings.Repeat("S", 2000)+"1" {
+		t.Errorf("the token was not replaced by its SyncState")
+	}
+
+	// after another login, the server gets the token and tells the client
+	// that it can't be used
+	translator.setCanary("other")
+	send(token)
+	if owa.last() != token {
+		t.Errorf("expected the token to be sent, got %q", owa.last())
+	}
+
+	status := translator.Status().SyncStates
+	if status == nil || status.Stored != 3 || status.Expanded != 1 || status.Missed != 1 || status.Folders["ID=="] != 2001 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -2,25 +2,45 @@ package ews
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/virtuald/ews-proxy/proxyutils"
+	"github.com/virtuald/go-ordered-json"
 )
 
 const ewsContextName = "ews_ctx"
 
+// operations that haven't seen much testing against real clients, and are
+// only translated when TranslationMiddleware.Experimental is set
+var experimentalOperations = map[string]bool{
+	"FindPeople": true,
+}
+
+// operations that carry large opaque blobs (mailbox migration, photos).
+// Their requests are streamed even when the length isn't known, and their
+// large responses aren't copied into the transaction log.
+var bulkDataOperations = map[string]bool{
+	"ExportItems":  true,
+	"GetUserPhoto": true,
+	"SetUserPhoto": true,
+	"UploadItems":  true,
+}
+
 // TranslationMiddleware implements a reverse proxy that allows EWS clients to
 // talk to an OWA endpoint
-//
 type TranslationMiddleware struct {
-	// Set to true if you want to see additional logging
+	// Set to true if you want to see additional logging, use SetDebug once
+	// the proxy is running
 	Debug bool
 
 	// default is "/ews/exchange.asmx"
@@ -29,30 +49,232 @@ type TranslationMiddleware struct {
 	// default is "/owa/service.svc"
 	OwaServicePath string
 
+	// path prefix of the exchange server (see proxyutils.PathPrefix). EWS
+	// requests are also translated if clients include it in EwsPath.
+	PathPrefix string
+
+	// GET requests to this path return the proxy status as JSON, default is
+	// "/status". Set to "" to disable
+	StatusPath string
+
+	// version of the exchange server, shared with the login middleware
+	Server *ServerInfo
+
+	// clock skew between us and the exchange server, NewProxy shares it
+	// with the redirector
+	Skew *proxyutils.SkewTracker
+
 	// OWA Canary value, required for the OWA service to work
 	OwaCanary string
 
+	// If set, OWA requests are authenticated using a bearer token from this
+	// instead of the canary (Exchange Online)
+	TokenSource TokenSource
+
+	// If set, OWA requests are sent with this X-AnchorMailbox header so that
+	// Exchange Online routes them to the right mailbox in a hybrid setup.
+	// Requests that use ExchangeImpersonation are routed to the impersonated
+	// mailbox instead, and a header sent by the client is left alone. See
+	// ews_anchor_mailbox.go
+	AnchorMailbox string
+
+	// If true, SyncFolderItems updates that don't change anything other than
+	// the ChangeKey of a previously seen item are not sent to the client
+	SuppressNoopUpdates bool
+
+	// maximum number of items remembered for SuppressNoopUpdates
+	NoopUpdateCacheSize int
+
+	// If set, the DisplayName of well-known folders in responses is replaced,
+	// see ews_folder_names.go
+	FolderNames FolderNameMap
+
+	// If true, the ChangeKey is removed from the ItemIds sent with DeleteItem,
+	// MoveItem and SendItem requests, as those operations don't need it
+	StripStaleChangeKeys bool
+
+	// If true, items and folders in responses that cannot be translated are
+	// left out (and listed in the X-EwsProxy-SkippedItems header) instead of
+	// failing the whole response
+	BestEffortLists bool
+
+	// how deep item attachments can be nested in a response, 0 is
+	// DefaultMaxAttachmentDepth
+	MaxAttachmentDepth int
+
+	// If true, translated responses only declare the m: and t: namespaces
+	// when they use them, see JSON2SOAPOptions. Streamed responses always
+	// declare both.
+	OmitUnusedNamespaces bool
+
+	// format of date-time values in translated requests and responses, see
+	// ews_datetime.go. The zero value leaves them unchanged.
+	RequestDateTimes  DateTimeFormat
+	ResponseDateTimes DateTimeFormat
+
+	// limits of the requests that are translated, 0 is
+	// DefaultMaxRequestDepth and DefaultMaxRequestTokens
+	MaxRequestDepth  int
+	MaxRequestTokens int
+
+	// the URL that clients use to reach the proxy, it is the service
+	// location in Services.wsdl. If nil, the Host of the request is used.
+	SourceServer *url.URL
+
+	// If true, the members of translated requests are put in schema order
+	// so that requests can be compared, see ews_canonical.go. Not needed for
+	// live traffic.
+	CanonicalizeJSON bool
+
+	// If true, translated requests are checked against the shape that OWA
+	// expects before they are sent, and fail with a translation fault that
+	// names the offending member, see ews_validate_outbound.go. Meant for
+	// testing changes to the type tables and request hooks.
+	ValidateOutbound bool
+
+	// Requests larger than this many bytes are streamed to the server
+	// instead of being held in memory, 0 disables streaming
+	StreamThreshold int64
+
+	// If true, operations listed in experimentalOperations are translated,
+	// otherwise they are rejected
+	Experimental bool
+
+	// If set, operations that it denies are answered with an
+	// ErrorAccessDenied SOAP fault instead of being sent to the server. Use
+	// SetPolicy once the proxy is running.
+	Policy *ActionPolicy
+
+	// Operations that are answered with a SOAP fault instead of being sent
+	// to OWA, see ews_declined_operations.go
+	DeclinedOperations map[string]DeclinedOperation
+
+	// If true, GetAppManifests and GetClientAccessToken are answered by the
+	// proxy as if there were no add-ins, see ews_extensions.go
+	SynthesizeEmptyExtensions bool
+
+	// Maximum number of translated requests that are sent to OWA at the same
+	// time, others wait for up to ConcurrencyWait and then get an
+	// ErrorServerBusy SOAP fault. 0 disables the limit, see
+	// ews_concurrency.go
+	MaxConcurrentRequests int
+	ConcurrencyWait       time.Duration
+
+	// How long the server gets to answer a translated request, 0 for no
+	// limit (other than the WriteTimeout of the server). Operations that are
+	// LongRunning get LongRunningTimeout instead, and are never sent twice,
+	// see ews_long_running.go.
+	UpstreamTimeout    time.Duration
+	LongRunningTimeout time.Duration
+
+	// Maximum number of requests that are translated at the same time,
+	// others wait for one of them to be done. 0 disables the limit, less
+	// than 0 is GOMAXPROCS, see ews_translation_workers.go
+	TranslationWorkers int
+
+	// If set, the content of file attachments returned by GetAttachment is
+	// kept, and requests for them are answered by the proxy, see
+	// ews_attachment_cache.go
+	AttachmentCache *AttachmentCache
+
+	// If set, the SyncState of SyncFolderItems responses is kept, and
+	// clients get a short token instead, see ews_sync_state.go
+	SyncStates *SyncStateStore
+
+	// If set, requests are also sent to a native EWS endpoint and the client
+	// gets its response instead of the translated one, see ews_shadow.go.
+	// Streamed requests are not shadowed. Experimental.
+	Shadow *ShadowEws
+
+	// If set, this is called in the background when a timeout is detected,
+	// and OnEwsTimeout is only called if it returns false (see
+	// LoginMiddleware.Relogin)
+	Relogin func() bool
+
 	// function pointers controlling various aspects of the transport
 	OnEwsLogin            func() // called whenever a login occurs. probably.
 	OnEwsSuccess          func() // called whenever a successful EWS transaction occurs
 	OnEwsTimeout          func() // called whenever an EWS timeout is detected
 	OnEwsTranslationError func(transactionLog *bytes.Buffer)
 
-	lock     sync.Mutex
-	loggedIn bool
+	// called when the state of the OWA session changes, in the order of the
+	// changes, see ews_session_state.go. It must not block for long.
+	OnStateChange func(old, new SessionState)
+
+	// what the translator, the login middlewares and the chain of NewProxy
+	// throttle, back off and keep alive with. Tests use a
+	// proxyutils.FakeClock
+	Clock proxyutils.Clock
+
+	// returns the random part of request IDs (see ews_soap_fault.go)
+	NewRequestId func() string
+
+	lock         sync.Mutex
+	loggedIn     bool
+	relogging    bool
+	backOffUntil time.Time // see ews_backoff.go
+
+	// see ews_session_state.go, stateLock serializes the changes
+	sessionState  SessionState
+	networkErrors int
+	stateLock     sync.Mutex
+
+	// ring of the results of CheckLogin, see ews_login_history.go
+	loginChecks     []LoginCheck
+	loginChecksNext int
+
+	// incremented by setCanary, see ews_login_session.go
+	loginSession uint64
+
+	noopLock   sync.Mutex
+	noopFilter *noopUpdateFilter
+
+	limiter requestLimiter
+	workers requestLimiter
+
+	// see AddRequestHook, protected by lock
+	requestHooks map[string][]RequestHookFunc
 }
 
+// ValidateTables is only logged once
+var validateTablesOnce sync.Once
+
 // Creates an TranslationMiddleware object with lots of defaults filled in
 func NewTranslationMiddleware() *TranslationMiddleware {
+	validateTablesOnce.Do(func() {
+		if err := ValidateTables(); err != nil {
+			Log.Warn.Printf("Warning: %s", err)
+		}
+	})
+
 	transport := &TranslationMiddleware{
 		Debug:          false,
 		EwsPath:        "/ews/exchange.asmx",
 		OwaServicePath: "/owa/service.svc",
+		StatusPath:     "/status",
+		Server:         &ServerInfo{},
+		Skew:           proxyutils.NewSkewTracker(),
+
+		NoopUpdateCacheSize: 10000,
+		StreamThreshold:     1024 * 1024,
+
+		DeclinedOperations: DefaultDeclinedOperations,
+
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests,
+		ConcurrencyWait:       DefaultConcurrencyWait,
+
+		LongRunningTimeout: DefaultLongRunningTimeout,
 
 		OnEwsLogin:            func() {},
 		OnEwsSuccess:          func() {},
 		OnEwsTimeout:          func() {},
 		OnEwsTranslationError: func(*bytes.Buffer) {},
+		OnStateChange:         func(old, new SessionState) {},
+
+		Clock:        proxyutils.RealClock,
+		NewRequestId: newRequestId,
+
+		sessionState: SessionUnauthenticated,
 	}
 
 	return transport
@@ -61,19 +283,51 @@ func NewTranslationMiddleware() *TranslationMiddleware {
 type ewsProxyContext struct {
 	EwsProxyOp     *OpDescriptor
 	TransactionLog *bytes.Buffer
+
+	// identifies the request in the transaction log and in faults
+	RequestId string
+
+	// native response when Shadow is set
+	shadow <-chan *shadowResult
+
+	// frees the request slot, nil if the request doesn't have one
+	release func()
+
+	// set if the attachments in the response are stored in the
+	// AttachmentCache, identifies the session
+	attachmentOwner string
+
+	// the folder of a SyncFolderItems request, if SyncStates is set
+	syncFolder string
+
+	// what the translation of the request and the response changed
+	notes FidelityNotes
 }
 
-func (this *TranslationMiddleware) RequestModifier(request *http.Request, cctx proxyutils.ChainContext) error {
+func (this *TranslationMiddleware) RequestModifier(reqCtx context.Context, request *http.Request, cctx *proxyutils.ChainValues) error {
 
-	// mangle requests to the EWS path only
-	if !strings.EqualFold(request.URL.Path, this.EwsPath) {
+	if proxyutils.IsBypassed(cctx) {
 		return nil
 	}
 
-	// return empty GET response
+	if this.StatusPath != "" && request.URL.Path == this.StatusPath && request.Method == "GET" {
+		return proxyutils.NewRequestError(this.statusResponse(request))
+	}
+
+	// Services.wsdl and the schemas, see ews_schema_files.go
 	if request.Method == "GET" {
-		response := proxyutils.CreateNewResponse(request, "")
-		response.StatusCode = http.StatusOK
+		if response := this.schemaResponse(request); response != nil {
+			return proxyutils.NewRequestError(response)
+		}
+	}
+
+	// mangle requests to the EWS path only
+	if !this.isEwsPath(request.URL.Path) {
+		return nil
+	}
+
+	// health checks, see ews_service_page.go
+	if response := this.ewsPathResponse(request); response != nil {
 		return proxyutils.NewRequestError(response)
 	}
 
@@ -83,146 +337,658 @@ func (this *TranslationMiddleware) RequestModifier(request *http.Request, cctx p
 	}
 
 	// begin the hard work of translation
+	session := this.currentLoginSession()
 	ctx := &ewsProxyContext{
 		TransactionLog: new(bytes.Buffer),
+		RequestId:      fmt.Sprintf("%d-%s", session, this.NewRequestId()),
+	}
+
+	// so that error reports say which server (and login) it was
+	this.appendTransaction(ctx, this.Server.String())
+	this.appendTransaction(ctx, this.Skew.String())
+	this.appendTransaction(ctx, fmt.Sprintf("Login session %d", session))
+	this.appendTransaction(ctx, "Request ID "+ctx.RequestId)
+
+	// declined operations don't need a login, and may not be translatable
+	if response := this.declineResponse(request, ctx, soapAction(request)); response != nil {
+		return proxyutils.NewRequestError(response)
 	}
 
 	// are we authenticated?
-	canary := this.OwaCanary
+	canary := this.credential()
 	if canary == "" {
 
-		if this.Debug {
-			log.Println("EWS request, but no canary present")
+		if this.isDebug() {
+			Log.Info.Println("EWS request, but no canary present")
 		}
+		this.appendTransaction(ctx, this.recentLoginChecks())
 
 		response := proxyutils.CreateNewResponse(request, "")
 		response.StatusCode = 440 // MS LoginTimeout
 
 		// throttle client, as it won't expect this and may keep asking
-		time.Sleep(5 * time.Second)
+		this.Clock.Sleep(5 * time.Second)
 
 		return proxyutils.NewRequestError(response)
 	} else {
 		// translate the XML body of the request to JSON
-		var ewsRequestData []byte
+		// -> large requests are streamed to the server instead of being
+		//    buffered, see soap2json_stream.go
+		var jsonRequest *JsonRequest
 		var jsonRequestData []byte
 		var err error
 
-		ewsRequestData, err = proxyutils.ReadGzipBody(&request.Header, request.Body)
-		if err != nil {
-			return err
+		// the request for shadow mode, nil if it is streamed
+		var soapData []byte
+
+		stream := this.StreamThreshold > 0 && (request.ContentLength > this.StreamThreshold ||
+			(request.ContentLength < 0 && bulkDataOperations[soapAction(request)]))
+
+		if stream {
+			var body io.ReadCloser
+			if body, err = proxyutils.OpenGzipBody(&request.Header, request.Body); err != nil {
+				return err
+			}
+
+			this.appendTransaction(ctx, "EWS question")
+			if request.ContentLength < 0 {
+				this.appendTransaction(ctx, "(unknown length, not logged)")
+			} else {
+				this.appendTransaction(ctx, fmt.Sprintf("(%d bytes, not logged)", request.ContentLength))
+			}
+
+			xmlBody := proxyutils.NewXmlBodyReader(body, request.Header.Get("Content-Type"))
+			jsonRequest, err = ParseSOAPWithOptions(xmlBody, this.soapOptions(request))
+			body.Close()
+			if err == nil {
+				ctx.EwsProxyOp = jsonRequest.Op
+			}
+
+		} else {
+			var body io.ReadCloser
+			if body, err = this.bufferBody(request.Body); err != nil {
+				return err
+			}
+
+			var done func()
+			if done, err = this.acquireWorker(reqCtx); err != nil {
+				return err
+			}
+			defer done()
+
+			var ewsRequestData []byte
+			ewsRequestData, err = proxyutils.ReadGzipBody(&request.Header, body)
+			if err != nil {
+				return err
+			}
+
+			// the native endpoint gets the request as the client sent it
+			soapData = ewsRequestData
+
+			// the log and the translator get UTF-8 without anything in front
+			// of the XML declaration
+			xmlBody := proxyutils.NewXmlBodyReader(bytes.NewReader(ewsRequestData), request.Header.Get("Content-Type"))
+			if ewsRequestData, err = ioutil.ReadAll(xmlBody); err != nil {
+				return errors.Wrapf(err, "reading request body")
+			}
+
+			this.appendTransaction(ctx, "EWS question")
+			this.appendTransaction(ctx, string(ewsRequestData))
+
+			// same as SOAP2JSONWithAction, but the message is kept so the
+			// headers can be looked at
+			if jsonRequest, err = ParseSOAPWithOptions(bytes.NewReader(ewsRequestData), this.soapOptions(request)); err == nil {
+				ctx.EwsProxyOp = jsonRequest.Op
+				jsonRequestData, err = json.Marshal(jsonRequest.msg)
+			}
+			done()
 		}
 
-		this.appendTransaction(ctx, "EWS question")
-		this.appendTransaction(ctx, string(ewsRequestData))
+		if err == nil && this.ValidateOutbound {
+			err = jsonRequest.ValidateOutbound()
+		}
 
-		jsonRequestData, ctx.EwsProxyOp, err = SOAP2JSON(bytes.NewReader(ewsRequestData))
 		if err != nil {
 			this.appendTransaction(ctx, "Ews Translator: Request Error: "+err.Error())
 			this.OnEwsTranslationError(ctx.TransactionLog)
 
-			// TODO
 			// throttle client -- need to slow davmail/macmail down as they won't
 			// expect this type of error
-			time.Sleep(time.Second)
-			return err
+			this.Clock.Sleep(time.Second)
+
+			operation := soapAction(request)
+			if ctx.EwsProxyOp != nil {
+				operation = ctx.EwsProxyOp.Action
+			}
+			fault := createTranslationFault(request, &TranslationError{
+				RequestId: ctx.RequestId,
+				Operation: operation,
+				Err:       err,
+			})
+			if soapData != nil && this.shadowAllowed(operation) {
+				ctx.shadow = this.Shadow.send(soapData, request.Header)
+				this.useShadowResponse(ctx, operation, fault, nil)
+			}
+			return proxyutils.NewRequestError(fault)
+		}
+
+		for _, note := range jsonRequest.Notes {
+			ctx.notes.add("%s", note)
+			this.appendTransaction(ctx, "Ews Translator: note: "+note)
+		}
+
+		if this.SyncStates != nil && ctx.EwsProxyOp.Action == "SyncFolderItems" {
+			ctx.syncFolder = syncFolderId(jsonRequest)
+		}
+
+		if this.SuppressNoopUpdates && ctx.EwsProxyOp.Action == "SyncFolderItems" {
+			this.confirmNoopUpdates(requestSyncState(jsonRequest))
+		}
+
+		// for clients that don't send a SOAPAction header
+		if response := this.declineResponse(request, ctx, ctx.EwsProxyOp.Action); response != nil {
+			return proxyutils.NewRequestError(response)
+		}
+
+		if experimentalOperations[ctx.EwsProxyOp.Action] && !this.Experimental {
+			return this.requestFault(request, ctx, errors.Errorf("%s is experimental and is disabled", ctx.EwsProxyOp.Action))
+		}
+
+		if policy := this.actionPolicy(); policy != nil && !policy.check(ctx.EwsProxyOp.Action) {
+			this.appendTransaction(ctx, "Ews Translator: "+ctx.EwsProxyOp.Action+" is denied by the action policy")
+			return proxyutils.NewRequestError(createSoapFault(request, "ErrorAccessDenied",
+				"The "+ctx.EwsProxyOp.Action+" operation is not allowed by the proxy."))
+		}
+
+		var synthesized *http.Response
+		if synthesized, err = this.synthesizedResponse(request, ctx); err != nil {
+			return this.requestFault(request, ctx, err)
+		} else if synthesized != nil {
+			return proxyutils.NewRequestError(synthesized)
+		}
+
+		var cached *http.Response
+		if cached, err = this.cachedAttachmentResponse(request, ctx, jsonRequest, canary); err != nil {
+			return this.requestFault(request, ctx, err)
+		} else if cached != nil {
+			return proxyutils.NewRequestError(cached)
+		}
+
+		var busy *http.Response
+		if busy, err = this.acquireSlot(reqCtx, request, ctx); err != nil {
+			return this.requestFault(request, ctx, err)
+		} else if busy != nil {
+			return proxyutils.NewRequestError(busy)
+		}
+
+		// only once the proxy has accepted the request, and OWA will get it
+		if soapData != nil && this.shadowAllowed(ctx.EwsProxyOp.Action) {
+			ctx.shadow = this.Shadow.send(soapData, request.Header)
+		}
+
+		// route impersonated requests to the impersonated mailbox, unless the
+		// client already said where they should go
+		if request.Header.Get("X-AnchorMailbox") == "" {
+			if mailbox := jsonRequest.ImpersonatedMailbox(); mailbox != "" {
+				request.Header.Set("X-AnchorMailbox", mailbox)
+			}
 		}
 
 		this.appendTransaction(ctx, "OWA JSON question")
-		this.appendTransaction(ctx, string(jsonRequestData))
 
-		SetupOwaRequest(this, request, jsonRequestData, ctx.EwsProxyOp.Action, canary)
+		if stream {
+			// serialize once without keeping the output to find the length,
+			// so the server doesn't have to deal with a chunked upload
+			var length int64
+			if length, err = jsonRequest.WriteTo(ioutil.Discard); err != nil {
+				if ctx.release != nil {
+					ctx.release()
+				}
+				return err
+			}
+
+			this.appendTransaction(ctx, fmt.Sprintf("(%d bytes, not logged)", length))
+			SetupOwaStreamingRequest(this, request, jsonRequest, length, canary)
+		} else {
+			this.appendTransaction(ctx, string(jsonRequestData))
+			SetupOwaRequest(this, request, jsonRequestData, ctx.EwsProxyOp.Action, canary)
+		}
+
+		this.setUpstreamOptions(reqCtx, ctx, cctx)
 
 		// store context for the translation response
-		cctx[ewsContextName] = ctx
+		cctx.Set(ewsContextName, ctx)
 	}
 
 	return nil
 }
 
-func (this *TranslationMiddleware) ResponseModifier(response *http.Response, cctx proxyutils.ChainContext) error {
+func (this *TranslationMiddleware) ResponseModifier(reqCtx context.Context, response *http.Response, cctx *proxyutils.ChainValues) error {
 
 	var err error
+	var translated []byte
 
 	// if our context isn't present, exit
-	if _, ok := cctx[ewsContextName]; !ok {
+	value, ok := cctx.Lookup(ewsContextName)
+	if !ok {
 		return nil
 	}
 
-	ctx := cctx["ews_ctx"].(*ewsProxyContext)
+	ctx := value.(*ewsProxyContext)
+	if ctx.release != nil {
+		defer ctx.release()
+	}
+
+	this.Server.Update(response.Header)
+
+	if isGatewayError(response.StatusCode) {
+		this.onNetworkError()
+	}
 
 	if response.StatusCode == 440 { // MS LoginTimeout
 		this.onTimeout()
 
+	} else if response.StatusCode == http.StatusGatewayTimeout && ctx.EwsProxyOp.LongRunning {
+		// the timeout of the proxy, or of a gateway in front of OWA
+		this.setLongRunningFault(ctx, response)
+
 	} else if response.StatusCode != http.StatusFound &&
 		response.StatusCode != http.StatusGatewayTimeout {
 		// translate the response into XML SOAP
 
+		var body io.ReadCloser
+		if body, err = this.bufferBody(response.Body); err != nil {
+			return err
+		}
+
+		var done func()
+		if done, err = this.acquireWorker(reqCtx); err != nil {
+			return err
+		}
+		defer done()
+
 		// read it into memory so we can output the json for debug purposes
 		var jsonResponseData []byte
-		jsonResponseData, err = proxyutils.ReadGzipBody(&response.Header, response.Body)
+		response.Body = body
+		jsonResponseData, err = proxyutils.ReadResponseBody(response)
 		if err != nil {
 			return err
 		}
 
+		// the client went away while the response was being read
+		if reqCtx.Err() != nil {
+			return reqCtx.Err()
+		}
+
+		// OWA sends UTF-8, but gateways in front of it have been seen to
+		// transcode the JSON and say so in the charset
+		if jsonResponseData, err = proxyutils.DecodeBody(jsonResponseData, response.Header.Get("Content-Type")); err != nil {
+			ctx.notes.add("%s, the response was read as UTF-8", err)
+			err = nil
+		}
+
 		this.appendTransaction(ctx, "OWA JSON response:")
-		this.appendTransaction(ctx, string(jsonResponseData))
+		if bulkDataOperations[ctx.EwsProxyOp.Action] && this.StreamThreshold > 0 &&
+			int64(len(jsonResponseData)) > this.StreamThreshold {
+			this.appendTransaction(ctx, fmt.Sprintf("(%d bytes, not logged)", len(jsonResponseData)))
+		} else {
+			this.appendTransaction(ctx, string(jsonResponseData))
+		}
+
+		if backOff := serverBusyBackOff(jsonResponseData); backOff > 0 {
+			this.appendTransaction(ctx, fmt.Sprintf("Server is busy, backing off for %s", backOff))
+			this.setBackOff(backOff)
+		}
+
+		if this.SuppressNoopUpdates && ctx.EwsProxyOp.Action == "SyncFolderItems" {
+			jsonResponseData, err = this.suppressNoopUpdates(ctx, jsonResponseData)
+			if err != nil {
+				return err
+			}
+		}
+
+		if this.SyncStates != nil && ctx.EwsProxyOp.Action == "SyncFolderItems" && response.StatusCode == http.StatusOK {
+			if jsonResponseData, err = this.storeSyncStates(ctx, jsonResponseData); err != nil {
+				return err
+			}
+		}
+
+		if len(this.FolderNames) != 0 {
+			var renamed int
+			if jsonResponseData, renamed, err = this.FolderNames.rewrite(jsonResponseData); err != nil {
+				return err
+			}
+			if renamed != 0 {
+				this.appendTransaction(ctx, fmt.Sprintf("Renamed %d well-known folders", renamed))
+			}
+		}
+
+		// the notes of the request are already in the transaction log
+		requestNotes := len(ctx.notes)
 
 		outbuf := new(bytes.Buffer)
-		err = JSON2SOAP(bytes.NewReader(jsonResponseData), ctx.EwsProxyOp, outbuf, false)
-		if err != nil {
+		var skipped []SkippedItem
+		fault := publicFolderFault(jsonResponseData)
+		if fault == nil {
+			skipped, err = JSON2SOAPWithOptions(bytes.NewReader(jsonResponseData), ctx.EwsProxyOp, outbuf,
+				JSON2SOAPOptions{
+					BestEffortLists:      this.BestEffortLists,
+					Notes:                &ctx.notes,
+					MaxAttachmentDepth:   this.MaxAttachmentDepth,
+					OmitUnusedNamespaces: this.OmitUnusedNamespaces,
+					DateTimes:            this.ResponseDateTimes,
+				})
+		}
+		done()
+		if fault != nil {
+			this.appendTransaction(ctx, "Ews Translator: OWA refused the public folder operation with "+fault.ResponseCode)
+			setSoapFault(response, "ErrorPublicFolderRequestProcessingFailed", fault.FaultMessage, fault.faultValues()...)
+
+		} else if err != nil {
 			this.appendTransaction(ctx, "Ews Translator: Response Error: "+err.Error())
 			this.OnEwsTranslationError(ctx.TransactionLog)
 
-			response.StatusCode = http.StatusInternalServerError
+			// the JSON is only in the transaction log
 			response.Header.Set("X-EwsProxyError", fmt.Sprintf("%s", err))
-			response.Body = ioutil.NopCloser(bytes.NewReader(jsonResponseData))
-			response.ContentLength = int64(len(jsonResponseData))
+			setTranslationFault(response, &TranslationError{
+				RequestId: ctx.RequestId,
+				Operation: ctx.EwsProxyOp.Action,
+				Response:  true,
+				Err:       err,
+			})
 
 			// throttle client -- need to slow davmail/macmail down as they won't
 			// expect this type of error
-			time.Sleep(time.Second)
+			select {
+			case <-this.Clock.After(time.Second):
+			case <-reqCtx.Done():
+			}
 			err = nil
 
 		} else {
+			translated = outbuf.Bytes()
+
+			if len(skipped) != 0 {
+				this.skippedItems(ctx, response, skipped)
+			}
+
+			this.responseNotes(ctx, response, requestNotes)
+
 			response.Header.Set("Content-Type", "text/xml; charset=utf-8")
+			// the length of the JSON isn't the length of the SOAP, the server
+			// works it out (or closes the connection for HTTP/1.0 clients)
+			response.Header.Del("Content-Length")
 			response.Body = ioutil.NopCloser(outbuf)
 			response.ContentLength = int64(outbuf.Len())
 
 			if response.StatusCode == http.StatusOK {
 				this.onSuccess()
+
+				if ctx.attachmentOwner != "" {
+					this.cacheAttachments(ctx, jsonResponseData)
+				}
 			}
 		}
 	}
 
+	if ctx.shadow != nil {
+		this.useShadowResponse(ctx, ctx.EwsProxyOp.Action, response, translated)
+	}
+
 	return err
 }
 
+// reports the items that were left out of a response because of
+// BestEffortLists
+func (this *TranslationMiddleware) skippedItems(ctx *ewsProxyContext, response *http.Response, skipped []SkippedItem) {
+	names := make([]string, len(skipped))
+	for i, item := range skipped {
+		names[i] = fmt.Sprintf("%s[%d]", item.List, item.Index)
+		this.appendTransaction(ctx, fmt.Sprintf("Skipped %s: %s", names[i], item.Err))
+	}
+
+	Log.Warn.Printf("%s response: skipped %d items that could not be translated", ctx.EwsProxyOp.Action, len(skipped))
+	response.Header.Set("X-EwsProxy-SkippedItems", strings.Join(names, ","))
+}
+
+// logs what the translation of the response changed, and lists everything
+// that was changed in the X-EwsProxy-Notes header when Debug is on
+func (this *TranslationMiddleware) responseNotes(ctx *ewsProxyContext, response *http.Response, requestNotes int) {
+	for _, note := range ctx.notes[requestNotes:] {
+		this.appendTransaction(ctx, "Ews Translator: note: "+note)
+	}
+
+	if this.isDebug() && len(ctx.notes) != 0 {
+		response.Header.Set("X-EwsProxy-Notes", strings.Join(ctx.notes, "; "))
+	}
+}
+
+// requestFault returns the fault for a request that was parsed, but that the
+// proxy can't send to OWA
+func (this *TranslationMiddleware) requestFault(request *http.Request, ctx *ewsProxyContext, err error) error {
+	this.appendTransaction(ctx, "Ews Translator: Request Error: "+err.Error())
+	return proxyutils.NewRequestError(createTranslationFault(request, &TranslationError{
+		RequestId: ctx.RequestId,
+		Operation: ctx.EwsProxyOp.Action,
+		Err:       err,
+	}))
+}
+
+// the client sent back the SyncState of a response, so it got the items
+func (this *TranslationMiddleware) confirmNoopUpdates(syncState string) {
+	if syncState == "" {
+		return
+	}
+
+	this.noopLock.Lock()
+	defer this.noopLock.Unlock()
+
+	if this.noopFilter != nil {
+		this.noopFilter.confirm(syncState)
+	}
+}
+
+func (this *TranslationMiddleware) suppressNoopUpdates(ctx *ewsProxyContext, jsonResponseData []byte) ([]byte, error) {
+	this.noopLock.Lock()
+	defer this.noopLock.Unlock()
+
+	if this.noopFilter == nil {
+		this.noopFilter = newNoopUpdateFilter(this.NoopUpdateCacheSize)
+	}
+
+	filtered, dropped, err := this.noopFilter.filter(jsonResponseData)
+	if err != nil {
+		return nil, err
+	}
+
+	if dropped != 0 {
+		this.appendTransaction(ctx, fmt.Sprintf("Suppressed %d no-op updates", dropped))
+	}
+
+	return filtered, nil
+}
+
+// ProxyStatus is what StatusPath returns
+type ProxyStatus struct {
+	LoggedIn         bool         `json:"loggedIn"`
+	State            SessionState `json:"state"`
+	ExchangeVersion  string       `json:"exchangeVersion,omitempty"`
+	ExchangeFrontEnd string       `json:"exchangeFrontEnd,omitempty"`
+	ClockSkew        string       `json:"clockSkew,omitempty"`
+	ClockSkewWarning bool         `json:"clockSkewWarning,omitempty"`
+
+	// requests denied by the action policy, by operation
+	DeniedOperations map[string]int `json:"deniedOperations,omitempty"`
+
+	// translated requests that are being sent to OWA, and that are waiting
+	// for MaxConcurrentRequests
+	ActiveRequests int `json:"activeRequests"`
+	QueuedRequests int `json:"queuedRequests"`
+
+	// the results of the last MaxLoginChecks checks of the login
+	LoginChecks *LoginCheckSummary `json:"loginChecks,omitempty"`
+
+	// the number of the current login, see ews_login_session.go
+	LoginSession uint64 `json:"loginSession"`
+
+	// only set if TranslationWorkers is used
+	TranslationWorkers *TranslationWorkerStatus `json:"translationWorkers,omitempty"`
+
+	// only set if SyncStates is used
+	SyncStates *SyncStateStatus `json:"syncStates,omitempty"`
+}
+
+// Status returns the current state of the proxy, as returned by StatusPath
+func (this *TranslationMiddleware) Status() ProxyStatus {
+	status := ProxyStatus{LoggedIn: this.isLoggedIn(), State: this.SessionState()}
+
+	status.ExchangeVersion, status.ExchangeFrontEnd = this.Server.Version()
+	if skew, ok := this.Skew.Skew(); ok {
+		status.ClockSkew = skew.String()
+		status.ClockSkewWarning = this.Skew.Exceeded()
+	}
+	if policy := this.actionPolicy(); policy != nil {
+		status.DeniedOperations = policy.Denied()
+	}
+	status.ActiveRequests, status.QueuedRequests = this.limiter.counts()
+	status.LoginChecks = this.loginCheckSummary()
+	status.LoginSession = this.currentLoginSession()
+	status.TranslationWorkers = this.translationWorkerStatus()
+	if this.SyncStates != nil {
+		status.SyncStates = this.SyncStates.status()
+	}
+	return status
+}
+
+func (this *TranslationMiddleware) statusResponse(request *http.Request) *http.Response {
+	data, _ := json.Marshal(this.Status())
+	response := proxyutils.CreateNewResponse(request, string(data))
+	response.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return response
+}
+
+// returns true for EwsPath, with or without PathPrefix
+func (this *TranslationMiddleware) isEwsPath(p string) bool {
+	return strings.EqualFold(p, this.EwsPath) ||
+		(this.PathPrefix != "" && strings.EqualFold(p, this.PathPrefix+this.EwsPath))
+}
+
+// returns the operation named in the SOAPAction header, which is optional
+// and only trusted for choosing how to read the body, or when the operation
+// in the body isn't known (see SOAP2JSONWithAction)
+func soapAction(request *http.Request) string {
+	action := strings.Trim(request.Header.Get("SOAPAction"), `"`)
+	return action[strings.LastIndex(action, "/")+1:]
+}
+
+// how the SOAP body of request is translated
+func (this *TranslationMiddleware) soapOptions(request *http.Request) SOAP2JSONOptions {
+	return SOAP2JSONOptions{
+		Action:    soapAction(request),
+		Hook:      this.requestHook,
+		DateTimes: this.RequestDateTimes,
+		MaxDepth:  this.MaxRequestDepth,
+		MaxTokens: this.MaxRequestTokens,
+	}
+}
+
+// returns the canary, or the bearer token if a TokenSource is in use
+func (this *TranslationMiddleware) credential() string {
+	if this.TokenSource != nil {
+		return this.TokenSource.Token()
+	}
+	return this.OwaCanary
+}
+
+// SetupOwaRequest turns request into an OWA JSON request. canary is the
+// value returned by credential()
 func SetupOwaRequest(translator *TranslationMiddleware, request *http.Request, json []byte, action string, canary string) {
 	// replace the body content with the JSON, set appropriate lengths
 	request.Body = ioutil.NopCloser(bytes.NewReader(json))
-	request.ContentLength = int64(len(json))
-	request.Header.Set("Content-Length", strconv.Itoa(len(json)))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(json)), nil
+	}
+
+	setupOwaHeaders(translator, request, int64(len(json)), action, canary)
+}
+
+// SetupOwaStreamingRequest is SetupOwaRequest, but the JSON is written to
+// the body as it is read. length must be the serialized size of jsonRequest.
+func SetupOwaStreamingRequest(translator *TranslationMiddleware, request *http.Request, jsonRequest *JsonRequest, length int64, canary string) {
+	request.GetBody = func() (io.ReadCloser, error) {
+		return jsonRequest.Reader(), nil
+	}
+	request.Body, _ = request.GetBody()
+
+	setupOwaHeaders(translator, request, length, jsonRequest.Op.Action, canary)
+}
+
+func setupOwaHeaders(translator *TranslationMiddleware, request *http.Request, length int64, action string, canary string) {
+	// the client's framing (chunked, or the end of an HTTP/1.0 connection)
+	// doesn't apply to the JSON
+	request.TransferEncoding = nil
+	request.ContentLength = length
+	request.Header.Set("Content-Length", strconv.FormatInt(length, 10))
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	request.URL.Path = translator.OwaServicePath
+	request.URL.Path = proxyutils.AddPathPrefix(translator.PathPrefix, translator.OwaServicePath)
 
 	// set the needed OWA headers
 	request.Header.Set("Action", action)
-	request.Header.Set("X-OWA-Canary", canary)
+	if translator.AnchorMailbox != "" && request.Header.Get("X-AnchorMailbox") == "" {
+		request.Header.Set("X-AnchorMailbox", translator.AnchorMailbox)
+	}
+	if translator.TokenSource != nil {
+		request.Header.Set("Authorization", "Bearer "+canary)
+	} else {
+		request.Header.Set("X-OWA-Canary", canary)
+	}
 	// OWA accepts either this header or POST data in the body
 	// -> prefer the POST body
 	//request.Header.Set("X-OWA-UrlPostData", url.PathEscape(string(jsonRequestData)))
 }
 
 func (this *TranslationMiddleware) appendTransaction(cxt *ewsProxyContext, content string) {
-	if this.Debug {
-		log.Println(content)
+	if this.isDebug() {
+		Log.Info.Println(content)
 	}
 
 	cxt.TransactionLog.WriteString(content)
 	cxt.TransactionLog.WriteRune('\n')
 }
 
+// SetDebug changes Debug while the proxy is running
+func (this *TranslationMiddleware) SetDebug(debug bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Debug = debug
+}
+
+func (this *TranslationMiddleware) isDebug() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.Debug
+}
+
+// SetPolicy changes the action policy while the proxy is running, nil
+// allows all operations
+func (this *TranslationMiddleware) SetPolicy(policy *ActionPolicy) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Policy = policy
+}
+
+func (this *TranslationMiddleware) actionPolicy() *ActionPolicy {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.Policy
+}
+
+func (this *TranslationMiddleware) isLoggedIn() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.loggedIn
+}
+
 func (this *TranslationMiddleware) onSuccess() {
 	loginEvent := false
 	this.lock.Lock()
@@ -235,6 +1001,7 @@ func (this *TranslationMiddleware) onSuccess() {
 	if loginEvent {
 		this.OnEwsLogin()
 	}
+	this.changeSessionState(SessionAuthenticated)
 
 	this.OnEwsSuccess()
 }
@@ -242,7 +1009,30 @@ func (this *TranslationMiddleware) onSuccess() {
 func (this *TranslationMiddleware) onTimeout() {
 	this.lock.Lock()
 	this.loggedIn = false
+	relogin := this.Relogin != nil && !this.relogging
+	if relogin {
+		this.relogging = true
+	}
+	this.lock.Unlock()
+
+	this.changeSessionState(SessionExpired, SessionAuthenticated, SessionDegraded)
+
+	if this.Relogin == nil {
+		this.OnEwsTimeout()
+	} else if relogin {
+		go this.relogin()
+	}
+}
+
+// timeouts that happen while this is running are ignored
+func (this *TranslationMiddleware) relogin() {
+	ok := this.Relogin()
+
+	this.lock.Lock()
+	this.relogging = false
 	this.lock.Unlock()
 
-	this.OnEwsTimeout()
+	if !ok {
+		this.OnEwsTimeout()
+	}
 }
@@ -0,0 +1,201 @@
+package ews
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func newFindPeopleRequest(t *testing.T) *http.Request {
+	data, err := ioutil.ReadFile("testdata/requests/FindPeople_owa.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+	return request
+}
+
+func TestExperimentalOperations(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	err := translator.RequestModifier(context.Background(), newFindPeopleRequest(t), proxyutils.NewChainValues())
+	requestError, ok := err.(*proxyutils.RequestError)
+	if !ok {
+		t.Fatalf("FindPeople should be rejected unless experimental operations are enabled, got %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(requestError.Response.Body)
+	if !strings.Contains(string(body), "ProxyTranslationError") || !strings.Contains(string(body), "RequestId") {
+		t.Errorf("expected a translation fault with the request id, got %s", body)
+	}
+
+	translator.Experimental = true
+
+	request := newFindPeopleRequest(t)
+	if err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Fatal(err)
+	}
+
+	if action := request.Header.Get("Action"); action != "FindPeople" {
+		t.Errorf("expected FindPeople request to be translated, got action %q", action)
+	}
+}
+
+// behind some gateways, OWA responses are gzipped and keep the Content-Length
+// of the compressed body. The client must get all of the translated SOAP
+// anyway.
+func TestGzippedResponse(t *testing.T) {
+	getFolderResponse, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetFolder_owa_counts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getFolder, err := ioutil.ReadFile(filepath.Join("testdata", "requests", "ews_getfolder_comment.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write(getFolderResponse)
+	writer.Close()
+
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer owa.Close()
+
+	server := httptest.NewUnstartedServer(nil)
+	source, _ := url.Parse("http://" + server.Listener.Addr().String())
+	target, _ := url.Parse(owa.URL)
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+
+	proxy, err := NewProxy(&ProxyOptions{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		Transport:  &http.Transport{},
+		Translator: translator,
+		Redirector: redirector,
+		Login:      &LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.Handler = proxy
+	server.Start()
+	defer server.Close()
+
+	expected := new(bytes.Buffer)
+	if err = JSON2SOAP(bytes.NewReader(getFolderResponse), EwsOperations["GetFolder"], expected, false); err != nil {
+		t.Fatal(err)
+	}
+	if expected.Len() <= compressed.Len() {
+		t.Fatal("the compressed response should be shorter than the SOAP")
+	}
+
+	// the client asks for gzip, so that it reaches OWA, and reads the
+	// response as it is
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	request, _ := http.NewRequest("POST", source.String()+"/ews/exchange.asmx", bytes.NewReader(getFolder))
+	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Encoding") != "" {
+		t.Errorf("unexpected response %d %s", response.StatusCode, response.Header)
+	}
+	if !bytes.Equal(body, expected.Bytes()) {
+		t.Errorf("expected %d bytes of SOAP, got %d:\n%s", expected.Len(), len(body), body)
+	}
+}
+
+// sends request through translator.RequestModifier in the background, and
+// waits for it to sleep on the fake clock
+func modifyOnFakeClock(translator *TranslationMiddleware, clock *proxyutils.FakeClock, data string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(data))
+		done <- translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues())
+	}()
+
+	clock.BlockUntil(1)
+	return done
+}
+
+// the response that the client gets after a throttle of d
+func throttledResponse(t *testing.T, clock *proxyutils.FakeClock, done <-chan error, d time.Duration) *http.Response {
+	clock.Advance(d - time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("the client was answered before %s", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case err := <-done:
+		requestError, ok := err.(*proxyutils.RequestError)
+		if !ok {
+			t.Fatalf("expected a response for the client, got %v", err)
+		}
+		return requestError.Response
+	case <-time.After(time.Second):
+		t.Fatalf("the client was not answered after %s", d)
+	}
+	return nil
+}
+
+func TestNoCanaryThrottle(t *testing.T) {
+	clock := proxyutils.NewFakeClock(time.Date(2017, 9, 12, 14, 0, 0, 0, time.UTC))
+	translator := NewTranslationMiddleware()
+	translator.Clock = clock
+
+	done := modifyOnFakeClock(translator, clock, getItemRequest)
+	if response := throttledResponse(t, clock, done, 5*time.Second); response.StatusCode != 440 {
+		t.Errorf("expected a 440, got %d", response.StatusCode)
+	}
+}
+
+func TestTranslationErrorThrottle(t *testing.T) {
+	clock := proxyutils.NewFakeClock(time.Date(2017, 9, 12, 14, 0, 0, 0, time.UTC))
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.Clock = clock
+	translator.NewRequestId = func() string { return "0123456789abcdef" }
+
+	done := modifyOnFakeClock(translator, clock, strings.Replace(getItemRequest, "</m:GetItem>", "", 1))
+	response := throttledResponse(t, clock, done, time.Second)
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), ">0-0123456789abcdef<") {
+		t.Errorf("expected a fault with the request ID, got %d:\n%s", response.StatusCode, body)
+	}
+}
@@ -0,0 +1,96 @@
+package ews
+
+/*
+	The translation of a request and its response (gzip, SOAP to JSON and
+	JSON to SOAP) is done on the goroutine that serves the client. With many
+	clients behind one proxy on a small machine, they all translate at the
+	same time and slow each other down. With TranslationWorkers set, only
+	that many requests are translated at the same time, the others wait in
+	line (first come, first served) until one is done. This doesn't make
+	translating faster, it keeps the machine from thrashing.
+
+	Bodies are read before waiting for a worker, so that no worker waits for
+	the network. Requests and responses that are streamed (see
+	StreamThreshold) are translated while they are sent, and don't use the
+	workers.
+*/
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// TranslationWorkerStatus is the part of the status about TranslationWorkers
+type TranslationWorkerStatus struct {
+	Workers int `json:"workers"`
+	Active  int `json:"active"`
+	Queued  int `json:"queued"`
+
+	// the requests that had to wait for a worker, and how long
+	Waited      int    `json:"waited"`
+	AverageWait string `json:"averageWait"`
+	MaxWait     string `json:"maxWait"`
+}
+
+// returns the number of workers, 0 if they aren't used
+func (this *TranslationMiddleware) translationWorkers() int {
+	if this.TranslationWorkers < 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return this.TranslationWorkers
+}
+
+// waits for a translation worker. The returned function frees it, and can
+// be called more than once.
+func (this *TranslationMiddleware) acquireWorker(reqCtx context.Context) (func(), error) {
+	workers := this.translationWorkers()
+	if workers == 0 {
+		return func() {}, nil
+	}
+
+	if !this.workers.acquire(reqCtx, workers, time.Duration(math.MaxInt64)) {
+		return nil, reqCtx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(this.workers.release)
+	}, nil
+}
+
+// reads body into memory if the workers are used, so that it is there
+// before a worker is taken
+func (this *TranslationMiddleware) bufferBody(body io.ReadCloser) (io.ReadCloser, error) {
+	if this.translationWorkers() == 0 {
+		return body, nil
+	}
+
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// returns nil if the workers aren't used
+func (this *TranslationMiddleware) translationWorkerStatus() *TranslationWorkerStatus {
+	workers := this.translationWorkers()
+	if workers == 0 {
+		return nil
+	}
+
+	status := &TranslationWorkerStatus{Workers: workers}
+	status.Active, status.Queued = this.workers.counts()
+
+	var average, max time.Duration
+	status.Waited, average, max = this.workers.waits()
+	status.AverageWait, status.MaxWait = average.String(), max.String()
+	return status
+}
@@ -0,0 +1,94 @@
+package ews
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// an OWA server that answers every GetItem request right away
+type fastOwa []byte
+
+func (this fastOwa) RoundTrip(request *http.Request) (*http.Response, error) {
+	ioutil.ReadAll(request.Body)
+	return proxyutils.CreateNewResponse(request, string(this)), nil
+}
+
+func TestTranslationWorkers(t *testing.T) {
+	response, err := ioutil.ReadFile("testdata/responses/GetItem_owa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.MaxConcurrentRequests = 0
+	translator.TranslationWorkers = 2
+
+	// the hook is called while the request is translated, it takes a while
+	// so that the requests overlap
+	var translating, maxTranslating int32
+	translator.AddRequestHook("GetItem", func(op *OpDescriptor, body json.OrderedObject) json.OrderedObject {
+		n := atomic.AddInt32(&translating, 1)
+		for max := atomic.LoadInt32(&maxTranslating); n > max && !atomic.CompareAndSwapInt32(&maxTranslating, max, n); {
+			max = atomic.LoadInt32(&maxTranslating)
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&translating, -1)
+		return body
+	})
+
+	proxy := newLimitedProxy(translator, fastOwa(response))
+
+	const clients = 20
+	var wg sync.WaitGroup
+	latencies := make([]time.Duration, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			response, err := sendGetItem(proxy, fmt.Sprintf("item%d", i))
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Errorf("client %d: request failed: %v", i, err)
+				return
+			}
+			ioutil.ReadAll(response.Body)
+			latencies[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	if maxTranslating > 2 {
+		t.Errorf("%d requests were translated at the same time", maxTranslating)
+	}
+
+	status := translator.Status().TranslationWorkers
+	if status == nil || status.Workers != 2 || status.Active != 0 || status.Queued != 0 || status.Waited == 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// the requests wait in line, none of them is left behind
+	maxWait, _ := time.ParseDuration(status.MaxWait)
+	for i, latency := range latencies {
+		if latency > 5*time.Second {
+			t.Errorf("client %d waited %s", i, latency)
+		}
+	}
+	if maxWait <= 0 || maxWait > 5*time.Second {
+		t.Errorf("unexpected maximum wait %s", status.MaxWait)
+	}
+
+	// off by default
+	if status := NewTranslationMiddleware().Status().TranslationWorkers; status != nil {
+		t.Errorf("expected no translation workers, got %+v", status)
+	}
+}
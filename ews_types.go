@@ -6,18 +6,22 @@ package ews
 
 import (
 	"encoding/xml"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
 )
 
 // simple type definitions
 const (
-	T_BOOL = iota
-	T_NUM  = iota
-	T_STR  = iota
-	T_ENUM = iota
-	T_LIST = iota
+	T_BOOL     = iota
+	T_NUM      = iota
+	T_STR      = iota
+	T_ENUM     = iota
+	T_LIST     = iota
+	T_DATETIME = iota
 )
 
 // element is used for initialization only
@@ -57,6 +61,11 @@ type EwsJsonElement struct {
 
 	// used to determine which type should be used
 	XmlChoiceHook XmlChoiceFunc
+
+	// the EwsType that has this element, and the type hints that were
+	// added for more than one XML element (only used by ValidateTables)
+	owner      string
+	collisions []string
 }
 
 type EwsJsonType struct {
@@ -98,6 +107,7 @@ type EwsType struct {
 	JsonListName    string
 	JsonListElement *EwsJsonElement // only set if JsonListName/IsList is
 	JsonHook        JsonHookFunc    // only set if special function is needed
+	XmlHook         XmlHookFunc     // only set if special function is needed
 
 	EnumValues []string // if this is an eumeration, these are the values
 
@@ -112,6 +122,10 @@ type OpDescriptor struct {
 
 	BodyType    string
 	RequestType string
+
+	// the operation can keep the server busy for a long time, see
+	// ews_long_running.go
+	LongRunning bool
 }
 
 func (v *EwsType) Initialize() {
@@ -205,8 +219,9 @@ func (v *EwsType) Initialize() {
 		v.JsonListElement = je
 	}
 
-	// insert the json hook
+	// insert the json and xml hooks
 	v.JsonHook = jsonHooks[v.Name]
+	v.XmlHook = xmlHooks[v.Name]
 
 	// resolve ListItemTypeStr to ListItemType
 	if v.ListItemTypeStr != "" {
@@ -236,6 +251,7 @@ func NewEwsJsonElement(xmlName string, jsonName string, isList bool) *EwsJsonEle
 		IsList:        isList,
 		XmlChoiceHook: xmlChoiceHooks[xmlName],
 		Elements:      make(map[string]*EwsJsonType),
+		owner:         xmlName,
 	}
 }
 
@@ -261,21 +277,98 @@ func (e *EwsJsonElement) addInternal(jt *EwsJsonType) {
 	var types []string
 	if jt.jsonType == "" {
 		// sometimes ews changes the type too... so put both types in
-		s := strings.Split(jt.Type.JsonType, ":")
-		types = []string{jt.Type.JsonType, s[0] + "Type" + ":#Exchange"}
+		types = []string{jt.Type.JsonType, typeHintAlias(jt.Type.JsonType)}
 	} else {
 		types = []string{jt.jsonType}
 	}
 
 	for _, t := range types {
-		// TODO: this could cause decoding errors
-		//if e.Types[t] != nil {
-		//	fmt.Printf("duplicate type!? %s -- %s // %#v\n", e.JsonName, t, jt)
-		//}
+		// the last one wins, which is wrong for the other element unless
+		// a hook chooses the element instead of the hint
+		if old := e.Types[t]; old != nil && old.XmlTag != jt.XmlTag && e.XmlChoiceHook == nil {
+			e.collisions = append(e.collisions, fmt.Sprintf("%s.%s: %s is %s (%s) and %s (%s)",
+				e.owner, e.JsonName, t, old.XmlTag.Local, old.Type.Name, jt.XmlTag.Local, jt.Type.Name))
+		}
 		e.Types[t] = jt
 	}
 }
 
+// the other type hint that is accepted for a JSON type, Foo:#Exchange is
+// also FooType:#Exchange
+func typeHintAlias(jsonType string) string {
+	return strings.Split(jsonType, ":")[0] + "Type" + ":#Exchange"
+}
+
+// hint collisions that ValidateTables doesn't report, key is the type and
+// the JSON name of the element
+var knownTypeHintCollisions = map[string]bool{}
+
+// ValidateTables checks the generated tables for JSON type hints that
+// JSON2SOAP cannot resolve: a hint that more than one XML element of a JSON
+// element was added for (the last one silently wins), and a complex type
+// whose alias hint is the hint of another complex type. The tables are
+// built when the package is initialized, NewTranslationMiddleware logs the
+// result and TestValidateTables fails on it.
+func ValidateTables() error {
+	names := make([]string, 0, len(ewsTypes))
+	hints := make(map[string]string)
+	for name, typ := range ewsTypes {
+		names = append(names, name)
+		if !typ.IsSimple && typ.JsonType != "" {
+			hints[typ.JsonType] = name
+		}
+	}
+	sort.Strings(names)
+
+	var problems []string
+	seen := make(map[string]bool)
+	known := make(map[string]bool)
+
+	for _, name := range names {
+		typ := ewsTypes[name]
+
+		elements := typ.JsonElementList
+		if typ.JsonListElement != nil {
+			elements = append(elements[:len(elements):len(elements)], typ.JsonListElement)
+		}
+
+		for _, e := range elements {
+			key := name + "." + e.JsonName
+			for _, collision := range e.collisions {
+				if knownTypeHintCollisions[key] {
+					known[key] = true
+				} else if !seen[collision] {
+					seen[collision] = true
+					problems = append(problems, collision)
+				}
+			}
+		}
+
+		if typ.IsSimple || typ.JsonType == "" {
+			continue
+		}
+		if other, ok := hints[typeHintAlias(typ.JsonType)]; ok {
+			problems = append(problems, fmt.Sprintf("%s: the alias %s is the type hint of %s",
+				name, typeHintAlias(typ.JsonType), other))
+		}
+	}
+
+	// so that the list doesn't hide a new collision later
+	var stale []string
+	for key := range knownTypeHintCollisions {
+		if !known[key] {
+			stale = append(stale, key+": listed in knownTypeHintCollisions, but there is no collision")
+		}
+	}
+	sort.Strings(stale)
+	problems = append(problems, stale...)
+
+	if len(problems) != 0 {
+		return errors.Errorf("JSON type hint collisions in the generated tables:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
 func (e *EwsJsonElement) IsCharData() bool {
 	return e.Types == nil &&
 		(e.SingleType == nil ||
@@ -283,13 +376,18 @@ func (e *EwsJsonElement) IsCharData() bool {
 }
 
 //
-// two types of hooks present
+// four types of hooks present
 // - JsonHookFunc: modifies JSON that was created from SOAP XML
+// - XmlHookFunc: modifies JSON before it is converted to SOAP XML
 // - XmlChoiceFunc: chooses the EwsType based on the JSON contents
+// - RequestHookFunc: modifies the JSON body of a translated request for an
+//   operation, set at runtime instead of being tied to a type
 //
 
 type JsonHookFunc func(*EwsType, *OrderedObject)
+type XmlHookFunc func(*EwsType, map[string]interface{})
 type XmlChoiceFunc func(*EwsJsonElement, map[string]interface{}) (*EwsJsonType, error)
+type RequestHookFunc func(*OpDescriptor, json.OrderedObject) json.OrderedObject
 
 var jsonHooks = map[string]JsonHookFunc{
 
@@ -299,6 +397,31 @@ var jsonHooks = map[string]JsonHookFunc{
 			obj.Set("ContactDataShape", "Default")
 		}
 	},
+
+	"FindPeopleType": func(t *EwsType, obj *OrderedObject) {
+		_, exists := obj.Get("ShouldResolveOneOffEmailAddress")
+		if !exists {
+			obj.Set("ShouldResolveOneOffEmailAddress", false)
+		}
+	},
+}
+
+// OWA leaves out values that are false, which EWS requires
+var xmlHooks = map[string]XmlHookFunc{
+
+	"EffectiveRightsType": func(t *EwsType, obj map[string]interface{}) {
+		for _, right := range []string{"CreateAssociated", "CreateContents", "CreateHierarchy", "Delete", "Modify", "Read"} {
+			if _, exists := obj[right]; !exists {
+				obj[right] = false
+			}
+		}
+	},
+
+	"RetentionTagType": func(t *EwsType, obj map[string]interface{}) {
+		if _, exists := obj["IsExplicit"]; !exists {
+			obj["IsExplicit"] = false
+		}
+	},
 }
 
 var xmlChoiceHooks = map[string]XmlChoiceFunc{
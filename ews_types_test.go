@@ -0,0 +1,44 @@
+package ews
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// the tables in ews_data.go, so that a schema or codegen change that makes
+// one element shadow another is noticed
+func TestValidateTables(t *testing.T) {
+	if err := ValidateTables(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypeHintCollision(t *testing.T) {
+	typ := ewsTypes["BaseObjectChangedEventType"]
+
+	e := NewEwsJsonElement("TestType", "Events", true)
+	e.add(NewEwsJsonType("t:CreatedEvent", typ))
+	e.add(NewEwsJsonType("t:DeletedEvent", typ))
+
+	// the hint and its alias
+	if len(e.collisions) != 2 || !strings.HasPrefix(e.collisions[0], "TestType.Events: BaseObjectChangedEvent:#Exchange is t:CreatedEvent") {
+		t.Errorf("unexpected collisions %q", e.collisions)
+	}
+
+	// a specific hint for each element is fine
+	e = NewEwsJsonElement("TestType", "Events", true)
+	e.add(&EwsJsonType{Type: typ, XmlTag: xml.Name{Local: "t:CreatedEvent"}, jsonType: "CreatedEvent:#Exchange"})
+	e.add(&EwsJsonType{Type: typ, XmlTag: xml.Name{Local: "t:DeletedEvent"}, jsonType: "DeletedEvent:#Exchange"})
+	if len(e.collisions) != 0 {
+		t.Errorf("unexpected collisions %q", e.collisions)
+	}
+
+	// and so is a hook that chooses the element
+	e = NewEwsJsonElement("SyncFolderHierarchyChangesType", "Changes", true)
+	e.add(NewEwsJsonType("t:Create", ewsTypes["SyncFolderHierarchyCreateOrUpdateType"]))
+	e.add(NewEwsJsonType("t:Update", ewsTypes["SyncFolderHierarchyCreateOrUpdateType"]))
+	if len(e.collisions) != 0 {
+		t.Errorf("unexpected collisions %q", e.collisions)
+	}
+}
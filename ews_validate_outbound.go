@@ -0,0 +1,201 @@
+package ews
+
+/*
+	A mistake in the type tables (or a request hook) produces JSON that OWA
+	rejects with a vague error, or worse, that it accepts and reads
+	differently than the client meant. With ValidateOutbound set, every
+	translated request is checked against what its OpDescriptor says it
+	should look like before it is sent, and fails with an
+	OutboundValidationError that names the offending member instead:
+
+		- the message is {"__type": <RequestType>, "Header": {...}, "Body": {...}}
+		- the Header is a JsonRequestHeaders object
+		- the Body is the request element of the operation, and has no
+		  members that the request type doesn't know about
+		- __type, where there is one, is the first member of its object and
+		  a type hint of the Exchange namespace
+		- no object has a member with an empty key
+
+	The checks only cost a walk over the message, but there's nothing to
+	find once the tables are right, so it's meant for testing new tables
+	and hooks rather than for live traffic.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/virtuald/go-ordered-json"
+)
+
+// OutboundValidationError is a translated request that doesn't have the
+// shape that OWA expects
+type OutboundValidationError struct {
+	Operation string
+	Path      string // JSON path of the member, such as Body.FolderIds[0].__type
+	Problem   string
+}
+
+func (this *OutboundValidationError) Error() string {
+	return fmt.Sprintf("the JSON of %s is invalid at %s: %s", this.Operation, this.Path, this.Problem)
+}
+
+// ValidateOutbound checks the translated request before it is sent to the
+// server, see ews_validate_outbound.go
+func (this *JsonRequest) ValidateOutbound() error {
+	return validateOutbound(this.Op, this.msg)
+}
+
+func validateOutbound(op *OpDescriptor, msg json.OrderedObject) error {
+	fail := func(path string, format string, args ...interface{}) error {
+		return &OutboundValidationError{
+			Operation: op.Action,
+			Path:      path,
+			Problem:   fmt.Sprintf(format, args...),
+		}
+	}
+
+	// what the OpDescriptor says is derived from the action, so a broken
+	// entry is caught here rather than by comparing it with itself
+	requestType := op.Action + "JsonRequest:#Exchange"
+	bodyType := op.Action + "Request:#Exchange"
+	if op.RequestType != requestType {
+		return fail("__type", "the operation has request type %q, expected %q", op.RequestType, requestType)
+	} else if op.BodyType != bodyType {
+		return fail("Body.__type", "the operation has body type %q, expected %q", op.BodyType, bodyType)
+	}
+
+	if err := validateMembers(op, "", msg); err != nil {
+		return err
+	}
+
+	for i, key := range []string{"__type", "Header", "Body"} {
+		if i >= len(msg) {
+			return fail(key, "the member is missing")
+		} else if msg[i].Key != key {
+			return fail(jsonPath("", msg[i].Key), "expected %s here", key)
+		}
+	}
+	if len(msg) > 3 {
+		return fail(jsonPath("", msg[3].Key), "the message only has __type, Header and Body")
+	}
+
+	if msg[0].Value != requestType {
+		return fail("__type", "%v is not %s", msg[0].Value, requestType)
+	}
+
+	header, ok := msg[1].Value.(json.OrderedObject)
+	if !ok {
+		return fail("Header", "expected an object, got %s", jsonKind(msg[1].Value))
+	} else if len(header) == 0 || header[0].Value != "JsonRequestHeaders:#Exchange" {
+		return fail("Header.__type", "expected JsonRequestHeaders:#Exchange")
+	}
+
+	body, ok := msg[2].Value.(json.OrderedObject)
+	if !ok {
+		return fail("Body", "expected the %s object, got %s", bodyType, jsonKind(msg[2].Value))
+	} else if len(body) == 0 || body[0].Value != bodyType {
+		return fail("Body.__type", "expected %s", bodyType)
+	}
+
+	known := requestMembers(op.Request)
+	for _, member := range body {
+		if !known[member.Key] {
+			return fail(jsonPath("Body", member.Key), "%s has no such element", op.Request.Name)
+		}
+	}
+
+	return nil
+}
+
+// members that OWA wants in requests but that aren't in the schema, added
+// by the jsonHooks. Key is the request type, value the JSON names.
+var knownRequestExtras = map[string][]string{
+	"FindPeopleType": {"ShouldResolveOneOffEmailAddress"},
+}
+
+// the members that a translated object of typ can have
+func requestMembers(typ *EwsType) map[string]bool {
+	known := map[string]bool{"__type": true}
+	for _, name := range knownRequestExtras[typ.Name] {
+		known[name] = true
+	}
+	for _, name := range typ.AttrsNames {
+		known[name] = true
+	}
+	if typ.TextAttr != "" {
+		known[typ.TextAttr] = true
+	}
+	if typ.JsonListName != "" {
+		known[typ.JsonListName] = true
+	}
+	for _, elem := range typ.JsonElementList {
+		known[elem.JsonName] = true
+	}
+	for _, e := range typ.JsonDefaults {
+		known[e.JsonName] = true
+	}
+	return known
+}
+
+// checks the keys and the type hints of value and everything in it
+func validateMembers(op *OpDescriptor, path string, value interface{}) error {
+	switch v := value.(type) {
+	case json.OrderedObject:
+		for i, member := range v {
+			memberPath := jsonPath(path, member.Key)
+			if member.Key == "" {
+				return &OutboundValidationError{op.Action, memberPath, "the member has an empty key"}
+			}
+
+			if member.Key == "__type" {
+				hint, ok := member.Value.(string)
+				if !ok || !strings.HasSuffix(hint, ":#Exchange") || len(hint) == len(":#Exchange") {
+					return &OutboundValidationError{op.Action, memberPath, fmt.Sprintf("%v is not a type hint", member.Value)}
+				} else if i != 0 {
+					return &OutboundValidationError{op.Action, memberPath, "the type hint must be the first member"}
+				}
+			}
+
+			if err := validateMembers(op, memberPath, member.Value); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		for i, item := range v {
+			if err := validateMembers(op, path+"["+strconv.Itoa(i)+"]", item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appends key to a JSON path like Body.FolderIds[0], empty keys are
+// quoted so that they can be seen
+func jsonPath(path string, key string) string {
+	if key == "" {
+		key = `""`
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case json.OrderedObject:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,174 @@
+package ews
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateOutboundFixtures(t *testing.T) {
+	testfiles, err := filepath.Glob(filepath.Join("testdata", "requests", "*.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testfile := range testfiles {
+		data, err := ioutil.ReadFile(testfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, err := ParseSOAP(bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", testfile, err)
+		}
+		if err = request.ValidateOutbound(); err != nil {
+			t.Errorf("%s: %s", testfile, err)
+		}
+	}
+}
+
+// breaks the tables the way a mistake in codegen or a hook would, and checks
+// that the error names the member that is wrong
+func TestValidateOutboundBrokenTables(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "requests", "ews_getfolder_comment.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folderShape := ewsTypes["GetFolderType"].TypeByElementName["FolderShape"]
+	shapeType := ewsTypes["FolderResponseShapeType"]
+	folderIdType := ewsTypes["DistinguishedFolderIdType"]
+
+	tests := []struct {
+		name   string
+		tamper func() func()
+		op     func(*OpDescriptor) *OpDescriptor
+		path   string
+	}{
+		{
+			name: "empty JSON name",
+			tamper: func() func() {
+				saved := folderShape.JsonName
+				folderShape.JsonName = ""
+				return func() { folderShape.JsonName = saved }
+			},
+			path: `Body.""`,
+		},
+		{
+			name: "JSON name of another element",
+			tamper: func() func() {
+				saved := folderShape.JsonName
+				folderShape.JsonName = "ItemShape"
+				return func() { folderShape.JsonName = saved }
+			},
+			path: "Body.ItemShape",
+		},
+		{
+			name: "type hint without namespace",
+			tamper: func() func() {
+				saved := folderIdType.JsonType
+				folderIdType.JsonType = "DistinguishedFolderId"
+				return func() { folderIdType.JsonType = saved }
+			},
+			path: "Body.FolderIds[0].__type",
+		},
+		{
+			name: "type hint after the members",
+			tamper: func() func() {
+				saved := shapeType.JsonHook
+				shapeType.JsonHook = func(typ *EwsType, obj *OrderedObject) {
+					obj.Object = append(obj.Object[1:], obj.Object[0])
+				}
+				return func() { shapeType.JsonHook = saved }
+			},
+			path: "Body.FolderShape.__type",
+		},
+		{
+			name: "wrong body type",
+			op: func(op *OpDescriptor) *OpDescriptor {
+				broken := *op
+				broken.BodyType = "GetFoldersRequest:#Exchange"
+				return &broken
+			},
+			path: "Body.__type",
+		},
+		{
+			name: "wrong request type",
+			op: func(op *OpDescriptor) *OpDescriptor {
+				broken := *op
+				broken.RequestType = "GetFolderRequest:#Exchange"
+				return &broken
+			},
+			path: "__type",
+		},
+	}
+
+	for _, test := range tests {
+		var err error
+		func() {
+			if test.tamper != nil {
+				defer test.tamper()()
+			}
+
+			var request *JsonRequest
+			if request, err = ParseSOAP(bytes.NewReader(data), nil); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if test.op != nil {
+				request.Op = test.op(request.Op)
+			}
+			err = request.ValidateOutbound()
+		}()
+
+		validationErr, ok := err.(*OutboundValidationError)
+		if !ok {
+			t.Errorf("%s: expected an OutboundValidationError, got %v", test.name, err)
+		} else if validationErr.Path != test.path || validationErr.Operation != "GetFolder" {
+			t.Errorf("%s: expected the error at %s, got %s", test.name, test.path, err)
+		}
+	}
+
+	// the tables were restored
+	request, err := ParseSOAP(bytes.NewReader(data), nil)
+	if err == nil {
+		err = request.ValidateOutbound()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateOutboundMiddleware(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "requests", "ews_getfolder_comment.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folderShape := ewsTypes["GetFolderType"].TypeByElementName["FolderShape"]
+	saved := folderShape.JsonName
+	folderShape.JsonName = ""
+	defer func() { folderShape.JsonName = saved }()
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.ValidateOutbound = true
+
+	owa := &delayedOwa{}
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+	response, err := newLimitedProxy(translator, owa).RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if owa.count() != 0 {
+		t.Error("the invalid request was sent")
+	}
+	if response.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), `at Body.&#34;&#34;: the member has an empty key`) {
+		t.Errorf("expected a translation fault that names the member, got %d: %s", response.StatusCode, body)
+	}
+}
@@ -0,0 +1,43 @@
+package ewstest_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/virtuald/ews-proxy"
+	"github.com/virtuald/ews-proxy/ewstest"
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+const getItemRequest = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+  <soap:Header><t:RequestServerVersion Version="Exchange2013"/></soap:Header>
+  <soap:Body>
+    <m:GetItem>
+      <m:ItemShape><t:BaseShape>Default</t:BaseShape></m:ItemShape>
+      <m:ItemIds><t:ItemId Id="AAMkAD"/></m:ItemIds>
+    </m:GetItem>
+  </soap:Body>
+</soap:Envelope>`
+
+// An EWS proxy in front of the fake OWA server
+func Example() {
+	owa := ewstest.NewServer(nil)
+	defer owa.Close()
+	owa.RespondWithFile("GetItem", "../testdata/responses/GetItem_owa.json")
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+	translator := ews.NewTranslationMiddleware()
+	redirector := proxyutils.NewRedirectorMiddleware(source, target)
+	login := &ews.LoginMiddleware{Translator: translator, Redirector: redirector, CheckPath: "/owa/"}
+	login.CanaryFinder = login.CookieCanaryFinder
+	login.CheckLogin(owa.Login())
+	proxy, _ := ews.NewProxy(&ews.ProxyOptions{Translator: translator, Redirector: redirector, Login: login})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(getItemRequest)))
+	fmt.Println(w.Code, strings.Contains(w.Body.String(), `<m:GetItemResponseMessage ResponseClass="Success">`))
+	// Output: 200 true
+}
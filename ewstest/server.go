@@ -0,0 +1,290 @@
+// Package ewstest provides a fake OWA server, for testing programs that use
+// ews-proxy without an exchange server. It has the forms based login of an
+// on-premises exchange server, and answers the OWA JSON requests that the
+// proxy sends to /owa/service.svc with canned responses, such as the ones in
+// testdata/responses. Failures can be injected to see how the proxy (and
+// its clients) deal with them.
+package ewstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the credentials accepted by the login form if Options doesn't set them
+const (
+	DefaultUsername = "user"
+	DefaultPassword = "secret"
+)
+
+// DefaultResponse is the answer to actions that have no response set with
+// Respond. It is what the login middleware expects from its keepalive.
+const DefaultResponse = `{"Body":{"ResponseMessages":{"Items":[{"ResponseCode":"NoError","ResponseClass":"Success"}]}}}`
+
+// Options of a Server, the zero value is usable
+type Options struct {
+	// the credentials accepted by the login form, default is
+	// DefaultUsername and DefaultPassword
+	Username string
+	Password string
+
+	// how long a canary is valid after the login, 0 is until Expire is
+	// called
+	CanaryLifetime time.Duration
+
+	// how long service.svc requests take to be answered
+	Latency time.Duration
+}
+
+// Failure is what a service.svc request is answered with instead of its
+// response, see Fail
+type Failure int
+
+const (
+	// 440 Login Timeout, as if the canary had expired
+	LoginTimeout Failure = iota
+
+	// 503 Service Unavailable with a Retry-After header
+	ServiceUnavailable
+
+	// a 200 response that isn't JSON
+	MalformedJson
+)
+
+// Server is a fake OWA server, see NewServer
+type Server struct {
+	*httptest.Server
+
+	options Options
+
+	lock      sync.Mutex
+	password  string
+	sessions  int
+	canary    string // of the current session, "" if it expired
+	expires   time.Time
+	logins    int
+	responses map[string][]byte
+	failures  map[string][]Failure
+	requests  map[string]int
+}
+
+// NewServer starts a fake OWA server, options may be nil. Close it when the
+// test is done.
+//
+// The login form is at /owa/auth/logon.aspx, and is posted to
+// /owa/auth.owa. A successful login starts a session, its canary (canary1,
+// canary2, ...) is set in the X-OWA-CANARY cookie. Requests to
+// /owa/service.svc without the canary of the current session get a 440.
+func NewServer(options *Options) *Server {
+	this := &Server{
+		responses: make(map[string][]byte),
+		failures:  make(map[string][]Failure),
+		requests:  make(map[string]int),
+	}
+	if options != nil {
+		this.options = *options
+	}
+	if this.options.Username == "" {
+		this.options.Username = DefaultUsername
+	}
+	if this.options.Password == "" {
+		this.options.Password = DefaultPassword
+	}
+	this.password = this.options.Password
+
+	this.Server = httptest.NewServer(this)
+	return this
+}
+
+// Respond sets the JSON response to action (the Action header of OWA
+// requests, such as GetItem). It fails if response isn't JSON.
+func (this *Server) Respond(action string, response []byte) error {
+	// the login middleware looks for the response code in compact JSON
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, response); err != nil {
+		return errors.Wrapf(err, "response to %s", action)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.responses[action] = compact.Bytes()
+	return nil
+}
+
+// RespondWithFile is Respond with the content of fileName
+func (this *Server) RespondWithFile(action string, fileName string) error {
+	response, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return this.Respond(action, response)
+}
+
+// Fail answers the next request for action with failure, or the next
+// request for any action if action is "". Calling it more than once fails
+// more requests, in order.
+func (this *Server) Fail(action string, failure Failure) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.failures[action] = append(this.failures[action], failure)
+}
+
+// Login starts a new session as if the login form had been used, and
+// returns its canary
+func (this *Server) Login() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.startSession()
+}
+
+// Canary returns the canary of the current session, "" if there is none
+func (this *Server) Canary() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.sessionExpired() {
+		return ""
+	}
+	return this.canary
+}
+
+// Expire ends the current session, as when it times out
+func (this *Server) Expire() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.canary = ""
+}
+
+// SetPassword changes the password accepted by the login form
+func (this *Server) SetPassword(password string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.password = password
+}
+
+// Logins returns how many times the login form was posted, including the
+// attempts that failed
+func (this *Server) Logins() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.logins
+}
+
+// Requests returns how many service.svc requests there were for action,
+// including the ones that failed
+func (this *Server) Requests(action string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests[action]
+}
+
+func (this *Server) startSession() string {
+	this.sessions++
+	this.canary = fmt.Sprintf("canary%d", this.sessions)
+	if this.options.CanaryLifetime > 0 {
+		this.expires = time.Now().Add(this.options.CanaryLifetime)
+	}
+	return this.canary
+}
+
+func (this *Server) sessionExpired() bool {
+	return this.canary == "" || (this.options.CanaryLifetime > 0 && time.Now().After(this.expires))
+}
+
+// returns the failure that the next request for action gets, if any
+func (this *Server) nextFailure(action string) (Failure, bool) {
+	for _, key := range []string{action, ""} {
+		if failures := this.failures[key]; len(failures) != 0 {
+			this.failures[key] = failures[1:]
+			return failures[0], true
+		}
+	}
+	return 0, false
+}
+
+func (this *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/owa/service.svc" && this.options.Latency > 0 {
+		time.Sleep(this.options.Latency)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/owa/auth/logon.aspx":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, logonPage)
+
+	case "/owa/auth.owa":
+		r.ParseForm()
+		this.logins++
+		if r.Form.Get("username") != this.options.Username || r.Form.Get("password") != this.password {
+			http.Redirect(w, r, "/owa/auth/logon.aspx?reason=2", http.StatusFound)
+			return
+		}
+
+		canary := this.startSession()
+		http.SetCookie(w, &http.Cookie{Name: "X-OWA-CANARY", Value: canary, Path: "/"})
+		http.Redirect(w, r, "/owa/", http.StatusFound)
+
+	case "/owa/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><body>OWA</body></html>")
+
+	case "/owa/service.svc":
+		action := r.Header.Get("Action")
+		if action == "" {
+			action = r.URL.Query().Get("action")
+		}
+		this.requests[action]++
+
+		if this.sessionExpired() || r.Header.Get("X-OWA-Canary") != this.canary {
+			w.WriteHeader(440)
+			return
+		}
+
+		if failure, ok := this.nextFailure(action); ok {
+			switch failure {
+			case LoginTimeout:
+				w.WriteHeader(440)
+			case ServiceUnavailable:
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case MalformedJson:
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				fmt.Fprint(w, `{"Body":{"ResponseMessages":`)
+			}
+			return
+		}
+
+		response, ok := this.responses[action]
+		if !ok {
+			response = []byte(DefaultResponse)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(response)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const logonPage = `<html>
+<body>
+<form action="/owa/auth.owa" method="POST">
+<input type="hidden" name="destination" value="/owa/">
+<input type="text" name="username">
+<input type="password" name="password">
+<input type="submit" value="Sign in">
+</form>
+</body>
+</html>
+`
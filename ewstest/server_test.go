@@ -0,0 +1,135 @@
+package ewstest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// posts an OWA request for action, returns the status and the body
+func serviceRequest(t *testing.T, server *Server, action string, canary string) (int, string) {
+	request, _ := http.NewRequest("POST", server.URL+"/owa/service.svc", strings.NewReader("{}"))
+	request.Header.Set("Action", action)
+	request.Header.Set("X-OWA-Canary", canary)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func TestServerLogin(t *testing.T) {
+	server := NewServer(&Options{Password: "changeme"})
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, password := range []string{DefaultPassword, "changeme"} {
+		response, err := client.PostForm(server.URL+"/owa/auth.owa", url.Values{"username": {DefaultUsername}, "password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		var canary string
+		for _, cookie := range response.Cookies() {
+			if cookie.Name == "X-OWA-CANARY" {
+				canary = cookie.Value
+			}
+		}
+
+		if password == DefaultPassword && (canary != "" || response.Header.Get("Location") != "/owa/auth/logon.aspx?reason=2") {
+			t.Errorf("the wrong password was accepted")
+		} else if password == "changeme" && (canary != "canary1" || server.Canary() != "canary1") {
+			t.Errorf("expected canary1, got %q", canary)
+		}
+	}
+
+	if server.Logins() != 2 {
+		t.Errorf("expected 2 logins, got %d", server.Logins())
+	}
+
+	if status, _ := serviceRequest(t, server, "GetFolder", "canary1"); status != http.StatusOK {
+		t.Errorf("expected the canary to work, got %d", status)
+	}
+
+	server.Expire()
+	if status, _ := serviceRequest(t, server, "GetFolder", "canary1"); status != 440 {
+		t.Errorf("expected 440 after the session expired, got %d", status)
+	}
+}
+
+func TestServerResponses(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	canary := server.Login()
+
+	if err := server.Respond("GetItem", []byte(`{"Body": `)); err == nil {
+		t.Error("a response that isn't JSON was accepted")
+	}
+	if err := server.RespondWithFile("GetItem", "../testdata/responses/GetItem_owa.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, body := serviceRequest(t, server, "GetItem", canary); !strings.HasPrefix(body, `{"Header":`) || strings.Contains(body, "\n") {
+		t.Errorf("unexpected GetItem response %.100s", body)
+	}
+	if _, body := serviceRequest(t, server, "GetFolder", canary); body != DefaultResponse {
+		t.Errorf("unexpected GetFolder response %s", body)
+	}
+
+	server.Fail("GetItem", ServiceUnavailable)
+	server.Fail("", MalformedJson)
+	server.Fail("", LoginTimeout)
+
+	expected := []struct {
+		action string
+		status int
+	}{
+		{"GetFolder", http.StatusOK}, // malformed
+		{"GetItem", http.StatusServiceUnavailable},
+		{"GetItem", 440},
+		{"GetItem", http.StatusOK},
+	}
+	for i, e := range expected {
+		status, body := serviceRequest(t, server, e.action, canary)
+		if status != e.status {
+			t.Errorf("request %d: expected %d, got %d", i, e.status, status)
+		}
+		if i == 0 && body == DefaultResponse {
+			t.Error("the response was not malformed")
+		}
+	}
+
+	if server.Requests("GetItem") != 4 || server.Requests("GetFolder") != 2 {
+		t.Errorf("unexpected request counts %d, %d", server.Requests("GetItem"), server.Requests("GetFolder"))
+	}
+}
+
+func TestServerCanaryLifetime(t *testing.T) {
+	server := NewServer(&Options{CanaryLifetime: 50 * time.Millisecond, Latency: 10 * time.Millisecond})
+	defer server.Close()
+	canary := server.Login()
+
+	start := time.Now()
+	if status, _ := serviceRequest(t, server, "GetFolder", canary); status != http.StatusOK {
+		t.Errorf("expected the canary to work, got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("the request took %s", elapsed)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if status, _ := serviceRequest(t, server, "GetFolder", canary); status != 440 || server.Canary() != "" {
+		t.Errorf("expected the canary to expire, got %d", status)
+	}
+}
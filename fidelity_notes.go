@@ -0,0 +1,26 @@
+package ews
+
+import (
+	"fmt"
+)
+
+// FidelityNotes describe what the translation of a message changed or left
+// out on the way, such as a server version that OWA doesn't accept or a
+// value that isn't in the schema, so that the output can be audited
+type FidelityNotes []string
+
+// add appends a note unless it is already there, it does nothing if this is
+// nil
+func (this *FidelityNotes) add(format string, args ...interface{}) {
+	if this == nil {
+		return
+	}
+
+	note := fmt.Sprintf(format, args...)
+	for _, existing := range *this {
+		if existing == note {
+			return
+		}
+	}
+	*this = append(*this, note)
+}
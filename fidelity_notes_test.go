@@ -0,0 +1,142 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestFidelityNotesRequest(t *testing.T) {
+	data := strings.Replace(getItemRequest, "Exchange2013_SP1", "Exchange2007_SP1", 1)
+
+	jsonRequest, err := ParseSOAPWithAction(strings.NewReader(data), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "RequestServerVersion Exchange2007_SP1 was sent as Exchange2013"
+	if len(jsonRequest.Notes) != 1 || jsonRequest.Notes[0] != expected {
+		t.Errorf("expected the note %q, got %q", expected, jsonRequest.Notes)
+	}
+
+	// nothing to say about a request that is translated as it is
+	if jsonRequest, err = ParseSOAPWithAction(strings.NewReader(getItemRequest), "", nil); err != nil {
+		t.Fatal(err)
+	} else if len(jsonRequest.Notes) != 0 {
+		t.Errorf("unexpected notes %q", jsonRequest.Notes)
+	}
+}
+
+func TestFidelityNotesEnum(t *testing.T) {
+	var notes FidelityNotes
+	dayOfWeek := ewsTypes["DayOfWeekType"]
+	d := &soapDecoder{notes: &notes}
+
+	if converted := convertSimpleToJson(d, dayOfWeek, "Monday"); converted != 1 || len(notes) != 0 {
+		t.Errorf("expected 1 without notes, got %#v %q", converted, notes)
+	}
+
+	// the same note is only added once
+	for i := 0; i < 2; i++ {
+		if converted := convertSimpleToJson(d, dayOfWeek, "Someday"); converted != "Someday" {
+			t.Errorf("expected the raw value, got %#v", converted)
+		}
+	}
+
+	expected := `"Someday" is not a DayOfWeekType value, it was sent as it is`
+	if len(notes) != 1 || notes[0] != expected {
+		t.Errorf("expected the note %q, got %q", expected, notes)
+	}
+}
+
+// read-only properties that clients echo back are left out
+func TestFidelityNotesReadOnly(t *testing.T) {
+	file, err := os.Open("testdata/requests/ews_updateitem_readonly_echo.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	jsonRequest, err := ParseSOAPWithAction(file, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"DisplayCc is read-only, it was left out",
+		"DisplayTo is read-only, it was left out",
+		"EffectiveRights is read-only, it was left out",
+	}
+	if strings.Join(jsonRequest.Notes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the notes %q, got %q", expected, jsonRequest.Notes)
+	}
+}
+
+// OWA needs a ConversationLastSyncTime, EWS clients often leave it out
+func TestFidelityNotesDefault(t *testing.T) {
+	for _, test := range []struct {
+		file  string
+		notes []string
+	}{
+		{"testdata/requests/ews_applyconversationaction_setreadstate.xml", []string{"ConversationLastSyncTime was not sent, a default was added"}},
+		{"testdata/requests/owa_applyconversationaction_request.xml", nil},
+	} {
+		data, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jsonRequest, err := ParseSOAPWithAction(bytes.NewReader(data), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(jsonRequest.Notes, "\n") != strings.Join(test.notes, "\n") {
+			t.Errorf("%s: expected the notes %q, got %q", test.file, test.notes, jsonRequest.Notes)
+		}
+	}
+}
+
+func TestFidelityNotesHeader(t *testing.T) {
+	getItemResponse, err := ioutil.ReadFile("testdata/responses/GetItem_owa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Replace(getItemRequest, "Exchange2013_SP1", "Exchange2010", 1)
+
+	for _, debug := range []bool{false, true} {
+		translator := NewTranslationMiddleware()
+		translator.OwaCanary = "canary"
+		translator.Debug = debug
+
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(data))
+		cctx := proxyutils.NewChainValues()
+		if err = translator.RequestModifier(context.Background(), request, cctx); err != nil {
+			t.Fatal(err)
+		}
+
+		response := proxyutils.CreateNewResponse(request, string(getItemResponse))
+		if err = translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+			t.Fatal(err)
+		}
+
+		value, _ := cctx.Lookup(ewsContextName)
+		ctx := value.(*ewsProxyContext)
+		if !bytes.Contains(ctx.TransactionLog.Bytes(), []byte("note: RequestServerVersion Exchange2010 was sent as Exchange2013\n")) {
+			t.Errorf("the note is missing from the transaction log:\n%s", ctx.TransactionLog)
+		}
+
+		header := response.Header.Get("X-EwsProxy-Notes")
+		if debug && !strings.HasPrefix(header, "RequestServerVersion Exchange2010 was sent as Exchange2013") {
+			t.Errorf("unexpected X-EwsProxy-Notes %q", header)
+		} else if !debug && header != "" {
+			t.Errorf("X-EwsProxy-Notes should only be set with Debug, got %q", header)
+		}
+	}
+}
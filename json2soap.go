@@ -6,10 +6,12 @@ package ews
 */
 
 import (
+	"bytes"
 	"encoding/xml"
 	//"fmt"
 	"io"
-	//"log"
+	"sort"
+	"sync"
 
 	"strconv"
 
@@ -33,10 +35,97 @@ type JsonSoapMessage struct {
 	Body   map[string]interface{}
 }
 
+// UnknownEnvelopeError is returned when a JSON response isn't a message,
+// or any of the envelopes that a message is known to be wrapped in
+type UnknownEnvelopeError struct {
+	Shape string
+}
+
+func (this *UnknownEnvelopeError) Error() string {
+	return "unknown JSON response envelope: " + this.Shape
+}
+
+// the envelope variants that have been logged already
+var seenEnvelopes = struct {
+	sync.Mutex
+	variants map[string]bool
+}{variants: make(map[string]bool)}
+
+func logEnvelopeVariant(variant string) {
+	seenEnvelopes.Lock()
+	defer seenEnvelopes.Unlock()
+
+	if !seenEnvelopes.variants[variant] {
+		seenEnvelopes.variants[variant] = true
+		Log.Debug.Printf("OWA responses are wrapped in a %s envelope", variant)
+	}
+}
+
+// unwrapJsonEnvelope returns the message inside the envelopes that newer
+// versions of service.svc use:
+// - {"d": {...}}
+// - [{...}], a batch containing a single message
+func unwrapJsonEnvelope(v interface{}) (map[string]interface{}, error) {
+	var envelopes []string
+
+	for {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			_, hasBody := vv["Body"]
+			_, hasHeader := vv["Header"]
+			if hasBody || hasHeader {
+				if len(envelopes) != 0 {
+					logEnvelopeVariant(strings.Join(envelopes, "+"))
+				}
+				return vv, nil
+			}
+
+			d, ok := vv["d"]
+			if !ok || len(vv) != 1 {
+				keys := make([]string, 0, len(vv))
+				for key := range vv {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				return nil, &UnknownEnvelopeError{Shape: "object with keys [" + strings.Join(keys, ", ") + "]"}
+			}
+
+			envelopes = append(envelopes, "d")
+			v = d
+
+		case []interface{}:
+			if len(vv) != 1 {
+				return nil, &UnknownEnvelopeError{Shape: "array of " + strconv.Itoa(len(vv)) + " elements"}
+			}
+
+			envelopes = append(envelopes, "array")
+			v = vv[0]
+
+		default:
+			return nil, &UnknownEnvelopeError{Shape: "not an object"}
+		}
+	}
+}
+
+// decodeJsonMessage reads a JSON response, removing any envelope
+func decodeJsonMessage(r io.Reader) (map[string]interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return unwrapJsonEnvelope(v)
+}
+
 // namespaces
 const NSSOAP = "http://schemas.xmlsoap.org/soap/envelope/"
 const NSMSG = "http://schemas.microsoft.com/exchange/services/2006/messages"
 const NSTYPE = "http://schemas.microsoft.com/exchange/services/2006/types"
+const NSXML = "http://www.w3.org/XML/1998/namespace"
+const NSXSI = "http://www.w3.org/2001/XMLSchema-instance"
 
 // xml names/attrs used to construct the resulting XML
 var soapEnvelopeTag = xml.Name{Local: "soap:Envelope"}
@@ -48,18 +137,105 @@ var soapXmlns = []xml.Attr{
 	{Name: xml.Name{Local: "xmlns:t"}, Value: NSTYPE},
 }
 
+// DefaultMaxAttachmentDepth is how deep item attachments can be nested when
+// JSON2SOAPOptions doesn't say
+const DefaultMaxAttachmentDepth = 10
+
+// JSON2SOAPOptions change how JSON2SOAPWithOptions converts a message
+type JSON2SOAPOptions struct {
+	// If true, the elements are indented, except inside the items of a list
+	// that BestEffortLists applies to
+	Indent bool
+
+	// If true, an item of a list of items or folders (see
+	// bestEffortListTypes) that cannot be converted is left out instead of
+	// failing the whole message. Lists of response messages are never
+	// changed.
+	BestEffortLists bool
+
+	// If not nil, what the translation changed is added to it
+	Notes *FidelityNotes
+
+	// An attached item can have its own item attachments, a message with
+	// them nested deeper than this fails. If 0, DefaultMaxAttachmentDepth
+	// is used.
+	MaxAttachmentDepth int
+
+	// If true, xmlns:m and xmlns:t are only declared on the envelope when
+	// the message has something in that namespace. The message is encoded
+	// to memory first.
+	OmitUnusedNamespaces bool
+
+	// format of date-time values sent to the EWS client
+	DateTimes DateTimeFormat
+}
+
+// SkippedItem is a list item that was left out because of BestEffortLists
+type SkippedItem struct {
+	List  string // JSON name of the list
+	Index int    // index of the item in the JSON list
+	Err   error
+}
+
+// lists that BestEffortLists applies to
+var bestEffortListTypes = map[string]bool{
+	"ArrayOfRealItemsType":     true,
+	"ArrayOfItemsType":         true,
+	"ArrayOfCalendarItemsType": true,
+	"ArrayOfFoldersType":       true,
+	"ArrayOfConversationsType": true,
+}
+
+// an xml.Encoder with the state of a conversion
+type jsonEncoder struct {
+	*xml.Encoder
+	w       io.Writer // what Encoder writes to
+	opts    JSON2SOAPOptions
+	skipped []SkippedItem
+
+	// the number of item attachments around the current element
+	attachmentDepth int
+}
+
 // JSON2SOAP converts a json message to a SOAP message
 // .. always server -> client
 // .. and we always know what type we're expecting
-func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err error) {
+func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) error {
+	_, err := JSON2SOAPWithOptions(r, op, w, JSON2SOAPOptions{Indent: indent})
+	return err
+}
 
-	var msg JsonSoapMessage
-	d := json.NewDecoder(r)
-	d.UseNumber()
+// JSON2SOAPWithOptions is JSON2SOAP, it returns the list items that were left
+// out because of BestEffortLists
+func JSON2SOAPWithOptions(r io.Reader, op *OpDescriptor, w io.Writer, opts JSON2SOAPOptions) ([]SkippedItem, error) {
+	enc := &jsonEncoder{opts: opts}
+	err := json2soap(r, op, w, enc)
+	return enc.skipped, err
+}
 
-	if err = d.Decode(&msg); err != nil {
-		return
+func json2soap(r io.Reader, op *OpDescriptor, w io.Writer, enc *jsonEncoder) error {
+	obj, err := decodeJsonMessage(r)
+	if err != nil {
+		return err
+	}
+	return encodeSoapMessage(obj, op, w, enc)
+}
+
+// encodeSoapMessage writes a decoded JSON message to w as SOAP
+func encodeSoapMessage(obj map[string]interface{}, op *OpDescriptor, w io.Writer, enc *jsonEncoder) (err error) {
+	if enc.opts.OmitUnusedNamespaces {
+		return encodeWithUsedNamespaces(obj, op, w, enc)
+	}
+
+	var msg JsonSoapMessage
+	var ok bool
+	if msg.Header, ok = obj["Header"].(map[string]interface{}); !ok && obj["Header"] != nil {
+		return errors.New("Header is not an object")
 	}
+	if msg.Body, ok = obj["Body"].(map[string]interface{}); !ok && obj["Body"] != nil {
+		return errors.New("Body is not an object")
+	}
+	msg.Type, _ = obj["__type"].(string)
 
 	// it appears that golang's XML encoder does not support namespaces in a
 	// readable/useful way, so we have to do all the prefixing stuff ourselves
@@ -70,8 +246,9 @@ func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err err
 	}
 
 	// construct the soap stuff
-	enc := xml.NewEncoder(w)
-	if indent {
+	enc.Encoder = xml.NewEncoder(w)
+	enc.w = w
+	if enc.opts.Indent {
 		enc.Indent("", " ")
 	}
 
@@ -84,18 +261,20 @@ func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err err
 		return
 	}
 
+	// the header comes first, and the body is always there: some OWA error
+	// responses only have a header, and a null Body
 	if msg.Header != nil {
 
-		if err = processJson(enc, msg.Header, &EwsSoapResponseHeader); err != nil {
+		if err = processJson(enc, responseHeader(msg.Header, enc.opts.Notes), &EwsSoapResponseHeader); err != nil {
 			return errors.Wrap(err, "soap:Header")
 		}
 	}
 
-	if msg.Body != nil {
+	if err = enc.EncodeToken(xml.StartElement{Name: soapBodyTag}); err != nil {
+		return
+	}
 
-		if err = enc.EncodeToken(xml.StartElement{Name: soapBodyTag}); err != nil {
-			return
-		}
+	if msg.Body != nil {
 
 		// given the op, we know what type is being used
 
@@ -110,7 +289,13 @@ func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err err
 		//ret1, _ := json.Marshal(msg)
 		//fmt.Println("original message", string(ret1))
 
-		for childName := range ewsResponseType.SingleType.Type.TypeByElementName {
+		for childName, childElement := range ewsResponseType.SingleType.Type.TypeByElementName {
+			// only the response message arrays need the hint, other children
+			// (such as the Persona returned by GetPersona) are regular objects
+			if childElement.Type.Name != "ArrayOfResponseMessagesType" {
+				continue
+			}
+
 			childBody := msg.Body[childName]
 
 			if nil == childBody {
@@ -162,10 +347,10 @@ func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err err
 		if err = processJson(enc, msg.Body, &op.Response); err != nil {
 			return errors.Wrap(err, "soap:Body")
 		}
+	}
 
-		if err = enc.EncodeToken(xml.EndElement{Name: soapBodyTag}); err != nil {
-			return
-		}
+	if err = enc.EncodeToken(xml.EndElement{Name: soapBodyTag}); err != nil {
+		return
 	}
 
 	// envelope
@@ -176,9 +361,84 @@ func JSON2SOAP(r io.Reader, op *OpDescriptor, w io.Writer, indent bool) (err err
 	return enc.Flush()
 }
 
+// returns the members of a response header that go in the soap:Header.
+// The header of an error response can also have details of the error,
+// which are left out (with a note) instead of failing the translation.
+func responseHeader(header map[string]interface{}, notes *FidelityNotes) map[string]interface{} {
+	headerType := EwsSoapResponseHeader.SingleType.Type
+
+	known := map[string]bool{"__type": true}
+	for _, je := range headerType.JsonElementList {
+		known[je.JsonName] = true
+	}
+	for _, extra := range headerType.JsonExtra {
+		known[extra] = true
+	}
+
+	kept := make(map[string]interface{}, len(header))
+	var left []string
+	for name, value := range header {
+		if known[name] {
+			kept[name] = value
+		} else {
+			left = append(left, name)
+		}
+	}
+
+	if len(left) != 0 {
+		sort.Strings(left)
+		notes.add("Header: %s was left out", strings.Join(left, ", "))
+	}
+	return kept
+}
+
+// encodes the message to memory, and removes the namespace declarations
+// that nothing in it uses from the envelope
+func encodeWithUsedNamespaces(obj map[string]interface{}, op *OpDescriptor, w io.Writer, enc *jsonEncoder) error {
+	enc.opts.OmitUnusedNamespaces = false
+	defer func() { enc.opts.OmitUnusedNamespaces = true }()
+
+	var buf bytes.Buffer
+	if err := encodeSoapMessage(obj, op, &buf, enc); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	used := usedPrefixes(data)
+	for _, attr := range soapXmlns {
+		if !used[strings.TrimPrefix(attr.Name.Local, "xmlns:")] {
+			data = bytes.Replace(data, []byte(" "+attr.Name.Local+"=\""+attr.Value+"\""), nil, 1)
+		}
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// returns the namespace prefixes of the elements and attributes of data
+func usedPrefixes(data []byte) map[string]bool {
+	used := make(map[string]bool)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return used
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			used[start.Name.Space] = true
+			for _, attr := range start.Attr {
+				if attr.Name.Space != "xmlns" {
+					used[attr.Name.Space] = true
+				}
+			}
+		}
+	}
+}
+
 // element: JSON element to process
 // edesc: contains information about the element, always present
-func processJson(enc *xml.Encoder, element interface{}, edesc *EwsJsonElement) (err error) {
+func processJson(enc *jsonEncoder, element interface{}, edesc *EwsJsonElement) (err error) {
 
 	// when this is called, the underlying JSON type is uncertain, so we have to
 	// inspect it to figure it out
@@ -210,13 +470,14 @@ func processJson(enc *xml.Encoder, element interface{}, edesc *EwsJsonElement) (
 		}
 
 	case nil:
+		enc.opts.Notes.add("%s: null was left out", edesc.JsonName)
 
 		/*if edesc.SingleType != nil {
-			if err = edesc.SingleType.EmitStart(enc, nil); err != nil {
+			if err = edesc.SingleType.EmitStart(enc.Encoder, nil); err != nil {
 				return errors.Wrap(err, edesc.JsonName)
 			}
 
-			if err = edesc.SingleType.EmitEnd(enc); err != nil {
+			if err = edesc.SingleType.EmitEnd(enc.Encoder); err != nil {
 				return errors.Wrap(err, edesc.JsonName)
 			}
 		}*/
@@ -227,7 +488,7 @@ func processJson(enc *xml.Encoder, element interface{}, edesc *EwsJsonElement) (
 			return errors.Errorf("%s: unexpected simple content `%#v`", edesc.JsonName, el)
 		}
 
-		if err = edesc.SingleType.EmitStart(enc, nil); err != nil {
+		if err = edesc.SingleType.EmitStart(enc.Encoder, nil); err != nil {
 			return errors.Wrap(err, edesc.JsonName)
 		}
 
@@ -237,20 +498,27 @@ func processJson(enc *xml.Encoder, element interface{}, edesc *EwsJsonElement) (
 		}
 
 		ewsType := edesc.SingleType.Type
-		if ewsType.IsSimple && ewsType.SimpleType == T_ENUM {
+		if ewsType.IsSimple && ewsType.SimpleType == T_ENUM && !isEnumValue(ewsType, text) {
 			// find chardata in enum_values
+			// -> some enums (such as DayOfWeek in timezone transitions) are
+			//    sent by name instead of by index
 			num, ierr := strconv.Atoi(text)
 			if nil != ierr {
 				return errors.Wrap(ierr, "Unable to convert " + text + " to an integer")
 			}
+			if num < 0 || num >= len(ewsType.EnumValues) {
+				return errors.Errorf("%s: enum index %d out of range for %s", edesc.JsonName, num, ewsType.Name)
+			}
 			text = ewsType.EnumValues[num]
+		} else if ewsType.IsSimple && ewsType.SimpleType == T_DATETIME {
+			text = convertDateTime(text, enc.opts.DateTimes)
 		}
 
 		if err = processJsonChardata(enc, text); err != nil {
 			return errors.Wrap(err, edesc.JsonName)
 		}
 
-		if err = edesc.SingleType.EmitEnd(enc); err != nil {
+		if err = edesc.SingleType.EmitEnd(enc.Encoder); err != nil {
 			return errors.Wrap(err, edesc.JsonName)
 		}
 	}
@@ -261,7 +529,7 @@ func processJson(enc *xml.Encoder, element interface{}, edesc *EwsJsonElement) (
 // element: json element to process
 // edesc: describes the element that is being processed, non-nil
 // lookupType: the parent type that the element resides in (may be nil)
-func processJsonObject(enc *xml.Encoder, element map[string]interface{}, edesc *EwsJsonElement) (err error) {
+func processJsonObject(enc *jsonEncoder, element map[string]interface{}, edesc *EwsJsonElement) (err error) {
 
 	//ret1, _ := json.Marshal(element)
 	//fmt.Println("processJsonObject", "elemnt:", string(ret1))
@@ -297,9 +565,20 @@ func processJsonObject(enc *xml.Encoder, element map[string]interface{}, edesc *
 
 	typ := jtyp.Type
 
+	if typ.Name == "ItemAttachmentType" {
+		if err = enc.enterItemAttachment(); err != nil {
+			return
+		}
+		defer enc.leaveItemAttachment()
+	}
+
 	// delete the type hint if present
 	delete(element, "__type")
 
+	if typ.XmlHook != nil {
+		typ.XmlHook(typ, element)
+	}
+
 	// make sure we're sane
 	if typ.IsSimple && typ.TextAttr == "" {
 		return errors.Errorf("%s is a simple type", typ.Name)
@@ -317,12 +596,16 @@ func processJsonObject(enc *xml.Encoder, element map[string]interface{}, edesc *
 				return errors.Wrapf(err, "invalid attribute %s", aname)
 			}
 
+			if atyp := typ.Attrs[attr.XN]; atyp != nil && atyp.SimpleType == T_DATETIME {
+				attrStr = convertDateTime(attrStr, enc.opts.DateTimes)
+			}
+
 			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: attr.XN}, Value: attrStr})
 			delete(element, aname)
 		}
 	}
 
-	if err = jtyp.EmitStart(enc, attrs); err != nil {
+	if err = jtyp.EmitStart(enc.Encoder, attrs); err != nil {
 		return
 	}
 
@@ -388,13 +671,13 @@ func processJsonObject(enc *xml.Encoder, element map[string]interface{}, edesc *
 					
 					text := strings.Join(names, " ")
 
-					if err = je.SingleType.EmitStart(enc, nil); err != nil {
+					if err = je.SingleType.EmitStart(enc.Encoder, nil); err != nil {
 						return errors.Wrap(err, je.JsonName)
 					}
 
 					enc.EncodeToken(xml.CharData([]byte(text)))
 					
-					if err = je.SingleType.EmitEnd(enc); err != nil {
+					if err = je.SingleType.EmitEnd(enc.Encoder); err != nil {
 						return errors.Wrap(err, je.JsonName)
 					}
 
@@ -420,13 +703,13 @@ func processJsonObject(enc *xml.Encoder, element map[string]interface{}, edesc *
 	}
 
 	// end element and we're done
-	return jtyp.EmitEnd(enc)
+	return jtyp.EmitEnd(enc.Encoder)
 }
 
 // elements: json content
 // edesc: describes the element we're decoding
 // lookupType: type that the element is present in
-func processJsonList(enc *xml.Encoder, elements []interface{}, edesc *EwsJsonElement) (err error) {
+func processJsonList(enc *jsonEncoder, elements []interface{}, edesc *EwsJsonElement) (err error) {
 
 	//start DEBUG
 	/*
@@ -482,23 +765,38 @@ func processJsonList(enc *xml.Encoder, elements []interface{}, edesc *EwsJsonEle
 
 	if jtyp != nil {
 		//log.Printf("Emitting start", jtyp)
-		if err = jtyp.EmitStart(enc, nil); err != nil {
+		if err = jtyp.EmitStart(enc.Encoder, nil); err != nil {
 			return
 		}
 	}
 
+	bestEffort := enc.opts.BestEffortLists && jtyp != nil && bestEffortListTypes[jtyp.Type.Name]
+
 	// for each item in the list
-	for _, e := range elements {
+	for i, e := range elements {
 		// sometimes exchange does this
 		if e == nil {
 			continue
 		}
 
+		if bestEffort {
+			data, skipped, itemErr := enc.encodeItem(e, childDesc)
+			if itemErr != nil {
+				enc.skipped = append(enc.skipped, SkippedItem{List: edesc.JsonName, Index: i, Err: itemErr})
+				continue
+			}
+
+			if err = enc.appendItem(data, skipped); err != nil {
+				return
+			}
+			continue
+		}
+
 		if childDesc.IsCharData() {
 
 			// process each item as chardata
 
-			if err = childDesc.SingleType.EmitStart(enc, nil); err != nil {
+			if err = childDesc.SingleType.EmitStart(enc.Encoder, nil); err != nil {
 				return
 			}
 
@@ -506,7 +804,7 @@ func processJsonList(enc *xml.Encoder, elements []interface{}, edesc *EwsJsonEle
 				return errors.Wrap(err, "processing list")
 			}
 
-			if err = childDesc.SingleType.EmitEnd(enc); err != nil {
+			if err = childDesc.SingleType.EmitEnd(enc.Encoder); err != nil {
 				return
 			}
 
@@ -527,7 +825,7 @@ func processJsonList(enc *xml.Encoder, elements []interface{}, edesc *EwsJsonEle
 	// end element and we're done
 	if jtyp != nil {
 		//log.Printf("Emitting end", jtyp)
-		if err = jtyp.EmitEnd(enc); err != nil {
+		if err = jtyp.EmitEnd(enc.Encoder); err != nil {
 			return
 		}
 	}
@@ -535,8 +833,79 @@ func processJsonList(enc *xml.Encoder, elements []interface{}, edesc *EwsJsonEle
 	return
 }
 
+// converts a list item into its own buffer, so that nothing of an item that
+// fails is added to the message. processJsonObject removes what it converts
+// from the item.
+func (this *jsonEncoder) encodeItem(item interface{}, edesc *EwsJsonElement) ([]byte, []SkippedItem, error) {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.Errorf("while processing list, expected object, got %#v", item)
+	}
+
+	buf := new(bytes.Buffer)
+	itemEnc := &jsonEncoder{
+		Encoder:         xml.NewEncoder(buf),
+		w:               buf,
+		opts:            this.opts,
+		attachmentDepth: this.attachmentDepth,
+	}
+
+	if err := processJsonObject(itemEnc, obj, edesc); err != nil {
+		return nil, nil, err
+	}
+	if err := itemEnc.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), itemEnc.skipped, nil
+}
+
+// adds an item converted by encodeItem to the message, with the items of
+// its own lists that were left out
+func (this *jsonEncoder) appendItem(data []byte, skipped []SkippedItem) error {
+	// what was encoded before the item must come first
+	if err := this.Flush(); err != nil {
+		return err
+	}
+	if _, err := this.w.Write(data); err != nil {
+		return err
+	}
+
+	this.skipped = append(this.skipped, skipped...)
+	return nil
+}
+
+// counts an item attachment around the elements that follow, fails if there
+// are more than MaxAttachmentDepth
+func (this *jsonEncoder) enterItemAttachment() error {
+	maxDepth := this.opts.MaxAttachmentDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxAttachmentDepth
+	}
+
+	if this.attachmentDepth >= maxDepth {
+		return errors.Errorf("item attachments are nested more than %d deep", maxDepth)
+	}
+	this.attachmentDepth++
+	return nil
+}
+
+func (this *jsonEncoder) leaveItemAttachment() {
+	this.attachmentDepth--
+}
+
+// returns true if text is one of the values of the enum typ, OWA sends some
+// enums by index instead
+func isEnumValue(typ *EwsType, text string) bool {
+	for _, v := range typ.EnumValues {
+		if v == text {
+			return true
+		}
+	}
+	return false
+}
+
 // emits an xml.CharData instruction
-func processJsonChardata(enc *xml.Encoder, el interface{}) (err error) {
+func processJsonChardata(enc *jsonEncoder, el interface{}) (err error) {
 	var text string
 	if text, err = toString(el); err != nil {
 		return
@@ -554,6 +923,13 @@ func toString(o interface{}) (string, error) {
 		}
 		return "false", nil
 	case json.Number:
+		// XML numbers can't have an exponent, in case a large value is
+		// serialized with one
+		if strings.ContainsAny(string(oo), "eE") {
+			if f, err := oo.Float64(); err == nil {
+				return strconv.FormatFloat(f, 'f', -1, 64), nil
+			}
+		}
 		return string(oo), nil
 	case string:
 		return oo, nil
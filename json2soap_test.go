@@ -0,0 +1,281 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+func TestJSON2SOAPUnknownEnvelope(t *testing.T) {
+	op := EwsOperations["GetFolder"]
+
+	for _, data := range []string{
+		`{"Result": {"Body": {}}}`,
+		`{"d": {"Result": {}}}`,
+		`[{"Body": {}}, {"Body": {}}]`,
+		`[]`,
+		`"Body"`,
+	} {
+		err := JSON2SOAP(strings.NewReader(data), op, ioutil.Discard, false)
+		if _, ok := err.(*UnknownEnvelopeError); !ok {
+			t.Errorf("%s: expected UnknownEnvelopeError, got %v", data, err)
+		}
+	}
+}
+
+func TestUnwrapJsonEnvelope(t *testing.T) {
+	for _, data := range []string{
+		`{"Body": {"x": 1}}`,
+		`{"d": {"Body": {"x": 1}}}`,
+		`[{"Body": {"x": 1}}]`,
+		`[{"d": {"Body": {"x": 1}}}]`,
+	} {
+		msg, err := decodeJsonMessage(strings.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %s", data, err)
+			continue
+		}
+
+		if body, ok := msg["Body"].(map[string]interface{}); !ok || body["x"] == nil {
+			t.Errorf("%s: message was not unwrapped: %#v", data, msg)
+		}
+	}
+}
+
+func TestBestEffortLists(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "FindItem_poison_item.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := EwsOperations["FindItem"]
+
+	// off by default
+	if err = JSON2SOAP(bytes.NewReader(data), op, ioutil.Discard, false); err == nil {
+		t.Fatal("expected the poisoned item to fail the translation")
+	}
+
+	buf := new(bytes.Buffer)
+	skipped, err := JSON2SOAPWithOptions(bytes.NewReader(data), op, buf, JSON2SOAPOptions{BestEffortLists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(skipped) != 1 || skipped[0].List != "Items" || skipped[0].Index != 2 || skipped[0].Err == nil {
+		t.Fatalf("unexpected skipped items %+v", skipped)
+	}
+
+	output := buf.String()
+	for _, subject := range []string{"first", "second", "fourth"} {
+		if !strings.Contains(output, "<t:Subject>"+subject+"</t:Subject>") {
+			t.Errorf("item %s is missing:\n%s", subject, output)
+		}
+	}
+
+	if strings.Contains(output, "poisoned") || strings.Count(output, "<t:Message>") != 3 {
+		t.Errorf("the poisoned item was not left out:\n%s", output)
+	}
+
+	// the items that are kept are encoded as they are otherwise
+	fixed := bytes.Replace(data, []byte(`"PoisonField": true`), []byte(`"IsDraft": false`), 1)
+	expected := new(bytes.Buffer)
+	if err = JSON2SOAP(bytes.NewReader(fixed), op, expected, false); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if skipped, err = JSON2SOAPWithOptions(bytes.NewReader(fixed), op, buf, JSON2SOAPOptions{BestEffortLists: true}); err != nil || len(skipped) != 0 {
+		t.Fatalf("unexpected result %+v %v", skipped, err)
+	}
+
+	if buf.String() != expected.String() {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf)
+	}
+
+	// response messages are never skipped
+	broken := bytes.Replace(data, []byte(`"ResponseClass": "Success"`), []byte(`"ResponseClass": "Success", "PoisonField": true`), 1)
+	if _, err = JSON2SOAPWithOptions(bytes.NewReader(broken), op, ioutil.Discard, JSON2SOAPOptions{BestEffortLists: true}); err == nil {
+		t.Error("expected a broken response message to fail the translation")
+	}
+}
+
+// wraps the attached message of the fixture in more item attachments
+func nestedItemAttachments(t *testing.T, depth int) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetAttachment_owa_itemattachment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := bytes.Index(data, []byte(`"Item": {`))
+	end := bytes.LastIndex(data, []byte(`}
+                    ]
+                }
+            ]`))
+	item := string(data[start+len(`"Item": `) : end])
+
+	for i := 1; i < depth; i++ {
+		item = `{"__type": "Message:#Exchange", "Subject": "Fwd", "Attachments": [{"__type": "ItemAttachment:#Exchange", "Name": "Fwd", "Item": ` + item + `}]}`
+	}
+	return []byte(string(data[:start]) + `"Item": ` + item + string(data[end:]))
+}
+
+func TestItemAttachmentDepth(t *testing.T) {
+	op := EwsOperations["GetAttachment"]
+
+	buf := new(bytes.Buffer)
+	if _, err := JSON2SOAPWithOptions(bytes.NewReader(nestedItemAttachments(t, 3)), op, buf, JSON2SOAPOptions{MaxAttachmentDepth: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file attachment of the innermost message is still there
+	output := buf.String()
+	if strings.Count(output, "<t:ItemAttachment>") != 3 || !strings.Contains(output, "<t:Name>report.pdf</t:Name>") {
+		t.Errorf("unexpected output\n%s", output)
+	}
+
+	_, err := JSON2SOAPWithOptions(bytes.NewReader(nestedItemAttachments(t, 4)), op, ioutil.Discard, JSON2SOAPOptions{MaxAttachmentDepth: 3})
+	if err == nil || !strings.Contains(err.Error(), "nested more than 3 deep") {
+		t.Errorf("expected the depth to be too much, got %v", err)
+	}
+
+	// the default
+	data := nestedItemAttachments(t, DefaultMaxAttachmentDepth+1)
+	if err = JSON2SOAP(bytes.NewReader(data), op, ioutil.Discard, false); err == nil {
+		t.Errorf("expected %d item attachments to be too many", DefaultMaxAttachmentDepth+1)
+	}
+}
+
+// translates a response file with the middleware, returns the SOAP body
+func translateResponseFile(t *testing.T, translator *TranslationMiddleware, fname string, op string, contentType string) []byte {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cctx := proxyutils.NewChainValues()
+	cctx.Set(ewsContextName, &ewsProxyContext{
+		EwsProxyOp:     EwsOperations[op],
+		TransactionLog: new(bytes.Buffer),
+	})
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/owa/service.svc", nil)
+	response := proxyutils.CreateNewResponse(request, string(data))
+	response.Header.Set("Content-Type", contentType)
+
+	if err = translator.ResponseModifier(context.Background(), response, cctx); err != nil {
+		t.Fatalf("%s: %s", fname, err)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/xml; charset=utf-8" {
+		t.Errorf("%s: unexpected Content-Type %s", fname, contentType)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	return body
+}
+
+// responses in other charsets are translated to the same UTF-8 SOAP
+func TestEncodedResponses(t *testing.T) {
+	translator := NewTranslationMiddleware()
+
+	expected := translateResponseFile(t, translator, filepath.Join("testdata", "responses", "GetFolder_owa_hebrew.json"), "GetFolder", "application/json; charset=utf-8")
+	for _, name := range []string{"דואר נכנס", "Entwürfe", "פרויקטים 📁 2024"} {
+		if !bytes.Contains(expected, []byte("<t:DisplayName>"+name+"</t:DisplayName>")) {
+			t.Errorf("%s is missing from the response:\n%s", name, expected)
+		}
+	}
+	if !bytes.HasPrefix(expected, []byte(`<?xml version="1.0" encoding="UTF-8"?>`)) {
+		t.Errorf("expected a UTF-8 XML declaration:\n%.100s", expected)
+	}
+
+	for fname, contentType := range map[string]string{
+		"GetFolder_owa_hebrew_windows1255.json": "application/json; charset=windows-1255",
+		"GetFolder_owa_hebrew_windows1252.json": "application/json; charset=windows-1252",
+	} {
+		data := translateResponseFile(t, translator, filepath.Join("testdata", "encodings", fname), "GetFolder", contentType)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: translated differently:\n%s", fname, data)
+		}
+	}
+}
+
+func TestToStringNumbers(t *testing.T) {
+	for number, expected := range map[json.Number]string{
+		"0":             "0",
+		"1523":          "1523",
+		"2147483647":    "2147483647",
+		"-12":           "-12",
+		"1.5":           "1.5",
+		"1.523E3":       "1523",
+		"2.147483647e9": "2147483647",
+	} {
+		if text, err := toString(number); err != nil || text != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", number, expected, text, err)
+		}
+	}
+}
+
+func TestOmitUnusedNamespaces(t *testing.T) {
+	op := EwsOperations["GetFolder"]
+	errorResponse := `{"Body": {"ResponseMessages": {"Items": [{"ResponseClass": "Error", "ResponseCode": "ErrorAccessDenied", "MessageText": "Access is denied."}]}}}`
+
+	translate := func(data string, omit bool) string {
+		buf := new(bytes.Buffer)
+		if _, err := JSON2SOAPWithOptions(strings.NewReader(data), op, buf, JSON2SOAPOptions{OmitUnusedNamespaces: omit}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// both are declared by default
+	if soap := translate(errorResponse, false); !strings.Contains(soap, `xmlns:t="`+NSTYPE+`"`) {
+		t.Errorf("expected t: to be declared: %s", soap)
+	}
+
+	// an error only has elements of the messages namespace
+	soap := translate(errorResponse, true)
+	if strings.Contains(soap, "xmlns:t=") || !strings.Contains(soap, `xmlns:m="`+NSMSG+`"`) {
+		t.Errorf("expected only m: to be declared: %s", soap)
+	}
+	if !strings.Contains(soap, "<m:ResponseCode>ErrorAccessDenied</m:ResponseCode>") {
+		t.Errorf("unexpected response %s", soap)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetFolder_simple.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soap := translate(string(data), true); soap != translate(string(data), false) {
+		t.Errorf("a response that uses both namespaces changed: %s", soap)
+	}
+}
+
+// the header is written before the body whatever the order in the JSON, and
+// the details of an error in the header are left out with a note
+func TestJSON2SOAPHeader(t *testing.T) {
+	op := EwsOperations["GetFolder"]
+	data := `{"Body": null, "Header": {"ErrorCode": "ErrorInternalServerTransientError", "ServerVersionInfo": {"MajorVersion": 15}}}`
+
+	var notes FidelityNotes
+	buf := new(bytes.Buffer)
+	if _, err := JSON2SOAPWithOptions(strings.NewReader(data), op, buf, JSON2SOAPOptions{Notes: &notes}); err != nil {
+		t.Fatal(err)
+	}
+
+	soap := buf.String()
+	header := strings.Index(soap, `<t:ServerVersionInfo MajorVersion="15">`)
+	body := strings.Index(soap, "<soap:Body></soap:Body>")
+	if header == -1 || body == -1 || header > body {
+		t.Errorf("expected the header and then an empty body: %s", soap)
+	}
+	if len(notes) != 1 || notes[0] != "Header: ErrorCode was left out" {
+		t.Errorf("unexpected notes %v", notes)
+	}
+}
@@ -0,0 +1,87 @@
+package proxyutils
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const bypassContextName = "bypass_ctx"
+
+// BypassMiddleware marks requests to some paths as raw passthrough requests.
+// Other middlewares check IsBypassed and leave those requests alone, except
+// that the RedirectorMiddleware still sends them to the target server. Only
+// the FramingMiddleware can come before it in the chain.
+type BypassMiddleware struct {
+	// path.Match patterns, compared without regard to case. Use SetPaths
+	// once the proxy is running.
+	Paths []string
+
+	lock sync.Mutex
+}
+
+// NewBypassMiddleware returns an error if one of the patterns is invalid
+func NewBypassMiddleware(paths []string) (*BypassMiddleware, error) {
+	if err := checkBypassPaths(paths); err != nil {
+		return nil, err
+	}
+
+	return &BypassMiddleware{Paths: paths}, nil
+}
+
+func checkBypassPaths(paths []string) error {
+	for _, pattern := range paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "bypass pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// SetPaths replaces the patterns while the proxy is running. If one of them
+// is invalid, the current patterns are kept.
+func (this *BypassMiddleware) SetPaths(paths []string) error {
+	if err := checkBypassPaths(paths); err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Paths = paths
+	return nil
+}
+
+// Matches returns true if the request path matches one of the patterns
+func (this *BypassMiddleware) Matches(requestPath string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	requestPath = strings.ToLower(requestPath)
+	for _, pattern := range this.Paths {
+		if ok, _ := path.Match(strings.ToLower(pattern), requestPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *BypassMiddleware) RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error {
+	if this.Matches(request.URL.Path) {
+		vals.Set(bypassContextName, true)
+	}
+	return nil
+}
+
+func (this *BypassMiddleware) ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error {
+	return nil
+}
+
+// IsBypassed returns true if the BypassMiddleware marked this request
+func IsBypassed(vals *ChainValues) bool {
+	_, ok := vals.Lookup(bypassContextName)
+	return ok
+}
@@ -0,0 +1,99 @@
+package proxyutils
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBypassMatches(t *testing.T) {
+	bypass, err := NewBypassMiddleware([]string{"/owa/ev.owa*", "/owa/sws/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]bool{
+		"/owa/ev.owa":          true,
+		"/owa/EV.owa2":         true,
+		"/owa/sws/health":      true,
+		"/owa/sws/a/b":         false,
+		"/owa/service.svc":     false,
+		"/ews/exchange.asmx":   false,
+		"/owa/attachment.ashx": false,
+	} {
+		if bypass.Matches(path) != expected {
+			t.Errorf("%s: expected %v", path, expected)
+		}
+	}
+
+	if _, err = NewBypassMiddleware([]string{"/owa/[a"}); err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+}
+
+func TestBypassKeepsClientCookies(t *testing.T) {
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse("https://mail.example.com")
+
+	redirector := NewRedirectorMiddleware(source, target)
+	redirector.Cookies.SetCookies(target, []*http.Cookie{{Name: "session", Value: "proxy"}})
+
+	bypass, _ := NewBypassMiddleware([]string{"/owa/ev.owa*"})
+
+	var upstream *http.Request
+	transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		upstream = request
+		response := CreateNewResponse(request, "")
+		response.Header.Add("Set-Cookie", "upstream=1")
+		return response, nil
+	})
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, transport, bypass, redirector)
+
+	for _, path := range []string{"/owa/ev.owa2", "/owa/"} {
+		bypassed := path != "/owa/"
+
+		request, _ := http.NewRequest("GET", "http://localhost:60001"+path, nil)
+		request.AddCookie(&http.Cookie{Name: "session", Value: "client"})
+		request.Header.Set("Referer", "http://localhost:60001/owa/")
+
+		response, err := chain.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if upstream.URL.Host != target.Host {
+			t.Errorf("%s: sent to %s", path, upstream.URL.Host)
+		}
+
+		cookie, _ := upstream.Cookie("session")
+		setCookie := response.Header.Get("Set-Cookie")
+
+		if bypassed {
+			if cookie == nil || cookie.Value != "client" {
+				t.Errorf("%s: client cookie was not forwarded: %v", path, cookie)
+			}
+			if upstream.Header.Get("Referer") != "http://localhost:60001/owa/" {
+				t.Errorf("%s: Referer was changed", path)
+			}
+			if setCookie != "upstream=1" {
+				t.Errorf("%s: Set-Cookie was not returned to the client", path)
+			}
+			for _, cookie := range redirector.Cookies.Cookies(target) {
+				if cookie.Name == "upstream" {
+					t.Errorf("%s: cookie from the response was stored", path)
+				}
+			}
+		} else {
+			if cookie == nil || cookie.Value != "proxy" {
+				t.Errorf("%s: client cookie was forwarded: %v", path, cookie)
+			}
+			if setCookie != "" {
+				t.Errorf("%s: Set-Cookie was returned to the client", path)
+			}
+		}
+	}
+}
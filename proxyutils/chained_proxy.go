@@ -1,26 +1,84 @@
 package proxyutils
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strings"
 	"time"
 )
 
-// used because the golang context stuff is weird...
+// Deprecated: ChainContext is what LegacyMiddleware implementations are
+// given, new middlewares should use ChainValues
 type ChainContext map[interface{}]interface{}
 
-type RequestModifierFunc func(*http.Request, ChainContext) error
-type ResponseModifierFunc func(*http.Response, ChainContext) error
+// ChainValues holds the values that middlewares share with each other while
+// a single request passes through the chain. Cancellation and deadlines come
+// from the context.Context instead, which is derived from the request.
+type ChainValues struct {
+	values ChainContext
+}
+
+func NewChainValues() *ChainValues {
+	return &ChainValues{values: make(ChainContext)}
+}
+
+// Get returns the value stored for key, or nil
+func (this *ChainValues) Get(key interface{}) interface{} {
+	return this.values[key]
+}
+
+// Lookup returns the value stored for key, and whether there was one
+func (this *ChainValues) Lookup(key interface{}) (value interface{}, ok bool) {
+	value, ok = this.values[key]
+	return
+}
+
+func (this *ChainValues) Set(key interface{}, value interface{}) {
+	this.values[key] = value
+}
+
+type RequestModifierFunc func(context.Context, *http.Request, *ChainValues) error
+type ResponseModifierFunc func(context.Context, *http.Response, *ChainValues) error
 
 type Middleware interface {
 
 	// Modifies the request
-	RequestModifier(*http.Request, ChainContext) error
+	RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error
 
 	// Modifies the response
+	ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error
+}
+
+// Deprecated: LegacyMiddleware is the Middleware interface from before the
+// request context was passed through the chain. Wrap implementations with
+// AdaptLegacy until they are updated, the adapter will be removed in the
+// next release.
+type LegacyMiddleware interface {
+	RequestModifier(*http.Request, ChainContext) error
 	ResponseModifier(*http.Response, ChainContext) error
 }
 
+type legacyAdapter struct {
+	middleware LegacyMiddleware
+}
+
+// AdaptLegacy returns a Middleware that calls a LegacyMiddleware. The legacy
+// middleware shares its values with the rest of the chain, but it cannot see
+// the request context.
+func AdaptLegacy(middleware LegacyMiddleware) Middleware {
+	return &legacyAdapter{middleware: middleware}
+}
+
+func (this *legacyAdapter) RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error {
+	return this.middleware.RequestModifier(request, vals.values)
+}
+
+func (this *legacyAdapter) ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error {
+	return this.middleware.ResponseModifier(response, vals.values)
+}
+
 // an error that contains a new response to send to the client
 type RequestError struct {
 	Response *http.Response
@@ -34,30 +92,47 @@ func NewRequestError(response *http.Response) error {
 	return &RequestError{Response: response}
 }
 
+// an error that indicates that a middleware panicked
+type middlewarePanic struct {
+	value interface{}
+}
+
+func (this *middlewarePanic) Error() string {
+	return fmt.Sprintf("middleware panic: %v", this.value)
+}
+
 type chainedProxy struct {
 	Name string
 
-	LogTrace *log.Logger
-	LogDebug *log.Logger
-	LogInfo *log.Logger
-	LogWarn *log.Logger
-	LogError *log.Logger
+	LogTrace Logger
+	LogDebug Logger
+	LogInfo Logger
+	LogWarn Logger
+	LogError Logger
 
 	RequestModifiers  []RequestModifierFunc
 	ResponseModifiers []ResponseModifierFunc
 
+	// waits between retries
+	Clock Clock
+
 	Transport http.RoundTripper
 }
 
-// returns a http.RoundTripper that calls each middleware in order
+// returns a http.RoundTripper that calls each middleware in order. clock
+// is RealClock and Transport is http.DefaultTransport if they are nil.
 func CreateChainedProxy(name string,
-	logTrace *log.Logger,
-	logDebug *log.Logger,
-	logInfo *log.Logger,
-	logWarn *log.Logger,
-	logError *log.Logger,
+	logTrace Logger,
+	logDebug Logger,
+	logInfo Logger,
+	logWarn Logger,
+	logError Logger,
+	clock Clock,
 	Transport http.RoundTripper, middlewares ...Middleware) http.RoundTripper {
 
+	if clock == nil {
+		clock = RealClock
+	}
 	if Transport == nil {
 		Transport = http.DefaultTransport
 	}
@@ -69,6 +144,7 @@ func CreateChainedProxy(name string,
 		LogInfo: logInfo,
 		LogWarn: logWarn,
 		LogError: logError,
+		Clock: clock,
 		Transport: Transport,
 	}
 
@@ -84,7 +160,9 @@ func CreateChainedProxy(name string,
 }
 
 // Passes the http.Request through all of the request handlers, sends to the
-// remote server, then passes through all of the response handlers
+// remote server, then passes through all of the response handlers. If the
+// client goes away (the request context is done) the remaining work is
+// abandoned and the context error is returned.
 func (this *chainedProxy) RoundTrip(request *http.Request) (*http.Response, error) {
 
 	this.LogInfo.Println(this.Name, request.Method, request.URL.Path)
@@ -99,13 +177,17 @@ func (this *chainedProxy) RoundTrip(request *http.Request) (*http.Response, erro
 		}
 	}()
 
-	ctx := make(ChainContext)
+	ctx := request.Context()
+	vals := NewChainValues()
 
 	// first pass through anyone who wants to modify this
 	for _, modifier := range this.RequestModifiers {
-		if err = modifier(request, ctx); err != nil {
+		if err = this.callRequestModifier(ctx, modifier, request, vals); err != nil {
 			if re, ok := err.(*RequestError); ok {
 				return re.Response, nil
+			} else if p, ok := err.(*middlewarePanic); ok {
+				response = createPanicResponse(request, p)
+				return response, nil
 			} else {
 				return nil, err
 			}
@@ -114,22 +196,50 @@ func (this *chainedProxy) RoundTrip(request *http.Request) (*http.Response, erro
 
 	this.LogTrace.Println(this.Name, "Request after modifications", request.Method, request.URL.Path, request.Header, request.RequestURI)
 
-	// try each connection up to 3 times
-  retryCount := 3
-  for retryCount > 0 {
-    response, err = this.Transport.RoundTrip(request)
-    if err == nil {
-      // success, stop trying
-      break
-    } else {
-      this.LogWarn.Println(this.Name, "Network error, retrying: ", err)
-      // throttle
-      time.Sleep(1 * time.Second)
-    }
-    retryCount -= 1;
-  }
-
-	if err != nil {
+	// try each connection up to 3 times, unless a middleware said not to
+	timeout := upstreamTimeout(vals)
+	retryCount := 3
+	for retryCount > 0 {
+		response, err = this.sendWithTimeout(request, timeout)
+		if err == nil || ctx.Err() != nil {
+			// success, or the client gave up: stop trying
+			break
+		} else if noRetry(vals) {
+			this.LogWarn.Println(this.Name, "Network error, not retrying: ", err)
+			break
+		}
+
+		this.LogWarn.Println(this.Name, "Network error, retrying: ", err)
+
+		// throttle
+		select {
+		case <-this.Clock.After(1 * time.Second):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		retryCount -= 1
+	}
+
+	// nobody is waiting for the response, so don't bother translating it
+	if ctx.Err() != nil {
+		if response != nil {
+			response.Body.Close()
+			response = nil
+		}
+		this.LogInfo.Println(this.Name, "request cancelled", request.URL.Path)
+		return nil, ctx.Err()
+	}
+
+	if err == context.DeadlineExceeded {
+		// the middleware that set the upstream timeout gets to answer it
+		this.LogWarn.Println(this.Name, "Upstream timeout after", timeout, request.URL.Path)
+		vals.Set(upstreamTimedOutName, true)
+		response = CreateNewResponse(request, "")
+		response.StatusCode = http.StatusGatewayTimeout
+		err = nil
+	} else if err != nil {
 		// this is always some sort of network error, but let's choose to return a
 		// valid response to the client telling them what happened...
 		response = CreateNewResponse(request, "")
@@ -141,8 +251,18 @@ func (this *chainedProxy) RoundTrip(request *http.Request) (*http.Response, erro
 
 	// anybody want to modify the response?
 	for _, modifier := range this.ResponseModifiers {
-		err = modifier(response, ctx)
+		if ctx.Err() != nil {
+			response.Body.Close()
+			return nil, ctx.Err()
+		}
+
+		err = this.callResponseModifier(ctx, modifier, response, vals)
 		if err != nil {
+			if p, ok := err.(*middlewarePanic); ok {
+				response.Body.Close()
+				response = createPanicResponse(request, p)
+				return response, nil
+			}
 			return nil, err
 		}
 	}
@@ -151,3 +271,45 @@ func (this *chainedProxy) RoundTrip(request *http.Request) (*http.Response, erro
 
 	return response, err
 }
+
+// calls a request modifier, converting a panic into an error
+func (this *chainedProxy) callRequestModifier(ctx context.Context, modifier RequestModifierFunc, request *http.Request, vals *ChainValues) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = this.recovered(r)
+		}
+	}()
+
+	return modifier(ctx, request, vals)
+}
+
+// calls a response modifier, converting a panic into an error
+func (this *chainedProxy) callResponseModifier(ctx context.Context, modifier ResponseModifierFunc, response *http.Response, vals *ChainValues) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = this.recovered(r)
+		}
+	}()
+
+	return modifier(ctx, response, vals)
+}
+
+func (this *chainedProxy) recovered(r interface{}) error {
+	// a middleware that panics with a RequestError still wants its response
+	// to be sent, so don't treat it as a crash
+	if re, ok := r.(*RequestError); ok {
+		return re
+	}
+
+	this.LogError.Printf("%s: panic in middleware: %v\n%s", this.Name, r, debug.Stack())
+	return &middlewarePanic{value: r}
+}
+
+func createPanicResponse(request *http.Request, p *middlewarePanic) *http.Response {
+	response := CreateNewResponse(request, "")
+	response.StatusCode = http.StatusInternalServerError
+	// header values cannot contain newlines
+	value := strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprintf("%v", p.value))
+	response.Header.Set("X-EwsProxy-Panic", value)
+	return response
+}
@@ -0,0 +1,272 @@
+package proxyutils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// returns a transport that always responds with 200 OK
+func okTransport() http.RoundTripper {
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		return CreateNewResponse(request, "upstream"), nil
+	})
+}
+
+// a middleware built from functions, any of which may be nil
+type funcMiddleware struct {
+	request  RequestModifierFunc
+	response ResponseModifierFunc
+}
+
+func (this *funcMiddleware) RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error {
+	if this.request != nil {
+		return this.request(ctx, request, vals)
+	}
+	return nil
+}
+
+func (this *funcMiddleware) ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error {
+	if this.response != nil {
+		return this.response(ctx, response, vals)
+	}
+	return nil
+}
+
+func testChain(logBuf *bytes.Buffer, middlewares ...Middleware) http.RoundTripper {
+	discard := log.New(ioutil.Discard, "", 0)
+	logError := log.New(logBuf, "", 0)
+	return CreateChainedProxy("test", discard, discard, discard, discard, logError, nil, okTransport(), middlewares...)
+}
+
+func newTestRequest(t *testing.T) *http.Request {
+	request, err := http.NewRequest("GET", "http://localhost/owa/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestChainRequestPanic(t *testing.T) {
+	logBuf := new(bytes.Buffer)
+
+	var nilMap map[string]string
+	panicky := &funcMiddleware{
+		request: func(ctx context.Context, request *http.Request, vals *ChainValues) error {
+			if request.URL.Path == "/owa/" {
+				nilMap["boom"] = "x"
+			}
+			return nil
+		},
+	}
+
+	chain := testChain(logBuf, panicky)
+
+	response, err := chain.RoundTrip(newTestRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", response.StatusCode)
+	}
+
+	if !strings.Contains(response.Header.Get("X-EwsProxy-Panic"), "nil map") {
+		t.Errorf("unexpected panic header %q", response.Header.Get("X-EwsProxy-Panic"))
+	}
+
+	if !strings.Contains(logBuf.String(), "goroutine") {
+		t.Errorf("stack was not logged: %s", logBuf)
+	}
+
+	// subsequent requests still work normally
+	request := newTestRequest(t)
+	request.URL.Path = "/other"
+	response, err = chain.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 after panic, got %d", response.StatusCode)
+	}
+}
+
+func TestChainResponsePanic(t *testing.T) {
+	logBuf := new(bytes.Buffer)
+
+	panicky := &funcMiddleware{
+		response: func(ctx context.Context, response *http.Response, vals *ChainValues) error {
+			panic("response failure")
+		},
+	}
+
+	response, err := testChain(logBuf, panicky).RoundTrip(newTestRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", response.StatusCode)
+	}
+
+	if response.Header.Get("X-EwsProxy-Panic") != "response failure" {
+		t.Errorf("unexpected panic header %q", response.Header.Get("X-EwsProxy-Panic"))
+	}
+}
+
+func TestChainRequestErrorNotSwallowed(t *testing.T) {
+	logBuf := new(bytes.Buffer)
+
+	// both returning and panicking with a RequestError send its response
+	returns := &funcMiddleware{
+		request: func(ctx context.Context, request *http.Request, vals *ChainValues) error {
+			response := CreateNewResponse(request, "returned")
+			response.StatusCode = http.StatusTeapot
+			return NewRequestError(response)
+		},
+	}
+
+	panics := &funcMiddleware{
+		request: func(ctx context.Context, request *http.Request, vals *ChainValues) error {
+			response := CreateNewResponse(request, "panicked")
+			response.StatusCode = http.StatusTeapot
+			panic(NewRequestError(response))
+		},
+	}
+
+	for _, m := range []Middleware{returns, panics} {
+		response, err := testChain(logBuf, m).RoundTrip(newTestRequest(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != http.StatusTeapot {
+			t.Errorf("expected RequestError response, got %d", response.StatusCode)
+		}
+	}
+
+	if logBuf.Len() != 0 {
+		t.Errorf("RequestError should not be logged as a panic: %s", logBuf)
+	}
+}
+
+func TestChainCancelledDuringUpstream(t *testing.T) {
+	logBuf := new(bytes.Buffer)
+
+	upstreamStarted := make(chan struct{})
+	upstreamDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(upstreamStarted)
+		<-r.Context().Done()
+		close(upstreamDone)
+	}))
+	defer server.Close()
+
+	responded := false
+	middleware := &funcMiddleware{
+		response: func(ctx context.Context, response *http.Response, vals *ChainValues) error {
+			responded = true
+			return nil
+		},
+	}
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, log.New(logBuf, "", 0), nil, transport, middleware)
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequest("GET", server.URL+"/owa/", nil)
+	request = request.WithContext(ctx)
+
+	result := make(chan error)
+	go func() {
+		_, err := chain.RoundTrip(request)
+		result <- err
+	}()
+
+	<-upstreamStarted
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RoundTrip did not return after the request was cancelled")
+	}
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+
+	if responded {
+		t.Error("response modifiers ran for a cancelled request")
+	}
+
+	// the connection goroutines wind down after the cancellation
+	transport.CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines still running after the request was cancelled, expected %d", n, before)
+	}
+}
+
+type legacyMiddleware struct{}
+
+func (this *legacyMiddleware) RequestModifier(request *http.Request, ctx ChainContext) error {
+	ctx["legacy"] = request.URL.Path
+	return nil
+}
+
+func (this *legacyMiddleware) ResponseModifier(response *http.Response, ctx ChainContext) error {
+	response.Header.Set("X-Legacy", ctx["legacy"].(string))
+	return nil
+}
+
+func TestAdaptLegacy(t *testing.T) {
+	var seen interface{}
+	current := &funcMiddleware{
+		request: func(ctx context.Context, request *http.Request, vals *ChainValues) error {
+			seen = vals.Get("legacy")
+			return nil
+		},
+	}
+
+	response, err := testChain(new(bytes.Buffer), AdaptLegacy(&legacyMiddleware{}), current).RoundTrip(newTestRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen != "/owa/" {
+		t.Errorf("value set by the legacy middleware was not shared, got %v", seen)
+	}
+
+	if response.Header.Get("X-Legacy") != "/owa/" {
+		t.Errorf("legacy response modifier was not called")
+	}
+}
@@ -0,0 +1,53 @@
+package proxyutils
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// CharsetEncoding returns the encoding of charset, nil if it is UTF-8. The
+// names are the ones that browsers know, so latin1 is windows-1252 like it
+// is on the web.
+func CharsetEncoding(charset string) (encoding.Encoding, error) {
+	if enc, ok := utf16Charsets[strings.ToLower(charset)]; ok {
+		return enc, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, errors.Errorf("unknown charset %s", charset)
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// DecodeBody returns data as UTF-8, transcoded from the charset of
+// contentType if it has one. A UTF-8 BOM is dropped. If the charset isn't
+// known, data is returned as it is with an error.
+func DecodeBody(data []byte, contentType string) ([]byte, error) {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		enc, err := CharsetEncoding(params["charset"])
+		if err != nil {
+			return data, err
+		}
+
+		if enc != nil {
+			decoded, err := enc.NewDecoder().Bytes(data)
+			if err != nil {
+				return data, errors.Wrapf(err, "decoding %s", params["charset"])
+			}
+			data = decoded
+		}
+	}
+
+	return bytes.TrimPrefix(data, utf8BOM), nil
+}
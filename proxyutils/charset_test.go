@@ -0,0 +1,30 @@
+package proxyutils
+
+import (
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	for _, test := range []struct {
+		data, contentType, expected string
+	}{
+		{"Entw\xfcrfe", "application/json; charset=windows-1252", "Entwürfe"},
+		// latin1 is windows-1252, like it is for browsers
+		{"\x93quoted\x94", "application/json; charset=ISO-8859-1", "“quoted”"},
+		{"\xe3\xe5\xe0\xf8", "application/json; charset=windows-1255", "דואר"},
+		{"\xef\xbb\xbf{}", "application/json; charset=utf-8", "{}"},
+		{"\xef\xbb\xbf{}", "application/json", "{}"},
+		{"{}", "application/json; charset=utf8", "{}"},
+		{"{\x00}\x00", "application/json; charset=utf-16le", "{}"},
+	} {
+		data, err := DecodeBody([]byte(test.data), test.contentType)
+		if err != nil || string(data) != test.expected {
+			t.Errorf("%q %s: expected %q, got %q %v", test.data, test.contentType, test.expected, data, err)
+		}
+	}
+
+	// unknown charsets are left alone
+	if data, err := DecodeBody([]byte("{}"), "application/json; charset=x-unknown"); err == nil || string(data) != "{}" {
+		t.Errorf("expected an error and the data as it is, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,165 @@
+package proxyutils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time that the proxy sleeps, throttles and ticks with.
+// RealClock is the clock of the system, tests use a FakeClock so that they
+// don't wait for real.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+
+	// After is time.After, for sleeps that can be cut short by a context
+	After(d time.Duration) <-chan time.Time
+
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of a *time.Ticker that the proxy uses
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the clock of the system
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (this realTicker) Chan() <-chan time.Time { return this.C }
+
+// FakeClock is a Clock for tests: time only passes when Advance is called.
+// Sleeps, Afters and tickers that are due when it is called fire at once.
+type FakeClock struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// a Sleep, an After or a ticker
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // 0 unless it's a ticker
+	ch     chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.changed = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (this *FakeClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.now
+}
+
+func (this *FakeClock) Sleep(d time.Duration) {
+	<-this.After(d)
+}
+
+func (this *FakeClock) After(d time.Duration) <-chan time.Time {
+	return this.add(d, 0).ch
+}
+
+func (this *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return &fakeTicker{clock: this, waiter: this.add(d, d)}
+}
+
+func (this *FakeClock) add(d time.Duration, period time.Duration) *fakeWaiter {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	waiter := &fakeWaiter{at: this.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		waiter.ch <- this.now
+		return waiter
+	}
+
+	this.waiters = append(this.waiters, waiter)
+	this.changed.Broadcast()
+	return waiter
+}
+
+func (this *FakeClock) remove(waiter *fakeWaiter) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i, w := range this.waiters {
+		if w == waiter {
+			this.waiters = append(this.waiters[:i], this.waiters[i+1:]...)
+			break
+		}
+	}
+	this.changed.Broadcast()
+}
+
+// Advance moves the time forward by d and fires what is due. Like a
+// *time.Ticker, a ticker that isn't read drops the ticks it missed.
+func (this *FakeClock) Advance(d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.now = this.now.Add(d)
+
+	waiting := this.waiters[:0]
+	for _, w := range this.waiters {
+		if w.at.After(this.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+
+		select {
+		case w.ch <- this.now:
+		default:
+		}
+
+		if w.period != 0 {
+			for !w.at.After(this.now) {
+				w.at = w.at.Add(w.period)
+			}
+			waiting = append(waiting, w)
+		}
+	}
+	this.waiters = waiting
+	this.changed.Broadcast()
+}
+
+// BlockUntil waits until n Sleeps, Afters and tickers are waiting for the
+// clock, so that a test can advance it once the code under test is blocked
+func (this *FakeClock) BlockUntil(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for len(this.waiters) < n {
+		this.changed.Wait()
+	}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	waiter *fakeWaiter
+}
+
+func (this *fakeTicker) Chan() <-chan time.Time { return this.waiter.ch }
+func (this *fakeTicker) Stop()                  { this.clock.remove(this.waiter) }
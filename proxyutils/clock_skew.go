@@ -0,0 +1,100 @@
+package proxyutils
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultSkewThreshold is the SkewTracker threshold if none is set
+const DefaultSkewThreshold = 5 * time.Minute
+
+// SkewTracker compares the Date header of the target server's responses to
+// the local clock. OWA validates the timestamp in the canary, so when the
+// clocks are too far apart the login seems to work but every request fails
+// with a 440.
+type SkewTracker struct {
+	// a warning is logged when the skew is larger than this
+	Threshold time.Duration
+
+	// for tests
+	now func() time.Time
+
+	lock   sync.Mutex
+	skew   time.Duration
+	known  bool
+	warned bool
+}
+
+func NewSkewTracker() *SkewTracker {
+	return &SkewTracker{
+		Threshold: DefaultSkewThreshold,
+		now:       time.Now,
+	}
+}
+
+// Update records the skew from the Date header, if present. A positive skew
+// means that the server's clock is ahead of ours.
+func (this *SkewTracker) Update(header http.Header) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := date.Sub(this.now()).Truncate(time.Second)
+
+	this.lock.Lock()
+	this.skew = skew
+	this.known = true
+	warn := this.exceeded() && !this.warned
+	this.warned = this.exceeded()
+	this.lock.Unlock()
+
+	if warn {
+		Log.Warn.Printf("WARNING: the local clock is %s. Exchange rejects the login when the clocks are too far apart, fix the system time", describeSkew(skew))
+	}
+}
+
+func (this *SkewTracker) exceeded() bool {
+	threshold := this.Threshold
+	if threshold == 0 {
+		threshold = DefaultSkewThreshold
+	}
+	return this.skew > threshold || -this.skew > threshold
+}
+
+// Skew returns the last skew seen, ok is false if there hasn't been a
+// response with a Date header yet
+func (this *SkewTracker) Skew() (skew time.Duration, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.skew, this.known
+}
+
+// Exceeded returns true if the last skew seen is larger than the threshold
+func (this *SkewTracker) Exceeded() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.known && this.exceeded()
+}
+
+func (this *SkewTracker) String() string {
+	skew, ok := this.Skew()
+	if !ok {
+		return "Clock skew unknown"
+	}
+
+	s := fmt.Sprintf("Clock skew %s", skew)
+	if this.Exceeded() {
+		s += " (WARNING: the local clock is " + describeSkew(skew) + ")"
+	}
+	return s
+}
+
+func describeSkew(skew time.Duration) string {
+	if skew > 0 {
+		return fmt.Sprintf("%s behind the exchange server", skew)
+	}
+	return fmt.Sprintf("%s ahead of the exchange server", -skew)
+}
@@ -0,0 +1,88 @@
+package proxyutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkewTracker(t *testing.T) {
+	local := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	skew := NewSkewTracker()
+	skew.now = func() time.Time { return local }
+
+	if _, ok := skew.Skew(); ok || skew.String() != "Clock skew unknown" {
+		t.Error("skew known before any response")
+	}
+
+	header := http.Header{}
+	header.Set("Date", local.Add(-2*time.Minute).Format(http.TimeFormat))
+	skew.Update(header)
+
+	if s, ok := skew.Skew(); !ok || s != -2*time.Minute || skew.Exceeded() {
+		t.Errorf("unexpected skew %s", s)
+	}
+
+	header.Set("Date", local.Add(40*time.Minute).Format(http.TimeFormat))
+	skew.Update(header)
+
+	if !skew.Exceeded() || !strings.Contains(skew.String(), "40m0s behind the exchange server") {
+		t.Errorf("unexpected skew: %s", skew)
+	}
+
+	// invalid dates are ignored
+	header.Set("Date", "yesterday")
+	skew.Update(header)
+
+	if s, _ := skew.Skew(); s != 40*time.Minute {
+		t.Errorf("invalid Date header changed the skew to %s", s)
+	}
+}
+
+func TestSkewFromRedirector(t *testing.T) {
+	// an exchange server with a clock that is 40 minutes fast
+	owa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(40*time.Minute).UTC().Format(http.TimeFormat))
+		w.Write([]byte("ok"))
+	}))
+	defer owa.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(owa.URL)
+
+	redirector := NewRedirectorMiddleware(source, target)
+	redirector.Skew = NewSkewTracker()
+
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, nil, redirector)
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+		response, err := chain.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	if skew, _ := redirector.Skew.Skew(); skew < 39*time.Minute || skew > 41*time.Minute {
+		t.Errorf("unexpected skew %s", skew)
+	}
+
+	// warned once, not for every response
+	if n := strings.Count(logBuf.String(), "WARNING"); n != 1 {
+		t.Errorf("expected one warning, got %d:\n%s", n, logBuf.String())
+	}
+}
@@ -0,0 +1,85 @@
+package proxyutils
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2017, 9, 12, 14, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	after := clock.After(2 * time.Second)
+	ticker := clock.NewTicker(time.Second)
+	expectFired := func(step string, ch <-chan time.Time, fired bool) {
+		select {
+		case <-ch:
+			if !fired {
+				t.Errorf("%s: fired too early", step)
+			}
+		default:
+			if fired {
+				t.Errorf("%s: did not fire", step)
+			}
+		}
+	}
+
+	clock.Advance(time.Second)
+	expectFired("1s after", after, false)
+	expectFired("1s tick", ticker.Chan(), true)
+
+	// the ticks that aren't read are dropped
+	clock.Advance(3 * time.Second)
+	expectFired("4s after", after, true)
+	expectFired("4s tick", ticker.Chan(), true)
+	expectFired("4s tick", ticker.Chan(), false)
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	expectFired("stopped", ticker.Chan(), false)
+
+	if now := clock.Now(); !now.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("unexpected time %s", now)
+	}
+}
+
+// the chain waits a second between retries of network errors
+func TestChainRetryClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 9, 12, 14, 0, 0, 0, time.UTC))
+
+	attempts := 0
+	transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return CreateNewResponse(request, "upstream"), nil
+	})
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, clock, transport)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := chain.RoundTrip(newTestRequest(t))
+		done <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil || attempts != 3 {
+			t.Errorf("expected the third attempt to work, got %v after %d", err, attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the retries did not finish")
+	}
+}
@@ -0,0 +1,193 @@
+package proxyutils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the request line and headers of the first request are only looked at if
+// they fit in this many bytes, the same limit as the net/http default
+const maxFramedHeaderBytes = http.DefaultMaxHeaderBytes
+
+// NewCloseDelimitedListener wraps the connections of listener so that an
+// HTTP/1.0 POST or PUT without Content-Length or Transfer-Encoding can have
+// a body, which the client ends by shutting down its side of the connection
+// (some embedded EWS clients do this). net/http treats such a request as
+// having no body at all. The body is read up front and the request is
+// given to the server with a Content-Length. Only the first request of a
+// connection is looked at, a client that keeps the connection open has to
+// frame its requests.
+func NewCloseDelimitedListener(listener net.Listener) net.Listener {
+	return &closeDelimitedListener{listener}
+}
+
+type closeDelimitedListener struct {
+	net.Listener
+}
+
+func (this *closeDelimitedListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeDelimitedConn{Conn: conn, wake: make(chan struct{})}, nil
+}
+
+type closeDelimitedConn struct {
+	net.Conn
+
+	// the first request, then the rest of the connection
+	reader io.Reader
+
+	// set when the client's end of the connection was the end of the body.
+	// net/http cancels the request when it sees the end of the connection,
+	// so reads wait for the deadline or Close instead of returning EOF.
+	holdEOF bool
+
+	lock     sync.Mutex
+	deadline time.Time
+	closed   bool
+	wake     chan struct{} // closed when deadline or closed changes
+}
+
+func (this *closeDelimitedConn) Read(p []byte) (int, error) {
+	if this.reader == nil {
+		this.reader = this.frameFirstRequest()
+	}
+
+	n, err := this.reader.Read(p)
+	if err == io.EOF && this.holdEOF {
+		return n, this.waitForDeadline()
+	}
+	return n, err
+}
+
+// returns a reader for the first request that has a Content-Length if it
+// needs one, followed by the rest of the connection
+func (this *closeDelimitedConn) frameFirstRequest() io.Reader {
+	br := bufio.NewReader(this.Conn)
+	head := new(bytes.Buffer)
+
+	for {
+		line, err := br.ReadSlice('\n')
+		head.Write(line)
+
+		if err == bufio.ErrBufferFull && head.Len() <= maxFramedHeaderBytes {
+			continue
+		} else if err != nil || head.Len() > maxFramedHeaderBytes {
+			// the server reports it
+			return io.MultiReader(head, br)
+		} else if head.Len() > len(line) && len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head.Bytes())))
+	if err != nil || !needsFraming(request) {
+		return io.MultiReader(head, br)
+	}
+
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		// the request is incomplete, so the server mustn't see all of it
+		return io.MultiReader(bytes.NewReader(head.Bytes()[:head.Len()-1]), &errorReader{err})
+	}
+
+	// the blank line at the end of the headers is replaced
+	framed := bytes.TrimRight(head.Bytes(), "\r\n")
+	framed = append(framed, "\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"...)
+
+	this.holdEOF = true
+	return io.MultiReader(bytes.NewReader(framed), bytes.NewReader(body))
+}
+
+// returns true for a request whose body can only end with the connection
+func needsFraming(request *http.Request) bool {
+	if request.ProtoMajor != 1 || request.ProtoMinor != 0 || !request.Close {
+		return false
+	}
+
+	if request.Method != "POST" && request.Method != "PUT" {
+		return false
+	}
+
+	_, hasLength := request.Header["Content-Length"]
+	return !hasLength && len(request.TransferEncoding) == 0
+}
+
+func (this *closeDelimitedConn) waitForDeadline() error {
+	for {
+		this.lock.Lock()
+		deadline, closed, wake := this.deadline, this.closed, this.wake
+		this.lock.Unlock()
+
+		if closed {
+			return net.ErrClosed
+		}
+
+		if deadline.IsZero() {
+			<-wake
+			continue
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// must be called with the lock held
+func (this *closeDelimitedConn) wakeUp() {
+	close(this.wake)
+	this.wake = make(chan struct{})
+}
+
+func (this *closeDelimitedConn) SetDeadline(t time.Time) error {
+	this.lock.Lock()
+	this.deadline = t
+	this.wakeUp()
+	this.lock.Unlock()
+	return this.Conn.SetDeadline(t)
+}
+
+func (this *closeDelimitedConn) SetReadDeadline(t time.Time) error {
+	this.lock.Lock()
+	this.deadline = t
+	this.wakeUp()
+	this.lock.Unlock()
+	return this.Conn.SetReadDeadline(t)
+}
+
+func (this *closeDelimitedConn) Close() error {
+	this.lock.Lock()
+	if !this.closed {
+		this.closed = true
+		this.wakeUp()
+	}
+	this.lock.Unlock()
+	return this.Conn.Close()
+}
+
+type errorReader struct {
+	err error
+}
+
+func (this *errorReader) Read(p []byte) (int, error) {
+	return 0, this.err
+}
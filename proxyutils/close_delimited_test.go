@@ -0,0 +1,100 @@
+package proxyutils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replies with what the handler saw of the request
+func newCloseDelimitedServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+
+		// net/http notices the end of the connection after the body
+		time.Sleep(50 * time.Millisecond)
+
+		fmt.Fprintf(w, "%s %d %q %v %v", r.Proto, r.ContentLength, body, err, r.Context().Err())
+	}))
+	server.Listener = NewCloseDelimitedListener(server.Listener)
+	server.Start()
+	return server
+}
+
+func TestCloseDelimitedRequest(t *testing.T) {
+	server := newCloseDelimitedServer()
+	defer server.Close()
+
+	for request, expected := range map[string]string{
+		"POST / HTTP/1.0\r\nHost: localhost\r\n\r\n<xml/>": `HTTP/1.0 6 "<xml/>" <nil> <nil>`,
+		"PUT / HTTP/1.0\r\n\r\n":                           `HTTP/1.0 0 "" <nil> <nil>`,
+		// framed requests are left alone, net/http cancels them when the
+		// client goes away
+		"POST / HTTP/1.0\r\nContent-Length: 3\r\n\r\nabcdef":                  `HTTP/1.0 3 "abc" <nil> context canceled`,
+		"GET / HTTP/1.0\r\n\r\nignored":                                       `HTTP/1.0 0 "" <nil> <nil>`,
+		"POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\nbody": `HTTP/1.1 0 "" <nil> <nil>`,
+	} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(request))
+		conn.(*net.TCPConn).CloseWrite()
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Errorf("%q: %s", request, err)
+			conn.Close()
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(response.Body)
+		conn.Close()
+
+		if string(body) != expected {
+			t.Errorf("%q: expected %s, got %s", request, expected, body)
+		}
+	}
+}
+
+func TestCloseDelimitedKeepAlive(t *testing.T) {
+	server := newCloseDelimitedServer()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// framed requests on the same connection are left alone
+	reader := bufio.NewReader(conn)
+	for _, body := range []string{"one", "two"} {
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, _ := ioutil.ReadAll(response.Body)
+
+		if expected := fmt.Sprintf(`HTTP/1.1 3 "%s" <nil> <nil>`, body); string(result) != expected {
+			t.Errorf("expected %s, got %s", expected, result)
+		}
+	}
+
+	// the server still notices when the client goes away
+	conn.(*net.TCPConn).CloseWrite()
+	if _, err = reader.ReadByte(); err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("expected the server to close the connection, got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package proxyutils
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCookieAllowList contains the names of cookies that OWA needs to keep
+// a session alive. Names ending in '*' match any cookie with that prefix.
+var DefaultCookieAllowList = []string{
+	"cadata*",
+	"X-OWA-CANARY",
+	"ClientId",
+	"X-BackEndCookie*",
+	"X-BackEndOverrideCookie",
+	"exchangecookie",
+	"PrivateComputer",
+	"PBack",
+	"UC",
+	"owacsdc",
+	"OIDC",
+}
+
+const defaultMaxCookiesPerHost = 50
+
+// the jar identifies a cookie by name, domain and path, so the deletion has
+// to be sent with the same values (and URL) that the cookie was set with
+type boundedCookieKey struct {
+	name   string
+	domain string
+	path   string
+}
+
+type boundedCookieEntry struct {
+	u       *url.URL
+	expires time.Time // zero if it's a session cookie
+	seq     uint64
+}
+
+// BoundedCookieJar is a http.CookieJar that limits the number of cookies
+// stored for each host, as OWA sets a new cookie on many requests and a
+// plain jar grows until the server rejects the request headers. When the
+// limit is exceeded, expired cookies are removed first, then the cookies
+// that were least recently set.
+type BoundedCookieJar struct {
+	// maximum number of cookies stored for each host
+	MaxPerHost int
+
+	// If set, only cookies with these names are stored. Names ending in '*'
+	// match any cookie with that prefix.
+	AllowList []string
+
+	// Set to true to log evicted and ignored cookies, use SetDebug once the
+	// proxy is running
+	Debug bool
+
+	lock  sync.Mutex
+	jar   *cookiejar.Jar
+	seq   uint64
+	hosts map[string]map[boundedCookieKey]*boundedCookieEntry
+}
+
+func NewBoundedCookieJar() *BoundedCookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &BoundedCookieJar{
+		MaxPerHost: defaultMaxCookiesPerHost,
+		jar:        jar,
+		hosts:      make(map[string]map[boundedCookieKey]*boundedCookieEntry),
+	}
+}
+
+// SetDebug changes Debug while the proxy is running
+func (this *BoundedCookieJar) SetDebug(debug bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Debug = debug
+}
+
+// the path that the jar stores the cookie under (RFC 6265 section 5.1.4)
+func cookiePath(u *url.URL, cookie *http.Cookie) string {
+	if strings.HasPrefix(cookie.Path, "/") {
+		return cookie.Path
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return u.Path[:i]
+}
+
+func (this *BoundedCookieJar) allowed(name string) bool {
+	if this.AllowList == nil {
+		return true
+	}
+	return matchCookieName(this.AllowList, name)
+}
+
+// returns true if name is in names. Names ending in '*' match any cookie
+// with that prefix.
+func matchCookieName(names []string, name string) bool {
+	for _, allowed := range names {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(name, allowed[:len(allowed)-1]) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCookies implements the http.CookieJar interface
+func (this *BoundedCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	entries := this.hosts[u.Host]
+	if entries == nil {
+		entries = make(map[boundedCookieKey]*boundedCookieEntry)
+		this.hosts[u.Host] = entries
+	}
+
+	accepted := make([]*http.Cookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		if !this.allowed(cookie.Name) {
+			if this.Debug {
+				Log.Info.Printf("Cookie jar: ignoring cookie %s from %s", cookie.Name, u.Host)
+			}
+			continue
+		}
+
+		accepted = append(accepted, cookie)
+
+		key := boundedCookieKey{cookie.Name, cookie.Domain, cookiePath(u, cookie)}
+
+		var expires time.Time
+		if cookie.MaxAge > 0 {
+			expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		} else if cookie.MaxAge == 0 && !cookie.Expires.IsZero() {
+			expires = cookie.Expires
+		}
+
+		if cookie.MaxAge < 0 || (!expires.IsZero() && !expires.After(now)) {
+			// the server is deleting the cookie
+			delete(entries, key)
+			continue
+		}
+
+		this.seq++
+		entries[key] = &boundedCookieEntry{u: u, expires: expires, seq: this.seq}
+	}
+
+	this.jar.SetCookies(u, accepted)
+	this.evict(u.Host, entries, now)
+}
+
+// removes cookies until the host is within MaxPerHost, must hold the lock
+func (this *BoundedCookieJar) evict(host string, entries map[boundedCookieKey]*boundedCookieEntry, now time.Time) {
+	if this.MaxPerHost <= 0 || len(entries) <= this.MaxPerHost {
+		return
+	}
+
+	// expired cookies are already ignored by the jar, forget about them
+	for key, entry := range entries {
+		if !entry.expires.IsZero() && !entry.expires.After(now) {
+			this.remove(key, entry)
+			delete(entries, key)
+		}
+	}
+
+	for len(entries) > this.MaxPerHost {
+		var oldestKey boundedCookieKey
+		var oldest *boundedCookieEntry
+		for key, entry := range entries {
+			if oldest == nil || entry.seq < oldest.seq {
+				oldestKey, oldest = key, entry
+			}
+		}
+
+		if this.Debug {
+			Log.Info.Printf("Cookie jar: evicting cookie %s from %s", oldestKey.name, host)
+		}
+
+		this.remove(oldestKey, oldest)
+		delete(entries, oldestKey)
+	}
+}
+
+func (this *BoundedCookieJar) remove(key boundedCookieKey, entry *boundedCookieEntry) {
+	this.jar.SetCookies(entry.u, []*http.Cookie{{
+		Name:   key.name,
+		Domain: key.domain,
+		Path:   key.path,
+		MaxAge: -1,
+	}})
+}
+
+// Cookies implements the http.CookieJar interface. If there are multiple
+// cookies with the same name, only the most specific one is returned.
+func (this *BoundedCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// the jar returns the cookies with the longest path first
+	cookies := this.jar.Cookies(u)
+	seen := make(map[string]bool, len(cookies))
+	ret := cookies[:0]
+
+	for _, cookie := range cookies {
+		if !seen[cookie.Name] {
+			seen[cookie.Name] = true
+			ret = append(ret, cookie)
+		}
+	}
+
+	return ret
+}
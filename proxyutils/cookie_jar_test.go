@@ -0,0 +1,128 @@
+package proxyutils
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func cookieHeaderSize(cookies []*http.Cookie) int {
+	request, _ := http.NewRequest("GET", "https://mail.example.com/owa/", nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	return len(request.Header.Get("Cookie"))
+}
+
+func TestBoundedCookieJarChurn(t *testing.T) {
+	u, _ := url.Parse("https://mail.example.com/owa/service.svc")
+
+	jar := NewBoundedCookieJar()
+	jar.MaxPerHost = 10
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "cadata", Value: "session", Path: "/"}})
+
+	// OWA sets a differently named diagnostics cookie on lots of requests
+	maxSize := 0
+	for i := 0; i < 1000; i++ {
+		jar.SetCookies(u, []*http.Cookie{
+			{Name: fmt.Sprintf("X-OWA-Diag%d", i), Value: "some diagnostics data", Path: "/"},
+			{Name: "ClientId", Value: fmt.Sprintf("client%d", i), Path: "/"},
+		})
+
+		// keep the session cookie fresh, like the server does
+		if i%5 == 0 {
+			jar.SetCookies(u, []*http.Cookie{{Name: "cadata", Value: "session", Path: "/"}})
+		}
+
+		cookies := jar.Cookies(u)
+		if len(cookies) > 10 {
+			t.Fatalf("jar has %d cookies, expected at most 10", len(cookies))
+		}
+
+		if size := cookieHeaderSize(cookies); size > maxSize {
+			maxSize = size
+		}
+	}
+
+	if maxSize > 500 {
+		t.Errorf("Cookie header grew to %d bytes", maxSize)
+	}
+
+	found := map[string]string{}
+	for _, cookie := range jar.Cookies(u) {
+		found[cookie.Name] = cookie.Value
+	}
+
+	if found["cadata"] != "session" {
+		t.Error("recently set session cookie was evicted")
+	}
+
+	if found["ClientId"] != "client999" {
+		t.Errorf("expected the latest ClientId, got %q", found["ClientId"])
+	}
+}
+
+func TestBoundedCookieJarExpiredFirst(t *testing.T) {
+	u, _ := url.Parse("https://mail.example.com/owa/")
+
+	jar := NewBoundedCookieJar()
+	jar.MaxPerHost = 2
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "old", Value: "1", Path: "/"}})
+	jar.SetCookies(u, []*http.Cookie{{Name: "shortlived", Value: "1", Path: "/", Expires: time.Now().Add(10 * time.Millisecond)}})
+
+	time.Sleep(20 * time.Millisecond)
+	jar.SetCookies(u, []*http.Cookie{{Name: "new", Value: "1", Path: "/"}})
+
+	cookies := jar.Cookies(u)
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies, got %v", cookies)
+	}
+
+	for _, cookie := range cookies {
+		if cookie.Name == "shortlived" {
+			t.Error("expired cookie still present")
+		}
+	}
+}
+
+func TestBoundedCookieJarAllowList(t *testing.T) {
+	u, _ := url.Parse("https://mail.example.com/owa/")
+
+	jar := NewBoundedCookieJar()
+	jar.AllowList = DefaultCookieAllowList
+
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "cadataKey", Value: "1", Path: "/"},
+		{Name: "X-OWA-CANARY", Value: "2", Path: "/"},
+		{Name: "tracking", Value: "3", Path: "/"},
+	})
+
+	cookies := jar.Cookies(u)
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies, got %v", cookies)
+	}
+
+	for _, cookie := range cookies {
+		if cookie.Name == "tracking" {
+			t.Error("cookie not in the allow list was stored")
+		}
+	}
+}
+
+func TestBoundedCookieJarDuplicates(t *testing.T) {
+	root, _ := url.Parse("https://mail.example.com/")
+	owa, _ := url.Parse("https://mail.example.com/owa/service.svc")
+
+	jar := NewBoundedCookieJar()
+	jar.SetCookies(root, []*http.Cookie{{Name: "ClientId", Value: "stale", Path: "/"}})
+	jar.SetCookies(owa, []*http.Cookie{{Name: "ClientId", Value: "current", Path: "/owa"}})
+
+	cookies := jar.Cookies(owa)
+	if len(cookies) != 1 || cookies[0].Value != "current" {
+		t.Errorf("expected only the most specific cookie, got %v", cookies)
+	}
+}
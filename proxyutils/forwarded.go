@@ -0,0 +1,98 @@
+package proxyutils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ForwardedHeaderMode says what the exchange server is told about the
+// client of a request
+type ForwardedHeaderMode int
+
+const (
+	// X-Forwarded-For, X-Forwarded-Proto and Forwarded are removed, the
+	// server only sees the proxy
+	ForwardedOff ForwardedHeaderMode = iota
+
+	// the client address is appended to X-Forwarded-For and Forwarded (RFC
+	// 7239), and X-Forwarded-Proto is the scheme that the client used
+	ForwardedStandard
+
+	// as ForwardedStandard, but the server is only told that the request
+	// was forwarded: the client is "unknown" and earlier hops are removed
+	ForwardedAnonymize
+)
+
+var forwardedHeaderModes = []string{"off", "standard", "anonymize"}
+
+func (this ForwardedHeaderMode) String() string {
+	if int(this) < len(forwardedHeaderModes) {
+		return forwardedHeaderModes[this]
+	}
+	return "invalid"
+}
+
+// ParseForwardedHeaderMode parses off, standard or anonymize
+func ParseForwardedHeaderMode(value string) (ForwardedHeaderMode, error) {
+	for i, name := range forwardedHeaderModes {
+		if strings.EqualFold(value, name) {
+			return ForwardedHeaderMode(i), nil
+		}
+	}
+	return ForwardedOff, errors.Errorf("invalid forwarded header mode `%s`, expected off, standard or anonymize", value)
+}
+
+// sets the forwarding headers of a request that the proxy received from a
+// client, before it is retargeted
+func (this ForwardedHeaderMode) apply(request *http.Request) {
+	if this == ForwardedOff {
+		request.Header.Del("X-Forwarded-For")
+		request.Header.Del("X-Forwarded-Proto")
+		request.Header.Del("Forwarded")
+		return
+	}
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+
+	client, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		client = request.RemoteAddr
+	}
+
+	forwardedFor := client
+	if strings.Contains(client, ":") {
+		forwardedFor = `"[` + client + `]"`
+	}
+
+	if this == ForwardedAnonymize || client == "" {
+		client, forwardedFor = "", "unknown"
+	}
+
+	if this == ForwardedAnonymize {
+		request.Header.Del("X-Forwarded-For")
+		request.Header.Del("Forwarded")
+	}
+
+	if client != "" {
+		if prior := request.Header.Values("X-Forwarded-For"); len(prior) != 0 {
+			client = strings.Join(prior, ", ") + ", " + client
+		}
+		request.Header.Set("X-Forwarded-For", client)
+	}
+
+	forwarded := "for=" + forwardedFor + ";proto=" + proto
+	if this == ForwardedStandard && request.Host != "" {
+		forwarded += `;host="` + request.Host + `"`
+	}
+	if prior := request.Header.Values("Forwarded"); len(prior) != 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	request.Header.Set("Forwarded", forwarded)
+	request.Header.Set("X-Forwarded-Proto", proto)
+}
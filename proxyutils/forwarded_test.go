@@ -0,0 +1,92 @@
+package proxyutils
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse("https://mail.example.com")
+
+	type forwarded struct {
+		forwardedFor   string
+		forwardedProto string
+		forwarded      string
+	}
+
+	for _, test := range []struct {
+		mode       ForwardedHeaderMode
+		remoteAddr string
+		prior      bool
+		tls        bool
+		expected   forwarded
+	}{
+		{ForwardedOff, "192.0.2.10:5555", true, false, forwarded{}},
+		{ForwardedStandard, "192.0.2.10:5555", false, false, forwarded{
+			"192.0.2.10", "http", `for=192.0.2.10;proto=http;host="localhost:60001"`,
+		}},
+		{ForwardedStandard, "192.0.2.10:5555", true, true, forwarded{
+			"198.51.100.1, 192.0.2.10", "https", `for=198.51.100.1, for=192.0.2.10;proto=https;host="localhost:60001"`,
+		}},
+		{ForwardedStandard, "[2001:db8::1]:5555", false, false, forwarded{
+			"2001:db8::1", "http", `for="[2001:db8::1]";proto=http;host="localhost:60001"`,
+		}},
+		{ForwardedAnonymize, "192.0.2.10:5555", true, true, forwarded{
+			"", "https", "for=unknown;proto=https",
+		}},
+	} {
+		var upstream http.Header
+		transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			upstream = request.Header
+			return CreateNewResponse(request, ""), nil
+		})
+
+		redirector := NewRedirectorMiddleware(source, target)
+		redirector.ForwardedHeaders = test.mode
+
+		discard := log.New(ioutil.Discard, "", 0)
+		chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, transport, redirector)
+
+		request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.prior {
+			request.Header.Set("X-Forwarded-For", "198.51.100.1")
+			request.Header.Set("X-Forwarded-Proto", "https")
+			request.Header.Set("Forwarded", "for=198.51.100.1")
+		}
+		if test.tls {
+			request.TLS = &tls.ConnectionState{}
+		}
+
+		response, err := chain.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := forwarded{upstream.Get("X-Forwarded-For"), upstream.Get("X-Forwarded-Proto"), upstream.Get("Forwarded")}
+		if got != test.expected {
+			t.Errorf("%s %s: expected %+v, got %+v", test.mode, test.remoteAddr, test.expected, got)
+		}
+
+		if host := response.Header.Get("Host"); host != "" {
+			t.Errorf("%s: Host header %q in the response", test.mode, host)
+		}
+	}
+}
+
+func TestParseForwardedHeaderMode(t *testing.T) {
+	for _, mode := range []ForwardedHeaderMode{ForwardedOff, ForwardedStandard, ForwardedAnonymize} {
+		if parsed, err := ParseForwardedHeaderMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("%s: got %s %v", mode, parsed, err)
+		}
+	}
+
+	if _, err := ParseForwardedHeaderMode("on"); err == nil {
+		t.Error("expected an error")
+	}
+}
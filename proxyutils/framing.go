@@ -0,0 +1,309 @@
+package proxyutils
+
+/*
+	A request that says where its body ends in more than one way (a
+	Content-Length and a Transfer-Encoding, or Content-Lengths that differ)
+	can be read one way by us and another way by whatever is in front of
+	us, which is how requests are smuggled. net/http rejects some of these
+	requests, and for others it picks one of the headers and drops the rest
+	before a handler sees them.
+
+	So the listener of NewFramingListener follows the requests on each
+	connection before net/http parses them, and adds AmbiguousFramingHeader
+	to the ones that frame their body in more than one way.
+	FramingMiddleware rejects those, and whatever it can see of such
+	requests that didn't come through the listener. It also removes the
+	client's framing headers, the request that is sent on is framed by the
+	transport for the body that it has by then.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AmbiguousFramingHeader is added by the listener of NewFramingListener to
+// requests with ambiguous framing, the value is the headers that are the
+// problem. A client's own copy is always removed.
+const AmbiguousFramingHeader = "X-EwsProxy-Ambiguous-Framing"
+
+// headers that the request is handled by, duplicates must agree
+var framingCriticalHeaders = []string{"Host", "Content-Type", "Content-Encoding", "SOAPAction"}
+
+// FramingMiddleware rejects requests with ambiguous framing with a 400. It
+// must be the first middleware in the chain.
+type FramingMiddleware struct{}
+
+func (this *FramingMiddleware) RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error {
+	problems := request.Header.Values(AmbiguousFramingHeader)
+	request.Header.Del(AmbiguousFramingHeader)
+
+	lengths := request.Header.Values("Content-Length")
+	encodings := request.Header.Values("Transfer-Encoding")
+	if len(lengths) > 1 || (len(lengths) == 1 && strings.Contains(lengths[0], ",")) {
+		problems = append(problems, "Content-Length: "+strings.Join(lengths, ", "))
+	}
+	if len(lengths) != 0 && (len(encodings) != 0 || len(request.TransferEncoding) != 0) {
+		problems = append(problems, "Content-Length with Transfer-Encoding")
+	}
+
+	for _, name := range framingCriticalHeaders {
+		values := request.Header.Values(name)
+		if len(values) < 2 {
+			continue
+		}
+
+		for _, value := range values[1:] {
+			if value != values[0] {
+				problems = append(problems, name+": "+strings.Join(values, ", "))
+				break
+			}
+		}
+
+		// the same value more than once is only one
+		request.Header.Set(name, values[0])
+	}
+
+	if len(problems) != 0 {
+		Log.Warn.Printf("Rejected %s %s from %s with ambiguous framing: %s", request.Method, request.URL.Path, request.RemoteAddr, strings.Join(problems, "; "))
+
+		response := CreateNewResponse(request, "Bad Request: the request is framed in more than one way\n")
+		response.StatusCode = http.StatusBadRequest
+		response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		return NewRequestError(response)
+	}
+
+	// the transport frames the body that is sent on
+	request.Header.Del("Content-Length")
+	request.Header.Del("Transfer-Encoding")
+	return nil
+}
+
+func (this *FramingMiddleware) ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error {
+	return nil
+}
+
+// NewFramingListener wraps the connections of listener so that requests
+// with ambiguous framing get AmbiguousFramingHeader. Once a request can't
+// be followed (a body that net/http rejects, an upgrade or a head that is
+// too long), the rest of the connection is passed on as it is.
+func NewFramingListener(listener net.Listener) net.Listener {
+	return &framingListener{listener}
+}
+
+type framingListener struct {
+	net.Listener
+}
+
+func (this *framingListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type framingConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// what was read of the current line and head. net/http interrupts
+	// reads with a deadline while it waits, so they are kept until the read
+	// is tried again.
+	line     []byte
+	head     [][]byte
+	headSize int
+
+	// returned before anything else is read
+	pending []byte
+
+	// the rest of the body or chunk that is being read
+	remaining int64
+
+	// set while a chunked body is read, trailer once the last chunk was
+	chunked bool
+	trailer bool
+
+	// set once the requests can't be followed
+	passthrough bool
+}
+
+func (this *framingConn) Read(p []byte) (int, error) {
+	for len(this.pending) == 0 {
+		if this.passthrough {
+			return this.reader.Read(p)
+		} else if this.remaining > 0 {
+			if int64(len(p)) > this.remaining {
+				p = p[:this.remaining]
+			}
+			n, err := this.reader.Read(p)
+			this.remaining -= int64(n)
+			return n, err
+		}
+
+		var err error
+		if this.pending, err = this.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
+
+// reads what comes before the next part of a body: a chunk size line, the
+// trailer or the head of the next request
+func (this *framingConn) next() ([]byte, error) {
+	if !this.chunked {
+		return this.nextHead()
+	}
+
+	line, err := this.readLine(maxFramedHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.trailer {
+		// the trailer ends with a blank line
+		if len(bytes.TrimSpace(line)) == 0 {
+			this.chunked, this.trailer = false, false
+		}
+		return line, nil
+	}
+
+	sizeText := string(line)
+	if semi := strings.IndexByte(sizeText, ';'); semi != -1 {
+		sizeText = sizeText[:semi]
+	}
+	size, perr := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+	if perr != nil || size < 0 {
+		// net/http rejects it
+		this.passthrough = true
+	} else if size == 0 {
+		this.trailer = true
+	} else {
+		// and the CRLF after the data
+		this.remaining = size + 2
+	}
+	return line, nil
+}
+
+// reads a line, up to limit bytes of it. A longer line is returned as far as
+// it was read and the rest of the connection is passed through.
+func (this *framingConn) readLine(limit int) ([]byte, error) {
+	for {
+		part, err := this.reader.ReadSlice('\n')
+		this.line = append(this.line, part...)
+
+		if err == bufio.ErrBufferFull && len(this.line) <= limit {
+			continue
+		} else if err == bufio.ErrBufferFull {
+			this.passthrough = true
+		} else if err != nil {
+			return nil, err
+		}
+
+		line := this.line
+		this.line = nil
+		return line, nil
+	}
+}
+
+// reads the head of the next request, marks it if it is ambiguous and sets
+// up reading its body
+func (this *framingConn) nextHead() ([]byte, error) {
+	for {
+		line, err := this.readLine(maxFramedHeaderBytes - this.headSize)
+		if err != nil {
+			return nil, err
+		}
+		this.head = append(this.head, line)
+		this.headSize += len(line)
+
+		// net/http reports a head that is too long
+		if this.headSize > maxFramedHeaderBytes {
+			this.passthrough = true
+		}
+		if this.passthrough || len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+	}
+
+	// net/http skips blank lines before the request line
+	lines := this.head
+	this.head, this.headSize = nil, 0
+	if len(lines) == 1 || this.passthrough {
+		return bytes.Join(lines, nil), nil
+	}
+
+	requestLine := strings.Fields(string(lines[0]))
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/1.") {
+		this.passthrough = true
+		return bytes.Join(lines, nil), nil
+	}
+	http10 := requestLine[2] == "HTTP/1.0"
+
+	var head bytes.Buffer
+	var lengths, encodings, problems []string
+	upgrade := requestLine[0] == "CONNECT"
+	for _, line := range lines[:len(lines)-1] {
+		name, value, _ := strings.Cut(string(line), ":")
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(name, AmbiguousFramingHeader) {
+			continue
+		}
+
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length":
+			for _, length := range strings.Split(value, ",") {
+				lengths = append(lengths, strings.TrimSpace(length))
+			}
+			problems = append(problems, strings.TrimSpace(string(line)))
+		case "Transfer-Encoding":
+			encodings = append(encodings, value)
+			problems = append(problems, strings.TrimSpace(string(line)))
+		case "Upgrade":
+			upgrade = true
+		}
+		head.Write(line)
+	}
+
+	ambiguous := len(encodings) > 1 || (len(encodings) != 0 && (len(lengths) != 0 || http10))
+	for _, length := range lengths {
+		ambiguous = ambiguous || length != lengths[0]
+	}
+	if ambiguous {
+		head.WriteString(AmbiguousFramingHeader + ": " + strings.Join(problems, "; ") + "\r\n")
+	}
+	head.Write(lines[len(lines)-1])
+
+	// the same as net/http: HTTP/1.0 ignores Transfer-Encoding, only
+	// chunked is supported, and Transfer-Encoding wins over Content-Length
+	switch {
+	case len(encodings) != 0 && !http10:
+		if len(encodings) == 1 && strings.EqualFold(encodings[0], "chunked") {
+			this.chunked = true
+		} else {
+			this.passthrough = true
+		}
+	case len(lengths) != 0:
+		length, err := strconv.ParseInt(lengths[0], 10, 64)
+		if err != nil || length < 0 || ambiguous {
+			this.passthrough = true
+		} else {
+			this.remaining = length
+		}
+	}
+
+	// whatever follows isn't HTTP/1
+	if upgrade {
+		this.passthrough = true
+	}
+	return head.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package proxyutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a server like the proxy's, replies with what the handler saw of the
+// request or with the response of the FramingMiddleware
+func newFramingServer() *httptest.Server {
+	middleware := &FramingMiddleware{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := middleware.RequestModifier(r.Context(), r, NewChainValues()); err != nil {
+			response := err.(*RequestError).Response
+			w.WriteHeader(response.StatusCode)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%q %q %q", body, r.Header.Get("SOAPAction"), r.Header.Get(AmbiguousFramingHeader))
+	}))
+	server.Listener = NewFramingListener(NewCloseDelimitedListener(server.Listener))
+	server.Start()
+	return server
+}
+
+// sends the requests on one connection, returns the status and body of each
+// response
+func sendRaw(t *testing.T, server *httptest.Server, requests ...string) []string {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	conn.Write([]byte(strings.Join(requests, "")))
+
+	var results []string
+	reader := bufio.NewReader(conn)
+	for range requests {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		results = append(results, fmt.Sprintf("%d %s", response.StatusCode, body))
+	}
+	return results
+}
+
+func TestFramingAmbiguous(t *testing.T) {
+	server := newFramingServer()
+	defer server.Close()
+
+	for request, expected := range map[string]string{
+		// rejected by us, net/http would use the chunked body
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n":  "400 ",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 10\r\n\r\n3\r\nabc\r\n0\r\n\r\n": "400 ",
+		// net/http would ignore Transfer-Encoding
+		"POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n3\r\nabc\r\n0\r\n\r\n": "400 ",
+		// rejected by net/http
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde":                        "400 400 Bad Request",
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3, 5\r\n\r\nabcde":                                          "400 400 Bad Request",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n":  "501 Unsupported transfer encoding",
+		"POST / HTTP/1.1\r\nHost: x\r\nSOAPAction: GetItem\r\nSOAPAction: DeleteItem\r\nContent-Length: 0\r\n\r\n": "400 ",
+		// the same value twice is only one
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc":                       `200 "abc" "" ""`,
+		"POST / HTTP/1.1\r\nHost: x\r\nSOAPAction: GetItem\r\nSOAPAction: GetItem\r\nContent-Length: 0\r\n\r\n": `200 "" "GetItem" ""`,
+		// a client can't mark its own requests
+		"POST / HTTP/1.1\r\nHost: x\r\n" + AmbiguousFramingHeader + ": x\r\nContent-Length: 3\r\n\r\nabc": `200 "abc" "" ""`,
+	} {
+		results := sendRaw(t, server, request)
+		if len(results) != 1 || results[0] != expected {
+			t.Errorf("%q: expected %s, got %q", request, expected, results)
+		}
+	}
+}
+
+// the requests after the first on a connection are looked at too
+func TestFramingKeepAlive(t *testing.T) {
+	server := newFramingServer()
+	defer server.Close()
+
+	results := sendRaw(t, server,
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nTrailer: x\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n\r\nContent-Len",
+		"\r\nPOST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+	)
+
+	expected := []string{`200 "abcde" "" ""`, `200 "Content-Len" "" ""`, "400 "}
+	if strings.Join(results, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, results)
+	}
+}
+
+func TestFramingMiddleware(t *testing.T) {
+	middleware := &FramingMiddleware{}
+
+	logBuf := new(bytes.Buffer)
+	defer func(saved *LevelLoggers) { Log = saved }(Log)
+	Log = NewLevelLoggers(log.New(logBuf, "", 0), LevelWarn)
+
+	request, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader("abc"))
+	request.Header.Set("Content-Length", "3")
+	request.TransferEncoding = []string{"chunked"}
+	if err, ok := middleware.RequestModifier(context.Background(), request, NewChainValues()).(*RequestError); !ok || err.Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 for Content-Length with chunked, got %v", err)
+	}
+
+	// the rejection is a warning
+	if !strings.Contains(logBuf.String(), "ambiguous framing") {
+		t.Errorf("the rejection was not logged: %q", logBuf)
+	}
+
+	// the client's framing isn't sent on
+	request, _ = http.NewRequest("POST", "http://localhost/", strings.NewReader("abc"))
+	request.Header.Set("Content-Length", "3")
+	if err := middleware.RequestModifier(context.Background(), request, NewChainValues()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := request.Header["Content-Length"]; ok || request.ContentLength != 3 {
+		t.Errorf("expected only the Content-Length header to be removed, got %q %d", request.Header, request.ContentLength)
+	}
+}
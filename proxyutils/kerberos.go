@@ -0,0 +1,72 @@
+//go:build kerberos
+// +build kerberos
+
+package proxyutils
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/pkg/errors"
+)
+
+// NewKerberosTransport returns a NegotiateTransport that gets its tickets
+// with the keytab or credential cache that kerberos names
+func NewKerberosTransport(kerberos *KerberosConfig, transport http.RoundTripper) (*NegotiateTransport, error) {
+	krb5Conf := kerberos.Krb5Conf
+	if krb5Conf == "" {
+		krb5Conf = "/etc/krb5.conf"
+	}
+
+	cfg, err := config.Load(krb5Conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading %s", krb5Conf)
+	}
+
+	var cl *client.Client
+	if kerberos.Keytab != "" {
+		kt, err := keytab.Load(kerberos.Keytab)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading keytab %s", kerberos.Keytab)
+		}
+
+		user, realm := kerberos.Principal, cfg.LibDefaults.DefaultRealm
+		if i := strings.LastIndex(user, "@"); i != -1 {
+			user, realm = user[:i], user[i+1:]
+		}
+		if user == "" {
+			return nil, errors.New("a principal is required with a keytab")
+		}
+
+		cl = client.NewWithKeytab(user, realm, kt, cfg, client.DisablePAFXFAST(true))
+		if err = cl.Login(); err != nil {
+			return nil, errors.Wrapf(err, "kerberos login as %s@%s", user, realm)
+		}
+
+	} else if kerberos.CCache != "" {
+		cc, err := credentials.LoadCCache(kerberos.CCache)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading credential cache %s", kerberos.CCache)
+		}
+
+		if cl, err = client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true)); err != nil {
+			return nil, errors.Wrapf(err, "credential cache %s", kerberos.CCache)
+		}
+
+	} else {
+		return nil, errors.New("a keytab or a credential cache is required")
+	}
+
+	return &NegotiateTransport{
+		Transport: transport,
+		SPN:       kerberos.SPN,
+		Authorize: func(request *http.Request, spn string) error {
+			return spnego.SetSPNEGOHeader(cl, request, spn)
+		},
+	}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !kerberos
+// +build !kerberos
+
+package proxyutils
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// NewKerberosTransport needs the gokrb5 package, which is only built in with
+// the kerberos build tag
+func NewKerberosTransport(kerberos *KerberosConfig, transport http.RoundTripper) (*NegotiateTransport, error) {
+	return nil, errors.New("Kerberos support is not built in, build with -tags kerberos")
+}
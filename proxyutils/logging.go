@@ -0,0 +1,133 @@
+package proxyutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is what the proxy logs with, *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// LogLevel is the minimum level of the messages that LevelLoggers log
+type LogLevel int
+
+const (
+	LevelTrace LogLevel = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+// Log is what the middlewares and helpers of this package log with, the
+// chain of CreateChainedProxy has its own loggers. The default logs Info and
+// above to the standard logger.
+var Log = NewLevelLoggers(log.Default(), LevelInfo)
+
+// LevelLoggers has a Logger for each level, as CreateChainedProxy takes them
+type LevelLoggers struct {
+	Trace Logger
+	Debug Logger
+	Info  Logger
+	Warn  Logger
+	Error Logger
+}
+
+// NewLevelLoggers returns LevelLoggers that log the messages of level and
+// above to logger, and discard the others
+func NewLevelLoggers(logger Logger, level LogLevel) *LevelLoggers {
+	at := func(l LogLevel) Logger {
+		if l < level {
+			return discardLogger
+		}
+		return logger
+	}
+
+	return &LevelLoggers{
+		Trace: at(LevelTrace),
+		Debug: at(LevelDebug),
+		Info:  at(LevelInfo),
+		Warn:  at(LevelWarn),
+		Error: at(LevelError),
+	}
+}
+
+// DedupLogger collapses identical messages. The first one is logged, the
+// ones that follow it within Window are only counted, and when the window is
+// over "previous message repeated N times: ..." is logged for each of them.
+// A client stuck in a retry loop would otherwise fill the log with the same
+// few lines, so messages are counted even when others come in between.
+type DedupLogger struct {
+	Logger Logger
+	Window time.Duration
+
+	lock sync.Mutex
+	// the messages logged in the current window, in order
+	seen    []string
+	repeats map[string]int
+	timer   *time.Timer
+}
+
+func NewDedupLogger(logger Logger, window time.Duration) *DedupLogger {
+	return &DedupLogger{
+		Logger:  logger,
+		Window:  window,
+		repeats: make(map[string]int),
+	}
+}
+
+func (this *DedupLogger) Printf(format string, v ...interface{}) {
+	this.print(fmt.Sprintf(format, v...))
+}
+
+func (this *DedupLogger) Println(v ...interface{}) {
+	this.print(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (this *DedupLogger) print(message string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.repeats[message]; ok {
+		this.repeats[message]++
+		return
+	}
+
+	this.seen = append(this.seen, message)
+	this.repeats[message] = 0
+	this.Logger.Println(message)
+
+	if this.timer == nil {
+		this.timer = time.AfterFunc(this.Window, this.Flush)
+	}
+}
+
+// Flush ends the current window, logging how often its messages were
+// repeated
+func (this *DedupLogger) Flush() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+
+	for _, message := range this.seen {
+		if n := this.repeats[message]; n != 0 {
+			this.Logger.Printf("previous message repeated %d times: %s", n, message)
+		}
+	}
+
+	this.seen = nil
+	this.repeats = make(map[string]int)
+}
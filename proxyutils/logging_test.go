@@ -0,0 +1,81 @@
+package proxyutils
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewDedupLogger(log.New(buf, "", 0), time.Hour)
+
+	// a client in a retry loop, with the chain's lines in between
+	for i := 0; i < 1000; i++ {
+		logger.Println("EWS Proxy POST /ews/exchange.asmx")
+		logger.Printf("Ews Translator: Request Error: %s", "unexpected EOF")
+	}
+	logger.Println("something else")
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines during the window, got %d:\n%s", lines, buf)
+	}
+
+	logger.Flush()
+	expected := "EWS Proxy POST /ews/exchange.asmx\n" +
+		"Ews Translator: Request Error: unexpected EOF\n" +
+		"something else\n" +
+		"previous message repeated 999 times: EWS Proxy POST /ews/exchange.asmx\n" +
+		"previous message repeated 999 times: Ews Translator: Request Error: unexpected EOF\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf)
+	}
+
+	// a new window logs the message again
+	buf.Reset()
+	logger.Println("something else")
+	logger.Flush()
+	if buf.String() != "something else\n" {
+		t.Errorf("unexpected output after the window:\n%s", buf)
+	}
+}
+
+func TestDedupLoggerWindow(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewDedupLogger(log.New(buf, "", 0), 10*time.Millisecond)
+
+	// the logger writes while it holds its lock
+	output := func() string {
+		logger.lock.Lock()
+		defer logger.lock.Unlock()
+		return buf.String()
+	}
+
+	logger.Println("Network error")
+	logger.Println("Network error")
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(output(), "repeated 1 times") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the repeats were not logged at the end of the window:\n%s", output())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLevelLoggers(t *testing.T) {
+	buf := new(bytes.Buffer)
+	loggers := NewLevelLoggers(log.New(buf, "", 0), LevelWarn)
+
+	loggers.Trace.Println("trace")
+	loggers.Debug.Println("debug")
+	loggers.Info.Println("info")
+	loggers.Warn.Println("warn")
+	loggers.Error.Println("error")
+
+	if buf.String() != "warn\nerror\n" {
+		t.Errorf("unexpected output:\n%s", buf)
+	}
+}
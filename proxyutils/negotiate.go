@@ -0,0 +1,100 @@
+package proxyutils
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KerberosConfig says where the tickets for NewKerberosTransport come from:
+// a keytab for Principal, or an existing credential cache (kinit)
+type KerberosConfig struct {
+	Keytab    string
+	Principal string // user@REALM, the realm defaults to the one in Krb5Conf
+	CCache    string
+
+	// default is /etc/krb5.conf
+	Krb5Conf string
+
+	// service principal of the exchange server, default is HTTP/ and the
+	// host name that requests are sent to
+	SPN string
+}
+
+// NegotiateTransport authenticates requests with SPNEGO (the Negotiate
+// scheme) for servers that require Kerberos on /owa instead of forms based
+// authentication. Every request gets a new token from Authorize. If the
+// server still asks for Negotiate, the request is sent once more with a new
+// token when its body can be sent again.
+type NegotiateTransport struct {
+	Transport http.RoundTripper
+
+	// sets the Authorization header of a request for the given SPN
+	Authorize func(request *http.Request, spn string) error
+
+	SPN string
+}
+
+func (this *NegotiateTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := this.authorized(request, request.Body)
+	if err != nil || !wantsNegotiate(response) || (request.Body != nil && request.GetBody == nil) {
+		return response, err
+	}
+
+	// the token was rejected, the ticket may have expired in between
+	body := request.Body
+	if request.GetBody != nil {
+		if body, err = request.GetBody(); err != nil {
+			return response, nil
+		}
+	}
+
+	response.Body.Close()
+	return this.authorized(request, body)
+}
+
+// sends a copy of the request with a new token
+func (this *NegotiateTransport) authorized(request *http.Request, body io.ReadCloser) (*http.Response, error) {
+	outreq := request.Clone(request.Context())
+	outreq.Body = body
+
+	if err := this.Authorize(outreq, negotiateSpn(this.SPN, request)); err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, errors.Wrap(err, "kerberos")
+	}
+
+	return this.Transport.RoundTrip(outreq)
+}
+
+// returns true if the server rejected the request and offers Negotiate
+func wantsNegotiate(response *http.Response) bool {
+	if response.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	for _, value := range response.Header.Values("WWW-Authenticate") {
+		if strings.EqualFold(strings.SplitN(value, " ", 2)[0], "Negotiate") {
+			return true
+		}
+	}
+	return false
+}
+
+// the SPN for a request, the Host header is the name that the server is
+// known by (see RedirectorMiddleware.HostOverride)
+func negotiateSpn(spn string, request *http.Request) string {
+	if spn != "" {
+		return spn
+	}
+
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	return "HTTP/" + (&url.URL{Host: host}).Hostname()
+}
@@ -0,0 +1,142 @@
+package proxyutils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a server that requires Negotiate and accepts each token once, except for
+// the ones in expired
+type negotiateServer struct {
+	lock    sync.Mutex
+	used    map[string]bool
+	expired map[string]bool
+	events  []string
+}
+
+func (this *negotiateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Negotiate ")
+
+	if token == "" || this.used[token] || this.expired[token] {
+		this.events = append(this.events, "reject "+token)
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	this.used[token] = true
+	this.events = append(this.events, fmt.Sprintf("accept %s %s", token, body))
+
+	// mutual authentication
+	w.Header().Set("WWW-Authenticate", "Negotiate oRQwEqADCgEA")
+	w.Write([]byte("ok"))
+}
+
+func TestNegotiateTransport(t *testing.T) {
+	server := &negotiateServer{used: map[string]bool{}, expired: map[string]bool{"token-2": true}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	var spns []string
+	tokens := 0
+	transport := &NegotiateTransport{
+		Transport: http.DefaultTransport,
+		Authorize: func(request *http.Request, spn string) error {
+			tokens++
+			spns = append(spns, spn)
+			request.Header.Set("Authorization", fmt.Sprintf("Negotiate token-%d", tokens))
+			return nil
+		},
+	}
+
+	send := func(method string, body string, replayable bool) *http.Response {
+		request, _ := http.NewRequest(method, ts.URL+"/owa/", nil)
+		if body != "" {
+			request, _ = http.NewRequest(method, ts.URL+"/owa/", strings.NewReader(body))
+			if !replayable {
+				request.GetBody = nil
+				request.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+			}
+		}
+		request.Host = "mail.example.com"
+
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	// every request has a token up front
+	if response := send("GET", "", true); response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	// a rejected token is replaced, and the body is sent again
+	if response := send("POST", "{}", true); response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	// unless the body can't be sent again
+	server.expired["token-4"] = true
+	if response := send("POST", "{}", false); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the 401, got %d", response.StatusCode)
+	}
+
+	expected := []string{
+		"accept token-1 ",
+		"reject token-2",
+		"accept token-3 {}",
+		"reject token-4",
+	}
+	if strings.Join(server.events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected sequence:\n%s", strings.Join(server.events, "\n"))
+	}
+
+	for _, spn := range spns {
+		if spn != "HTTP/mail.example.com" {
+			t.Errorf("unexpected SPN %s", spn)
+		}
+	}
+}
+
+func TestNegotiateTransportGivesUp(t *testing.T) {
+	server := &negotiateServer{used: map[string]bool{}, expired: map[string]bool{}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// a server that never accepts the token is asked twice, not forever
+	transport := &NegotiateTransport{
+		Transport: http.DefaultTransport,
+		SPN:       "HTTP/exchange.example.com",
+		Authorize: func(request *http.Request, spn string) error {
+			request.Header.Set("Authorization", "Negotiate same")
+			return nil
+		},
+	}
+
+	server.used["same"] = true
+	request, _ := http.NewRequest("GET", ts.URL+"/owa/", nil)
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnauthorized || len(server.events) != 2 {
+		t.Errorf("unexpected result %d %v", response.StatusCode, server.events)
+	}
+
+	if spn := negotiateSpn(transport.SPN, request); spn != "HTTP/exchange.example.com" {
+		t.Errorf("unexpected SPN %s", spn)
+	}
+}
@@ -0,0 +1,76 @@
+package proxyutils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Exchange may be published under a path prefix, such as
+	https://portal.example.com/exchange/owa/. The path of the target URL is
+	that prefix: clients of the proxy use the paths without it, and it is
+	added to the requests sent to the server. Paths that already have it are
+	left alone, because pages from the server link to them.
+*/
+
+// NormalizeTargetUrl checks the URL of an exchange server and gives its
+// path a trailing slash, so that references resolve below it. The OWA or
+// EWS path is removed if it was included.
+func NormalizeTargetUrl(target *url.URL) error {
+	if target.Scheme == "" || target.Host == "" {
+		return errors.Errorf("`%s` is not an absolute URL", target)
+	}
+	if target.RawQuery != "" || target.Fragment != "" {
+		return errors.Errorf("`%s` must not have a query or fragment", target)
+	}
+
+	prefix := strings.TrimSuffix(target.Path, "/")
+	for _, suffix := range []string{"/owa", "/ews/exchange.asmx", "/ews"} {
+		if len(prefix) >= len(suffix) && strings.EqualFold(prefix[len(prefix)-len(suffix):], suffix) {
+			prefix = prefix[:len(prefix)-len(suffix)]
+			break
+		}
+	}
+
+	target.Path = prefix + "/"
+	target.RawPath = ""
+	return nil
+}
+
+// PathPrefix returns the path prefix of a target URL, without the trailing
+// slash, or "" if it has none
+func PathPrefix(target *url.URL) string {
+	return strings.TrimSuffix(target.Path, "/")
+}
+
+func hasPathPrefix(p string, prefix string) bool {
+	return len(p) >= len(prefix) && strings.EqualFold(p[:len(prefix)], prefix) &&
+		(len(p) == len(prefix) || p[len(prefix)] == '/')
+}
+
+// AddPathPrefix returns p with prefix in front of it, unless it already
+// starts with prefix
+func AddPathPrefix(prefix string, p string) string {
+	if prefix == "" || hasPathPrefix(p, prefix) {
+		return p
+	}
+	return prefix + p
+}
+
+// removes the prefix from the path of a header that is a URL
+func stripPathPrefix(header *http.Header, name string, prefix string) {
+	hUrl, _ := url.Parse(header.Get(name))
+	if hUrl == nil || !hasPathPrefix(hUrl.Path, prefix) {
+		return
+	}
+
+	hUrl.Path = hUrl.Path[len(prefix):]
+	if hUrl.Path == "" {
+		hUrl.Path = "/"
+	}
+	hUrl.RawPath = ""
+	header.Set(name, hUrl.String())
+}
@@ -0,0 +1,44 @@
+package proxyutils
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeTargetUrl(t *testing.T) {
+	for value, expected := range map[string]string{
+		"https://mail.example.com":                              "https://mail.example.com/",
+		"https://mail.example.com/owa/":                         "https://mail.example.com/",
+		"https://portal.example.com/exchange":                   "https://portal.example.com/exchange/",
+		"https://portal.example.com/exchange/OWA":               "https://portal.example.com/exchange/",
+		"https://portal.example.com/exchange/EWS/Exchange.asmx": "https://portal.example.com/exchange/",
+	} {
+		u, _ := url.Parse(value)
+		if err := NormalizeTargetUrl(u); err != nil {
+			t.Errorf("%s: %s", value, err)
+		} else if u.String() != expected {
+			t.Errorf("%s: expected %s, got %s", value, expected, u)
+		}
+	}
+
+	for _, value := range []string{"mail.example.com", "/exchange/", "https://mail.example.com/?a=b"} {
+		u, _ := url.Parse(value)
+		if err := NormalizeTargetUrl(u); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+func TestAddPathPrefix(t *testing.T) {
+	for _, test := range [][3]string{
+		{"", "/owa/", "/owa/"},
+		{"/exchange", "/owa/", "/exchange/owa/"},
+		{"/exchange", "/Exchange/owa/", "/Exchange/owa/"},
+		{"/exchange", "/exchange", "/exchange"},
+		{"/exchange", "/exchangeowa/", "/exchange/exchangeowa/"},
+	} {
+		if p := AddPathPrefix(test[0], test[1]); p != test[2] {
+			t.Errorf("%s + %s: expected %s, got %s", test[0], test[1], test[2], p)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 package proxyutils
 
 import (
+	"context"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
+	"sync"
 )
 
+// DefaultClientVisibleCookies are the cookies that the OWA login pages use in
+// the browser (language and theme selection)
+var DefaultClientVisibleCookies = []string{
+	"PBack",
+	"mkt*",
+	"X-OWA-JS-PSD",
+	"AppcacheVer",
+}
+
 // RedirectorMiddleware is a reverse proxy that hides details from both the source client
 // and the target server
 type RedirectorMiddleware struct {
@@ -14,28 +24,63 @@ type RedirectorMiddleware struct {
 	// -> URL is TargetServer
 	Cookies http.CookieJar
 
+	// Cookies with these names are also passed through to the browser, bound
+	// to the proxy host. Names ending in '*' match any cookie with that prefix.
+	ClientVisibleCookies []string
+
 	// If a Location: header is encountered, use this to figure out how to handle it
 	RetargetMap RetargetMap
 
-	// Remote
+	// Remote. If it has a path, it is a prefix for all paths on the server,
+	// see NormalizeTargetUrl
 	TargetServer *url.URL
 
+	// if set, requests go to the current server of the pool instead of
+	// TargetServer, see UseTargetPool
+	Pool *TargetPool
+
+	// if set, the Host header of requests to the target servers, for servers
+	// behind a load balancer that routes on a name while TargetServer is an
+	// address. The TLS ServerName of the transport must be set to match.
+	HostOverride string
+
+	// what the target servers are told about the client, default is
+	// ForwardedOff
+	ForwardedHeaders ForwardedHeaderMode
+
 	// the host:port that the proxy is listening on
 	SourceServer *url.URL
 
-	// Set this to something to override the UserAgent sent to the remote site
+	// Set this to something to override the UserAgent sent to the remote site.
+	// Once requests are served, use SetUserAgent and CurrentUserAgent.
 	UserAgent string
+
+	// If set, the User-Agent of the browser that logs in becomes the
+	// UserAgent when it isn't set. NewRedirectorMiddleware sets it, turn it
+	// off to always send the configured UserAgent (or none).
+	CaptureUserAgent bool
+
+	// if set, learned state (the UserAgent) is persisted here
+	Store *SessionStore
+
+	// if set, the clock of the target server is compared to ours
+	Skew *SkewTracker
+
+	// protects UserAgent, which is captured while requests are served
+	lock sync.Mutex
 }
 
 func NewRedirectorMiddleware(source *url.URL, target *url.URL) *RedirectorMiddleware {
 
-	cookies, _ := cookiejar.New(nil)
+	cookies := NewBoundedCookieJar()
 
 	proxy := &RedirectorMiddleware{
-		Cookies:      cookies,
-		RetargetMap:  make(RetargetMap),
-		SourceServer: source,
-		TargetServer: target,
+		Cookies:              cookies,
+		ClientVisibleCookies: DefaultClientVisibleCookies,
+		RetargetMap:          make(RetargetMap),
+		SourceServer:         source,
+		TargetServer:         target,
+		CaptureUserAgent:     true,
 	}
 
 	// seed the RetargetMap
@@ -43,44 +88,180 @@ func NewRedirectorMiddleware(source *url.URL, target *url.URL) *RedirectorMiddle
 	return proxy
 }
 
+// SetUserAgent sets the UserAgent and persists it if a store is set
+func (this *RedirectorMiddleware) SetUserAgent(userAgent string) {
+	this.lock.Lock()
+	this.UserAgent = userAgent
+	this.lock.Unlock()
+
+	this.changed()
+}
+
+// CurrentUserAgent returns the UserAgent, "" if it isn't set
+func (this *RedirectorMiddleware) CurrentUserAgent() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.UserAgent
+}
+
+// returns the state that a SessionStore persists
+func (this *RedirectorMiddleware) sessionState() sessionState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return sessionState{
+		Version:   sessionStoreVersion,
+		UserAgent: this.UserAgent,
+	}
+}
+
+// UseTargetPool sends requests to the servers in the pool. They must front
+// the same mailboxes, as the cookies are shared; TargetServer should be the
+// first of them.
+func (this *RedirectorMiddleware) UseTargetPool(pool *TargetPool) {
+	this.Pool = pool
+
+	// Location headers from any of them point back to the proxy
+	for _, target := range pool.Targets() {
+		if target.Host != this.TargetServer.Host {
+			this.RetargetMap[target.Host] = this.SourceServer
+		}
+	}
+}
+
+// CurrentTarget returns the server that requests are sent to
+func (this *RedirectorMiddleware) CurrentTarget() *url.URL {
+	if this.Pool != nil {
+		return this.Pool.Current()
+	}
+	return this.TargetServer
+}
+
+func (this *RedirectorMiddleware) changed() {
+	if this.Store != nil {
+		this.Store.Changed()
+	}
+}
+
 // this implements the http.RoundTripper interface, but we break a lot of the
 // rules as we modify the request significantly
-func (this *RedirectorMiddleware) RequestModifier(request *http.Request, ctx ChainContext) error {
+func (this *RedirectorMiddleware) RequestModifier(ctx context.Context, request *http.Request, vals *ChainValues) error {
+
+	target := this.CurrentTarget()
+
+	this.ForwardedHeaders.apply(request)
+
+	// bypassed requests are only retargeted
+	if IsBypassed(vals) {
+		this.retarget(request, target, vals)
+		return nil
+	}
 
 	// mangle the request in various ways
-	request.Header.Del("X-Forwarded-For")
 	request.Header.Del("Upgrade-Insecure-Requests")
 
-	// don't forward any cookies from the client
+	// don't forward any cookies from the client, the cookies of all pool
+	// servers are kept as if they came from TargetServer
 	request.Header.Del("Cookie")
 	for _, cookie := range this.Cookies.Cookies(this.TargetServer) {
 		request.AddCookie(cookie)
 	}
 
 	// Fix various headers that may contain a URL
-	this.RetargetMap.Retarget(&request.Header, "Origin", this.TargetServer)
-	this.RetargetMap.Retarget(&request.Header, "Referer", this.TargetServer)
-	request.Header.Set("Host", this.TargetServer.Host)
-
-	// retarget the request itself
-	ctx["maskcxt_host"] = request.Host
-	request.Host = this.TargetServer.Host
-	request.URL.Host = this.TargetServer.Host
-	request.URL.Scheme = this.TargetServer.Scheme
+	this.RetargetMap.Retarget(&request.Header, "Origin", target)
+	this.RetargetMap.Retarget(&request.Header, "Referer", target)
+	if target != this.TargetServer {
+		this.moveHeader(&request.Header, "Origin", target)
+		this.moveHeader(&request.Header, "Referer", target)
+	}
+	if this.HostOverride != "" {
+		setHeaderHost(&request.Header, "Origin", this.HostOverride)
+		setHeaderHost(&request.Header, "Referer", this.HostOverride)
+	}
+	request.Header.Set("Host", this.requestHost(target))
+
+	this.retarget(request, target, vals)
 	return nil
 }
 
-func (this *RedirectorMiddleware) ResponseModifier(response *http.Response, ctx ChainContext) error {
+// retarget the request itself
+func (this *RedirectorMiddleware) retarget(request *http.Request, target *url.URL, vals *ChainValues) {
+	vals.Set("maskcxt_host", request.Host)
+	vals.Set("maskcxt_prefix", PathPrefix(target))
+	request.Host = this.requestHost(target)
+	request.URL.Host = target.Host
+	request.URL.Scheme = target.Scheme
+	if prefixed := AddPathPrefix(PathPrefix(target), request.URL.Path); prefixed != request.URL.Path {
+		request.URL.Path = prefixed
+		request.URL.RawPath = ""
+	}
+}
+
+// TargetUrl returns the URL on TargetServer for a reference that a client
+// used, with the path prefix of TargetServer
+func (this *RedirectorMiddleware) TargetUrl(ref *url.URL) *url.URL {
+	u := this.TargetServer.ResolveReference(ref)
+	u.Path = AddPathPrefix(PathPrefix(this.TargetServer), u.Path)
+	return u
+}
+
+// the Host header for a request that is sent to target
+func (this *RedirectorMiddleware) requestHost(target *url.URL) string {
+	if this.HostOverride != "" {
+		return this.HostOverride
+	}
+	return target.Host
+}
+
+// changes the host of a header that is a URL
+func setHeaderHost(header *http.Header, name string, host string) {
+	if hUrl, _ := url.Parse(header.Get(name)); hUrl != nil && hUrl.Host != "" {
+		hUrl.Host = host
+		header.Set(name, hUrl.String())
+	}
+}
+
+// RetargetMap maps the proxy to TargetServer, this changes a header that
+// was retargeted there to another server of the pool
+func (this *RedirectorMiddleware) moveHeader(header *http.Header, name string, target *url.URL) {
+	if hUrl, _ := url.Parse(header.Get(name)); hUrl != nil && hUrl.Host == this.TargetServer.Host {
+		hUrl.Scheme = target.Scheme
+		hUrl.Host = target.Host
+		header.Set(name, hUrl.String())
+	}
+}
+
+func (this *RedirectorMiddleware) ResponseModifier(ctx context.Context, response *http.Response, vals *ChainValues) error {
+	if this.Skew != nil {
+		this.Skew.Update(response.Header)
+	}
+
 	// If there's a location header, redirect back to this server, not to the target
 	this.RetargetMap.Retarget(&response.Header, "Location", this.SourceServer)
+	if prefix, _ := vals.Get("maskcxt_prefix").(string); prefix != "" {
+		stripPathPrefix(&response.Header, "Location", prefix)
+	}
 
-	// steal all the cookies, don't expose them to the client
-	if cookies := response.Cookies(); cookies != nil {
+	// steal all the cookies, don't expose them to the client (unless the
+	// request is bypassed, then the client keeps its own session)
+	if cookies := response.Cookies(); cookies != nil && !IsBypassed(vals) {
+		if this.HostOverride != "" || (response.Request != nil && response.Request.URL.Host != this.TargetServer.Host) {
+			// the jar would reject a domain that doesn't match TargetServer
+			for _, cookie := range cookies {
+				cookie.Domain = ""
+			}
+		}
 		this.Cookies.SetCookies(this.TargetServer, cookies)
 		response.Header.Del("Set-Cookie")
+
+		for _, cookie := range cookies {
+			if matchCookieName(this.ClientVisibleCookies, cookie.Name) {
+				visible := *cookie
+				visible.Domain = ""
+				response.Header.Add("Set-Cookie", visible.String())
+			}
+		}
 	}
 
-	// restore the Host header
-	response.Header.Set("Host", ctx["maskcxt_host"].(string))
 	return nil
 }
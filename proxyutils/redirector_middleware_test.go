@@ -0,0 +1,108 @@
+package proxyutils
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestClientVisibleCookies(t *testing.T) {
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse("https://mail.example.com")
+
+	redirector := NewRedirectorMiddleware(source, target)
+
+	transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		response := CreateNewResponse(request, "")
+		response.Header.Add("Set-Cookie", "PBack=0; Domain=mail.example.com; Path=/")
+		response.Header.Add("Set-Cookie", "mkt=de-DE; Domain=.example.com; Path=/owa")
+		response.Header.Add("Set-Cookie", "cadata=secret; Path=/; Secure; HttpOnly")
+		return response, nil
+	})
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, transport, redirector)
+
+	request, _ := http.NewRequest("GET", "http://localhost:60001/owa/languageselection.aspx", nil)
+	response, err := chain.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visible := make(map[string]*http.Cookie)
+	for _, cookie := range response.Cookies() {
+		visible[cookie.Name] = cookie
+	}
+
+	if len(visible) != 2 || visible["PBack"] == nil || visible["mkt"] == nil {
+		t.Fatalf("unexpected cookies passed through: %v", response.Header["Set-Cookie"])
+	}
+
+	if visible["PBack"].Domain != "" || visible["mkt"].Domain != "" {
+		t.Errorf("Domain was not removed: %v", response.Header["Set-Cookie"])
+	}
+
+	if visible["mkt"].Path != "/owa" {
+		t.Errorf("Path was changed: %v", response.Header["Set-Cookie"])
+	}
+
+	// all of them are still stored
+	stored := make(map[string]bool)
+	u, _ := url.Parse("https://mail.example.com/owa/")
+	for _, cookie := range redirector.Cookies.Cookies(u) {
+		stored[cookie.Name] = true
+	}
+
+	if !stored["PBack"] || !stored["mkt"] || !stored["cadata"] {
+		t.Errorf("cookies missing from the jar: %v", stored)
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	var host, serverName, cookie string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, serverName = r.Host, r.TLS.ServerName
+		if c, err := r.Cookie("session"); err == nil {
+			cookie = c.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Domain: "example.com", Path: "/"})
+	}))
+	defer server.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	target, _ := url.Parse(server.URL)
+
+	redirector := NewRedirectorMiddleware(source, target)
+	redirector.HostOverride = "example.com"
+
+	// the certificate of the test server is for example.com, so it is
+	// verified against the name instead of the address
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ServerName = "example.com"
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, transport, redirector)
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+		request.Header.Set("Origin", "http://localhost:60001")
+
+		response, err := chain.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	if host != "example.com" || serverName != "example.com" {
+		t.Errorf("expected Host and SNI example.com, got %q and %q", host, serverName)
+	}
+
+	// the cookie for the name is kept for the address
+	if cookie != "abc" {
+		t.Errorf("the session cookie was not sent back, got %q", cookie)
+	}
+}
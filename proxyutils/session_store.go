@@ -0,0 +1,129 @@
+package proxyutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bump this whenever the format of sessionState changes in an incompatible way
+const sessionStoreVersion = 1
+
+// the on-disk representation of the learned redirector state
+type sessionState struct {
+	Version   int
+	UserAgent string `json:",omitempty"`
+}
+
+// SessionStore persists state that the RedirectorMiddleware learns at runtime
+// (the captured UserAgent) so that a restarted proxy behaves the same way
+// without the user opening the browser again. The RetargetMap only has the
+// entries of the configuration, so it isn't stored; the RetargetMap of
+// stores written by older versions is ignored.
+type SessionStore struct {
+	// file that the state is stored in
+	Path string
+
+	// writes are debounced: at most one write occurs per WriteDelay
+	WriteDelay time.Duration
+
+	lock  sync.Mutex
+	timer *time.Timer
+	r     *RedirectorMiddleware
+}
+
+func NewSessionStore(path string) *SessionStore {
+	return &SessionStore{
+		Path:       path,
+		WriteDelay: 5 * time.Second,
+	}
+}
+
+// Load restores any previously saved state into the redirector, and attaches
+// the store to the redirector so that future changes are persisted. This
+// should be called before the first request is served. A missing file is not
+// an error.
+func (this *SessionStore) Load(redirector *RedirectorMiddleware) error {
+	this.lock.Lock()
+	this.r = redirector
+	this.lock.Unlock()
+
+	redirector.Store = this
+
+	data, err := ioutil.ReadFile(this.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "reading session store %s", this.Path)
+	}
+
+	var state sessionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return errors.Wrapf(err, "parsing session store %s", this.Path)
+	}
+
+	if state.Version > sessionStoreVersion {
+		return errors.Errorf("session store %s has unsupported version %d", this.Path, state.Version)
+	}
+
+	// a captured UserAgent doesn't replace a configured one
+	if state.UserAgent != "" && redirector.CaptureUserAgent && redirector.UserAgent == "" {
+		redirector.UserAgent = state.UserAgent
+	}
+
+	return nil
+}
+
+// Changed schedules a write of the redirector state
+func (this *SessionStore) Changed() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// a write is already pending, it will pick up this change too
+	if this.timer != nil {
+		return
+	}
+
+	this.timer = time.AfterFunc(this.WriteDelay, func() {
+		if err := this.Flush(); err != nil {
+			Log.Error.Printf("Error saving session: %s", err)
+		}
+	})
+}
+
+// Flush writes the redirector state to disk immediately
+func (this *SessionStore) Flush() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+
+	if this.r == nil {
+		return nil
+	}
+
+	// the redirector's state is read under its lock, requests may be
+	// changing it while this runs on the timer
+	state := this.r.sessionState()
+
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial store
+	tmpPath := this.Path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrapf(err, "writing session store %s", tmpPath)
+	}
+
+	return os.Rename(tmpPath, this.Path)
+}
@@ -0,0 +1,141 @@
+package proxyutils
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ews-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session.json")
+	source := mustParse(t, "http://localhost:60001")
+	target := mustParse(t, "https://mail.example.com")
+
+	// learn some state and persist it
+	r1 := NewRedirectorMiddleware(source, target)
+	store1 := NewSessionStore(path)
+	if err = store1.Load(r1); err != nil {
+		t.Fatal(err)
+	}
+
+	r1.SetUserAgent("Mozilla/5.0 Test")
+
+	if err = store1.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new redirector should pick it up
+	r2 := NewRedirectorMiddleware(source, target)
+	store2 := NewSessionStore(path)
+	if err = store2.Load(r2); err != nil {
+		t.Fatal(err)
+	}
+
+	if r2.UserAgent != "Mozilla/5.0 Test" {
+		t.Errorf("UserAgent not restored: %q", r2.UserAgent)
+	}
+
+	// a configured UserAgent isn't replaced
+	r3 := NewRedirectorMiddleware(source, target)
+	r3.UserAgent = "Fixed"
+	if err = NewSessionStore(path).Load(r3); err != nil || r3.UserAgent != "Fixed" {
+		t.Errorf("the configured UserAgent was replaced: %q (%v)", r3.UserAgent, err)
+	}
+
+}
+
+func TestSessionStoreIgnoresRetargetMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ews-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// written by an older version
+	path := filepath.Join(dir, "session.json")
+	data := `{"Version": 1, "UserAgent": "agent", "RetargetMap": {"localhost:60001": "https://sso.example.com"}}`
+	if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRedirectorMiddleware(mustParse(t, "http://localhost:60001"), mustParse(t, "https://mail.example.com"))
+	if err = NewSessionStore(path).Load(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.UserAgent != "agent" {
+		t.Errorf("UserAgent not restored: %q", r.UserAgent)
+	}
+	if u := r.RetargetMap["localhost:60001"]; u.Host != "mail.example.com" {
+		t.Errorf("the stored mapping replaced the seed: %s", u)
+	}
+	if _, ok := r.RetargetMap["sso.example.com"]; ok || len(r.RetargetMap) != 2 {
+		t.Errorf("stored mappings were restored: %v", r.RetargetMap)
+	}
+}
+
+func TestSessionStoreDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ews-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session.json")
+	r := NewRedirectorMiddleware(mustParse(t, "http://localhost:60001"), mustParse(t, "https://mail.example.com"))
+
+	store := NewSessionStore(path)
+	store.WriteDelay = 50 * time.Millisecond
+	if err = store.Load(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		r.SetUserAgent("agent")
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("store was written before the write delay expired")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("store was not written after the write delay: %s", err)
+	}
+}
+
+func TestSessionStoreVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ews-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session.json")
+	if err = ioutil.WriteFile(path, []byte(`{"Version": 1000}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRedirectorMiddleware(mustParse(t, "http://localhost:60001"), mustParse(t, "https://mail.example.com"))
+	if err = NewSessionStore(path).Load(r); err == nil {
+		t.Error("expected an error loading a newer store version")
+	}
+}
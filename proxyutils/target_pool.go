@@ -0,0 +1,229 @@
+package proxyutils
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultRetestInterval   = 30 * time.Second
+)
+
+type poolTarget struct {
+	url      *url.URL
+	failures int       // consecutive connect failures
+	healthy  bool      // false once failures reaches the threshold
+	retestAt time.Time // when an unhealthy target is tried again
+	testing  bool      // an unhealthy target was given to a request to test it
+}
+
+// TargetPool is a list of servers that front the same mailboxes (such as
+// multiple CAS addresses). Requests go to the first healthy one, a server is
+// marked unhealthy after FailureThreshold consecutive connect failures and
+// is tried again after RetestInterval.
+type TargetPool struct {
+	FailureThreshold int
+	RetestInterval   time.Duration
+
+	lock    sync.Mutex
+	targets []*poolTarget
+	now     func() time.Time
+}
+
+// NewTargetPool creates a pool, targets are preferred in the order given
+func NewTargetPool(targets []*url.URL) *TargetPool {
+	pool := &TargetPool{
+		FailureThreshold: DefaultFailureThreshold,
+		RetestInterval:   DefaultRetestInterval,
+		now:              time.Now,
+	}
+
+	for _, target := range targets {
+		pool.targets = append(pool.targets, &poolTarget{url: target, healthy: true})
+	}
+	return pool
+}
+
+// Targets returns all of the servers in the pool
+func (this *TargetPool) Targets() []*url.URL {
+	targets := make([]*url.URL, len(this.targets))
+	for i, target := range this.targets {
+		targets[i] = target.url
+	}
+	return targets
+}
+
+// Current returns the server that the next request should go to. An
+// unhealthy server that is due to be tested again is returned to a single
+// request, if that succeeds the server is healthy again.
+func (this *TargetPool) Current() *url.URL {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.now()
+	for _, target := range this.targets {
+		if target.healthy {
+			return target.url
+		}
+
+		if !now.Before(target.retestAt) {
+			target.retestAt = now.Add(this.RetestInterval)
+			target.testing = true
+			return target.url
+		}
+	}
+
+	// nothing is healthy, keep trying the preferred one
+	return this.targets[0].url
+}
+
+func (this *TargetPool) find(host string) *poolTarget {
+	for _, target := range this.targets {
+		if target.url.Host == host {
+			return target
+		}
+	}
+	return nil
+}
+
+// Contains returns true if a server in the pool has this host:port
+func (this *TargetPool) Contains(host string) bool {
+	return this.find(host) != nil
+}
+
+// Healthy returns false if the server with this host:port has been marked
+// unhealthy
+func (this *TargetPool) Healthy(host string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	target := this.find(host)
+	return target == nil || target.healthy
+}
+
+// returns the healthy server that a request for host should go to instead,
+// or nil if it should go to host
+func (this *TargetPool) redirect(host string) *url.URL {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	target := this.find(host)
+	if target == nil || target.healthy || target.testing {
+		return nil
+	}
+
+	for _, other := range this.targets {
+		if other.healthy {
+			return other.url
+		}
+	}
+	return nil
+}
+
+// Failed records a connect failure for the server with this host:port
+func (this *TargetPool) Failed(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	target := this.find(host)
+	if target == nil {
+		return
+	}
+
+	target.testing = false
+	target.failures++
+	if target.healthy && target.failures >= this.FailureThreshold {
+		Log.Warn.Printf("Exchange server %s is not reachable, failing over", host)
+		target.healthy = false
+	}
+	if !target.healthy {
+		target.retestAt = this.now().Add(this.RetestInterval)
+	}
+}
+
+// Succeeded records that the server with this host:port responded
+func (this *TargetPool) Succeeded(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	target := this.find(host)
+	if target == nil {
+		return
+	}
+
+	if !target.healthy {
+		Log.Info.Printf("Exchange server %s is reachable again", host)
+	}
+	target.failures = 0
+	target.healthy = true
+	target.testing = false
+}
+
+// Transport wraps a http.RoundTripper so that connect failures and
+// responses are recorded. A request to a server that has been marked
+// unhealthy (such as a retry, or a request from a http.Client that uses
+// TargetServer) is sent to the current server instead.
+func (this *TargetPool) Transport(transport http.RoundTripper) http.RoundTripper {
+	return &poolTransport{pool: this, transport: transport}
+}
+
+type poolTransport struct {
+	pool      *TargetPool
+	transport http.RoundTripper
+}
+
+func (this *poolTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	host := request.URL.Host
+	if !this.pool.Contains(host) {
+		return this.transport.RoundTrip(request)
+	}
+
+	if current := this.pool.redirect(host); current != nil {
+		request = retargetRequest(request, current)
+		host = current.Host
+	}
+
+	response, err := this.transport.RoundTrip(request)
+	if err != nil {
+		if isConnectError(err) {
+			this.pool.Failed(host)
+		}
+	} else {
+		this.pool.Succeeded(host)
+	}
+	return response, err
+}
+
+// returns a copy of the request for another server, the body is replaced if
+// possible as the transport closes it when a request fails
+func retargetRequest(original *http.Request, target *url.URL) *http.Request {
+	request := original.Clone(original.Context())
+	if request.Host == request.URL.Host {
+		request.Host = target.Host
+	}
+	if request.Header.Get("Host") != "" {
+		request.Header.Set("Host", target.Host)
+	}
+	request.URL.Host = target.Host
+	request.URL.Scheme = target.Scheme
+
+	if request.Body != nil && request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			request.Body = body
+		}
+	}
+	return request
+}
+
+// true if the server could not be reached at all
+func isConnectError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
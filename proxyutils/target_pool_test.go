@@ -0,0 +1,146 @@
+package proxyutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// starts a server that responds with its name, on addr if it isn't empty
+func startNamedServer(t *testing.T, name string, addr string) *httptest.Server {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "from", Value: name, Domain: "127.0.0.1"})
+			w.Header().Set("Location", fmt.Sprintf("http://%s/owa/", r.Host))
+			fmt.Fprint(w, name)
+		})},
+	}
+	server.Start()
+	return server
+}
+
+func TestTargetPoolFailover(t *testing.T) {
+	primary := startNamedServer(t, "primary", "")
+	secondary := startNamedServer(t, "secondary", "")
+	defer secondary.Close()
+
+	source, _ := url.Parse("http://localhost:60001")
+	primaryUrl, _ := url.Parse(primary.URL)
+	secondaryUrl, _ := url.Parse(secondary.URL)
+
+	now := time.Now()
+	pool := NewTargetPool([]*url.URL{primaryUrl, secondaryUrl})
+	pool.FailureThreshold = 1
+	pool.now = func() time.Time { return now }
+
+	redirector := NewRedirectorMiddleware(source, primaryUrl)
+	redirector.UseTargetPool(pool)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	transport := pool.Transport(&http.Transport{DisableKeepAlives: true})
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, discard, nil, transport, redirector)
+
+	get := func() (string, *http.Response) {
+		request, _ := http.NewRequest("GET", "http://localhost:60001/owa/", nil)
+		response, err := chain.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body), response
+	}
+
+	if body, _ := get(); body != "primary" {
+		t.Fatalf("expected the primary server, got %q", body)
+	}
+
+	// the primary goes down, the retry is sent to the secondary
+	primaryAddr := primary.Listener.Addr().String()
+	primary.Close()
+
+	body, response := get()
+	if body != "secondary" {
+		t.Fatalf("expected the secondary server after the primary failed, got %d %q", response.StatusCode, body)
+	}
+
+	if location := response.Header.Get("Location"); location != "http://localhost:60001/owa/" {
+		t.Errorf("Location of the secondary server was not retargeted: %s", location)
+	}
+
+	// the cookie from the secondary is shared with the primary
+	found := false
+	for _, cookie := range redirector.Cookies.Cookies(primaryUrl) {
+		found = found || (cookie.Name == "from" && cookie.Value == "secondary")
+	}
+	if !found {
+		t.Error("cookie from the secondary server was not stored")
+	}
+
+	if body, _ = get(); body != "secondary" || pool.Healthy(primaryUrl.Host) {
+		t.Fatalf("expected the secondary server while the primary is unhealthy, got %q", body)
+	}
+
+	// the primary comes back, it is used again once it has been tested
+	primary = startNamedServer(t, "primary", primaryAddr)
+	defer primary.Close()
+
+	if body, _ = get(); body != "secondary" {
+		t.Errorf("the primary server was tested too early, got %q", body)
+	}
+
+	now = now.Add(pool.RetestInterval)
+
+	if body, _ = get(); body != "primary" {
+		t.Fatalf("expected the primary server after it recovered, got %q", body)
+	}
+
+	if !pool.Healthy(primaryUrl.Host) {
+		t.Error("the primary server is still unhealthy")
+	}
+}
+
+func TestTargetPoolAllDown(t *testing.T) {
+	first, _ := url.Parse("https://cas1.example.com")
+	second, _ := url.Parse("https://cas2.example.com")
+
+	now := time.Now()
+	pool := NewTargetPool([]*url.URL{first, second})
+	pool.now = func() time.Time { return now }
+
+	for i := 0; i < pool.FailureThreshold; i++ {
+		if current := pool.Current(); current != first {
+			t.Fatalf("failed over before the threshold, got %s", current)
+		}
+		pool.Failed(first.Host)
+	}
+
+	if current := pool.Current(); current != second {
+		t.Fatalf("expected the second server, got %s", current)
+	}
+
+	for i := 0; i < pool.FailureThreshold; i++ {
+		pool.Failed(second.Host)
+	}
+
+	// when nothing is healthy, the first one is still tried
+	if current := pool.Current(); current != first {
+		t.Errorf("expected the first server when all are down, got %s", current)
+	}
+}
@@ -0,0 +1,129 @@
+package proxyutils
+
+/*
+	Middlewares can change how the chained proxy sends a request to the
+	server. SetUpstreamTimeout limits how long each attempt may take, and
+	SetNoRetry sends the request only once, for requests that must not be
+	done twice by the server. When the upstream timeout passes, the response
+	modifiers get a 504 response (unlike for other network errors) and
+	UpstreamTimedOut returns true, so that the middleware that set it can
+	tell the client what happened.
+
+	The server's WriteTimeout covers the time spent waiting for the server,
+	so a middleware that gives a request a longer upstream timeout should
+	also call ExtendWriteDeadline. That only works for handlers wrapped with
+	AllowLongerWrites.
+*/
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+const upstreamTimeoutName = "upstream_timeout"
+const noRetryName = "upstream_no_retry"
+const upstreamTimedOutName = "upstream_timed_out"
+
+// SetUpstreamTimeout limits each attempt to send the request to timeout
+func SetUpstreamTimeout(vals *ChainValues, timeout time.Duration) {
+	vals.Set(upstreamTimeoutName, timeout)
+}
+
+// SetNoRetry sends the request only once, even after a network error
+func SetNoRetry(vals *ChainValues) {
+	vals.Set(noRetryName, true)
+}
+
+// UpstreamTimedOut returns true if the 504 response is because the timeout
+// of SetUpstreamTimeout passed
+func UpstreamTimedOut(vals *ChainValues) bool {
+	_, ok := vals.Lookup(upstreamTimedOutName)
+	return ok
+}
+
+func upstreamTimeout(vals *ChainValues) time.Duration {
+	timeout, _ := vals.Get(upstreamTimeoutName).(time.Duration)
+	return timeout
+}
+
+func noRetry(vals *ChainValues) bool {
+	_, ok := vals.Lookup(noRetryName)
+	return ok
+}
+
+// cancels the context of the attempt once the body has been read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *cancelBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.cancel()
+	return err
+}
+
+// sends the request with the upstream timeout, if there is one. The
+// returned error is context.DeadlineExceeded if the timeout passed.
+func (this *chainedProxy) sendWithTimeout(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return this.Transport.RoundTrip(request)
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	response, err := this.Transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded && request.Context().Err() == nil {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	// the body is read after RoundTrip returns
+	response.Body = &cancelBody{response.Body, cancel}
+	return response, nil
+}
+
+type writeDeadline struct {
+	controller   *http.ResponseController
+	writeTimeout time.Duration
+	start        time.Time
+}
+
+type writeDeadlineKey struct{}
+
+// AllowLongerWrites lets middlewares give a request more time than
+// writeTimeout, the WriteTimeout of the server (0 if it has none), see
+// ExtendWriteDeadline
+func AllowLongerWrites(handler http.Handler, writeTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline := &writeDeadline{
+			controller:   http.NewResponseController(w),
+			writeTimeout: writeTimeout,
+			start:        time.Now(),
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), writeDeadlineKey{}, deadline)))
+	})
+}
+
+// ExtendWriteDeadline makes sure that the response to the request of ctx
+// can be sent for at least d from now. It returns false if that isn't
+// possible, because the handler isn't wrapped with AllowLongerWrites or
+// the connection doesn't support it.
+func ExtendWriteDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Value(writeDeadlineKey{}).(*writeDeadline)
+	if !ok {
+		return false
+	} else if deadline.writeTimeout <= 0 {
+		return true
+	}
+
+	extended := time.Now().Add(d)
+	if !extended.After(deadline.start.Add(deadline.writeTimeout)) {
+		return true
+	}
+	return deadline.controller.SetWriteDeadline(extended) == nil
+}
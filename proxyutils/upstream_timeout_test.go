@@ -0,0 +1,112 @@
+package proxyutils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		// the body comes later than the header
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("upstream"))
+	}))
+	defer server.Close()
+
+	var timedOut bool
+	middleware := &funcMiddleware{
+		request: func(ctx context.Context, request *http.Request, vals *ChainValues) error {
+			SetUpstreamTimeout(vals, 200*time.Millisecond)
+			SetNoRetry(vals)
+			return nil
+		},
+		response: func(ctx context.Context, response *http.Response, vals *ChainValues) error {
+			timedOut = UpstreamTimedOut(vals)
+			return nil
+		},
+	}
+
+	discard := log.New(ioutil.Discard, "", 0)
+	chain := CreateChainedProxy("test", discard, discard, discard, discard, log.New(new(bytes.Buffer), "", 0), nil, nil, middleware)
+
+	// the timeout doesn't cut off the body
+	request, _ := http.NewRequest("GET", server.URL+"/fast", nil)
+	response, err := chain.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(data) != "upstream" || timedOut {
+		t.Errorf("expected the upstream body, got %q (timed out: %v)", data, timedOut)
+	}
+
+	// the response modifiers get a 504, and it isn't retried
+	atomic.StoreInt32(&attempts, 0)
+	request, _ = http.NewRequest("GET", server.URL+"/slow", nil)
+	if response, err = chain.RoundTrip(request); err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusGatewayTimeout || !timedOut {
+		t.Errorf("expected a 504 that the middleware knows about, got %d (timed out: %v)", response.StatusCode, timedOut)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestExtendWriteDeadline(t *testing.T) {
+	writeTimeout := 100 * time.Millisecond
+
+	for _, extend := range []bool{false, true} {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if extend && !ExtendWriteDeadline(r.Context(), time.Second) {
+				t.Error("the write deadline was not extended")
+			}
+			time.Sleep(3 * writeTimeout)
+			w.Write([]byte("done"))
+		})
+
+		server := httptest.NewUnstartedServer(AllowLongerWrites(handler, writeTimeout))
+		server.Config.WriteTimeout = writeTimeout
+		server.Start()
+
+		response, err := http.Get(server.URL)
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+		server.Close()
+
+		if extend && string(data) != "done" {
+			t.Errorf("the response was not sent: %q (%v)", data, err)
+		} else if !extend && err == nil {
+			t.Errorf("expected the write timeout to cut off the response, got %q", data)
+		}
+	}
+
+	// not wrapped with AllowLongerWrites
+	if ExtendWriteDeadline(context.Background(), time.Second) {
+		t.Error("expected ExtendWriteDeadline to fail without AllowLongerWrites")
+	}
+}
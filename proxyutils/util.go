@@ -1,6 +1,7 @@
 package proxyutils
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"io/ioutil"
@@ -25,26 +26,51 @@ func CreateNewResponse(request *http.Request, content string) *http.Response {
 	return response
 }
 
-// utility function that reads the bytes from either a request or a response
-// and returns them. Handles gzip compression if present
-func ReadGzipBody(header *http.Header, body io.ReadCloser) ([]byte, error) {
+// OpenGzipBody returns a reader for the body that decompresses it if needed.
+// Closing the returned reader closes the body. The Content-Encoding and
+// Content-Length of a compressed body are removed from header, as they
+// describe the compressed bytes.
+func OpenGzipBody(header *http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+	// ReverseProxy removes the body of a request that has no Content-Length
+	// and no Transfer-Encoding
+	if body == nil {
+		body = http.NoBody
+	}
+
+	if header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+
+	// we never gzip anything, and the length is the compressed size (behind
+	// some gateways it isn't the length of anything)
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
 
-	var theReader io.ReadCloser
-	var err error
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open gzip reader")
+	}
+
+	return &gzipBody{reader, body}, nil
+}
 
-	if header.Get("Content-Encoding") == "gzip" {
-		// we never gzip anything
-		header.Del("Content-Encoding")
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
 
-		theReader, err = gzip.NewReader(body)
-		if err != nil {
-			return nil, errors.Wrapf(err, "open gzip reader")
-		}
+func (this *gzipBody) Close() error {
+	this.Reader.Close()
+	return this.body.Close()
+}
 
-		defer theReader.Close()
+// ReadGzipBody reads the bytes from either a request or a response and
+// returns them, see OpenGzipBody
+func ReadGzipBody(header *http.Header, body io.ReadCloser) ([]byte, error) {
 
-	} else {
-		theReader = body
+	theReader, err := OpenGzipBody(header, body)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the data (through the set reader)
@@ -54,10 +80,26 @@ func ReadGzipBody(header *http.Header, body io.ReadCloser) ([]byte, error) {
 	}
 
 	// Close the reader
-	err = body.Close()
+	err = theReader.Close()
 	if err != nil {
 		return nil, errors.Wrapf(err, "closing response reader")
 	}
 
 	return b, nil
 }
+
+// ReadResponseBody reads the body of the response like ReadGzipBody, and
+// makes the bytes that were read its body. The response is left with no
+// Content-Length header and a ContentLength that matches the body, so that
+// it can still be sent to the client (or be replaced) whatever happens next.
+func ReadResponseBody(response *http.Response) ([]byte, error) {
+	data, err := ReadGzipBody(&response.Header, response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Header.Del("Content-Length")
+	response.Body = ioutil.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	return data, nil
+}
@@ -0,0 +1,51 @@
+package proxyutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestReadResponseBody(t *testing.T) {
+	content := bytes.Repeat([]byte("<t:Folder/>"), 100)
+
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write(content)
+	writer.Close()
+
+	for _, gzipped := range []bool{true, false} {
+		body := content
+		header := http.Header{"Content-Length": {strconv.Itoa(compressed.Len())}}
+		if gzipped {
+			body = compressed.Bytes()
+			header.Set("Content-Encoding", "gzip")
+		}
+
+		response := &http.Response{
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(compressed.Len()),
+		}
+
+		data, err := ReadResponseBody(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("gzipped %v: expected the content, got %q", gzipped, data)
+		}
+
+		// the stale length is gone, and the body can be read again
+		if _, ok := response.Header["Content-Length"]; ok || response.Header.Get("Content-Encoding") != "" {
+			t.Errorf("gzipped %v: unexpected header %s", gzipped, response.Header)
+		}
+		data, _ = ioutil.ReadAll(response.Body)
+		if !bytes.Equal(data, content) || response.ContentLength != int64(len(content)) {
+			t.Errorf("gzipped %v: the body is %d bytes, ContentLength %d", gzipped, len(data), response.ContentLength)
+		}
+	}
+}
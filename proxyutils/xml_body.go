@@ -0,0 +1,64 @@
+package proxyutils
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/encoding"
+	textunicode "golang.org/x/text/encoding/unicode"
+)
+
+// the UTF-16 charsets that clients are known to send. Windows tools mean
+// little endian when they say utf-16, a BOM in the body takes precedence.
+var utf16Charsets = map[string]encoding.Encoding{
+	"utf-16":   textunicode.UTF16(textunicode.LittleEndian, textunicode.UseBOM),
+	"utf-16le": textunicode.UTF16(textunicode.LittleEndian, textunicode.IgnoreBOM),
+	"utf-16be": textunicode.UTF16(textunicode.BigEndian, textunicode.IgnoreBOM),
+	"unicode":  textunicode.UTF16(textunicode.LittleEndian, textunicode.UseBOM),
+}
+
+// IsUTF16Charset returns true if the charset is one that NewXmlBodyReader
+// transcodes
+func IsUTF16Charset(charset string) bool {
+	_, ok := utf16Charsets[strings.ToLower(charset)]
+	return ok
+}
+
+// NewXmlBodyReader returns a reader for an XML body that is UTF-8 and starts
+// at the first '<'. UTF-16 bodies are transcoded when the charset of the
+// contentType says that they are, and a BOM and whitespace in front of the
+// XML declaration are dropped.
+func NewXmlBodyReader(body io.Reader, contentType string) io.Reader {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, ok := utf16Charsets[strings.ToLower(params["charset"])]; ok {
+			body = enc.NewDecoder().Reader(body)
+		}
+	}
+
+	return &trimLeadingReader{reader: bufio.NewReader(body)}
+}
+
+// trimLeadingReader drops a BOM and whitespace at the start of the data
+type trimLeadingReader struct {
+	reader  *bufio.Reader
+	trimmed bool
+}
+
+func (this *trimLeadingReader) Read(p []byte) (int, error) {
+	for !this.trimmed {
+		c, _, err := this.reader.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+
+		if c != '\ufeff' && !unicode.IsSpace(c) {
+			this.reader.UnreadRune()
+			this.trimmed = true
+		}
+	}
+
+	return this.reader.Read(p)
+}
@@ -0,0 +1,27 @@
+package proxyutils
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestXmlBodyReader(t *testing.T) {
+	for _, test := range []struct {
+		body        string
+		contentType string
+	}{
+		{`<?xml version="1.0"?><a/>`, "text/xml"},
+		{"\ufeff<?xml version=\"1.0\"?><a/>", "text/xml; charset=utf-8"},
+		{"\r\n \t<?xml version=\"1.0\"?><a/>", ""},
+		{"\xff\xfe<\x00?\x00x\x00m\x00l\x00 \x00v\x00e\x00r\x00s\x00i\x00o\x00n\x00=\x00\"\x001\x00.\x000\x00\"\x00?\x00>\x00<\x00a\x00/\x00>\x00", "text/xml; charset=UTF-16"},
+		{"<\x00?\x00x\x00m\x00l\x00 \x00v\x00e\x00r\x00s\x00i\x00o\x00n\x00=\x00\"\x001\x00.\x000\x00\"\x00?\x00>\x00<\x00a\x00/\x00>\x00", "text/xml; charset=utf-16le"},
+	} {
+		data, err := ioutil.ReadAll(NewXmlBodyReader(strings.NewReader(test.body), test.contentType))
+		if err != nil {
+			t.Errorf("%q: %s", test.body, err)
+		} else if string(data) != `<?xml version="1.0"?><a/>` {
+			t.Errorf("%q: got %q", test.body, data)
+		}
+	}
+}
@@ -3,10 +3,11 @@ package ews
 import (
 	"encoding/xml"
 	"io"
-	//"log"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/virtuald/ews-proxy/proxyutils"
 	"github.com/virtuald/go-ordered-json"
 )
 
@@ -26,6 +27,15 @@ import (
 	an object. Very annoying.
 */
 
+// read-only properties of items and folders that OWA adds to its responses.
+// Clients that echo them back in a request would have it rejected, so they
+// are left out.
+var readOnlyRequestElements = map[string]bool{
+	"DisplayTo":       true,
+	"DisplayCc":       true,
+	"EffectiveRights": true,
+}
+
 // OrderedObject is only used for adding items, because json.OrderedObject is
 // actually a slice
 type OrderedObject struct {
@@ -60,11 +70,45 @@ func (obj *OrderedObject) Set(key string, value interface{}) (exists bool) {
 	}
 }
 
+// Append adds value to the list stored at key, creating the list if needed.
+// Repeated elements always end up in the same list, even if other elements
+// were added in between them
+func (obj *OrderedObject) Append(key string, value interface{}) error {
+	if idx, ok := obj.keys[key]; ok {
+		elist, ok := obj.Object[idx].Value.([]interface{})
+		if !ok {
+			return errors.Errorf("Internal error: inconsistent list type for key %s", key)
+		}
+		obj.Object[idx].Value = append(elist, value)
+	} else {
+		obj.keys[key] = len(obj.Object)
+		obj.Object = append(obj.Object, json.Member{Key: key, Value: []interface{}{value}})
+	}
+	return nil
+}
+
 //
 // XML -> JSON
 //
 
-func convertSimpleToJson(typ *EwsType, chardata string) (converted interface{}) {
+// soapDecoder is the state of a translation from SOAP to JSON
+type soapDecoder struct {
+	*xml.Decoder
+
+	// what the translation changed, may be nil
+	notes *FidelityNotes
+
+	// format of T_DATETIME values
+	dateTimes DateTimeFormat
+
+	// see soap2json_limits.go
+	depth     int
+	tokens    int
+	maxDepth  int // 0 is DefaultMaxRequestDepth
+	maxTokens int // 0 is DefaultMaxRequestTokens
+}
+
+func convertSimpleToJson(d *soapDecoder, typ *EwsType, chardata string) (converted interface{}) {
 	switch typ.SimpleType {
 	case T_BOOL:
 		if chardata == "true" || chardata == "1" {
@@ -74,6 +118,8 @@ func convertSimpleToJson(typ *EwsType, chardata string) (converted interface{})
 		}
 	case T_NUM:
 		converted = json.Number(chardata)
+	case T_DATETIME:
+		converted = convertDateTime(chardata, d.dateTimes)
 	case T_ENUM:
 		// find chardata in enum_values
 		for idx, value := range typ.EnumValues {
@@ -82,15 +128,62 @@ func convertSimpleToJson(typ *EwsType, chardata string) (converted interface{})
 				return
 			}
 		}
-		//LogError.Println("Cannot find ", chardata, " in ", typ.EnumValues, " using raw data instead")
+		d.notes.add("%q is not a %s value, it was sent as it is", chardata, typ.Name)
 		converted = chardata
+	case T_LIST:
+		if typ.ListItemType != nil && typ.ListItemType.SimpleType == T_ENUM {
+			converted = convertFlagsToJson(typ.ListItemType, chardata, d.notes)
+		} else {
+			converted = chardata
+		}
 	default:
 		converted = chardata
 	}
 	return
 }
 
-func initRetObject(el xml.StartElement, typ *EwsType, simple bool) (obj *OrderedObject, listObj JsonList, ret interface{}, err error) {
+// enum values that stand for several flags. They come after the flags in the
+// enum, but OWA has no bits for them.
+var compositeFlags = map[string]map[string]uint32{
+	"DayOfWeekType": {
+		"Day":        127, // every day
+		"Weekday":    62,  // Monday to Friday
+		"WeekendDay": 65,  // Saturday and Sunday
+	},
+}
+
+// a list of flags is sent as a bitfield with the bit of the index of each
+// value set, the reverse of processJson in json2soap.go. If one of the values
+// isn't in the enum chardata is sent as it is.
+func convertFlagsToJson(typ *EwsType, chardata string, notes *FidelityNotes) interface{} {
+	var bits uint32
+	for _, name := range strings.Fields(chardata) {
+		// the flags lists that have All mean every flag by it
+		if name == "All" && !isEnumValue(typ, name) {
+			bits |= 1<<uint(len(typ.EnumValues)) - 1
+			continue
+		}
+
+		if flags, ok := compositeFlags[typ.Name][name]; ok {
+			bits |= flags
+			continue
+		}
+
+		idx := 0
+		for idx < len(typ.EnumValues) && typ.EnumValues[idx] != name {
+			idx++
+		}
+
+		if idx == len(typ.EnumValues) || idx >= 32 {
+			notes.add("%q is not a %s value, it was sent as it is", name, typ.Name)
+			return chardata
+		}
+		bits |= 1 << uint(idx)
+	}
+	return json.Number(strconv.FormatUint(uint64(bits), 10))
+}
+
+func initRetObject(d *soapDecoder, el xml.StartElement, typ *EwsType, simple bool) (obj *OrderedObject, listObj JsonList, ret interface{}, err error) {
 
 	// if this isn't a simple type, then create a json object to
 	// add elements to
@@ -133,8 +226,14 @@ func initRetObject(el xml.StartElement, typ *EwsType, simple bool) (obj *Ordered
 			// add my attributes to this
 			for _, attr := range el.Attr {
 				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
-					if atype, ok := typ.Attrs[attr.Name.Local]; ok {
-						obj.Set(typ.AttrsNames[attr.Name.Local], convertSimpleToJson(atype, attr.Value))
+					// the attributes are unqualified, except xml:lang
+					name := attr.Name.Local
+					if attr.Name.Space == NSXML {
+						name = "xml:" + name
+					}
+
+					if atype, ok := typ.Attrs[name]; ok {
+						obj.Set(typ.AttrsNames[name], convertSimpleToJson(d, atype, attr.Value))
 					} else {
 						err = errors.Errorf("Unknown attribute %s for type %s?", attr.Name.Local, typ.Name)
 						return
@@ -147,8 +246,17 @@ func initRetObject(el xml.StartElement, typ *EwsType, simple bool) (obj *Ordered
 	return
 }
 
+func isNilElement(el xml.StartElement) bool {
+	for _, attr := range el.Attr {
+		if attr.Name.Space == NSXSI && attr.Name.Local == "nil" {
+			return attr.Value == "true" || attr.Value == "1"
+		}
+	}
+	return false
+}
+
 // typ is never nil
-func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret interface{}, err error) {
+func processElement(d *soapDecoder, el xml.StartElement, typ *EwsType) (ret interface{}, err error) {
 
 	var obj *OrderedObject
 	var listObj []interface{}
@@ -158,9 +266,25 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 		return
 	}
 
+	leave, err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	// nillable elements (such as the DictionaryValue of a UserConfiguration)
+	// are null
+	if isNilElement(el) {
+		return nil, d.Skip()
+	}
+
+	// the text of the element, comments and CDATA sections split it into
+	// several tokens
+	var text []byte
+
 	// early attribute initialization
 	if len(el.Attr) != 0 {
-		if obj, listObj, ret, err = initRetObject(el, typ, false); err != nil {
+		if obj, listObj, ret, err = initRetObject(d, el, typ, false); err != nil {
 			return
 		}
 	}
@@ -176,11 +300,19 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 		case xml.StartElement:
 
 			if ret == nil {
-				if obj, listObj, ret, err = initRetObject(el, typ, false); err != nil {
+				if obj, listObj, ret, err = initRetObject(d, el, typ, false); err != nil {
 					return
 				}
 			}
 
+			if readOnlyRequestElements[tokel.Name.Local] {
+				d.notes.add("%s is read-only, it was left out", tokel.Name.Local)
+				if err = d.Skip(); err != nil {
+					return
+				}
+				continue
+			}
+
 			// look up the element type
 			// -> this should always succeed
 			nextElem, ok := typ.TypeByElementName[tokel.Name.Local]
@@ -196,7 +328,6 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 				return nil, err
 			}
 
-			//FIXME I think here is where we need to deal with enumerated lists, but we need a testcase
 			if typ.JsonListName != "" {
 				listObj = append(listObj, newItem)
 				obj.Set(typ.JsonListName, listObj)
@@ -206,14 +337,10 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 				ret = listObj
 
 			} else if nextElem.IsList {
-				if elistIf, ok := obj.Get(jsonName); ok {
-					if elist, ok := elistIf.([]interface{}); ok {
-						obj.Set(jsonName, append(elist, newItem))
-					} else {
-						return nil, errors.Errorf("Internal error: inconsistent list type")
-					}
-				} else {
-					obj.Set(jsonName, []interface{}{newItem})
+				// the elements may not be contiguous, so always append to
+				// the existing list instead of starting a new one
+				if err = obj.Append(jsonName, newItem); err != nil {
+					return nil, err
 				}
 
 			} else {
@@ -228,6 +355,26 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 			}
 
 		case xml.EndElement:
+			// the text is only trimmed at the edges, base64 (MimeContent)
+			// that is wrapped over several lines or tokens is kept whole.
+			// trim borrowed from mxj
+			if chardata := strings.Trim(string(text), "\t\r\b\n "); len(chardata) != 0 {
+				if ret == nil {
+					if obj, listObj, ret, err = initRetObject(d, el, typ, true); err != nil {
+						return
+					}
+				}
+
+				converted := convertSimpleToJson(d, typ, chardata)
+
+				if typ.TextAttr != "" {
+					obj.Set(typ.TextAttr, converted)
+					ret = obj
+				} else {
+					ret = converted
+				}
+			}
+
 			// done, return the constructed json.OrderedObject
 			if ret == obj {
 
@@ -235,6 +382,7 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 				for _, e := range typ.JsonDefaults {
 					if _, ok := obj.Get(e.JsonName); !ok {
 						obj.Set(e.JsonName, e.JsonDefault)
+						d.notes.add("%s was not sent, a default was added", e.JsonName)
 					}
 				}
 
@@ -248,24 +396,7 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 			return
 
 		case xml.CharData:
-			// trim borrowed from mxj
-			chardata := strings.Trim(string(tokel), "\t\r\b\n ")
-			if len(chardata) != 0 {
-				if ret == nil {
-					if obj, listObj, ret, err = initRetObject(el, typ, true); err != nil {
-						return
-					}
-				}
-
-				converted := convertSimpleToJson(typ, chardata)
-
-				if typ.TextAttr != "" {
-					obj.Set(typ.TextAttr, converted)
-					ret = obj
-				} else {
-					ret = converted
-				}
-			}
+			text = append(text, tokel...)
 
 		default:
 			// ignore anything else
@@ -273,7 +404,7 @@ func processElement(d *xml.Decoder, el xml.StartElement, typ *EwsType) (ret inte
 	}
 }
 
-func getNextElement(x *xml.Decoder, wantStart bool) (ret interface{}, err error) {
+func getNextElement(x xml.TokenReader, wantStart bool) (ret interface{}, err error) {
 	var tok xml.Token
 	for {
 		tok, err = x.Token()
@@ -296,13 +427,13 @@ func getNextElement(x *xml.Decoder, wantStart bool) (ret interface{}, err error)
 			}
 			err = errors.Errorf("unexpected element (wanted start), got %#v", tok)
 			return
-		default:
-			// don't care about various xml elements
+		case xml.Comment, xml.ProcInst, xml.Directive, xml.CharData:
+			// don't care about comments, processing instructions, whitespace..
 		}
 	}
 }
 
-func getNextStartElement(x *xml.Decoder) (ret xml.StartElement, err error) {
+func getNextStartElement(x xml.TokenReader) (ret xml.StartElement, err error) {
 	el, err := getNextElement(x, true)
 	if err == nil {
 		ret = el.(xml.StartElement)
@@ -310,7 +441,7 @@ func getNextStartElement(x *xml.Decoder) (ret xml.StartElement, err error) {
 	return
 }
 
-func processSoapElement(d *xml.Decoder, el xml.StartElement, typ *EwsType, jsonType string) (obj json.OrderedObject, err error) {
+func processSoapElement(d *soapDecoder, el xml.StartElement, typ *EwsType, jsonType string) (obj json.OrderedObject, err error) {
 
 	// the caller has consumed a start element, expectation is that
 	// this function will consume the end element
@@ -357,9 +488,64 @@ func processSoapElement(d *xml.Decoder, el xml.StartElement, typ *EwsType, jsonT
 // decode the returned message via Json2Soap
 // .. always client -> server
 func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
+	return SOAP2JSONWithHook(r, nil)
+}
+
+// SOAP2JSONWithHook is SOAP2JSON, but if hook is not nil it is called with the
+// translated body before it is serialized
+func SOAP2JSONWithHook(r io.Reader, hook RequestHookFunc) (ret []byte, op *OpDescriptor, err error) {
+	return SOAP2JSONWithAction(r, "", hook)
+}
+
+// SOAP2JSONWithAction is SOAP2JSONWithHook, action is the operation named in
+// the SOAPAction header (or ""). The body decides which operation it is, but
+// if the operation element isn't known and only differs from action in
+// case, action is used.
+func SOAP2JSONWithAction(r io.Reader, action string, hook RequestHookFunc) (ret []byte, op *OpDescriptor, err error) {
+	var msg json.OrderedObject
+	if msg, op, err = parseSOAP(r, SOAP2JSONOptions{Action: action, Hook: hook}, nil); err != nil {
+		return
+	}
+
+	//ret, err = json.MarshalIndent(msg, "", "  ")
+	ret, err = json.Marshal(msg)
+	return
+}
+
+// UTF-16 bodies are transcoded before they are parsed (see
+// proxyutils.NewXmlBodyReader), but the XML declaration still says utf-16.
+// Bodies in other charsets are transcoded here.
+func transcodedCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if proxyutils.IsUTF16Charset(charset) {
+		return input, nil
+	}
+
+	enc, err := proxyutils.CharsetEncoding(charset)
+	if err != nil {
+		return nil, errors.Errorf("unsupported encoding %s", charset)
+	} else if enc == nil {
+		return input, nil
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// parseSOAP translates the SOAP message into a JSON message, but doesn't
+// serialize it
+// notes are added to notes, which may be nil
+func parseSOAP(r io.Reader, opts SOAP2JSONOptions, notes *FidelityNotes) (msg json.OrderedObject, op *OpDescriptor, err error) {
 
 	var ok bool
-	d := xml.NewDecoder(r)
+	d := &soapDecoder{
+		Decoder:   xml.NewDecoder(r),
+		notes:     notes,
+		dateTimes: opts.DateTimes,
+		maxDepth:  opts.MaxDepth,
+		maxTokens: opts.MaxTokens,
+	}
+	d.CharsetReader = transcodedCharsetReader
+
+	// unknown actions are ignored
+	hint := EwsOperations[opts.Action]
 
 	// consume the envelope
 	el, err := getNextStartElement(d)
@@ -417,6 +603,7 @@ func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
 										// HACK: The specified server version, Exchange2007_SP1, is not valid for a JSON request.
 										//       .. which of course is what mac mail uses, so let's upgrade!
 										if strings.HasPrefix(ver, "Exchange2007") || strings.HasPrefix(ver, "Exchange2010") {
+											d.notes.add("RequestServerVersion %s was sent as Exchange2013", ver)
 											ver = "Exchange2013"
 										}
 
@@ -431,6 +618,7 @@ func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
 				// The GLOBAL exchange server is older, and it requires a header,
 				// so set that if the requesting client didn't ask for it
 				// TODO: version detect for versions of Exchange that care about this
+				d.notes.add("the request has no SOAP header, one with RequestServerVersion Exchange2013 was added")
 				customHeader := NewOrderedObject()
 				customHeader.Set("__type", "JsonRequestHeaders:#Exchange")
 				customHeader.Set("RequestServerVersion", "Exchange2013")
@@ -450,10 +638,25 @@ func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
 				return
 			}
 
-			op, ok = EwsOperations[el.Name.Local]
+			// some frameworks wrap the operation in an extra element, so if
+			// this isn't an operation look one level deeper
+			wrapped := false
+			op, ok = lookupOperation(el.Name.Local, hint)
 			if !ok {
-				err = errors.Errorf("Unknown EWS operation %s", el.Name.Local)
-				return
+				wrapper := el.Name.Local
+				el, err = getNextStartElement(d)
+				if err != nil {
+					err = errors.Errorf("Unknown EWS operation %s", wrapper)
+					return
+				}
+
+				op, ok = lookupOperation(el.Name.Local, hint)
+				if !ok {
+					err = errors.Errorf("Unknown EWS operation %s (also tried %s, assuming %s is a wrapper)", wrapper, el.Name.Local, wrapper)
+					return
+				}
+
+				wrapped = true
 			}
 
 			msgType = op.RequestType
@@ -463,10 +666,21 @@ func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
 				return
 			}
 
+			if opts.Hook != nil {
+				body = opts.Hook(op, body)
+			}
+
 			gotBody = true
 
 			// processSoapElement got rid of the action end tag, still need to
-			// remove the body end tag
+			// remove the wrapper and body end tags
+			if wrapped {
+				_, err = getNextElement(d, false)
+				if err != nil {
+					return
+				}
+			}
+
 			_, err = getNextElement(d, false)
 			if err != nil {
 				return
@@ -482,14 +696,28 @@ func SOAP2JSON(r io.Reader) (ret []byte, op *OpDescriptor, err error) {
 
 	// TODO: consume EOF
 
-	// construct the final message and serialize it
-	msg := json.OrderedObject{
+	// construct the final message
+	msg = json.OrderedObject{
 		{Key: "__type", Value: msgType},
 		{Key: "Header", Value: header},
 		{Key: "Body", Value: body},
 	}
+	return
+}
+
+// returns the operation for an element in the SOAP body. hint is the
+// operation named in the SOAPAction header, or nil.
+func lookupOperation(name string, hint *OpDescriptor) (op *OpDescriptor, ok bool) {
+	op, ok = EwsOperations[name]
+	if hint == nil {
+		return
+	}
 
-	//ret, err = json.MarshalIndent(msg, "", "  ")
-	ret, err = json.Marshal(msg)
+	if ok && op != hint {
+		Log.Warn.Printf("SOAPAction header names %s, but the body is %s, using %s", hint.Action, op.Action, op.Action)
+	} else if !ok && strings.EqualFold(name, hint.Action) {
+		Log.Warn.Printf("Unknown EWS operation %s, using %s from the SOAPAction header", name, hint.Action)
+		op, ok = hint, true
+	}
 	return
 }
@@ -0,0 +1,95 @@
+package ews
+
+/*
+	SOAP2JSON translates elements recursively, so a request that nests
+	elements very deeply (by mistake or on purpose) would use a lot of stack
+	and CPU before anything else stops it, and gzip makes a small body go a
+	long way. Requests are limited to a number of nested elements and of XML
+	tokens (see SOAP2JSONOptions), past that the translation fails with a
+	*RequestLimitError.
+
+	encoding/xml doesn't expand entities that are declared in a DTD (the
+	decoder is Strict and has no Entity map), so the entities of a billion
+	laughs document are rejected as unknown. SOAP messages must not have a
+	DTD, so documents with one are rejected before that.
+*/
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Limits of the requests that SOAP2JSON translates, when SOAP2JSONOptions
+// doesn't say
+const (
+	DefaultMaxRequestDepth  = 100
+	DefaultMaxRequestTokens = 1000000
+)
+
+// RequestLimitError is returned by SOAP2JSON when a request is past one of
+// the limits above
+type RequestLimitError struct {
+	Limit string // "depth" or "tokens"
+	Max   int
+}
+
+func (this *RequestLimitError) Error() string {
+	return fmt.Sprintf("the request is past the maximum %s of %d", this.Limit, this.Max)
+}
+
+// Token is xml.Decoder.Token, but it fails on a DTD and once the document
+// has more than maxTokens tokens
+func (d *soapDecoder) Token() (xml.Token, error) {
+	maxTokens := d.maxTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxRequestTokens
+	}
+
+	if d.tokens++; d.tokens > maxTokens {
+		return nil, &RequestLimitError{Limit: "tokens", Max: maxTokens}
+	}
+
+	tok, err := d.Decoder.Token()
+	if directive, ok := tok.(xml.Directive); ok && bytes.HasPrefix(directive, []byte("DOCTYPE")) {
+		return nil, errors.New("SOAP messages must not have a document type declaration")
+	}
+	return tok, err
+}
+
+// Skip is xml.Decoder.Skip, but the skipped tokens count
+func (d *soapDecoder) Skip() error {
+	for depth := 0; ; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+	}
+}
+
+// called when processElement starts on an element, the returned function is
+// called when it is done
+func (d *soapDecoder) enter() (func(), error) {
+	maxDepth := d.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxRequestDepth
+	}
+
+	if d.depth++; d.depth > maxDepth {
+		d.depth--
+		return nil, &RequestLimitError{Limit: "depth", Max: maxDepth}
+	}
+	return func() { d.depth-- }, nil
+}
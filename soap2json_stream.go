@@ -0,0 +1,210 @@
+package ews
+
+/*
+	Large requests (CreateAttachment with a big Content element) would be
+	held in memory several times if translated via SOAP2JSON: the raw SOAP,
+	the translated message, and the serialized JSON. To avoid that, the
+	translated message is kept and written directly to the upstream request
+	body when it is read.
+*/
+
+import (
+	"bufio"
+	"io"
+	"unicode/utf8"
+
+	"github.com/virtuald/go-ordered-json"
+)
+
+// strings longer than this are escaped in pieces instead of all at once
+const jsonStringChunkSize = 32 * 1024
+
+// JsonRequest is a SOAP request that has been translated to JSON, but not
+// serialized yet
+type JsonRequest struct {
+	Op *OpDescriptor
+
+	// what the translation changed
+	Notes FidelityNotes
+
+	msg json.OrderedObject
+}
+
+// ParseSOAP translates a SOAP message without serializing the resulting JSON.
+// If hook is not nil it is called with the translated body.
+func ParseSOAP(r io.Reader, hook RequestHookFunc) (*JsonRequest, error) {
+	return ParseSOAPWithAction(r, "", hook)
+}
+
+// ParseSOAPWithAction is ParseSOAP, action is used as in SOAP2JSONWithAction
+func ParseSOAPWithAction(r io.Reader, action string, hook RequestHookFunc) (*JsonRequest, error) {
+	return ParseSOAPWithOptions(r, SOAP2JSONOptions{Action: action, Hook: hook})
+}
+
+// SOAP2JSONOptions change how ParseSOAPWithOptions translates a message
+type SOAP2JSONOptions struct {
+	// the operation named in the SOAPAction header, see SOAP2JSONWithAction
+	Action string
+
+	// If not nil, it is called with the translated body
+	Hook RequestHookFunc
+
+	// format of date-time values sent to OWA
+	DateTimes DateTimeFormat
+
+	// How deep elements can be nested, and how many XML tokens the message
+	// can have, see soap2json_limits.go. If 0, DefaultMaxRequestDepth and
+	// DefaultMaxRequestTokens are used.
+	MaxDepth  int
+	MaxTokens int
+}
+
+// ParseSOAPWithOptions is ParseSOAP, with the options in opts
+func ParseSOAPWithOptions(r io.Reader, opts SOAP2JSONOptions) (*JsonRequest, error) {
+	var notes FidelityNotes
+	msg, op, err := parseSOAP(r, opts, &notes)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonRequest{Op: op, Notes: notes, msg: msg}, nil
+}
+
+// WriteTo writes the JSON message to w, the output is identical to what
+// SOAP2JSON returns. Implements io.WriterTo.
+func (this *JsonRequest) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriterSize(cw, jsonStringChunkSize)
+
+	if err := writeJson(bw, this.msg); err != nil {
+		return cw.n, err
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Reader returns the JSON message as it is serialized, the output is
+// identical to what WriteTo writes. Closing the reader early stops the
+// serialization.
+func (this *JsonRequest) Reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := this.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// SOAP2JSONStream is SOAP2JSONWithHook, but the JSON is written to w instead
+// of being returned
+func SOAP2JSONStream(r io.Reader, w io.Writer, hook RequestHookFunc) (op *OpDescriptor, err error) {
+	var req *JsonRequest
+	if req, err = ParseSOAP(r, hook); err != nil {
+		return
+	}
+
+	_, err = req.WriteTo(w)
+	return req.Op, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = this.w.Write(p)
+	this.n += int64(n)
+	return
+}
+
+func writeJson(w *bufio.Writer, value interface{}) (err error) {
+	switch v := value.(type) {
+	case json.OrderedObject:
+		w.WriteByte('{')
+		for i, member := range v {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			if err = writeJsonString(w, member.Key); err != nil {
+				return
+			}
+			w.WriteByte(':')
+			if err = writeJson(w, member.Value); err != nil {
+				return
+			}
+		}
+		return w.WriteByte('}')
+
+	case JsonList:
+		return writeJsonList(w, v)
+
+	case []interface{}:
+		return writeJsonList(w, v)
+
+	case string:
+		return writeJsonString(w, v)
+
+	default:
+		var data []byte
+		if data, err = json.Marshal(v); err != nil {
+			return
+		}
+		_, err = w.Write(data)
+		return
+	}
+}
+
+func writeJsonList(w *bufio.Writer, list []interface{}) (err error) {
+	w.WriteByte('[')
+	for i, item := range list {
+		if i != 0 {
+			w.WriteByte(',')
+		}
+		if err = writeJson(w, item); err != nil {
+			return
+		}
+	}
+	return w.WriteByte(']')
+}
+
+// escapes the string a piece at a time, so that a large string doesn't need
+// a second copy of itself
+func writeJsonString(w *bufio.Writer, s string) error {
+	if len(s) <= jsonStringChunkSize {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	w.WriteByte('"')
+	for len(s) != 0 {
+		end := jsonStringChunkSize
+		if end >= len(s) {
+			end = len(s)
+		} else {
+			// don't split a multibyte character
+			for end > 0 && !utf8.RuneStart(s[end]) {
+				end--
+			}
+			if end == 0 {
+				end = jsonStringChunkSize
+			}
+		}
+
+		data, err := json.Marshal(s[:end])
+		if err != nil {
+			return err
+		}
+
+		// strip the quotes
+		if _, err = w.Write(data[1 : len(data)-1]); err != nil {
+			return err
+		}
+		s = s[end:]
+	}
+	return w.WriteByte('"')
+}
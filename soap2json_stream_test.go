@@ -0,0 +1,296 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+	"github.com/virtuald/go-ordered-json"
+)
+
+// a CreateAttachment request with contentSize bytes of attachment
+func createAttachmentRequest(contentSize int) []byte {
+	content := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("attachment data "), contentSize/16))
+
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header>
+        <t:RequestServerVersion Version="Exchange2013"/>
+    </soap:Header>
+    <soap:Body>
+        <m:CreateAttachment>
+            <m:ParentItemId Id="PPPP==" ChangeKey="CCCC==" />
+            <m:Attachments>
+                <t:FileAttachment>
+                    <t:Content>%s</t:Content>
+                    <t:ContentType>application/octet-stream</t:ContentType>
+                    <t:Name>large.bin</t:Name>
+                </t:FileAttachment>
+            </m:Attachments>
+        </m:CreateAttachment>
+    </soap:Body>
+</soap:Envelope>`, content))
+}
+
+// an UploadItems request with dataSize bytes of item data, as sent by
+// mailbox migration tools
+func uploadItemsRequest(dataSize int) []byte {
+	data := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("exported item "), dataSize/14))
+
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header>
+        <t:RequestServerVersion Version="Exchange2013"/>
+    </soap:Header>
+    <soap:Body>
+        <m:UploadItems>
+            <m:Items>
+                <t:Item CreateAction="CreateNew" IsAssociated="false">
+                    <t:ParentFolderId Id="INBOXID=="/>
+                    <t:Data>%s</t:Data>
+                </t:Item>
+            </m:Items>
+        </m:UploadItems>
+    </soap:Body>
+</soap:Envelope>`, data))
+}
+
+// a SetUserPhoto request with a photo of photoSize bytes
+func setUserPhotoRequest(photoSize int) []byte {
+	content := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("photo "), photoSize/6))
+
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header>
+        <t:RequestServerVersion Version="Exchange2013"/>
+    </soap:Header>
+    <soap:Body>
+        <m:SetUserPhoto>
+            <m:Email>user@example.com</m:Email>
+            <m:Content>%s</m:Content>
+            <m:TypeRequested>UserPhoto</m:TypeRequested>
+        </m:SetUserPhoto>
+    </soap:Body>
+</soap:Envelope>`, content))
+}
+
+func TestSOAP2JSONStreamMatches(t *testing.T) {
+	testfiles, err := filepath.Glob(filepath.Join("testdata", "requests", "*.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testfiles = append(testfiles, "large CreateAttachment", "large UploadItems")
+
+	for _, testfile := range testfiles {
+		var data []byte
+		if strings.HasSuffix(testfile, ".xml") {
+			if data, err = ioutil.ReadFile(testfile); err != nil {
+				t.Fatal(err)
+			}
+		} else if strings.Contains(testfile, "UploadItems") {
+			data = uploadItemsRequest(256 * 1024)
+		} else {
+			data = createAttachmentRequest(256 * 1024)
+		}
+
+		expected, expectedOp, err := SOAP2JSON(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %s", testfile, err)
+		}
+
+		buf := new(bytes.Buffer)
+		op, err := SOAP2JSONStream(bytes.NewReader(data), buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", testfile, err)
+		}
+
+		if op != expectedOp {
+			t.Errorf("%s: different operation returned", testfile)
+		}
+
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%s: streamed output differs from SOAP2JSON", testfile)
+		}
+	}
+}
+
+func TestWriteJsonStringChunks(t *testing.T) {
+	// multibyte characters and characters that need escaping, positioned so
+	// that they straddle the chunk boundaries
+	s := strings.Repeat("a", jsonStringChunkSize-1) + "é<\"\\\n" + strings.Repeat("ü&", jsonStringChunkSize)
+
+	expected, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &JsonRequest{msg: json.OrderedObject{{Key: "Content", Value: s}}}
+
+	buf := new(bytes.Buffer)
+	if _, err = req.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != `{"Content":`+string(expected)+`}` {
+		t.Error("large string was not escaped correctly")
+	}
+}
+
+func TestStreamedTranslation(t *testing.T) {
+	data := createAttachmentRequest(256 * 1024)
+	expected, _, err := SOAP2JSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.StreamThreshold = 1024
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+	if err = translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.ContentLength != int64(len(expected)) {
+		t.Errorf("expected Content-Length %d, got %d", len(expected), request.ContentLength)
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, expected) {
+		t.Error("streamed body differs from SOAP2JSON")
+	}
+
+	// the body can be replayed
+	replay, _ := request.GetBody()
+	body, _ = ioutil.ReadAll(replay)
+	if !bytes.Equal(body, expected) {
+		t.Error("replayed body differs from SOAP2JSON")
+	}
+}
+
+func TestStreamedUploadItemsWithoutLength(t *testing.T) {
+	data := uploadItemsRequest(64 * 1024)
+	expected, _, err := SOAP2JSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	var transactionLog string
+	translator.OnEwsTranslationError = func(buf *bytes.Buffer) {
+		transactionLog = buf.String()
+	}
+
+	// a chunked upload, the length isn't known
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", ioutil.NopCloser(bytes.NewReader(data)))
+	request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/UploadItems"`)
+	request.ContentLength = -1
+
+	cctx := proxyutils.NewChainValues()
+	if err = translator.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.ContentLength != int64(len(expected)) {
+		t.Errorf("expected Content-Length %d, got %d", len(expected), request.ContentLength)
+	}
+
+	body, _ := ioutil.ReadAll(request.Body)
+	if !bytes.Equal(body, expected) {
+		t.Error("streamed body differs from SOAP2JSON")
+	}
+
+	// the data isn't in the transaction log
+	translator.OnEwsTranslationError(cctx.Get(ewsContextName).(*ewsProxyContext).TransactionLog)
+	if !strings.Contains(transactionLog, "(unknown length, not logged)") || strings.Contains(transactionLog, "<t:Data>") {
+		t.Errorf("request was logged:\n%.200s", transactionLog)
+	}
+}
+
+func TestStreamedSetUserPhotoWithoutLength(t *testing.T) {
+	data := setUserPhotoRequest(2 * 1024 * 1024)
+	expected, _, err := SOAP2JSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", ioutil.NopCloser(bytes.NewReader(data)))
+	request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/SetUserPhoto"`)
+	request.ContentLength = -1
+
+	if err = translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.ContentLength != int64(len(expected)) {
+		t.Errorf("expected Content-Length %d, got %d", len(expected), request.ContentLength)
+	}
+
+	body, _ := ioutil.ReadAll(request.Body)
+	if !bytes.Equal(body, expected) {
+		t.Error("streamed body differs from SOAP2JSON")
+	}
+}
+
+// the allocation counts (-benchmem) show the difference between buffering
+// a large attachment and streaming it
+const benchmarkAttachmentSize = 8 * 1024 * 1024
+
+func benchmarkTranslation(b *testing.B, data []byte, streamThreshold int64) {
+
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+	translator.StreamThreshold = streamThreshold
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+		if err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+			b.Fatal(err)
+		}
+
+		// the transport would do this
+		if _, err := io.Copy(ioutil.Discard, request.Body); err != nil {
+			b.Fatal(err)
+		}
+		request.Body.Close()
+	}
+}
+
+func BenchmarkCreateAttachmentBuffered(b *testing.B) {
+	benchmarkTranslation(b, createAttachmentRequest(benchmarkAttachmentSize), 0)
+}
+
+func BenchmarkCreateAttachmentStreamed(b *testing.B) {
+	benchmarkTranslation(b, createAttachmentRequest(benchmarkAttachmentSize), 1024)
+}
+
+func BenchmarkUploadItemsBuffered(b *testing.B) {
+	benchmarkTranslation(b, uploadItemsRequest(benchmarkAttachmentSize), 0)
+}
+
+func BenchmarkUploadItemsStreamed(b *testing.B) {
+	benchmarkTranslation(b, uploadItemsRequest(benchmarkAttachmentSize), 1024)
+}
@@ -0,0 +1,402 @@
+package ews
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtuald/go-ordered-json"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// a minimal type with a repeated element and a single element, so that list
+// handling can be tested without depending on the generated schema
+func interleavedTestType() *EwsType {
+	str := &EwsType{Name: "string", IsSimple: true, SimpleType: T_STR}
+
+	return &EwsType{
+		Name:     "InterleavedTestType",
+		JsonType: "InterleavedTest:#Exchange",
+		TypeByElementName: map[string]*EwsXmlElement{
+			"Entry": {JsonName: "Entry", Type: str, IsList: true},
+			"Other": {JsonName: "Other", Type: str},
+			"Last":  {JsonName: "Last", Type: str},
+		},
+	}
+}
+
+func TestSOAP2JSONInterleavedList(t *testing.T) {
+	d := xml.NewDecoder(strings.NewReader(`
+		<Test>
+			<Entry>a</Entry>
+			<Other>x</Other>
+			<Entry>b</Entry>
+			<Last>y</Last>
+			<Entry>c</Entry>
+		</Test>`))
+
+	el, err := getNextStartElement(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := processElement(&soapDecoder{Decoder: d}, el, interleavedTestType())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"__type":"InterleavedTest:#Exchange","Entry":["a","b","c"],"Other":"x","Last":"y"}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestOrderedObjectAppend(t *testing.T) {
+	obj := NewOrderedObject()
+	obj.Set("Single", "x")
+
+	if err := obj.Append("Single", "y"); err == nil {
+		t.Error("appending to a non-list value should fail")
+	}
+
+	obj.Append("List", 1)
+	obj.Set("Other", 2)
+	obj.Append("List", 3)
+
+	if len(obj.Object) != 3 {
+		t.Fatalf("expected 3 keys, got %#v", obj.Object)
+	}
+
+	list, _ := obj.Get("List")
+	if l, ok := list.([]interface{}); !ok || len(l) != 2 {
+		t.Errorf("expected a single list with 2 entries, got %#v", list)
+	}
+}
+
+func TestSOAP2JSONUnknownWrapper(t *testing.T) {
+	_, _, err := SOAP2JSON(strings.NewReader(`
+		<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+			<soap:Header></soap:Header>
+			<soap:Body><Wrapper><NotAnOperation/></Wrapper></soap:Body>
+		</soap:Envelope>`))
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if msg := err.Error(); !strings.Contains(msg, "Wrapper") || !strings.Contains(msg, "NotAnOperation") {
+		t.Errorf("error should mention the wrapper and the inner element: %s", msg)
+	}
+}
+
+// a GetItem request with the operation element given
+func getItemWithElement(element string) string {
+	return strings.Replace(strings.Replace(getItemRequest, "<m:GetItem>", "<m:"+element+">", 1), "</m:GetItem>", "</m:"+element+">", 1)
+}
+
+func TestSOAP2JSONWithAction(t *testing.T) {
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	expected, _, err := SOAP2JSON(strings.NewReader(getItemRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		element string
+		action  string
+		warning bool
+	}{
+		{"GetItem", "", false},
+		{"GetItem", "GetItem", false},
+		{"GetItem", "NotAnOperation", false},
+		// the body wins
+		{"GetItem", "DeleteItem", true},
+		// the case of the element was changed
+		{"getitem", "GetItem", true},
+	} {
+		logBuf.Reset()
+
+		data, op, err := SOAP2JSONWithAction(strings.NewReader(getItemWithElement(test.element)), test.action, nil)
+		if err != nil {
+			t.Errorf("%s/%s: %s", test.element, test.action, err)
+			continue
+		}
+
+		if op.Action != "GetItem" || string(data) != string(expected) {
+			t.Errorf("%s/%s: translated as %s: %s", test.element, test.action, op.Action, data)
+		}
+
+		if warned := logBuf.Len() != 0; warned != test.warning {
+			t.Errorf("%s/%s: unexpected log output %q", test.element, test.action, logBuf)
+		}
+	}
+
+	// the header only helps if the names differ in case
+	for _, action := range []string{"", "FindItem"} {
+		if _, _, err = SOAP2JSONWithAction(strings.NewReader(getItemWithElement("getitem")), action, nil); err == nil {
+			t.Errorf("%s: expected an error for an unknown operation", action)
+		}
+	}
+}
+
+func TestSOAPActionHeader(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", strings.NewReader(getItemWithElement("GETITEM")))
+	request.Header.Set("SOAPAction", `"http://schemas.microsoft.com/exchange/services/2006/messages/GetItem"`)
+
+	if err := translator.RequestModifier(context.Background(), request, proxyutils.NewChainValues()); err != nil {
+		t.Fatal(err)
+	}
+
+	if action := request.Header.Get("Action"); action != "GetItem" {
+		t.Errorf("expected the GetItem action, got %q", action)
+	}
+}
+
+func TestConvertFlagsList(t *testing.T) {
+	daysOfWeek := ewsTypes["DaysOfWeekType"]
+
+	for chardata, expected := range map[string]interface{}{
+		"Tuesday":                   json.Number("4"),
+		"Saturday Sunday":           json.Number("65"),
+		" Monday \n  Friday ":       json.Number("34"),
+		"Sunday Weekday WeekendDay": json.Number("127"),
+		"Weekday":                   json.Number("62"),
+		"WeekendDay":                json.Number("65"),
+		"Day Monday":                json.Number("127"),
+		"":                          json.Number("0"),
+		// not a day
+		"Sunday Someday": "Sunday Someday",
+	} {
+		if converted := convertSimpleToJson(&soapDecoder{}, daysOfWeek, chardata); converted != expected {
+			t.Errorf("%q: expected %#v, got %#v", chardata, expected, converted)
+		}
+	}
+
+	// All is every flag
+	properties := ewsTypes["UserConfigurationPropertyType"]
+	for chardata, expected := range map[string]interface{}{
+		"Id XmlData": json.Number("5"),
+		"All":        json.Number("15"),
+	} {
+		if converted := convertSimpleToJson(&soapDecoder{}, properties, chardata); converted != expected {
+			t.Errorf("%q: expected %#v, got %#v", chardata, expected, converted)
+		}
+	}
+}
+
+// the bitfield of a list of flags is turned back into the same days
+func TestDaysOfWeekRoundTrip(t *testing.T) {
+	response, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetItem_owa_recurrence.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for days, expected := range map[string]string{
+		"Tuesday":         "Tuesday",
+		"Saturday Sunday": "Sunday Saturday",
+	} {
+		converted := convertSimpleToJson(&soapDecoder{}, ewsTypes["DaysOfWeekType"], days)
+
+		data := bytes.Replace(response, []byte(`"DaysOfWeek": 65`), []byte(`"DaysOfWeek": `+string(converted.(json.Number))), 1)
+		buf := new(bytes.Buffer)
+		if err = JSON2SOAP(bytes.NewReader(data), EwsOperations["GetItem"], buf, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(buf.String(), "<t:DaysOfWeek>"+expected+"</t:DaysOfWeek>") {
+			t.Errorf("%q: expected %q in the response:\n%s", days, expected, buf)
+		}
+	}
+}
+
+// translates a request file with the middleware, returns the JSON body
+func translateRequestFile(t *testing.T, translator *TranslationMiddleware, fname string, contentType string) []byte {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("POST", "http://localhost:60001/ews/exchange.asmx", bytes.NewReader(data))
+	request.Header.Set("Content-Type", contentType)
+
+	cctx := proxyutils.NewChainValues()
+	if err = translator.RequestModifier(context.Background(), request, cctx); err != nil {
+		t.Fatalf("%s: %s", fname, err)
+	}
+	releaseSlot(cctx)
+
+	body, _ := ioutil.ReadAll(request.Body)
+	return body
+}
+
+func TestEncodedRequests(t *testing.T) {
+	translator := NewTranslationMiddleware()
+	translator.OwaCanary = "canary"
+
+	for _, threshold := range []int64{0, 1} {
+		translator.StreamThreshold = threshold
+
+		for _, test := range []struct {
+			fname, contentType, utf8 string
+		}{
+			{"ews_getfolder_root_davmail_bom.xml", "text/xml; charset=utf-8", "ews_getfolder_root_davmail.xml"},
+			{"ews_getfolder_root_davmail_utf16le.xml", "text/xml; charset=utf-16", "ews_getfolder_root_davmail.xml"},
+			{"ews_createfolder_hebrew_windows1255.xml", "text/xml; charset=windows-1255", "ews_createfolder_hebrew.xml"},
+		} {
+			expected := translateRequestFile(t, translator, filepath.Join("testdata", "requests", test.utf8), "text/xml; charset=utf-8")
+
+			data := translateRequestFile(t, translator, filepath.Join("testdata", "encodings", test.fname), test.contentType)
+			if string(data) != string(expected) {
+				t.Errorf("%s (stream threshold %d): translated differently:\n%s", test.fname, threshold, data)
+			}
+		}
+	}
+}
+
+// a FindItem request whose restriction is nested depth times
+func nestedRestrictionRequest(depth int) []byte {
+	restriction := strings.Repeat("<t:Not>", depth) +
+		`<t:Exists><t:FieldURI FieldURI="item:Subject"/></t:Exists>` +
+		strings.Repeat("</t:Not>", depth)
+
+	return []byte(`<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+    <soap:Header>
+        <t:RequestServerVersion Version="Exchange2013"/>
+    </soap:Header>
+    <soap:Body>
+        <m:FindItem Traversal="Shallow">
+            <m:ItemShape><t:BaseShape>IdOnly</t:BaseShape></m:ItemShape>
+            <m:Restriction>` + restriction + `</m:Restriction>
+            <m:ParentFolderIds><t:DistinguishedFolderId Id="inbox"/></m:ParentFolderIds>
+        </m:FindItem>
+    </soap:Body>
+</soap:Envelope>`)
+}
+
+func TestSOAP2JSONDepthLimit(t *testing.T) {
+	if _, _, err := SOAP2JSON(bytes.NewReader(nestedRestrictionRequest(20))); err != nil {
+		t.Fatalf("a restriction nested 20 times was rejected: %s", err)
+	}
+
+	_, _, err := SOAP2JSON(bytes.NewReader(nestedRestrictionRequest(1000)))
+	if err, ok := errors.Cause(err).(*RequestLimitError); !ok || err.Limit != "depth" || err.Max != DefaultMaxRequestDepth {
+		t.Errorf("expected a depth RequestLimitError, got %v", err)
+	}
+
+	_, err = ParseSOAPWithOptions(bytes.NewReader(nestedRestrictionRequest(20)), SOAP2JSONOptions{MaxDepth: 10})
+	if err, ok := errors.Cause(err).(*RequestLimitError); !ok || err.Limit != "depth" || err.Max != 10 {
+		t.Errorf("expected a depth RequestLimitError, got %v", err)
+	}
+}
+
+func TestSOAP2JSONTokenLimit(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/requests/ews_finditem_restrict_and.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ParseSOAPWithOptions(bytes.NewReader(data), SOAP2JSONOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseSOAPWithOptions(bytes.NewReader(data), SOAP2JSONOptions{MaxTokens: 20})
+	if err, ok := errors.Cause(err).(*RequestLimitError); !ok || err.Limit != "tokens" || err.Max != 20 {
+		t.Errorf("expected a tokens RequestLimitError, got %v", err)
+	}
+}
+
+func TestSOAP2JSONEntities(t *testing.T) {
+	// billion laughs, in the DTD and in the body
+	var dtd bytes.Buffer
+	dtd.WriteString(`<!DOCTYPE soap:Envelope [<!ENTITY lol0 "lol">`)
+	for i := 1; i < 10; i++ {
+		fmt.Fprintf(&dtd, `<!ENTITY lol%d "%s">`, i, strings.Repeat(fmt.Sprintf("&lol%d;", i-1), 10))
+	}
+	dtd.WriteString("]>")
+
+	data := nestedRestrictionRequest(1)
+	laughs := bytes.Replace(data, []byte(`item:Subject`), []byte(`&lol9;`), 1)
+
+	for name, data := range map[string][]byte{
+		"dtd":      bytes.Replace(laughs, []byte("?>\n"), []byte("?>\n"+dtd.String()), 1),
+		"entities": laughs,
+	} {
+		start := time.Now()
+		if _, _, err := SOAP2JSON(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: the document was translated", name)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: rejecting the document took %s", name, elapsed)
+		}
+	}
+}
+
+// the base64 of MimeContent is kept whole when it's wrapped over several
+// lines, or split into several CDATA sections
+func TestSOAP2JSONWrappedMimeContent(t *testing.T) {
+	var decoded []string
+	for _, fname := range []string{
+		"testdata/requests/ews_createitem_mimecontent_wrapped.xml",
+		"testdata/requests/ews_createitem_mimecontent_cdata.xml",
+	} {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		translated, _, err := SOAP2JSON(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg struct {
+			Body struct {
+				Items []struct {
+					MimeContent struct {
+						CharacterSet string
+						Value        string
+					}
+				}
+			}
+		}
+		if err = json.Unmarshal(translated, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		mime := msg.Body.Items[0].MimeContent
+		content, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(mime.Value), ""))
+		if err != nil || mime.CharacterSet != "UTF-8" {
+			t.Fatalf("%s: %s %v", fname, mime.CharacterSet, err)
+		}
+		decoded = append(decoded, string(content))
+	}
+
+	if !strings.Contains(decoded[0], "Subject: Grüße aus München") || !strings.HasSuffix(decoded[0], "bis dann!\r\n") ||
+		decoded[1] != decoded[0] {
+		t.Errorf("unexpected MIME content:\n%q", decoded)
+	}
+}
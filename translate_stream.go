@@ -0,0 +1,51 @@
+package ews
+
+/*
+	For programs that embed the translator in their own proxy: the body of
+	an EWS request goes in and the JSON for OWA comes out, and the OWA
+	response goes in and the SOAP for the client comes out, without an
+	http.Request in between. The output is written to a pipe as the reader
+	reads it. Both functions are safe for concurrent use.
+*/
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/virtuald/ews-proxy/proxyutils"
+)
+
+// TranslateRequestStream translates the body of an EWS request into the
+// JSON for the OWA service, op is the operation it asks for. The request is
+// parsed before this returns, the JSON is serialized as it is read. The
+// caller must close json.
+func TranslateRequestStream(r io.Reader) (json io.ReadCloser, op *OpDescriptor, err error) {
+	jsonRequest, err := ParseSOAP(proxyutils.NewXmlBodyReader(r, ""), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return jsonRequest.Reader(), jsonRequest.Op, nil
+}
+
+// TranslateResponseStream translates the body of an OWA response to a
+// request for op into the SOAP for the EWS client. The JSON is decoded
+// before this returns, errors in translating it are returned by Read. The
+// caller must close soap.
+func TranslateResponseStream(r io.Reader, op *OpDescriptor) (soap io.ReadCloser, err error) {
+	if op == nil {
+		return nil, errors.New("no operation given for the response")
+	}
+
+	obj, err := decodeJsonMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encodeSoapMessage(obj, op, pw, &jsonEncoder{}))
+	}()
+	return pr, nil
+}
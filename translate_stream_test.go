@@ -0,0 +1,175 @@
+package ews
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// reads r a few bytes at a time
+func readChunks(r io.Reader, size int) ([]byte, error) {
+	out := new(bytes.Buffer)
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.Bytes(), nil
+		} else if err != nil {
+			return out.Bytes(), err
+		}
+	}
+}
+
+func TestTranslateRequestStream(t *testing.T) {
+	testfiles, err := filepath.Glob(filepath.Join("testdata", "requests", "*.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrently, so that the race detector can see it
+	var wg sync.WaitGroup
+	for _, testfile := range testfiles {
+		wg.Add(1)
+		go func(testfile string) {
+			defer wg.Done()
+
+			data, err := ioutil.ReadFile(testfile)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			expected, expectedOp, err := SOAP2JSON(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("%s: %s", testfile, err)
+				return
+			}
+
+			stream, op, err := TranslateRequestStream(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("%s: %s", testfile, err)
+				return
+			}
+			defer stream.Close()
+
+			translated, err := readChunks(stream, 7)
+			if err != nil {
+				t.Errorf("%s: %s", testfile, err)
+			} else if op != expectedOp || !bytes.Equal(translated, expected) {
+				t.Errorf("%s: stream differs from SOAP2JSON:\n%s\n%s", testfile, translated, expected)
+			}
+		}(testfile)
+	}
+	wg.Wait()
+}
+
+func TestTranslateResponseStream(t *testing.T) {
+	testfiles, err := filepath.Glob(filepath.Join("testdata", "responses", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, testfile := range testfiles {
+		wg.Add(1)
+		go func(testfile string) {
+			defer wg.Done()
+
+			// the operation is the first part of the file name
+			op := EwsOperations[strings.Split(filepath.Base(testfile), "_")[0]]
+
+			data, err := ioutil.ReadFile(testfile)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			expected := new(bytes.Buffer)
+			if err = JSON2SOAP(bytes.NewReader(data), op, expected, false); err != nil {
+				t.Errorf("%s: %s", testfile, err)
+				return
+			}
+
+			stream, err := TranslateResponseStream(bytes.NewReader(data), op)
+			if err != nil {
+				t.Errorf("%s: %s", testfile, err)
+				return
+			}
+			defer stream.Close()
+
+			translated, err := readChunks(stream, 5)
+			if err != nil {
+				t.Errorf("%s: %s", testfile, err)
+			} else if !bytes.Equal(translated, expected.Bytes()) {
+				t.Errorf("%s: stream differs from JSON2SOAP:\n%s\n%s", testfile, translated, expected)
+			}
+		}(testfile)
+	}
+	wg.Wait()
+}
+
+func TestTranslateStreamErrors(t *testing.T) {
+	if _, _, err := TranslateRequestStream(strings.NewReader("<invalid")); err == nil {
+		t.Error("expected an error for an invalid request")
+	}
+
+	if _, err := TranslateResponseStream(strings.NewReader("{invalid"), EwsOperations["GetItem"]); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+
+	if _, err := TranslateResponseStream(strings.NewReader("{}"), nil); err == nil {
+		t.Error("expected an error without an operation")
+	}
+
+	// translation errors come from Read
+	stream, err := TranslateResponseStream(strings.NewReader(`{"Body": {"ResponseMessages": {"Items": [{"Unknown": 1}]}}}`), EwsOperations["GetItem"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readChunks(stream, 5); err == nil {
+		t.Error("expected a translation error from Read")
+	}
+	stream.Close()
+}
+
+func TestTranslateRequestStreamClose(t *testing.T) {
+	stream, _, err := TranslateRequestStream(bytes.NewReader(createAttachmentRequest(1024 * 1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err = io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest isn't serialized after the reader is closed
+	stream.Close()
+	if _, err = stream.Read(buf); err != io.ErrClosedPipe {
+		t.Errorf("expected ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestTranslateRequestStreamBOM(t *testing.T) {
+	file, err := os.Open("testdata/encodings/ews_getfolder_root_davmail_bom.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stream, op, err := TranslateRequestStream(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if _, err = readChunks(stream, 3); err != nil || op.Action != "GetFolder" {
+		t.Errorf("unexpected result %v %s", err, op.Action)
+	}
+}
@@ -1,19 +1,17 @@
 package ews
 
 import (
-	diff "github.com/yudai/gojsondiff"
-	"github.com/yudai/gojsondiff/formatter"
-
 	"github.com/pkg/errors"
-	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/virtuald/ews-proxy/comparison"
+	"github.com/virtuald/go-ordered-json"
 
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -46,57 +44,57 @@ func shouldFail(xfail map[string]bool, fname string) (ret bool) {
 	return false
 }
 
-// borrowed from https://github.com/yudai/gojsondiff/blob/master/jd/main.go
-// .. why isn't there a utility function for this?
-// .. returns true on error/modified, false otherwise
-func diffJson(a []byte, b []byte) (diffString string, err error) {
-
-	// the diff library seems to be buggy (but still useful for showing
-	// the output), so use Reflect instead
-
-	var aj map[string]interface{}
-	var bj map[string]interface{}
-
-	if err = json.Unmarshal(a, &aj); err != nil {
-		return "", errors.Wrap(err, "A json error")
-	}
-
-	if err = json.Unmarshal(b, &bj); err != nil {
-		return "", errors.Wrap(err, "B json error")
-	}
-
-	if reflect.DeepEqual(aj, bj) {
-		return "", nil
+// with -update (or UPDATE_GOLDEN=1), the expected output of each test file
+// that doesn't match is replaced with the generated output. Review the
+// changes with git diff before committing them.
+var updateGolden = flag.Bool("update", os.Getenv("UPDATE_GOLDEN") != "", "write the generated output as the expected output")
+
+// TestFunc translates a test file, and returns the output along with the
+// name of the file that holds the expected output
+type TestFunc func(testfile string) (output []byte, golden string, err error)
+
+// CompareFunc compares the expected output with the generated output, and
+// returns ErrDifferent and a description if they are different
+type CompareFunc func(expected []byte, actual []byte) (diffString string, err error)
+
+// the golden files are written in the same format as the ones that were
+// written by hand
+func writeGolden(golden string, output []byte) error {
+	if filepath.Ext(golden) == ".json" {
+		buf := new(bytes.Buffer)
+		if err := json.Indent(buf, output, "", "    "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		output = buf.Bytes()
 	}
+	return ioutil.WriteFile(golden, output, 0644)
+}
 
-	differ := diff.New()
-
-	d, err := differ.Compare(a, b)
+// runs a single test, and updates the golden file if requested
+func testSingle(testfile string, fn TestFunc, compare CompareFunc, update bool) (diffString string, updated string, err error) {
+	output, golden, err := fn(testfile)
 	if err != nil {
-		return "", errors.Wrap(err, "json diff failed")
+		return "", "", err
 	}
 
-	if d.Modified() {
-		config := formatter.AsciiFormatterConfig{
-			ShowArrayIndex: true,
-			Coloring:       true,
-		}
-
-		dformat := formatter.NewAsciiFormatter(aj, config)
-
-		diffString, err = dformat.Format(d)
-		if err != nil {
-			return "", errors.Wrap(err, "json diff format failed")
+	correctBuf, err := ioutil.ReadFile(golden)
+	if err == nil {
+		diffString, err = compare(correctBuf, output)
+		if err == nil || !update {
+			return diffString, "", err
 		}
+	} else if !update || !os.IsNotExist(err) {
+		return "", "", errors.Wrapf(err, "loading `%s` failed", golden)
 	}
 
-	err = errors.New("A and B are different")
-	return
+	if err = writeGolden(golden, output); err != nil {
+		return "", "", errors.Wrapf(err, "writing `%s` failed", golden)
+	}
+	return "", golden, nil
 }
 
-type TestFunc func(string) (string, error)
-
-func testRunner(t *testing.T, globpath string, fn TestFunc) {
+func testRunner(t *testing.T, globpath string, fn TestFunc, compare CompareFunc) {
 	var testfiles []string
 
 	// for debugging only
@@ -117,6 +115,7 @@ func testRunner(t *testing.T, globpath string, fn TestFunc) {
 	sort.Strings(testfiles)
 
 	passed := 0
+	var updated []string
 
 	for _, testfile := range testfiles {
 
@@ -124,11 +123,18 @@ func testRunner(t *testing.T, globpath string, fn TestFunc) {
 		xfailStr := ""
 		if xfail {
 			xfailStr = " (should fail)"
+			if *updateGolden {
+				t.Logf("Not updating %s, it is listed in xfail", testfile)
+			}
 		}
 
 		t.Logf("Now testing %s%s", testfile, xfailStr)
 
-		diffString, err := fn(testfile)
+		diffString, golden, err := testSingle(testfile, fn, compare, *updateGolden && !xfail)
+		if golden != "" {
+			updated = append(updated, golden)
+		}
+
 		if err != nil {
 			if xfail {
 				passed++
@@ -155,43 +161,44 @@ func testRunner(t *testing.T, globpath string, fn TestFunc) {
 	if passed == 0 {
 		t.Fail()
 	}
+
+	// shown without -v, so that nothing is changed silently
+	if *updateGolden {
+		fmt.Printf("%s: updated %d golden files\n", t.Name(), len(updated))
+		for _, golden := range updated {
+			fmt.Printf("    %s\n", golden)
+		}
+	}
 }
 
-func testSoapToJsonSingle(testfile string) (diffstring string, err error) {
+func testSoapToJsonSingle(testfile string) (output []byte, golden string, err error) {
 	xmlReader, err := os.Open(testfile)
 	if err != nil {
-		return "", errors.Wrapf(err, "opening %s", testfile)
+		return nil, "", errors.Wrapf(err, "opening %s", testfile)
 	}
 
 	defer xmlReader.Close()
 
 	data, _, err := SOAP2JSON(xmlReader)
 	if err != nil {
-		return "", errors.Wrapf(err, "parse failed %s", testfile)
+		return nil, "", errors.Wrapf(err, "parse failed %s", testfile)
 	}
 
-	// if you need the contents of the file
-	//ioutil.WriteFile(testfile + ".gen.json", data, 0700)
-
-	// load the correct output from a file
-	buf, err := ioutil.ReadFile(testfile + ".json")
-	if err != nil {
-		return "", errors.Wrapf(err, "%s.json load failed %s", testfile)
-	}
+	return data, testfile + ".json", nil
+}
 
-	return diffJson(buf, data)
+func compareJson(expected []byte, actual []byte) (diffString string, err error) {
+	return comparison.DiffJson(expected, actual, true)
 }
 
 func TestSOAP2JSON(t *testing.T) {
-	testRunner(t, filepath.Join("testdata", "requests", "*.xml"), testSoapToJsonSingle)
+	testRunner(t, filepath.Join("testdata", "requests", "*.xml"), testSoapToJsonSingle, compareJson)
 }
 
-func testJson2SoapSingle(testfile string) (diffstring string, err error) {
-	dmp := diffmatchpatch.New()
-
+func testJson2SoapSingle(testfile string) (output []byte, golden string, err error) {
 	jsonReader, err := os.Open(testfile)
 	if err != nil {
-		return "", errors.Wrapf(err, "Opening %s", testfile)
+		return nil, "", errors.Wrapf(err, "Opening %s", testfile)
 	}
 
 	defer jsonReader.Close()
@@ -201,41 +208,48 @@ func testJson2SoapSingle(testfile string) (diffstring string, err error) {
 	opname := strings.Split(strings.Split(filepath.Base(testfile), ".")[0], "_")[0]
 	op := EwsOperations[opname]
 	if op == nil {
-		return "", errors.Errorf("unknown EWS operation `%s` in `%s`", opname, testfile)
+		return nil, "", errors.Errorf("unknown EWS operation `%s` in `%s`", opname, testfile)
 	}
 
 	buf := new(bytes.Buffer)
 	err = JSON2SOAP(jsonReader, op, buf, true)
 	if err != nil {
-		return "", errors.Wrapf(err, "parsing `%s` failed", testfile)
+		return nil, "", errors.Wrapf(err, "parsing `%s` failed", testfile)
 	}
 
-	// if you need the contents of the file
-	//ioutil.WriteFile(testfile + ".gen.xml", buf.Bytes(), 0700)
-
-	// we're cheating here -- just going to do a text comparison of the XML,
-	// since the output should be fairly deterministic. It would be nice to
-	// do a logical comparison instead... but we need something for now
-
-	// load the correct output from a file
-	correctBuf, err := ioutil.ReadFile(testfile + ".xml")
-	if err != nil {
-		return "", errors.Wrapf(err, "loading `%s.xml` failed", testfile)
-	}
+	return buf.Bytes(), testfile + ".xml", nil
+}
 
-	// if they match, then we're good to go
-	if bytes.Compare(buf.Bytes(), correctBuf) == 0 {
-		return "", nil
-	} else {
+// the XML is compared token by token, so changes to the indentation don't
+// make every test fail
+func compareXml(expected []byte, actual []byte) (diffString string, err error) {
+	diffString, err = comparison.DiffXml(expected, actual)
+	if err == comparison.ErrDifferent {
 		// display a diff
-		// TODO: this diff ignores whitespace, which happens to
-		//       be really annoying if the outputs only differ by whitespace
-		diffs := dmp.DiffMain(string(correctBuf), string(buf.Bytes()), true)
-		diffText := dmp.DiffPrettyText(diffs)
-		return diffText, errors.New("outputs are different")
+		diffString += "\n" + comparison.DiffText(string(expected), string(actual))
 	}
+	return diffString, err
 }
 
 func TestJSON2SOAP(t *testing.T) {
-	testRunner(t, filepath.Join("testdata", "responses", "*.json"), testJson2SoapSingle)
+	testRunner(t, filepath.Join("testdata", "responses", "*.json"), testJson2SoapSingle, compareXml)
+}
+
+// GetServerTimeZones returns one of the largest responses that clients ask
+// for, so it's useful for noticing performance regressions
+func BenchmarkJSON2SOAPGetServerTimeZones(b *testing.B) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "responses", "GetServerTimeZones_owa.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	op := EwsOperations["GetServerTimeZones"]
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err = JSON2SOAP(bytes.NewReader(data), op, ioutil.Discard, false); err != nil {
+			b.Fatal(err)
+		}
+	}
 }